@@ -0,0 +1,463 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package apitoken implements bearer tokens that let scripts and other
+// automation make requests as a user or client without signing them with the
+// actor's private key. Each token is limited to the scopes it was issued with,
+// may expire, and may be revoked. Only a hash of the token's secret is kept.
+package apitoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/client"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/user"
+	"github.com/ctdk/goiardi/util"
+	"github.com/pborman/uuid"
+	"github.com/tideland/golib/logger"
+)
+
+// Token is an API token. The secret is only available when the token is first
+// made; after that only its hash is kept.
+type Token struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner"`
+	OwnerType  string    `json:"owner_type"`
+	Scopes     []string  `json:"scopes"`
+	SecretHash string    `json:"secret_hash"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	LastUsedIP string    `json:"last_used_ip"`
+	RevokedAt  time.Time `json:"revoked_at"`
+	secret     string
+}
+
+// Scopes a token can have, besides the endpoint families. A family scope
+// allows any request the owner could make under that part of the API, like
+// "/search" or "/shovey", and adding ":read" to it ("reports:read") only allows
+// GET and HEAD requests there.
+const (
+	ScopeAll  = "all"
+	ScopeRead = "read"
+)
+
+// Families are the parts of the API tokens may be scoped to, named after the
+// first part of the request path. Tokens can never be used to manage tokens,
+// or to log users in.
+var Families = []string{"clients", "cookbooks", "data", "environments", "events", "nodes", "principals", "reports", "roles", "sandboxes", "search", "shovey", "status", "universe", "users"}
+
+// Making or changing users and clients can hand out new private keys or set
+// keys and passwords that would outlast the token, so tokens can't do that
+// whatever their scopes are.
+var credentialFamilies = map[string]bool{"clients": true, "users": true}
+
+// How long to wait between saving when a token was last used.
+const lastUsedInterval = time.Minute
+
+// Owner types.
+const (
+	OwnerUser   = "user"
+	OwnerClient = "client"
+)
+
+// New makes a new token for the actor with the given scopes. The token's
+// secret is only available from the new token's String method, so it needs to
+// be handed to the caller before the token is thrown away.
+func New(owner actor.Actor, name string, scopes []string, expires time.Time, createdBy string) (*Token, util.Gerror) {
+	if err := ValidateScopes(scopes); err != nil {
+		return nil, err
+	}
+	if !expires.IsZero() && !expires.After(time.Now()) {
+		err := util.Errorf("token expiration time %s is in the past", expires.Format(time.RFC3339))
+		err.SetStatus(http.StatusBadRequest)
+		return nil, err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		gerr := util.CastErr(err)
+		gerr.SetStatus(http.StatusInternalServerError)
+		return nil, gerr
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	s := make([]string, len(scopes))
+	copy(s, scopes)
+	sort.Strings(s)
+	t := &Token{
+		ID:         uuid.New(),
+		Name:       name,
+		Owner:      owner.GetName(),
+		OwnerType:  ownerType(owner),
+		Scopes:     s,
+		SecretHash: hashSecret(secret),
+		CreatedBy:  createdBy,
+		CreatedAt:  time.Now(),
+		ExpiresAt:  expires,
+		secret:     secret,
+	}
+	return t, nil
+}
+
+// ValidateScopes makes sure the scopes given for a token are ones goiardi
+// knows about.
+func ValidateScopes(scopes []string) util.Gerror {
+	if len(scopes) == 0 {
+		err := util.Errorf("a token needs at least one scope")
+		err.SetStatus(http.StatusBadRequest)
+		return err
+	}
+	for _, s := range scopes {
+		if s == ScopeAll || s == ScopeRead {
+			continue
+		}
+		if !isFamily(strings.TrimSuffix(s, ":read")) {
+			err := util.Errorf("invalid token scope '%s'", s)
+			err.SetStatus(http.StatusBadRequest)
+			return err
+		}
+	}
+	return nil
+}
+
+func isFamily(f string) bool {
+	for _, fam := range Families {
+		if f == fam {
+			return true
+		}
+	}
+	return false
+}
+
+func hashSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// String returns the token as given to clients in the Authorization header:
+// the token's id and secret, separated by a ".". It's only available on a
+// newly made token.
+func (t *Token) String() string {
+	if t.secret == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s.%s", t.ID, t.secret)
+}
+
+// Expired is true if the token has an expiration time, and it's passed.
+func (t *Token) Expired() bool {
+	return !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt)
+}
+
+// Revoked is true if the token's been revoked.
+func (t *Token) Revoked() bool {
+	return !t.RevokedAt.IsZero()
+}
+
+// Allows checks if the token's scopes allow the request method on the path.
+func (t *Token) Allows(method string, path string) bool {
+	family := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	if !isFamily(family) {
+		return false
+	}
+	read := method == http.MethodGet || method == http.MethodHead
+	if credentialFamilies[family] && (method == http.MethodPost || method == http.MethodPut) {
+		return false
+	}
+	for _, s := range t.Scopes {
+		switch s {
+		case ScopeAll, family:
+			return true
+		case ScopeRead, family + ":read":
+			if read {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Actor returns the user or client the token belongs to.
+func (t *Token) Actor() (actor.Actor, util.Gerror) {
+	if t.OwnerType == OwnerUser {
+		return user.Get(t.Owner)
+	}
+	return client.Get(t.Owner)
+}
+
+// FromHeader returns the bearer token in the request's Authorization header,
+// if there is one.
+func FromHeader(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// Authenticate checks a bearer token from a request, making sure it exists,
+// its secret is right, it hasn't expired or been revoked, and that its scopes
+// allow the request. It returns the actor the token belongs to.
+func Authenticate(bearer string, r *http.Request) (actor.Actor, util.Gerror) {
+	parts := strings.SplitN(bearer, ".", 2)
+	if len(parts) != 2 || uuid.Parse(parts[0]) == nil {
+		return nil, authErr("malformed API token")
+	}
+	t, err := Get(parts[0])
+	if err != nil {
+		if err.Status() == http.StatusNotFound {
+			return nil, authErr("invalid API token")
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[1])), []byte(t.SecretHash)) != 1 {
+		return nil, authErr("invalid API token")
+	}
+	if t.Revoked() {
+		return nil, authErr(fmt.Sprintf("API token %s has been revoked", t.ID))
+	}
+	if t.Expired() {
+		return nil, authErr(fmt.Sprintf("API token %s has expired", t.ID))
+	}
+	if !t.Allows(r.Method, r.URL.Path) {
+		err := util.Errorf("API token %s is not allowed to %s %s", t.ID, r.Method, r.URL.Path)
+		err.SetStatus(http.StatusForbidden)
+		return nil, err
+	}
+	a, err := t.Actor()
+	if err != nil {
+		return nil, authErr(fmt.Sprintf("the owner of API token %s no longer exists", t.ID))
+	}
+	t.used(util.RemoteIP(r))
+	return a, nil
+}
+
+func authErr(msg string) util.Gerror {
+	err := util.Errorf("%s", msg)
+	err.SetStatus(http.StatusUnauthorized)
+	return err
+}
+
+// used records when and where the token was last used. To keep from saving
+// the token on every request, it's only saved when the address changes or
+// it's been a while since the last save.
+func (t *Token) used(ip string) {
+	if ip == t.LastUsedIP && time.Since(t.LastUsedAt) < lastUsedInterval {
+		return
+	}
+	t.LastUsedAt = time.Now()
+	t.LastUsedIP = ip
+	if err := t.Save(); err != nil {
+		logger.Errorf("error saving when API token %s was last used: %s", t.ID, err.Error())
+	}
+}
+
+// Save saves the token.
+func (t *Token) Save() util.Gerror {
+	if config.UsingDB() {
+		if err := t.saveSQL(); err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return gerr
+		}
+		return nil
+	}
+	ds := datastore.New()
+	ds.Set("api_token", t.ID, t)
+	return nil
+}
+
+// Get gets the token with the given id.
+func Get(id string) (*Token, util.Gerror) {
+	var t *Token
+	var found bool
+	if config.UsingDB() {
+		var err error
+		t, err = getSQL(id)
+		if err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return nil, gerr
+		}
+		found = t != nil
+	} else {
+		ds := datastore.New()
+		var tt interface{}
+		tt, found = ds.Get("api_token", id)
+		if tt != nil {
+			t = tt.(*Token)
+		}
+	}
+	if !found {
+		err := util.Errorf("API token %s not found", id)
+		err.SetStatus(http.StatusNotFound)
+		return nil, err
+	}
+	return t, nil
+}
+
+// Revoke revokes the token. Revoked tokens are kept around so it's possible
+// to see when they were made and last used.
+func (t *Token) Revoke() util.Gerror {
+	if t.Revoked() {
+		return nil
+	}
+	t.RevokedAt = time.Now()
+	return t.Save()
+}
+
+// Delete removes the token entirely.
+func (t *Token) Delete() util.Gerror {
+	if config.UsingDB() {
+		if err := t.deleteSQL(); err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return gerr
+		}
+		return nil
+	}
+	ds := datastore.New()
+	ds.Delete("api_token", t.ID)
+	return nil
+}
+
+// AllTokens returns all the API tokens, sorted by when they were made.
+func AllTokens() []*Token {
+	var tokens []*Token
+	if config.UsingDB() {
+		var err error
+		tokens, err = allTokensSQL()
+		if err != nil {
+			logger.Errorf("error getting API tokens: %s", err.Error())
+		}
+	} else {
+		ds := datastore.New()
+		for _, id := range ds.GetList("api_token") {
+			t, err := Get(id)
+			if err != nil {
+				continue
+			}
+			tokens = append(tokens, t)
+		}
+	}
+	sort.Sort(byCreated(tokens))
+	return tokens
+}
+
+// OwnerTokens returns the API tokens belonging to the actor.
+func OwnerTokens(owner actor.Actor) []*Token {
+	return ownerTokens(owner.GetName(), ownerType(owner))
+}
+
+func ownerTokens(name string, ownerType string) []*Token {
+	var tokens []*Token
+	for _, t := range AllTokens() {
+		if t.Owner == name && t.OwnerType == ownerType {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+func ownerType(owner actor.Actor) string {
+	if owner.IsUser() {
+		return OwnerUser
+	}
+	return OwnerClient
+}
+
+// RevokeOwner revokes all of the tokens belonging to the user or client with
+// the given name. It needs to be called when users or clients are deleted or
+// renamed, so that a new actor with the old name doesn't pick up the old one's
+// tokens.
+func RevokeOwner(name string, ownerType string) util.Gerror {
+	for _, t := range ownerTokens(name, ownerType) {
+		if err := t.Revoke(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type byCreated []*Token
+
+func (b byCreated) Len() int           { return len(b) }
+func (b byCreated) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byCreated) Less(i, j int) bool { return b[i].CreatedAt.Before(b[j].CreatedAt) }
+
+// ToJSON formats a token to render as JSON for the client. The secret hash is
+// never included.
+func (t *Token) ToJSON() map[string]interface{} {
+	toJSON := make(map[string]interface{})
+	toJSON["id"] = t.ID
+	toJSON["name"] = t.Name
+	toJSON["owner"] = t.Owner
+	toJSON["owner_type"] = t.OwnerType
+	toJSON["scopes"] = t.Scopes
+	toJSON["created_by"] = t.CreatedBy
+	toJSON["created_at"] = t.CreatedAt
+	toJSON["expires_at"] = timeOrNil(t.ExpiresAt)
+	toJSON["last_used_at"] = timeOrNil(t.LastUsedAt)
+	toJSON["last_used_ip"] = t.LastUsedIP
+	toJSON["revoked_at"] = timeOrNil(t.RevokedAt)
+	toJSON["expired"] = t.Expired()
+	toJSON["revoked"] = t.Revoked()
+	return toJSON
+}
+
+func timeOrNil(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// Import is used to import API tokens from the exported JSON dump.
+func Import(tokenJSON map[string]interface{}) error {
+	t := new(Token)
+	for k, s := range map[string]*string{"id": &t.ID, "name": &t.Name, "owner": &t.Owner, "owner_type": &t.OwnerType, "secret_hash": &t.SecretHash, "created_by": &t.CreatedBy, "last_used_ip": &t.LastUsedIP} {
+		*s, _ = tokenJSON[k].(string)
+	}
+	if t.ID == "" || t.SecretHash == "" {
+		return fmt.Errorf("API token is missing its id or secret hash")
+	}
+	if scopes, ok := tokenJSON["scopes"].([]interface{}); ok {
+		for _, s := range scopes {
+			if ss, ok := s.(string); ok {
+				t.Scopes = append(t.Scopes, ss)
+			}
+		}
+	}
+	for k, ts := range map[string]*time.Time{"created_at": &t.CreatedAt, "expires_at": &t.ExpiresAt, "last_used_at": &t.LastUsedAt, "revoked_at": &t.RevokedAt} {
+		if s, ok := tokenJSON[k].(string); ok {
+			*ts, _ = time.Parse(time.RFC3339, s)
+		}
+	}
+	return t.Save()
+}
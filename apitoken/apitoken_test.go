@@ -0,0 +1,193 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package apitoken
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ctdk/goiardi/client"
+	"github.com/ctdk/goiardi/user"
+)
+
+func init() {
+	gob.Register(new(Token))
+	gob.Register(new(user.User))
+	gob.Register(new(client.Client))
+}
+
+func tokenReq(method string, path string, token string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestScopes(t *testing.T) {
+	if err := ValidateScopes(nil); err == nil {
+		t.Errorf("a token with no scopes should not have been allowed")
+	}
+	if err := ValidateScopes([]string{"search", "tokens"}); err == nil {
+		t.Errorf("tokens should not be a valid scope")
+	}
+	if err := ValidateScopes([]string{"search", "reports:read", "read", "all"}); err != nil {
+		t.Errorf("valid scopes were rejected: %s", err.Error())
+	}
+	tk := &Token{Scopes: []string{"search", "reports:read"}}
+	checks := []struct {
+		method string
+		path   string
+		ok     bool
+	}{
+		{"GET", "/search/node", true},
+		{"POST", "/search/node", true},
+		{"GET", "/reports/nodes/foo/runs", true},
+		{"HEAD", "/reports/nodes/foo/runs", true},
+		{"POST", "/reports/nodes/foo/runs", false},
+		{"GET", "/nodes/foo", false},
+		{"GET", "/tokens", false},
+	}
+	for _, c := range checks {
+		if tk.Allows(c.method, c.path) != c.ok {
+			t.Errorf("%s %s: expected %t", c.method, c.path, c.ok)
+		}
+	}
+	tk.Scopes = []string{"read"}
+	if !tk.Allows("GET", "/nodes/foo") || tk.Allows("PUT", "/nodes/foo") || tk.Allows("GET", "/tokens/foo") {
+		t.Errorf("a read-only token had the wrong access")
+	}
+	tk.Scopes = []string{"all"}
+	if !tk.Allows("DELETE", "/nodes/foo") || tk.Allows("POST", "/tokens") {
+		t.Errorf("an all-access token had the wrong access")
+	}
+	// no scope lets a token make credentials that outlast it
+	for _, s := range []string{"all", "clients", "users"} {
+		tk.Scopes = []string{s}
+		for _, c := range []struct{ method, path string }{{"POST", "/clients"}, {"PUT", "/clients/foo"}, {"POST", "/users"}, {"PUT", "/users/foo"}} {
+			if tk.Allows(c.method, c.path) {
+				t.Errorf("a token with the %s scope should not be allowed to %s %s", s, c.method, c.path)
+			}
+		}
+	}
+	tk.Scopes = []string{"clients"}
+	if !tk.Allows("GET", "/clients/foo") || !tk.Allows("DELETE", "/clients/foo") {
+		t.Errorf("a token with the clients scope should be able to get and delete clients")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	u, _ := user.New("token-user")
+	u.Save()
+	tk, err := New(u, "ci", []string{"search:read"}, time.Time{}, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tk.Save(); err != nil {
+		t.Fatal(err)
+	}
+	secret := tk.String()
+	if !strings.HasPrefix(secret, tk.ID+".") {
+		t.Errorf("token %s doesn't start with its id", secret)
+	}
+	if strings.Contains(tk.SecretHash, strings.SplitN(secret, ".", 2)[1]) {
+		t.Errorf("the token secret was stored")
+	}
+
+	a, err := Authenticate(secret, tokenReq("GET", "/search/node?q=*:*", secret))
+	if err != nil {
+		t.Fatalf("token should have been accepted: %s", err.Error())
+	}
+	if !a.IsUser() || a.GetName() != "token-user" {
+		t.Errorf("token authenticated as the wrong actor: %s", a.GetName())
+	}
+	got, _ := Get(tk.ID)
+	if got.LastUsedAt.IsZero() || got.LastUsedIP != "192.0.2.1" {
+		t.Errorf("last use was not recorded: %v %s", got.LastUsedAt, got.LastUsedIP)
+	}
+	if got.String() != "" {
+		t.Errorf("a stored token should not be able to give its secret out")
+	}
+
+	if _, err = Authenticate(tk.ID+".wrong", tokenReq("GET", "/search/node", "")); err == nil || err.Status() != http.StatusUnauthorized {
+		t.Errorf("a bad secret should have been a 401, got %v", err)
+	}
+	if _, err = Authenticate("garbage", tokenReq("GET", "/search/node", "")); err == nil || err.Status() != http.StatusUnauthorized {
+		t.Errorf("a malformed token should have been a 401, got %v", err)
+	}
+	if _, err = Authenticate(secret, tokenReq("POST", "/search/node", secret)); err == nil || err.Status() != http.StatusForbidden {
+		t.Errorf("a read-only token should not have been able to POST, got %v", err)
+	}
+
+	got.ExpiresAt = time.Now().Add(-time.Minute)
+	got.Save()
+	if _, err = Authenticate(secret, tokenReq("GET", "/search/node", secret)); err == nil || err.Status() != http.StatusUnauthorized {
+		t.Errorf("an expired token should have been a 401, got %v", err)
+	}
+	got.ExpiresAt = time.Time{}
+	got.Save()
+
+	if rerr := RevokeOwner("token-user", OwnerUser); rerr != nil {
+		t.Fatal(rerr)
+	}
+	if _, err = Authenticate(secret, tokenReq("GET", "/search/node", secret)); err == nil || err.Status() != http.StatusUnauthorized {
+		t.Errorf("a revoked token should have been a 401, got %v", err)
+	}
+	if len(OwnerTokens(u)) != 1 {
+		t.Errorf("revoked tokens should still be listed")
+	}
+}
+
+func TestExpiresInPast(t *testing.T) {
+	c, _ := client.New("token-client")
+	if _, err := New(c, "", []string{"read"}, time.Now().Add(-time.Hour), "admin"); err == nil {
+		t.Errorf("a token expiring in the past should not have been made")
+	}
+	tk, err := New(c, "", []string{"read"}, time.Now().Add(time.Hour), "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tk.OwnerType != OwnerClient {
+		t.Errorf("token owner type was %s, not client", tk.OwnerType)
+	}
+}
+
+func TestImport(t *testing.T) {
+	u, _ := user.New("import-user")
+	u.Save()
+	tk, _ := New(u, "imported", []string{"shovey", "status:read"}, time.Now().Add(time.Hour).Truncate(time.Second), "admin")
+	secret := tk.String()
+	b, _ := json.Marshal(tk)
+	var tj map[string]interface{}
+	json.Unmarshal(b, &tj)
+	if err := Import(tj); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Get(tk.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Owner != "import-user" || len(got.Scopes) != 2 || !got.ExpiresAt.Equal(tk.ExpiresAt) {
+		t.Errorf("imported token doesn't match: %+v", got)
+	}
+	if _, err := Authenticate(secret, tokenReq("POST", "/shovey/jobs", secret)); err != nil {
+		t.Errorf("imported token should have worked: %s", err.Error())
+	}
+}
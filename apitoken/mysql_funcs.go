@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package apitoken
+
+/* MySQL funcs for API tokens */
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/go-sql-driver/mysql"
+)
+
+func (t *Token) fillTokenFromMySQL(row datastore.ResRow) error {
+	var scopes []byte
+	var cb, ip sql.NullString
+	var ca, ea, lu, ra mysql.NullTime
+	err := row.Scan(&t.ID, &t.Name, &t.Owner, &t.OwnerType, &scopes, &t.SecretHash, &cb, &ca, &ea, &lu, &ip, &ra)
+	if err != nil {
+		return err
+	}
+	if err = t.decodeScopes(scopes); err != nil {
+		return err
+	}
+	t.CreatedBy = cb.String
+	t.LastUsedIP = ip.String
+	for _, nt := range []struct {
+		n  mysql.NullTime
+		ts *time.Time
+	}{{ca, &t.CreatedAt}, {ea, &t.ExpiresAt}, {lu, &t.LastUsedAt}, {ra, &t.RevokedAt}} {
+		if nt.n.Valid {
+			*nt.ts = nt.n.Time
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package apitoken
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
+)
+
+const tokenCols = "id, name, owner_name, owner_type, scopes, secret_hash, created_by, created_at, expires_at, last_used_at, last_used_ip, revoked_at"
+
+func (t *Token) fillTokenFromSQL(row datastore.ResRow) error {
+	if config.Config.UseMySQL {
+		return t.fillTokenFromMySQL(row)
+	} else if config.Config.UsePostgreSQL {
+		return t.fillTokenFromPostgreSQL(row)
+	}
+	return util.NoDBConfigured
+}
+
+func (t *Token) decodeScopes(scopes []byte) error {
+	t.Scopes = make([]string, 0)
+	if len(scopes) == 0 {
+		return nil
+	}
+	return json.Unmarshal(scopes, &t.Scopes)
+}
+
+// nullTime stores unset times as NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func (t *Token) saveSQL() error {
+	scopes, err := json.Marshal(t.Scopes)
+	if err != nil {
+		return err
+	}
+	if config.Config.UseMySQL {
+		_, err = datastore.Dbh.Exec("INSERT INTO api_tokens (id, name, owner_name, owner_type, scopes, secret_hash, created_by, created_at, expires_at, last_used_at, last_used_ip, revoked_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE name = VALUES(name), scopes = VALUES(scopes), expires_at = VALUES(expires_at), last_used_at = VALUES(last_used_at), last_used_ip = VALUES(last_used_ip), revoked_at = VALUES(revoked_at)", t.ID, t.Name, t.Owner, t.OwnerType, scopes, t.SecretHash, t.CreatedBy, t.CreatedAt, nullTime(t.ExpiresAt), nullTime(t.LastUsedAt), t.LastUsedIP, nullTime(t.RevokedAt))
+		return err
+	} else if !config.Config.UsePostgreSQL {
+		return util.NoDBConfigured
+	}
+
+	tx, err := datastore.Dbh.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE goiardi.api_tokens SET name = $1, scopes = $2, expires_at = $3, last_used_at = $4, last_used_ip = $5, revoked_at = $6 WHERE id = $7", t.Name, scopes, nullTime(t.ExpiresAt), nullTime(t.LastUsedAt), t.LastUsedIP, nullTime(t.RevokedAt), t.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = tx.Exec("INSERT INTO goiardi.api_tokens (id, name, owner_name, owner_type, scopes, secret_hash, created_by, created_at, expires_at, last_used_at, last_used_ip, revoked_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)", t.ID, t.Name, t.Owner, t.OwnerType, scopes, t.SecretHash, t.CreatedBy, t.CreatedAt, nullTime(t.ExpiresAt), nullTime(t.LastUsedAt), t.LastUsedIP, nullTime(t.RevokedAt))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func getSQL(id string) (*Token, error) {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "SELECT " + tokenCols + " FROM api_tokens WHERE id = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "SELECT " + tokenCols + " FROM goiardi.api_tokens WHERE id = $1"
+	} else {
+		return nil, util.NoDBConfigured
+	}
+	t := new(Token)
+	row := datastore.Dbh.QueryRow(sqlStatement, id)
+	if err := t.fillTokenFromSQL(row); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Token) deleteSQL() error {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "DELETE FROM api_tokens WHERE id = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "DELETE FROM goiardi.api_tokens WHERE id = $1"
+	} else {
+		return util.NoDBConfigured
+	}
+	_, err := datastore.Dbh.Exec(sqlStatement, t.ID)
+	return err
+}
+
+func allTokensSQL() ([]*Token, error) {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "SELECT " + tokenCols + " FROM api_tokens"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "SELECT " + tokenCols + " FROM goiardi.api_tokens"
+	} else {
+		return nil, util.NoDBConfigured
+	}
+	var tokens []*Token
+	rows, err := datastore.Dbh.Query(sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := new(Token)
+		if err = t.fillTokenFromSQL(rows); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
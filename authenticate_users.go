@@ -22,8 +22,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/ctdk/goiardi/config"
-	"github.com/ctdk/goiardi/user"
+	"github.com/ctdk/goiardi/lockout"
+	"github.com/ctdk/goiardi/login"
+	"github.com/ctdk/goiardi/util"
+	"github.com/tideland/golib/logger"
+	"math"
 	"net/http"
+	"strconv"
 )
 
 type authenticator struct {
@@ -50,7 +55,17 @@ func authenticateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp := validateLogin(auth)
+	// users who've gotten their password wrong too many times don't get
+	// to try again for a while.
+	if l := lockout.Check(auth.Name, ""); l != nil {
+		logger.Warningf("login refused for %s: locked out until %s", auth.Name, l.LockedUntil)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(l.RetryAfter().Seconds()))))
+		lerr := l.Error()
+		jsonErrorReport(w, r, lerr.Error(), lerr.Status())
+		return
+	}
+
+	resp := validateLogin(auth, util.RemoteIP(r))
 
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(resp); err != nil {
@@ -58,7 +73,7 @@ func authenticateUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func validateLogin(auth *authenticator) authResponse {
+func validateLogin(auth *authenticator, ip string) authResponse {
 	// Check passwords and such later.
 	// Automatically validate if UseAuth is not on
 	var resp authResponse
@@ -67,15 +82,13 @@ func validateLogin(auth *authenticator) authResponse {
 		resp.Verified = true
 		return resp
 	}
-	u, err := user.Get(auth.Name)
+	_, err := login.Authenticate(auth.Name, auth.Password)
 	if err != nil {
-		resp.Verified = false
-		return resp
-	}
-	perr := u.CheckPasswd(auth.Password)
-	if perr != nil {
+		logger.Infof("login failed for %s: %s", auth.Name, err.Error())
+		lockout.FailLogin(auth.Name, ip, err.Error())
 		resp.Verified = false
 	} else {
+		lockout.Succeed(auth.Name, "")
 		resp.Verified = true
 	}
 	return resp
@@ -0,0 +1,244 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package authentication
+
+// Authenticating clients and users with TLS client certificates.
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/util"
+	"github.com/tideland/golib/logger"
+)
+
+// ClientCertsEnabled is true if clients and users can authenticate with TLS
+// client certificates.
+func ClientCertsEnabled() bool {
+	return config.Config.UseSSL && config.Config.SSLClientCA != ""
+}
+
+// ClientCertTLSConfig adds verifying client certificates against the CA bundle
+// and revocation list to the server's TLS configuration. Certificates are
+// asked for but not required, since not every request needs authentication;
+// whether a request needs one is decided by CheckClientCert.
+func ClientCertTLSConfig(tc *tls.Config) error {
+	pemCerts, err := ioutil.ReadFile(config.Config.SSLClientCA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return fmt.Errorf("no certificates found in client CA bundle %s", config.Config.SSLClientCA)
+	}
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.VerifyClientCertIfGiven
+	if config.Config.SSLClientCRL != "" {
+		crls.caFile = config.Config.SSLClientCA
+		crls.pool = parseCAs(pemCerts)
+		crls.path = config.Config.SSLClientCRL
+		if _, err = crls.get(); err != nil {
+			return err
+		}
+		tc.VerifyPeerCertificate = verifyNotRevoked
+	}
+	return nil
+}
+
+func parseCAs(pemCerts []byte) []*x509.Certificate {
+	var cas []*x509.Certificate
+	for len(pemCerts) > 0 {
+		var block *pem.Block
+		block, pemCerts = pem.Decode(pemCerts)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if c, err := x509.ParseCertificate(block.Bytes); err == nil {
+			cas = append(cas, c)
+		}
+	}
+	return cas
+}
+
+// crlCache holds the revocation list, reading it again when the file changes.
+type crlCache struct {
+	sync.Mutex
+	path    string
+	caFile  string
+	pool    []*x509.Certificate
+	modTime time.Time
+	crl     *x509.RevocationList
+}
+
+var crls = new(crlCache)
+
+func (c *crlCache) get() (*x509.RevocationList, error) {
+	c.Lock()
+	defer c.Unlock()
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		return nil, err
+	}
+	if c.crl != nil && fi.ModTime().Equal(c.modTime) {
+		return c.crl, nil
+	}
+	b, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		b = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(b)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing client certificate revocation list %s: %s", c.path, err.Error())
+	}
+	signed := false
+	for _, ca := range c.pool {
+		if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return nil, fmt.Errorf("client certificate revocation list %s isn't signed by a CA in %s", c.path, c.caFile)
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		logger.Warningf("client certificate revocation list %s is out of date: it should have been updated by %s", c.path, crl.NextUpdate)
+	}
+	logger.Infof("Loaded client certificate revocation list %s with %d revoked certificates", c.path, len(crl.RevokedCertificateEntries))
+	c.crl = crl
+	c.modTime = fi.ModTime()
+	return crl, nil
+}
+
+// verifyNotRevoked turns away client certificates on the revocation list. If
+// the list can't be read, no client certificates are accepted.
+func verifyNotRevoked(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(verifiedChains) == 0 {
+		return nil
+	}
+	crl, err := crls.get()
+	if err != nil {
+		logger.Errorf("refusing client certificate: %s", err.Error())
+		return err
+	}
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if revoked(crl, cert) {
+				return fmt.Errorf("client certificate %s (serial %s) has been revoked", cert.Subject.String(), cert.SerialNumber.String())
+			}
+		}
+	}
+	return nil
+}
+
+func revoked(crl *x509.RevocationList, cert *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, crl.RawIssuer) {
+		return false
+	}
+	for _, rc := range crl.RevokedCertificateEntries {
+		if rc.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// CertActor finds the client or user named by the request's verified client
+// certificate. It returns nil with no error if the request didn't come with a
+// certificate.
+func CertActor(r *http.Request) (actor.Actor, util.Gerror) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	names := certNames(cert)
+	for _, n := range names {
+		if a, err := actor.GetReqUser(n); err == nil {
+			return a, nil
+		}
+	}
+	gerr := util.Errorf("No client or user matches the client certificate %s", cert.Subject.String())
+	gerr.SetStatus(http.StatusUnauthorized)
+	return nil, gerr
+}
+
+// certNames returns the names in the certificate that might be a client or
+// user, depending on --ssl-client-identity.
+func certNames(cert *x509.Certificate) []string {
+	var names []string
+	switch config.Config.SSLClientIdentity {
+	case config.ClientCertDNS:
+		names = cert.DNSNames
+	case config.ClientCertURI:
+		for _, u := range cert.URIs {
+			if n := path.Base(u.Path); n != "." && n != "/" {
+				names = append(names, n)
+			}
+		}
+	default:
+		if cert.Subject.CommonName != "" {
+			names = []string{cert.Subject.CommonName}
+		}
+	}
+	return names
+}
+
+// CheckClientCert gets the client or user from the request's client
+// certificate, if there is one, and enforces --ssl-client-auth: with 'both' or
+// 'cert', requests that need authentication must have a certificate.
+func CheckClientCert(r *http.Request) (actor.Actor, util.Gerror) {
+	if !ClientCertsEnabled() {
+		return nil, nil
+	}
+	a, err := CertActor(r)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil && config.Config.SSLClientAuth != config.ClientCertEither {
+		gerr := util.Errorf("A client certificate is required.")
+		gerr.SetStatus(http.StatusUnauthorized)
+		return nil, gerr
+	}
+	return a, nil
+}
+
+// CertMatches checks that the client or user named by a client certificate is
+// the same one that signed the request, for --ssl-client-auth=both.
+func CertMatches(certActor actor.Actor, signer string) util.Gerror {
+	if certActor == nil || certActor.GetName() == signer {
+		return nil
+	}
+	gerr := util.Errorf("The client certificate for '%s' does not match '%s'.", certActor.GetName(), signer)
+	gerr.SetStatus(http.StatusUnauthorized)
+	return gerr
+}
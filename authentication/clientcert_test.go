@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package authentication
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ctdk/goiardi/client"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/indexer"
+)
+
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "goiardi test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+func (ca *testCA) issue(t *testing.T, cn string, dns []string, uri string) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dns,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if uri != "" {
+		u, _ := url.Parse(uri)
+		tmpl.URIs = []*url.URL{u}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writeTemp(t *testing.T, blockType string, der []byte) string {
+	f, err := ioutil.TempFile("", "clientcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+	f.Close()
+	return f.Name()
+}
+
+func TestClientCerts(t *testing.T) {
+	gob.Register(new(client.Client))
+	config.Config.UseAuth = true
+	indexer.Initialize(config.Config)
+	for _, n := range []string{"cert-node", "dns-node", "uri-node", "revoked-node"} {
+		c, _ := client.New(n)
+		c.Save()
+	}
+
+	ca := newTestCA(t)
+	good := ca.issue(t, "cert-node", []string{"dns-node.example.com", "dns-node"}, "spiffe://example.org/goiardi/uri-node")
+	unknown := ca.issue(t, "nobody", nil, "")
+	revoked := ca.issue(t, "revoked-node", nil, "")
+	crlDer, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-time.Minute),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: []x509.RevocationListEntry{{SerialNumber: revoked.Leaf.SerialNumber, RevocationTime: time.Now()}},
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := writeTemp(t, "CERTIFICATE", ca.cert.Raw)
+	defer os.Remove(caFile)
+	crlFile := writeTemp(t, "X509 CRL", crlDer)
+	defer os.Remove(crlFile)
+
+	config.Config.UseSSL = true
+	config.Config.SSLClientCA = caFile
+	config.Config.SSLClientCRL = crlFile
+	config.Config.SSLClientAuth = config.ClientCertEither
+	config.Config.SSLClientIdentity = config.ClientCertCN
+	defer func() {
+		config.Config.UseAuth = false
+		config.Config.UseSSL = false
+		config.Config.SSLClientCA = ""
+		config.Config.SSLClientCRL = ""
+	}()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a, err := CheckClientCert(r)
+		if err != nil {
+			http.Error(w, err.Error(), err.Status())
+			return
+		}
+		if a == nil {
+			w.Write([]byte("-"))
+			return
+		}
+		w.Write([]byte(a.GetName()))
+	}))
+	srv.TLS = &tls.Config{}
+	if err := ClientCertTLSConfig(srv.TLS); err != nil {
+		t.Fatal(err)
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(cert *tls.Certificate) (int, string, error) {
+		tc := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			tc.Certificates = []tls.Certificate{*cert}
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+		resp, err := c.Get(srv.URL)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b), nil
+	}
+
+	checks := []struct {
+		identity string
+		expected string
+	}{
+		{config.ClientCertCN, "cert-node"},
+		{config.ClientCertDNS, "dns-node"},
+		{config.ClientCertURI, "uri-node"},
+	}
+	for _, c := range checks {
+		config.Config.SSLClientIdentity = c.identity
+		status, body, err := get(&good)
+		if err != nil || status != http.StatusOK || body != c.expected {
+			t.Errorf("with identity %s expected %s, got %d %q %v", c.identity, c.expected, status, body, err)
+		}
+	}
+	config.Config.SSLClientIdentity = config.ClientCertCN
+
+	if status, _, err := get(&unknown); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("a certificate for nobody should have been a 401, got %d %v", status, err)
+	}
+	if _, _, err := get(&revoked); err == nil {
+		t.Errorf("a revoked certificate should not have been accepted")
+	}
+	if status, body, err := get(nil); err != nil || status != http.StatusOK || body != "-" {
+		t.Errorf("no certificate should have been fine with 'either', got %d %q %v", status, body, err)
+	}
+	config.Config.SSLClientAuth = config.ClientCertBoth
+	if status, _, err := get(nil); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("no certificate should have been a 401 with 'both', got %d %v", status, err)
+	}
+
+	a, _ := client.Get("cert-node")
+	if CertMatches(a, "cert-node") != nil || CertMatches(nil, "whoever") != nil {
+		t.Errorf("matching certificates were rejected")
+	}
+	if CertMatches(a, "dns-node") == nil {
+		t.Errorf("a certificate for cert-node should not have matched dns-node")
+	}
+}
@@ -596,6 +596,13 @@ func (c *Client) SetPublicKey(pk interface{}) error {
 	return nil
 }
 
+// ClearStoredSecrets empties the public key kept with the client itself, once
+// it's been moved to an external secret store. Save() must be called after this
+// method is used.
+func (c *Client) ClearStoredSecrets() {
+	c.pubKey = ""
+}
+
 // CheckPermEdit checks to see if the client is trying to edit admin and
 // validator attributes, and if it has permissions to do so.
 func (c *Client) CheckPermEdit(clientData map[string]interface{}, perm string) util.Gerror {
@@ -21,6 +21,7 @@ package main
 import (
 	"encoding/json"
 	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/apitoken"
 	"github.com/ctdk/goiardi/client"
 	"github.com/ctdk/goiardi/loginfo"
 	"github.com/ctdk/goiardi/reqctx"
@@ -64,6 +65,10 @@ func clientHandler(w http.ResponseWriter, r *http.Request) {
 			jsonErrorReport(w, r, err.Error(), http.StatusForbidden)
 			return
 		}
+		if terr := apitoken.RevokeOwner(chefClient.GetName(), apitoken.OwnerClient); terr != nil {
+			jsonErrorReport(w, r, terr.Error(), terr.Status())
+			return
+		}
 
 		enc := json.NewEncoder(w)
 		if err = enc.Encode(&jsonClient); err != nil {
@@ -104,6 +109,10 @@ func clientHandler(w http.ResponseWriter, r *http.Request) {
 		 * json_class
 		 */
 		jsonClient := chefClient.ToJSON()
+		if kerr := keyVersion(r, chefClient, jsonClient); kerr != nil {
+			jsonErrorReport(w, r, kerr.Error(), kerr.Status())
+			return
+		}
 		enc := json.NewEncoder(w)
 		if err := enc.Encode(&jsonClient); err != nil {
 			jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
@@ -170,6 +179,10 @@ func clientHandler(w http.ResponseWriter, r *http.Request) {
 				jsonErrorReport(w, r, err.Error(), err.Status())
 				return
 			}
+			if terr := apitoken.RevokeOwner(clientName, apitoken.OwnerClient); terr != nil {
+				jsonErrorReport(w, r, terr.Error(), terr.Status())
+				return
+			}
 			w.WriteHeader(http.StatusCreated)
 		}
 		if uerr := chefClient.UpdateFromJSON(clientData); uerr != nil {
@@ -23,8 +23,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
+	"github.com/ctdk/goiardi/secret"
+	"github.com/ctdk/goiardi/util"
 	"github.com/tideland/golib/logger"
 )
 
@@ -130,3 +133,34 @@ func chkRunList(rl interface{}) ([]string, error) {
 		return nil, err
 	}
 }
+
+// keyVersion swaps the public key in a client's or user's JSON for an older
+// version of it, if one was asked for with the key_version parameter.
+func keyVersion(r *http.Request, c secret.ActorKeyer, jsonObj map[string]interface{}) util.Gerror {
+	kv := r.URL.Query().Get("key_version")
+	if kv == "" {
+		return nil
+	}
+	version, err := strconv.Atoi(kv)
+	if err != nil || version < 1 {
+		gerr := util.Errorf("invalid key_version '%s'", kv)
+		gerr.SetStatus(http.StatusBadRequest)
+		return gerr
+	}
+	pk, err := secret.GetPublicKeyVersion(c, version)
+	if err != nil {
+		gerr := util.CastErr(err)
+		switch err {
+		case secret.ErrNotFound:
+			gerr = util.Errorf("version %d of the public key for %s was not found", version, c.GetName())
+			gerr.SetStatus(http.StatusNotFound)
+		case secret.ErrNoVersions:
+			gerr.SetStatus(http.StatusBadRequest)
+		default:
+			gerr.SetStatus(http.StatusInternalServerError)
+		}
+		return gerr
+	}
+	jsonObj["public_key"] = pk
+	return nil
+}
@@ -46,24 +46,47 @@ type Conf struct {
 	Ipaddress            string
 	Port                 int
 	Hostname             string
-	ProxyHostname        string `toml:"proxy-hostname"`
-	ProxyPort            int    `toml:"proxy-port"`
-	ConfFile             string `toml:"conf-file"`
-	IndexFile            string `toml:"index-file"`
-	DataStoreFile        string `toml:"data-file"`
-	DebugLevel           int    `toml:"debug-level"`
-	LogLevel             string `toml:"log-level"`
-	FreezeInterval       int    `toml:"freeze-interval"`
-	FreezeData           bool   `toml:"freeze-data"`
-	LogFile              string `toml:"log-file"`
-	SysLog               bool   `toml:"syslog"`
-	UseAuth              bool   `toml:"use-auth"`
-	TimeSlew             string `toml:"time-slew"`
+	ProxyHostname        string   `toml:"proxy-hostname"`
+	ProxyPort            int      `toml:"proxy-port"`
+	ConfFile             string   `toml:"conf-file"`
+	IndexFile            string   `toml:"index-file"`
+	DataStoreFile        string   `toml:"data-file"`
+	DebugLevel           int      `toml:"debug-level"`
+	LogLevel             string   `toml:"log-level"`
+	FreezeInterval       int      `toml:"freeze-interval"`
+	FreezeData           bool     `toml:"freeze-data"`
+	LogFile              string   `toml:"log-file"`
+	SysLog               bool     `toml:"syslog"`
+	UseAuth              bool     `toml:"use-auth"`
+	PasswordHash         string   `toml:"password-hash"`
+	BcryptCost           int      `toml:"bcrypt-cost"`
+	Argon2Time           uint32   `toml:"argon2-time"`
+	Argon2Memory         uint32   `toml:"argon2-memory"`
+	Argon2Threads        uint8    `toml:"argon2-threads"`
+	AuthProviders        []string `toml:"auth-providers"`
+	HtpasswdFile         string   `toml:"htpasswd-file"`
+	AuthAutoProvision    bool     `toml:"auth-auto-provision"`
+	LDAP                 LDAPConf `toml:"ldap"`
+	DisableAuthLockout   bool     `toml:"disable-auth-lockout"`
+	AuthLockoutThreshold int      `toml:"auth-lockout-threshold"`
+	AuthLockoutWindow    string   `toml:"auth-lockout-window"`
+	AuthLockoutWindowDur time.Duration
+	AuthLockoutTime      string `toml:"auth-lockout-time"`
+	AuthLockoutTimeDur   time.Duration
+	AuthLockoutMax       string `toml:"auth-lockout-max"`
+	AuthLockoutMaxDur    time.Duration
+	TrustProxy           bool          `toml:"trust-proxy"`
+	RateLimit            RateLimitConf `toml:"rate-limit"`
+	TimeSlew             string        `toml:"time-slew"`
 	TimeSlewDur          time.Duration
 	ConfRoot             string       `toml:"conf-root"`
 	UseSSL               bool         `toml:"use-ssl"`
 	SSLCert              string       `toml:"ssl-cert"`
 	SSLKey               string       `toml:"ssl-key"`
+	SSLClientCA          string       `toml:"ssl-client-ca"`
+	SSLClientCRL         string       `toml:"ssl-client-crl"`
+	SSLClientAuth        string       `toml:"ssl-client-auth"`
+	SSLClientIdentity    string       `toml:"ssl-client-identity"`
 	HTTPSUrls            bool         `toml:"https-urls"`
 	DisableWebUI         bool         `toml:"disable-webui"`
 	UseMySQL             bool         `toml:"use-mysql"`
@@ -86,8 +109,19 @@ type Conf struct {
 	UseSerf              bool     `toml:"use-serf"`
 	SerfEventAnnounce    bool     `toml:"serf-event-announce"`
 	SerfAddr             string   `toml:"serf-addr"`
+	NodeCheckIns         bool     `toml:"node-check-ins"`
+	NodeStaleAfter       string   `toml:"node-stale-after"`
+	EnvStaleAfter        []string `toml:"env-stale-after"`
+	NodeStaleDur         time.Duration
+	EnvStaleDurs         map[string]time.Duration
 	UseShovey            bool     `toml:"use-shovey"`
+	ShoveyTransport      string   `toml:"shovey-transport"`
+	ShoveyTemplatesOnly  bool     `toml:"shovey-templates-only"`
+	ShoveyCancelTimedOut bool     `toml:"shovey-cancel-timed-out"`
 	SignPrivKey          string   `toml:"sign-priv-key"`
+	ShoveyKeyringFile    string   `toml:"shovey-keyring-file"`
+	ShoveyKeyRotation    string   `toml:"shovey-key-rotation"`
+	ShoveyKeyOverlap     string   `toml:"shovey-key-overlap"`
 	DotSearch            bool     `toml:"dot-search"`
 	ConvertSearch        bool     `toml:"convert-search"`
 	PgSearch             bool     `toml:"pg-search"`
@@ -101,18 +135,46 @@ type Conf struct {
 	AWSDisableSSL        bool     `toml:"aws-disable-ssl"`
 	S3Endpoint           string   `toml:"s3-endpoint"`
 	S3FilePeriod         int      `toml:"s3-file-period"`
+	FileURLPeriod        int      `toml:"file-url-period"`
+	FileURLKeyFile       string   `toml:"file-url-key-file"`
+	UnsignedFileURLs     bool     `toml:"unsigned-file-urls"`
 	UseExtSecrets        bool     `toml:"use-external-secrets"`
 	VaultAddr            string   `toml:"vault-addr"`
 	VaultShoveyKey       string   `toml:"vault-shovey-key"`
+	VaultAuthMethod      string   `toml:"vault-auth-method"`
+	VaultAppRoleMount    string   `toml:"vault-approle-mount"`
+	VaultRoleID          string   `toml:"vault-role-id"`
+	VaultSecretIDFile    string   `toml:"vault-secret-id-file"`
+	VaultKVVersion       int      `toml:"vault-kv-version"`
+	VaultKVMount         string   `toml:"vault-kv-mount"`
+	VaultCacheTTL        string   `toml:"vault-cache-ttl"`
+	SecretStore          string   `toml:"secret-store"`
+	KeystoreFile         string   `toml:"keystore-file"`
+	KeystoreKeyFile      string   `toml:"keystore-key-file"`
+	MigrateSecretsFrom   string   `toml:"-"`
+	EncryptData          bool     `toml:"encrypt-data"`
+	DataKeyPath          string   `toml:"data-key-path"`
+	RotateDataKey        bool     `toml:"-"`
+	UnindexedDataBags    []string `toml:"unindexed-data-bags"`
 	EnvVars              []string `toml:"env-vars"`
 	IndexValTrim         int      `toml:"index-val-trim"`
 	PprofWhitelist       []string `toml:"pprof-whitelist"`
 	PurgeNodeStatusAfter string   `toml:"purge-status-after"`
 	PurgeReportsAfter    string   `toml:"purge-reports-after"`
 	PurgeSandboxesAfter  string   `toml:"purge-sandboxes-after"`
+	PurgeFailedAfter     string   `toml:"purge-failed-reports-after"`
+	KeepNodeReports      int      `toml:"keep-reports-per-node"`
+	PurgeShoveyAfter     string   `toml:"purge-shovey-after"`
+	PurgeInterval        string   `toml:"purge-interval"`
 	PurgeNodeStatusDur   time.Duration
 	PurgeReportsDur      time.Duration
 	PurgeSandboxesDur    time.Duration
+	PurgeFailedDur       time.Duration
+	PurgeShoveyDur       time.Duration
+	PurgeIntervalDur     time.Duration
+	VaultCacheTTLDur     time.Duration
+	ShoveyKeyRotationDur time.Duration
+	ShoveyKeyOverlapDur  time.Duration
 	SearchQueryDebug     bool
 }
 
@@ -156,75 +218,230 @@ type PostgreSQLdb struct {
 	SSLMode  string `long:"ssl-mode" description:"PostgreSQL SSL mode ('enable' or 'disable')" env:"GOIARDI_POSTGRESQL_SSL_MODE"`
 }
 
+// LDAPConf holds options for checking user passwords against an LDAP
+// directory.
+type LDAPConf struct {
+	URL          string `toml:"url" long:"url" description:"URL of the LDAP server, like 'ldap://ldap.example.com' or 'ldaps://ldap.example.com'." env:"GOIARDI_LDAP_URL"`
+	StartTLS     bool   `toml:"start-tls" long:"start-tls" description:"Use StartTLS with an ldap:// URL." env:"GOIARDI_LDAP_START_TLS"`
+	BindDN       string `toml:"bind-dn" long:"bind-dn" description:"DN to bind as when searching for users. Searches anonymously if not set." env:"GOIARDI_LDAP_BIND_DN"`
+	BindPassword string `toml:"bind-password" long:"bind-password" description:"Password for the bind DN." env:"GOIARDI_LDAP_BIND_PASSWORD"`
+	BaseDN       string `toml:"base-dn" long:"base-dn" description:"DN to search for users under." env:"GOIARDI_LDAP_BASE_DN"`
+	UserFilter   string `toml:"user-filter" long:"user-filter" description:"Filter for finding a user, with %s for the user name. Default: (uid=%s)." env:"GOIARDI_LDAP_USER_FILTER"`
+	NameAttr     string `toml:"name-attr" long:"name-attr" description:"Attribute with the user's full name. Default: cn." env:"GOIARDI_LDAP_NAME_ATTR"`
+	EmailAttr    string `toml:"email-attr" long:"email-attr" description:"Attribute with the user's email address. Default: mail." env:"GOIARDI_LDAP_EMAIL_ATTR"`
+	AdminAttr    string `toml:"admin-attr" long:"admin-attr" description:"Attribute that makes users created with --auth-auto-provision admins when it has the --ldap-admin-value value, like memberOf." env:"GOIARDI_LDAP_ADMIN_ATTR"`
+	AdminValue   string `toml:"admin-value" long:"admin-value" description:"Value of --ldap-admin-attr that makes a user an admin, like 'cn=chef-admins,ou=groups,dc=example,dc=com'." env:"GOIARDI_LDAP_ADMIN_VALUE"`
+}
+
+// RateLimitConf holds the request rate limits. Limits are set for each family
+// of endpoints (search, cookbooks, file_store, reports, and other for
+// everything else) and look like "10/s", "600/m", or "1000/h", with an
+// optional burst size after a colon, like "10/s:50". "unlimited" lifts a limit
+// set for everyone for admins, validators, or particular actors.
+type RateLimitConf struct {
+	Enable    bool                         `toml:"enable" long:"enable" description:"Limit how fast each client or user can make requests." env:"GOIARDI_RATE_LIMIT_ENABLE"`
+	All       map[string]string            `toml:"all" long:"all" description:"Rate limit for everyone for an endpoint family, like 'search:10/s:20'. Specify multiple times for more families." env:"GOIARDI_RATE_LIMIT_ALL" env-delim:","`
+	Admin     map[string]string            `toml:"admin" long:"admin" description:"Rate limit for admins for an endpoint family, overriding --rate-limit-all, like 'search:unlimited'. Specify multiple times for more families." env:"GOIARDI_RATE_LIMIT_ADMIN" env-delim:","`
+	Validator map[string]string            `toml:"validator" long:"validator" description:"Rate limit for validators for an endpoint family, overriding --rate-limit-all, like 'other:1/s:10'. Specify multiple times for more families." env:"GOIARDI_RATE_LIMIT_VALIDATOR" env-delim:","`
+	Actors    map[string]map[string]string `toml:"actors"`
+}
+
+// RateLimitFamilies are the families of endpoints rate limits are set for.
+var RateLimitFamilies = []string{"search", "cookbooks", "file_store", "reports", "other"}
+
+// RateLimit is a parsed rate limit: Rate requests a second, with up to Burst
+// requests at once.
+type RateLimit struct {
+	Rate      float64
+	Burst     int
+	Unlimited bool
+}
+
+// ParseRateLimit parses a rate limit like "10/s", "600/m:100", or
+// "unlimited". The burst size defaults to the number of requests allowed in
+// the limit's period.
+func ParseRateLimit(limit string) (RateLimit, error) {
+	var rl RateLimit
+	if limit == "unlimited" {
+		rl.Unlimited = true
+		return rl, nil
+	}
+	rateStr := limit
+	burstStr := ""
+	if i := strings.Index(limit, ":"); i != -1 {
+		rateStr, burstStr = limit[:i], limit[i+1:]
+	}
+	rp := strings.Split(rateStr, "/")
+	if len(rp) != 2 {
+		return rl, fmt.Errorf("invalid rate limit '%s': must look like '10/s', '600/m:100', or 'unlimited'", limit)
+	}
+	n, err := strconv.Atoi(rp[0])
+	if err != nil || n <= 0 {
+		return rl, fmt.Errorf("invalid rate limit '%s': the number of requests must be a whole number greater than zero", limit)
+	}
+	var per time.Duration
+	switch rp[1] {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return rl, fmt.Errorf("invalid rate limit '%s': the period must be 's', 'm', or 'h'", limit)
+	}
+	rl.Rate = float64(n) / per.Seconds()
+	rl.Burst = n
+	if burstStr != "" {
+		rl.Burst, err = strconv.Atoi(burstStr)
+		if err != nil || rl.Burst <= 0 {
+			return rl, fmt.Errorf("invalid rate limit '%s': the burst size must be a whole number greater than zero", limit)
+		}
+	}
+	return rl, nil
+}
+
+// LimitFor returns the rate limit for an actor in a class ("admin",
+// "validator", or "" for everyone else) for an endpoint family. Limits for the
+// actor come first, then its class, then everyone. An empty string means
+// there's no limit.
+func (rc RateLimitConf) LimitFor(name string, class string, family string) string {
+	if l, ok := rc.Actors[name][family]; ok {
+		return l
+	}
+	switch class {
+	case "admin":
+		if l, ok := rc.Admin[family]; ok {
+			return l
+		}
+	case "validator":
+		if l, ok := rc.Validator[family]; ok {
+			return l
+		}
+	}
+	return rc.All[family]
+}
+
 // Options holds options set from the command line or (in most cases)
 // environment variables, which are then merged with the options in Conf.
 // Configurations from the command line/env vars are preferred to those set in
 // the config file.
 type Options struct {
-	Version              bool         `short:"v" long:"version" description:"Print version info."`
-	Verbose              []bool       `short:"V" long:"verbose" description:"Show verbose debug information. Repeat for more verbosity."`
-	ConfFile             string       `short:"c" long:"config" description:"Specify a config file to use." env:"GOIARDI_CONFIG"`
-	Ipaddress            string       `short:"I" long:"ipaddress" description:"Listen on a specific IP address." env:"GOIARDI_IPADDRESS"`
-	Hostname             string       `short:"H" long:"hostname" description:"Hostname to use for this server. Defaults to hostname reported by the kernel." env:"GOIARDI_HOSTNAME"`
-	Port                 int          `short:"P" long:"port" description:"Port to listen on. If port is set to 443, SSL will be activated. (default: 4545)" env:"GOIARDI_PORT"`
-	ProxyHostname        string       `short:"Z" long:"proxy-hostname" description:"Hostname to report to clients if this goiardi server is behind a proxy using a different hostname. See also --proxy-port. Can be used with --proxy-port or alone, or not at all." env:"GOIARDI_PROXY_HOSTNAME"`
-	ProxyPort            int          `short:"W" long:"proxy-port" description:"Port to report to clients if this goiardi server is behind a proxy using a different port than the port goiardi is listening on. Can be used with --proxy-hostname or alone, or not at all." env:"GOIARDI_PROXY_PORT"`
-	IndexFile            string       `short:"i" long:"index-file" description:"File to save search index data to." env:"GOIARDI_INDEX_FILE"`
-	DataStoreFile        string       `short:"D" long:"data-file" description:"File to save data store data to." env:"GOIARDI_DATA_FILE"`
-	FreezeInterval       int          `short:"F" long:"freeze-interval" description:"Interval in seconds to freeze in-memory data structures to disk if there have been any changes (requires -i/--index-file and -D/--data-file options to be set). (Default 10 seconds.)" env:"GOIARDI_FREEZE_INTERVAL"`
-	LogFile              string       `short:"L" long:"log-file" description:"Log to file X" env:"GOIARDI_LOG_FILE"`
-	SysLog               bool         `short:"s" long:"syslog" description:"Log to syslog rather than a log file. Incompatible with -L/--log-file." env:"GOIARDI_SYSLOG"`
-	LogLevel             string       `short:"g" long:"log-level" description:"Specify logging verbosity. Performs the same function as -V, but works like the 'log-level' option in the configuration file. Acceptable values are 'debug', 'info', 'warning', 'error', 'critical', and 'fatal'." env:"GOIARDI_LOG_LEVEL"`
-	TimeSlew             string       `long:"time-slew" description:"Time difference allowed between the server's clock and the time in the X-OPS-TIMESTAMP header. Formatted like 5m, 150s, etc. Defaults to 15m." env:"GOIARDI_TIME_SLEW"`
-	ConfRoot             string       `long:"conf-root" description:"Root directory for configs and certificates. Default: the directory the config file is in, or the current directory if no config file is set." env:"GOIARDI_CONF_ROOT"`
-	UseAuth              bool         `short:"A" long:"use-auth" description:"Use authentication. Default: false. (NB: At a future time, the default behavior will change to authentication being enabled.)" env:"GOIARDI_USE_AUTH"`
-	UseSSL               bool         `long:"use-ssl" description:"Use SSL for connections. If --port is set to 433, this will automatically be turned on. If it is set to 80, it will automatically be turned off. Default: off. Requires --ssl-cert and --ssl-key." env:"GOIARDI_USE_SSL"`
-	SSLCert              string       `long:"ssl-cert" description:"SSL certificate file. If a relative path, will be set relative to --conf-root." env:"GOIARDI_SSL_CERT"`
-	SSLKey               string       `long:"ssl-key" description:"SSL key file. If a relative path, will be set relative to --conf-root." env:"GOIARDI_SSL_KEY"`
-	HTTPSUrls            bool         `long:"https-urls" description:"Use 'https://' in URLs to server resources if goiardi is not using SSL for its connections. Useful when goiardi is sitting behind a reverse proxy that uses SSL, but is communicating with the proxy over HTTP." env:"GOIARDI_HTTPS_URLS"`
-	DisableWebUI         bool         `long:"disable-webui" description:"If enabled, disables connections and logins to goiardi over the webui interface." env:"GOIARDI_DISABLE_WEBUI"`
-	UseMySQL             bool         `long:"use-mysql" description:"Use a MySQL database for data storage. Configure database options in the config file." env:"GOIARDI_USE_MYSQL"`
-	MySQL                MySQLdb      `group:"MySQL connection options (requires --use-mysql)" namespace:"mysql"`
-	UsePostgreSQL        bool         `long:"use-postgresql" description:"Use a PostgreSQL database for data storage. Configure database options in the config file." env:"GOIARDI_USE_POSTGRESQL"`
-	PostgreSQL           PostgreSQLdb `group:"PostgreSQL connection options (requires --use-postgresql)" namespace:"postgresql"`
-	LocalFstoreDir       string       `long:"local-filestore-dir" description:"Directory to save uploaded files in. Optional when running in in-memory mode, *mandatory* (unless using S3 uploads) for SQL mode." env:"GOIARDI_LOCAL_FILESTORE_DIR"`
-	LogEvents            bool         `long:"log-events" description:"Log changes to chef objects." env:"GOIARDI_LOG_EVENTS"`
-	LogEventKeep         int          `short:"K" long:"log-event-keep" description:"Number of events to keep in the event log. If set, the event log will be checked periodically and pruned to this number of entries." env:"GOIARDI_LOG_EVENT_KEEP"`
-	SkipLogExtended      bool         `long:"skip-log-extended" description:"If set, do not save a JSON encoded blob of the object being logged when logging an event." env:"GOIARDI_SKIP_LOG_EXTENDED"`
-	Export               string       `short:"x" long:"export" description:"Export all server data to the given file, exiting afterwards. Should be used with caution. Cannot be used at the same time as -m/--import."`
-	Import               string       `short:"m" long:"import" description:"Import data from the given file, exiting afterwards. Cannot be used at the same time as -x/--export."`
-	Bootstrap            bool         `long:"bootstrap" description:"Bootstrap the server creating default actors, their pem certificates. Exits afterwards"`
-	ObjMaxSize           int64        `short:"Q" long:"obj-max-size" description:"Maximum object size in bytes for the file store. Default 10485760 bytes (10MB)." env:"GOIARDI_OBJ_MAX_SIZE"`
-	JSONReqMaxSize       int64        `short:"j" long:"json-req-max-size" description:"Maximum size for a JSON request from the client. Per chef-pedant, default is 1000000." env:"GOIARDI_JSON_REQ_MAX_SIZE"`
-	UseUnsafeMemStore    bool         `long:"use-unsafe-mem-store" description:"Use the faster, but less safe, old method of storing data in the in-memory data store with pointers, rather than encoding the data with gob and giving a new copy of the object to each requestor. If this is enabled goiardi will run faster in in-memory mode, but one goroutine could change an object while it's being used by another. Has no effect when using an SQL backend. (DEPRECATED - will be removed in a future release.)"`
-	DbPoolSize           int          `long:"db-pool-size" description:"Number of idle db connections to maintain. Only useful when using one of the SQL backends. Default is 0 - no idle connections retained" env:"GOIARDI_DB_POOL_SIZE"`
-	MaxConn              int          `long:"max-connections" description:"Maximum number of connections allowed for the database. Only useful when using one of the SQL backends. Default is 0 - unlimited." env:"GOIARDI_MAX_CONN"`
-	UseSerf              bool         `long:"use-serf" description:"If set, have goidari use serf to send and receive events and queries from a serf cluster. Required for shovey." env:"GOIARDI_USE_SERF"`
-	SerfEventAnnounce    bool         `long:"serf-event-announce" description:"Announce log events and joining the serf cluster over serf, as serf events. Requires --use-serf." env:"GOIARDI_SERF_EVENT_ANNOUNCE"`
-	SerfAddr             string       `long:"serf-addr" description:"IP address and port to use for RPC communication with a serf agent. Defaults to 127.0.0.1:7373." env:"GOIARDI_SERF_ADDR"`
-	UseShovey            bool         `long:"use-shovey" description:"Enable using shovey for sending jobs to nodes. Requires --use-serf." env:"GOIARDI_USE_SHOVEY"`
-	SignPrivKey          string       `long:"sign-priv-key" description:"Path to RSA private key used to sign shovey requests." env:"GOIARDI_SIGN_PRIV_KEY"`
-	DotSearch            bool         `long:"dot-search" description:"If set, searches will use . to separate elements instead of _." env:"GOIARDI_DOT_SEARCH"`
-	ConvertSearch        bool         `long:"convert-search" description:"If set, convert _ syntax searches to . syntax. Only useful if --dot-search is set." env:"GOIARDI_CONVERT_SEARCH"`
-	PgSearch             bool         `long:"pg-search" description:"Use the new Postgres based search engine instead of the default ersatz Solr. Requires --use-postgresql, automatically turns on --dot-search. --convert-search is recommended, but not required." env:"GOIARDI_PG_SEARCH"`
-	UseStatsd            bool         `long:"use-statsd" description:"Whether or not to collect statistics about goiardi and send them to statsd." env:"GOIARDI_USE_STATSD"`
-	StatsdAddr           string       `long:"statsd-addr" description:"IP address and port of statsd instance to connect to. (default 'localhost:8125')" env:"GOIARDI_STATSD_ADDR"`
-	StatsdType           string       `long:"statsd-type" description:"statsd format, can be either 'standard' or 'datadog' (default 'standard')" env:"GOIARDI_STATSD_TYPE"`
-	StatsdInstance       string       `long:"statsd-instance" description:"Statsd instance name to use for this server. Defaults to the server's hostname, with '.' replaced by '_'." env:"GOIARDI_STATSD_INSTANCE"`
-	UseS3Upload          bool         `long:"use-s3-upload" description:"Store cookbook files in S3 rather than locally in memory or on disk. This or --local-filestore-dir must be set in SQL mode. Cannot be used with in-memory mode." env:"GOIARDI_USE_S3_UPLOAD"`
-	AWSRegion            string       `long:"aws-region" description:"AWS region to use S3 uploads." env:"GOIARDI_AWS_REGION"`
-	S3Bucket             string       `long:"s3-bucket" description:"The name of the S3 bucket storing the files." env:"GOIARDI_S3_BUCKET"`
-	AWSDisableSSL        bool         `long:"aws-disable-ssl" description:"Set to disable SSL for the endpoint. Mostly useful just for testing." env:"GOIARDI_AWS_DISABLE_SSL"`
-	S3Endpoint           string       `long:"s3-endpoint" description:"Set a different endpoint than the default s3.amazonaws.com. Mostly useful for testing with a fake S3 service, or if using an S3-compatible service." env:"GOIARDI_S3_ENDPOINT"`
-	S3FilePeriod         int          `long:"s3-file-period" description:"Length of time, in minutes, to allow files to be saved to or retrieved from S3 by the client. Defaults to 15 minutes." env:"GOIARDI_S3_FILE_PERIOD"`
-	UseExtSecrets        bool         `long:"use-external-secrets" description:"Use an external service to store secrets (currently user/client public keys). Currently only vault is supported." env:"GOIARDI_USE_EXTERNAL_SECRETS"`
-	VaultAddr            string       `long:"vault-addr" description:"Specify address of vault server (i.e. https://127.0.0.1:8200). Defaults to the value of VAULT_ADDR."`
-	VaultShoveyKey       string       `long:"vault-shovey-key" description:"Specify a path in vault holding shovey's private key. The key must be put in vault as 'privateKey=<contents>'." env:"GOIARDI_VAULT_SHOVEY_KEY"`
-	IndexValTrim         int          `short:"T" long:"index-val-trim" description:"Trim values indexed for chef search to this many characters (keys are untouched). If not set or set <= 0, trimming is disabled. This behavior will change with the next major release." env:"GOIARDI_INDEX_VAL_TRIM"`
-	PprofWhitelist       []string     `short:"y" long:"pprof-whitelist" description:"Address to allow to access /debug/pprof (in addition to localhost). Specify multiple times to allow more addresses." env:"GOIARDI_PPROF_WHITELIST" env-delim:","`
-	PurgeReportsAfter    string       `long:"purge-reports-after" description:"Time to purge old reports after, given in golang duration format (e.g. \"720h\"). Default is not to purge them at all." env:"GOIARDI_PURGE_REPORTS_AFTER"`
-	PurgeNodeStatusAfter string       `long:"purge-status-after" description:"Time to purge old node statuses after, given in golang duration format (e.g. \"720h\"). Default is not to purge them at all." env:"GOIARDI_PURGE_STATUS_AFTER"`
-	PurgeSandboxesAfter  string       `long:"purge-sandboxes-after" description:"Time to purge old reports after, given in golang duration format (e.g. \"720h\"). Default is to purge them after one week. Set this to '0s' to disable sandbox purging." env:"GOIARDI_PURGE_SANDBOXES_AFTER"`
+	Version              bool          `short:"v" long:"version" description:"Print version info."`
+	Verbose              []bool        `short:"V" long:"verbose" description:"Show verbose debug information. Repeat for more verbosity."`
+	ConfFile             string        `short:"c" long:"config" description:"Specify a config file to use." env:"GOIARDI_CONFIG"`
+	Ipaddress            string        `short:"I" long:"ipaddress" description:"Listen on a specific IP address." env:"GOIARDI_IPADDRESS"`
+	Hostname             string        `short:"H" long:"hostname" description:"Hostname to use for this server. Defaults to hostname reported by the kernel." env:"GOIARDI_HOSTNAME"`
+	Port                 int           `short:"P" long:"port" description:"Port to listen on. If port is set to 443, SSL will be activated. (default: 4545)" env:"GOIARDI_PORT"`
+	ProxyHostname        string        `short:"Z" long:"proxy-hostname" description:"Hostname to report to clients if this goiardi server is behind a proxy using a different hostname. See also --proxy-port. Can be used with --proxy-port or alone, or not at all." env:"GOIARDI_PROXY_HOSTNAME"`
+	ProxyPort            int           `short:"W" long:"proxy-port" description:"Port to report to clients if this goiardi server is behind a proxy using a different port than the port goiardi is listening on. Can be used with --proxy-hostname or alone, or not at all." env:"GOIARDI_PROXY_PORT"`
+	IndexFile            string        `short:"i" long:"index-file" description:"File to save search index data to." env:"GOIARDI_INDEX_FILE"`
+	DataStoreFile        string        `short:"D" long:"data-file" description:"File to save data store data to." env:"GOIARDI_DATA_FILE"`
+	FreezeInterval       int           `short:"F" long:"freeze-interval" description:"Interval in seconds to freeze in-memory data structures to disk if there have been any changes (requires -i/--index-file and -D/--data-file options to be set). (Default 10 seconds.)" env:"GOIARDI_FREEZE_INTERVAL"`
+	LogFile              string        `short:"L" long:"log-file" description:"Log to file X" env:"GOIARDI_LOG_FILE"`
+	SysLog               bool          `short:"s" long:"syslog" description:"Log to syslog rather than a log file. Incompatible with -L/--log-file." env:"GOIARDI_SYSLOG"`
+	LogLevel             string        `short:"g" long:"log-level" description:"Specify logging verbosity. Performs the same function as -V, but works like the 'log-level' option in the configuration file. Acceptable values are 'debug', 'info', 'warning', 'error', 'critical', and 'fatal'." env:"GOIARDI_LOG_LEVEL"`
+	TimeSlew             string        `long:"time-slew" description:"Time difference allowed between the server's clock and the time in the X-OPS-TIMESTAMP header. Formatted like 5m, 150s, etc. Defaults to 15m." env:"GOIARDI_TIME_SLEW"`
+	ConfRoot             string        `long:"conf-root" description:"Root directory for configs and certificates. Default: the directory the config file is in, or the current directory if no config file is set." env:"GOIARDI_CONF_ROOT"`
+	UseAuth              bool          `short:"A" long:"use-auth" description:"Use authentication. Default: false. (NB: At a future time, the default behavior will change to authentication being enabled.)" env:"GOIARDI_USE_AUTH"`
+	PasswordHash         string        `long:"password-hash" description:"How to hash user passwords, either 'argon2id' or 'bcrypt'. Passwords hashed some other way are rehashed the next time the user logs in. Default: argon2id." env:"GOIARDI_PASSWORD_HASH"`
+	BcryptCost           int           `long:"bcrypt-cost" description:"Cost for hashing passwords with bcrypt. Default: 12." env:"GOIARDI_BCRYPT_COST"`
+	Argon2Time           uint32        `long:"argon2-time" description:"Number of passes over the memory when hashing passwords with argon2id. Default: 1." env:"GOIARDI_ARGON2_TIME"`
+	Argon2Memory         uint32        `long:"argon2-memory" description:"Memory in KiB to use when hashing passwords with argon2id. Default: 65536 (64MB)." env:"GOIARDI_ARGON2_MEMORY"`
+	Argon2Threads        uint8         `long:"argon2-threads" description:"Number of threads to use when hashing passwords with argon2id. Default: 4." env:"GOIARDI_ARGON2_THREADS"`
+	AuthProviders        []string      `long:"auth-providers" description:"Where to check user passwords for /authenticate_user, tried in order: 'local' (goiardi's own user passwords), 'htpasswd', and 'ldap'. Specify multiple times for more providers. Default: local." env:"GOIARDI_AUTH_PROVIDERS" env-delim:","`
+	HtpasswdFile         string        `long:"htpasswd-file" description:"Path to an htpasswd file for the 'htpasswd' authentication provider. Supports bcrypt, MD5, and SHA-1 hashes." env:"GOIARDI_HTPASSWD_FILE"`
+	AuthAutoProvision    bool          `long:"auth-auto-provision" description:"Create goiardi users for people who log in with the 'htpasswd' or 'ldap' authentication providers but aren't goiardi users yet." env:"GOIARDI_AUTH_AUTO_PROVISION"`
+	DisableAuthLockout   bool          `long:"disable-auth-lockout" description:"Don't lock out users, clients, and addresses after repeated authentication failures." env:"GOIARDI_DISABLE_AUTH_LOCKOUT"`
+	AuthLockoutThreshold int           `long:"auth-lockout-threshold" description:"Number of authentication failures within --auth-lockout-window that lock out a user, client, or address. Default: 10." env:"GOIARDI_AUTH_LOCKOUT_THRESHOLD"`
+	AuthLockoutWindow    string        `long:"auth-lockout-window" description:"How long authentication failures are counted for, in golang duration format. Default: 15m." env:"GOIARDI_AUTH_LOCKOUT_WINDOW"`
+	AuthLockoutTime      string        `long:"auth-lockout-time" description:"How long the first lockout lasts, in golang duration format. Each lockout after that without a successful login in between lasts twice as long as the one before, up to --auth-lockout-max. Default: 15m." env:"GOIARDI_AUTH_LOCKOUT_TIME"`
+	AuthLockoutMax       string        `long:"auth-lockout-max" description:"The longest a lockout can last, in golang duration format. Set it to the same as --auth-lockout-time to keep lockouts from getting longer. Default: 24h." env:"GOIARDI_AUTH_LOCKOUT_MAX"`
+	TrustProxy           bool          `long:"trust-proxy" description:"Use the last address in the X-Forwarded-For header as the client's address, for when goiardi is behind a reverse proxy. Only turn this on if it is, or clients can pretend to be anywhere." env:"GOIARDI_TRUST_PROXY"`
+	LDAP                 LDAPConf      `group:"LDAP authentication options (requires --auth-providers=ldap)" namespace:"ldap"`
+	RateLimit            RateLimitConf `group:"Rate limiting options (requires --rate-limit-enable)" namespace:"rate-limit"`
+	UseSSL               bool          `long:"use-ssl" description:"Use SSL for connections. If --port is set to 433, this will automatically be turned on. If it is set to 80, it will automatically be turned off. Default: off. Requires --ssl-cert and --ssl-key." env:"GOIARDI_USE_SSL"`
+	SSLCert              string        `long:"ssl-cert" description:"SSL certificate file. If a relative path, will be set relative to --conf-root." env:"GOIARDI_SSL_CERT"`
+	SSLKey               string        `long:"ssl-key" description:"SSL key file. If a relative path, will be set relative to --conf-root." env:"GOIARDI_SSL_KEY"`
+	SSLClientCA          string        `long:"ssl-client-ca" description:"CA certificate bundle to verify client certificates against. Turns on authenticating clients and users with TLS client certificates. Requires --use-ssl. If a relative path, will be set relative to --conf-root." env:"GOIARDI_SSL_CLIENT_CA"`
+	SSLClientCRL         string        `long:"ssl-client-crl" description:"Certificate revocation list for client certificates, in PEM or DER format. Read again when it changes. If a relative path, will be set relative to --conf-root." env:"GOIARDI_SSL_CLIENT_CRL"`
+	SSLClientAuth        string        `long:"ssl-client-auth" description:"How client certificates are used for authentication: 'either' (a certificate or signed headers), 'both' (a certificate and signed headers for the same client or user), or 'cert' (only a certificate). Default: either." env:"GOIARDI_SSL_CLIENT_AUTH"`
+	SSLClientIdentity    string        `long:"ssl-client-identity" description:"Which part of a client certificate names the goiardi client or user: 'cn' (the subject's common name), 'dns' (a DNS subject alternative name), or 'uri' (the last part of the path of a URI subject alternative name). Default: cn." env:"GOIARDI_SSL_CLIENT_IDENTITY"`
+	HTTPSUrls            bool          `long:"https-urls" description:"Use 'https://' in URLs to server resources if goiardi is not using SSL for its connections. Useful when goiardi is sitting behind a reverse proxy that uses SSL, but is communicating with the proxy over HTTP." env:"GOIARDI_HTTPS_URLS"`
+	DisableWebUI         bool          `long:"disable-webui" description:"If enabled, disables connections and logins to goiardi over the webui interface." env:"GOIARDI_DISABLE_WEBUI"`
+	UseMySQL             bool          `long:"use-mysql" description:"Use a MySQL database for data storage. Configure database options in the config file." env:"GOIARDI_USE_MYSQL"`
+	MySQL                MySQLdb       `group:"MySQL connection options (requires --use-mysql)" namespace:"mysql"`
+	UsePostgreSQL        bool          `long:"use-postgresql" description:"Use a PostgreSQL database for data storage. Configure database options in the config file." env:"GOIARDI_USE_POSTGRESQL"`
+	PostgreSQL           PostgreSQLdb  `group:"PostgreSQL connection options (requires --use-postgresql)" namespace:"postgresql"`
+	LocalFstoreDir       string        `long:"local-filestore-dir" description:"Directory to save uploaded files in. Optional when running in in-memory mode, *mandatory* (unless using S3 uploads) for SQL mode." env:"GOIARDI_LOCAL_FILESTORE_DIR"`
+	LogEvents            bool          `long:"log-events" description:"Log changes to chef objects." env:"GOIARDI_LOG_EVENTS"`
+	LogEventKeep         int           `short:"K" long:"log-event-keep" description:"Number of events to keep in the event log. If set, the event log will be checked periodically and pruned to this number of entries." env:"GOIARDI_LOG_EVENT_KEEP"`
+	SkipLogExtended      bool          `long:"skip-log-extended" description:"If set, do not save a JSON encoded blob of the object being logged when logging an event." env:"GOIARDI_SKIP_LOG_EXTENDED"`
+	Export               string        `short:"x" long:"export" description:"Export all server data to the given file, exiting afterwards. Should be used with caution. Cannot be used at the same time as -m/--import."`
+	Import               string        `short:"m" long:"import" description:"Import data from the given file, exiting afterwards. Cannot be used at the same time as -x/--export."`
+	Bootstrap            bool          `long:"bootstrap" description:"Bootstrap the server creating default actors, their pem certificates. Exits afterwards"`
+	ObjMaxSize           int64         `short:"Q" long:"obj-max-size" description:"Maximum object size in bytes for the file store. Default 10485760 bytes (10MB)." env:"GOIARDI_OBJ_MAX_SIZE"`
+	JSONReqMaxSize       int64         `short:"j" long:"json-req-max-size" description:"Maximum size for a JSON request from the client. Per chef-pedant, default is 1000000." env:"GOIARDI_JSON_REQ_MAX_SIZE"`
+	UseUnsafeMemStore    bool          `long:"use-unsafe-mem-store" description:"Use the faster, but less safe, old method of storing data in the in-memory data store with pointers, rather than encoding the data with gob and giving a new copy of the object to each requestor. If this is enabled goiardi will run faster in in-memory mode, but one goroutine could change an object while it's being used by another. Has no effect when using an SQL backend. (DEPRECATED - will be removed in a future release.)"`
+	DbPoolSize           int           `long:"db-pool-size" description:"Number of idle db connections to maintain. Only useful when using one of the SQL backends. Default is 0 - no idle connections retained" env:"GOIARDI_DB_POOL_SIZE"`
+	MaxConn              int           `long:"max-connections" description:"Maximum number of connections allowed for the database. Only useful when using one of the SQL backends. Default is 0 - unlimited." env:"GOIARDI_MAX_CONN"`
+	UseSerf              bool          `long:"use-serf" description:"If set, have goidari use serf to send and receive events and queries from a serf cluster. Required for shovey." env:"GOIARDI_USE_SERF"`
+	SerfEventAnnounce    bool          `long:"serf-event-announce" description:"Announce log events and joining the serf cluster over serf, as serf events. Requires --use-serf." env:"GOIARDI_SERF_EVENT_ANNOUNCE"`
+	SerfAddr             string        `long:"serf-addr" description:"IP address and port to use for RPC communication with a serf agent. Defaults to 127.0.0.1:7373." env:"GOIARDI_SERF_ADDR"`
+	NodeCheckIns         bool          `long:"node-check-ins" description:"Track whether nodes are up or down from chef-client check-ins (run reports, node saves with a new ohai_time, and heartbeats to /status/node/<node>/heartbeat) rather than needing serf." env:"GOIARDI_NODE_CHECK_INS"`
+	NodeStaleAfter       string        `long:"node-stale-after" description:"How long a node can go without checking in before it's marked as down, given in golang duration format. Defaults to \"10m\" with serf and \"1h\" with --node-check-ins." env:"GOIARDI_NODE_STALE_AFTER"`
+	EnvStaleAfter        []string      `long:"env-stale-after" description:"Staleness threshold for nodes in a particular environment, overriding --node-stale-after, given as <environment>:<duration> (e.g. \"production:30m\"). Specify multiple times for more environments." env:"GOIARDI_ENV_STALE_AFTER" env-delim:","`
+	UseShovey            bool          `long:"use-shovey" description:"Enable using shovey for sending jobs to nodes. Requires --use-serf, unless --shovey-transport is 'http'." env:"GOIARDI_USE_SHOVEY"`
+	ShoveyTransport      string        `long:"shovey-transport" description:"How to send shovey jobs to nodes. 'serf' (the default) sends them out with serf queries, while 'http' has nodes poll goiardi for jobs over HTTP, for nodes that can't be part of a serf cluster. The HTTP job queue is kept in memory, so it only works with a single goiardi process." env:"GOIARDI_SHOVEY_TRANSPORT"`
+	ShoveyTemplatesOnly  bool          `long:"shovey-templates-only" description:"Only allow shovey jobs made from a shovey command template, rather than any command an admin types in." env:"GOIARDI_SHOVEY_TEMPLATES_ONLY"`
+	ShoveyCancelTimedOut bool          `long:"shovey-cancel-timed-out" description:"Send a cancel command to nodes whose shovey runs time out without reporting back." env:"GOIARDI_SHOVEY_CANCEL_TIMED_OUT"`
+	SignPrivKey          string        `long:"sign-priv-key" description:"Path to RSA private key used to sign shovey requests." env:"GOIARDI_SIGN_PRIV_KEY"`
+	ShoveyKeyringFile    string        `long:"shovey-keyring-file" description:"Path to the file holding the shovey signing keyring when not using an external secret store. Defaults to shovey-keyring in the conf-root." env:"GOIARDI_SHOVEY_KEYRING_FILE"`
+	ShoveyKeyRotation    string        `long:"shovey-key-rotation" description:"How often to make a new shovey signing key, as a duration like '720h'. Keys are not rotated if this isn't set." env:"GOIARDI_SHOVEY_KEY_ROTATION"`
+	ShoveyKeyOverlap     string        `long:"shovey-key-overlap" description:"How long a new shovey signing key is published before it's used, and how long the key it replaces is still accepted afterwards. Defaults to 24h." env:"GOIARDI_SHOVEY_KEY_OVERLAP"`
+	DotSearch            bool          `long:"dot-search" description:"If set, searches will use . to separate elements instead of _." env:"GOIARDI_DOT_SEARCH"`
+	ConvertSearch        bool          `long:"convert-search" description:"If set, convert _ syntax searches to . syntax. Only useful if --dot-search is set." env:"GOIARDI_CONVERT_SEARCH"`
+	PgSearch             bool          `long:"pg-search" description:"Use the new Postgres based search engine instead of the default ersatz Solr. Requires --use-postgresql, automatically turns on --dot-search. --convert-search is recommended, but not required." env:"GOIARDI_PG_SEARCH"`
+	UseStatsd            bool          `long:"use-statsd" description:"Whether or not to collect statistics about goiardi and send them to statsd." env:"GOIARDI_USE_STATSD"`
+	StatsdAddr           string        `long:"statsd-addr" description:"IP address and port of statsd instance to connect to. (default 'localhost:8125')" env:"GOIARDI_STATSD_ADDR"`
+	StatsdType           string        `long:"statsd-type" description:"statsd format, can be either 'standard' or 'datadog' (default 'standard')" env:"GOIARDI_STATSD_TYPE"`
+	StatsdInstance       string        `long:"statsd-instance" description:"Statsd instance name to use for this server. Defaults to the server's hostname, with '.' replaced by '_'." env:"GOIARDI_STATSD_INSTANCE"`
+	UseS3Upload          bool          `long:"use-s3-upload" description:"Store cookbook files in S3 rather than locally in memory or on disk. This or --local-filestore-dir must be set in SQL mode. Cannot be used with in-memory mode." env:"GOIARDI_USE_S3_UPLOAD"`
+	AWSRegion            string        `long:"aws-region" description:"AWS region to use S3 uploads." env:"GOIARDI_AWS_REGION"`
+	S3Bucket             string        `long:"s3-bucket" description:"The name of the S3 bucket storing the files." env:"GOIARDI_S3_BUCKET"`
+	AWSDisableSSL        bool          `long:"aws-disable-ssl" description:"Set to disable SSL for the endpoint. Mostly useful just for testing." env:"GOIARDI_AWS_DISABLE_SSL"`
+	S3Endpoint           string        `long:"s3-endpoint" description:"Set a different endpoint than the default s3.amazonaws.com. Mostly useful for testing with a fake S3 service, or if using an S3-compatible service." env:"GOIARDI_S3_ENDPOINT"`
+	S3FilePeriod         int           `long:"s3-file-period" description:"Length of time, in minutes, to allow files to be saved to or retrieved from S3 by the client. Defaults to 15 minutes." env:"GOIARDI_S3_FILE_PERIOD"`
+	FileURLPeriod        int           `long:"file-url-period" description:"Length of time, in minutes, that signed /file_store URLs for saving or retrieving files from the local file store are good for. Defaults to 15 minutes." env:"GOIARDI_FILE_URL_PERIOD"`
+	FileURLKeyFile       string        `long:"file-url-key-file" description:"Path to the key used to sign /file_store URLs. It will be created if it doesn't exist, and must be shared by goiardi servers using the same file store. Defaults to file-url-key in the conf-root." env:"GOIARDI_FILE_URL_KEY_FILE"`
+	UnsignedFileURLs     bool          `long:"unsigned-file-urls" description:"Allow unsigned and expired /file_store URLs, like older versions of goiardi did. Only for use while moving to signed URLs." env:"GOIARDI_UNSIGNED_FILE_URLS"`
+	UseExtSecrets        bool          `long:"use-external-secrets" description:"Use an external service to store secrets (currently user/client public keys, user password hashes, and the shovey signing key). Which one is set with --secret-store." env:"GOIARDI_USE_EXTERNAL_SECRETS"`
+	VaultAddr            string        `long:"vault-addr" description:"Specify address of vault server (i.e. https://127.0.0.1:8200). Defaults to the value of VAULT_ADDR."`
+	VaultShoveyKey       string        `long:"vault-shovey-key" description:"Specify a path in vault holding shovey's private key. The key must be put in vault as 'privateKey=<contents>'." env:"GOIARDI_VAULT_SHOVEY_KEY"`
+	VaultAuthMethod      string        `long:"vault-auth-method" description:"How to log in to vault: 'token', using the VAULT_TOKEN environment variable, or 'approle'. Default: token." env:"GOIARDI_VAULT_AUTH_METHOD"`
+	VaultAppRoleMount    string        `long:"vault-approle-mount" description:"Path the AppRole auth method is mounted at in vault. Default: approle." env:"GOIARDI_VAULT_APPROLE_MOUNT"`
+	VaultRoleID          string        `long:"vault-role-id" description:"Role ID to log in to vault with when --vault-auth-method is approle." env:"GOIARDI_VAULT_ROLE_ID"`
+	VaultSecretIDFile    string        `long:"vault-secret-id-file" description:"File holding the secret ID to log in to vault with when --vault-auth-method is approle. It's read again every time goiardi logs in. If this isn't set, the secret ID is read from the GOIARDI_VAULT_SECRET_ID environment variable." env:"GOIARDI_VAULT_SECRET_ID_FILE"`
+	VaultKVVersion       int           `long:"vault-kv-version" description:"Version of the vault key/value secrets engine goiardi's secrets are kept in, 1 or 2. Default: 1." env:"GOIARDI_VAULT_KV_VERSION"`
+	VaultKVMount         string        `long:"vault-kv-mount" description:"Path the key/value secrets engine is mounted at in vault, for version 2. Default: keys." env:"GOIARDI_VAULT_KV_MOUNT"`
+	VaultCacheTTL        string        `long:"vault-cache-ttl" description:"How long to keep secrets fetched from vault before fetching them again, as a duration like '5m'. If not set, secrets are kept for as long as vault says they're good for." env:"GOIARDI_VAULT_CACHE_TTL"`
+	SecretStore          string        `long:"secret-store" description:"Which external secret store to use with --use-external-secrets, either 'vault' or 'keystore' (an encrypted file kept locally). Default: vault." env:"GOIARDI_SECRET_STORE"`
+	KeystoreFile         string        `long:"keystore-file" description:"Path to the encrypted keystore file. Relative paths are under --conf-root. Default: goiardi-keystore in --conf-root." env:"GOIARDI_KEYSTORE_FILE"`
+	KeystoreKeyFile      string        `long:"keystore-key-file" description:"Path to the file holding the keystore's master keys, one base64 encoded 32 byte key per line. The first key encrypts the keystore; any others are older keys that can still decrypt it. If this isn't set, the keys are read from the GOIARDI_KEYSTORE_KEY environment variable, separated by commas." env:"GOIARDI_KEYSTORE_KEY_FILE"`
+	EncryptData          bool          `long:"encrypt-data" description:"Encrypt data bag items and node attributes in the database, with master keys kept in the external secret store. Requires MySQL or PostgreSQL and --use-external-secrets." env:"GOIARDI_ENCRYPT_DATA"`
+	DataKeyPath          string        `long:"data-key-path" description:"Path in the external secret store holding the master keys for --encrypt-data. Default: keys/encryption/data." env:"GOIARDI_DATA_KEY_PATH"`
+	RotateDataKey        bool          `long:"rotate-data-key" description:"Make a new master key for --encrypt-data and save it to the external secret store, exiting afterwards. Data encrypted with the older keys is encrypted again with the new one in the background by running goiardi servers once they've been restarted or sent SIGHUP."`
+	UnindexedDataBags    []string      `long:"unindexed-data-bag" description:"Don't index the items in this data bag for search, for data bags with sensitive data in them. Specify multiple times for more data bags." env:"GOIARDI_UNINDEXED_DATA_BAGS" env-delim:","`
+	MigrateSecretsFrom   string        `long:"migrate-secrets-from" description:"Copy public keys, password hashes, the shovey signing key, and the data encryption master keys from this secret store ('builtin', 'vault', or 'keystore') into the one goiardi is configured to use, exiting afterwards."`
+	IndexValTrim         int           `short:"T" long:"index-val-trim" description:"Trim values indexed for chef search to this many characters (keys are untouched). If not set or set <= 0, trimming is disabled. This behavior will change with the next major release." env:"GOIARDI_INDEX_VAL_TRIM"`
+	PprofWhitelist       []string      `short:"y" long:"pprof-whitelist" description:"Address to allow to access /debug/pprof (in addition to localhost). Specify multiple times to allow more addresses." env:"GOIARDI_PPROF_WHITELIST" env-delim:","`
+	PurgeReportsAfter    string        `long:"purge-reports-after" description:"Time to purge old reports after, given in golang duration format (e.g. \"720h\"). Default is not to purge them at all." env:"GOIARDI_PURGE_REPORTS_AFTER"`
+	PurgeNodeStatusAfter string        `long:"purge-status-after" description:"Time to purge old node statuses after, given in golang duration format (e.g. \"720h\"). Default is not to purge them at all." env:"GOIARDI_PURGE_STATUS_AFTER"`
+	PurgeSandboxesAfter  string        `long:"purge-sandboxes-after" description:"Time to purge old reports after, given in golang duration format (e.g. \"720h\"). Default is to purge them after one week. Set this to '0s' to disable sandbox purging." env:"GOIARDI_PURGE_SANDBOXES_AFTER"`
+	PurgeFailedAfter     string        `long:"purge-failed-reports-after" description:"Time to purge reports of failed runs after, given in golang duration format (e.g. \"2160h\"). Lets failed runs be kept around longer than successful ones. Defaults to the value of --purge-reports-after." env:"GOIARDI_PURGE_FAILED_REPORTS_AFTER"`
+	KeepNodeReports      int           `long:"keep-reports-per-node" description:"Maximum number of reports to keep for each node. Older reports past this number are purged. Default is not to limit the number of reports per node." env:"GOIARDI_KEEP_REPORTS_PER_NODE"`
+	PurgeShoveyAfter     string        `long:"purge-shovey-after" description:"Time to purge finished shovey jobs, along with their node runs and output, after, given in golang duration format (e.g. \"720h\"). Default is not to purge them at all." env:"GOIARDI_PURGE_SHOVEY_AFTER"`
+	PurgeInterval        string        `long:"purge-interval" description:"How often to check for reports, node statuses, and shovey jobs to purge, given in golang duration format. Can be changed by reloading the configuration with SIGHUP. Defaults to \"2h\"." env:"GOIARDI_PURGE_INTERVAL"`
 	// hidden argument to print a formatted man page to stdout and exit
 	PrintManPage bool `long:"print-man-page" hidden:"true"`
 	// hidden argument to enable logging full postgres search queries
@@ -250,6 +467,49 @@ var SupportedAPIVersions = []string{"0", "1"}
 // in the X-OPS-TIMESTAMP header.
 const DefaultTimeSlew = "15m"
 
+// The default password hashing settings. The argon2id settings are the ones
+// recommended by golang.org/x/crypto/argon2; memory is in KiB.
+const (
+	DefaultPasswordHash         = "argon2id"
+	DefaultBcryptCost           = 12
+	DefaultArgon2Time    uint32 = 1
+	DefaultArgon2Memory  uint32 = 64 * 1024
+	DefaultArgon2Threads uint8  = 4
+)
+
+// How client certificates are used to authenticate requests, and which part of
+// the certificate names the client or user.
+const (
+	ClientCertEither = "either"
+	ClientCertBoth   = "both"
+	ClientCertOnly   = "cert"
+	ClientCertCN     = "cn"
+	ClientCertDNS    = "dns"
+	ClientCertURI    = "uri"
+)
+
+// The places secrets like public keys and password hashes can be kept.
+const (
+	SecretStoreBuiltin  = "builtin"
+	SecretStoreVault    = "vault"
+	SecretStoreKeystore = "keystore"
+)
+
+// The ways goiardi can log in to vault.
+const (
+	VaultAuthToken   = "token"
+	VaultAuthAppRole = "approle"
+)
+
+// The default settings for locking out users, clients, and addresses after
+// authentication failures.
+const (
+	DefaultAuthLockoutThreshold = 10
+	DefaultAuthLockoutWindow    = "15m"
+	DefaultAuthLockoutTime      = "15m"
+	DefaultAuthLockoutMax       = "24h"
+)
+
 /* The general plan is to read the command-line options, then parse the config
  * file, fill in the config struct with those values, then apply the
  * command-line options to the config struct. We read the cli options first so
@@ -272,7 +532,9 @@ func ParseConfigOptions() error {
 	parser.LongDescription = "With no arguments, goiardi runs without any authentication or persistence entirely in memory. For authentication, persistence, stability, or other features, run goiardi with the appropriate combination of flags (or set options in the configuration file).\n\nMany of goiardi's command line arguments can be set with environment variables instead of flags, if desired. The options that allow this are followed by the name of the appropriate environment variable (e.g. [$GOIARDI_SOME_OPTION])."
 	parser.NamespaceDelimiter = "-"
 	if hideVaultOptions {
-		vopts := []string{"vault-addr", "vault-shovey-key", "use-external-secrets"}
+		// the keystore works without vault, so external secrets are still
+		// an option
+		vopts := []string{"vault-addr", "vault-shovey-key", "vault-auth-method", "vault-approle-mount", "vault-role-id", "vault-secret-id-file", "vault-kv-version", "vault-kv-mount", "vault-cache-ttl"}
 		for _, v := range vopts {
 			c := parser.FindOptionByLongName(v)
 			c.Hidden = true
@@ -302,6 +564,11 @@ func ParseConfigOptions() error {
 	/* Load the config file. Command-line options have precedence over
 	 * config file options. */
 	if opts.ConfFile != "" {
+		// decoding into the existing rate limit maps would keep limits
+		// that were taken out of the file when it's reloaded, and the
+		// same goes for unindexed data bags
+		Config.RateLimit = RateLimitConf{}
+		Config.UnindexedDataBags = nil
 		if _, err := toml.DecodeFile(opts.ConfFile, Config); err != nil {
 			log.Println(err)
 			os.Exit(1)
@@ -317,6 +584,20 @@ func ParseConfigOptions() error {
 		os.Exit(1)
 	}
 
+	Config.MigrateSecretsFrom = opts.MigrateSecretsFrom
+	if Config.MigrateSecretsFrom != "" {
+		if opts.Export != "" || opts.Import != "" {
+			log.Println("Cannot use --migrate-secrets-from with the -x/--export or -m/--import flags.")
+			os.Exit(1)
+		}
+		switch Config.MigrateSecretsFrom {
+		case SecretStoreBuiltin, SecretStoreVault, SecretStoreKeystore:
+		default:
+			log.Printf("--migrate-secrets-from must be one of '%s', '%s', or '%s', not '%s'.\n", SecretStoreBuiltin, SecretStoreVault, SecretStoreKeystore, Config.MigrateSecretsFrom)
+			os.Exit(1)
+		}
+	}
+
 	if opts.Export != "" {
 		Config.DoExport = true
 		Config.ImpExFile = opts.Export
@@ -538,6 +819,27 @@ func ParseConfigOptions() error {
 		}
 	}
 
+	if opts.FileURLPeriod != 0 {
+		Config.FileURLPeriod = opts.FileURLPeriod
+	}
+	if Config.FileURLPeriod == 0 {
+		Config.FileURLPeriod = 15
+	} else if Config.FileURLPeriod < 0 {
+		logger.Fatalf("file-url-period must be greater than zero")
+		os.Exit(1)
+	}
+	if opts.FileURLKeyFile != "" {
+		Config.FileURLKeyFile = opts.FileURLKeyFile
+	}
+	if Config.FileURLKeyFile == "" {
+		Config.FileURLKeyFile = path.Join(Config.ConfRoot, "file-url-key")
+	} else if !path.IsAbs(Config.FileURLKeyFile) {
+		Config.FileURLKeyFile = path.Join(Config.ConfRoot, Config.FileURLKeyFile)
+	}
+	if opts.UnsignedFileURLs {
+		Config.UnsignedFileURLs = opts.UnsignedFileURLs
+	}
+
 	if Config.LocalFstoreDir == "" && ((Config.UseMySQL || Config.UsePostgreSQL) && !Config.UseS3Upload) {
 		logger.Fatalf("local-filestore-dir or use-s3-upload must be set and configured when running goiardi in SQL mode")
 		os.Exit(1)
@@ -609,6 +911,109 @@ func ParseConfigOptions() error {
 	if opts.VaultAddr != "" {
 		Config.VaultAddr = opts.VaultAddr
 	}
+	if opts.SecretStore != "" {
+		Config.SecretStore = opts.SecretStore
+	}
+	if opts.KeystoreFile != "" {
+		Config.KeystoreFile = opts.KeystoreFile
+	}
+	if opts.KeystoreKeyFile != "" {
+		Config.KeystoreKeyFile = opts.KeystoreKeyFile
+	}
+	if Config.SecretStore == "" {
+		Config.SecretStore = SecretStoreVault
+	}
+	if Config.SecretStore != SecretStoreVault && Config.SecretStore != SecretStoreKeystore {
+		logger.Fatalf("--secret-store must be either '%s' or '%s', not '%s'.", SecretStoreVault, SecretStoreKeystore, Config.SecretStore)
+		os.Exit(1)
+	}
+	if opts.VaultAuthMethod != "" {
+		Config.VaultAuthMethod = opts.VaultAuthMethod
+	}
+	if opts.VaultAppRoleMount != "" {
+		Config.VaultAppRoleMount = opts.VaultAppRoleMount
+	}
+	if opts.VaultRoleID != "" {
+		Config.VaultRoleID = opts.VaultRoleID
+	}
+	if opts.VaultSecretIDFile != "" {
+		Config.VaultSecretIDFile = opts.VaultSecretIDFile
+	}
+	if opts.VaultKVVersion != 0 {
+		Config.VaultKVVersion = opts.VaultKVVersion
+	}
+	if opts.VaultKVMount != "" {
+		Config.VaultKVMount = opts.VaultKVMount
+	}
+	if opts.VaultCacheTTL != "" {
+		Config.VaultCacheTTL = opts.VaultCacheTTL
+	}
+	if Config.VaultAuthMethod == "" {
+		Config.VaultAuthMethod = VaultAuthToken
+	}
+	if Config.VaultAppRoleMount == "" {
+		Config.VaultAppRoleMount = "approle"
+	}
+	if Config.VaultKVVersion == 0 {
+		Config.VaultKVVersion = 1
+	}
+	if Config.VaultKVMount == "" {
+		Config.VaultKVMount = "keys"
+	}
+	Config.VaultKVMount = strings.Trim(Config.VaultKVMount, "/")
+	if Config.VaultAuthMethod != VaultAuthToken && Config.VaultAuthMethod != VaultAuthAppRole {
+		logger.Fatalf("--vault-auth-method must be either '%s' or '%s', not '%s'.", VaultAuthToken, VaultAuthAppRole, Config.VaultAuthMethod)
+		os.Exit(1)
+	}
+	if Config.VaultAuthMethod == VaultAuthAppRole && Config.VaultRoleID == "" {
+		logger.Fatalf("--vault-role-id is required when --vault-auth-method is '%s'.", VaultAuthAppRole)
+		os.Exit(1)
+	}
+	if Config.VaultKVVersion != 1 && Config.VaultKVVersion != 2 {
+		logger.Fatalf("--vault-kv-version must be 1 or 2, not %d.", Config.VaultKVVersion)
+		os.Exit(1)
+	}
+	if Config.VaultCacheTTL != "" {
+		d, derr := time.ParseDuration(Config.VaultCacheTTL)
+		if derr != nil {
+			logger.Fatalf("Error parsing vault-cache-ttl: %s", derr.Error())
+			os.Exit(1)
+		}
+		Config.VaultCacheTTLDur = d
+	} else {
+		Config.VaultCacheTTLDur = 0
+	}
+	if Config.VaultSecretIDFile != "" && !path.IsAbs(Config.VaultSecretIDFile) {
+		Config.VaultSecretIDFile = path.Join(Config.ConfRoot, Config.VaultSecretIDFile)
+	}
+	if opts.EncryptData {
+		Config.EncryptData = opts.EncryptData
+	}
+	if opts.DataKeyPath != "" {
+		Config.DataKeyPath = opts.DataKeyPath
+	}
+	if Config.DataKeyPath == "" {
+		Config.DataKeyPath = "keys/encryption/data"
+	}
+	Config.RotateDataKey = opts.RotateDataKey
+	if (Config.EncryptData || Config.RotateDataKey) && (!UsingDB() || !Config.UseExtSecrets) {
+		logger.Fatalf("Encrypting data with --encrypt-data or --rotate-data-key requires MySQL or PostgreSQL, and --use-external-secrets.")
+		os.Exit(1)
+	}
+	if len(opts.UnindexedDataBags) > 0 {
+		Config.UnindexedDataBags = opts.UnindexedDataBags
+	}
+
+	if (Config.UseExtSecrets && Config.SecretStore == SecretStoreKeystore) || Config.MigrateSecretsFrom == SecretStoreKeystore {
+		if Config.KeystoreFile == "" {
+			Config.KeystoreFile = path.Join(Config.ConfRoot, "goiardi-keystore")
+		} else if !path.IsAbs(Config.KeystoreFile) {
+			Config.KeystoreFile = path.Join(Config.ConfRoot, Config.KeystoreFile)
+		}
+		if Config.KeystoreKeyFile != "" && !path.IsAbs(Config.KeystoreKeyFile) {
+			Config.KeystoreKeyFile = path.Join(Config.ConfRoot, Config.KeystoreKeyFile)
+		}
+	}
 
 	if opts.UseSSL {
 		Config.UseSSL = opts.UseSSL
@@ -643,6 +1048,53 @@ func ParseConfigOptions() error {
 		}
 	}
 
+	// Client certificate authentication
+	if opts.SSLClientCA != "" {
+		Config.SSLClientCA = opts.SSLClientCA
+	}
+	if opts.SSLClientCRL != "" {
+		Config.SSLClientCRL = opts.SSLClientCRL
+	}
+	if opts.SSLClientAuth != "" {
+		Config.SSLClientAuth = opts.SSLClientAuth
+	}
+	if opts.SSLClientIdentity != "" {
+		Config.SSLClientIdentity = opts.SSLClientIdentity
+	}
+	if Config.SSLClientAuth == "" {
+		Config.SSLClientAuth = ClientCertEither
+	}
+	if Config.SSLClientIdentity == "" {
+		Config.SSLClientIdentity = ClientCertCN
+	}
+	switch Config.SSLClientAuth {
+	case ClientCertEither, ClientCertBoth, ClientCertOnly:
+	default:
+		logger.Fatalf("Invalid ssl-client-auth '%s': must be 'either', 'both', or 'cert'.", Config.SSLClientAuth)
+		os.Exit(1)
+	}
+	switch Config.SSLClientIdentity {
+	case ClientCertCN, ClientCertDNS, ClientCertURI:
+	default:
+		logger.Fatalf("Invalid ssl-client-identity '%s': must be 'cn', 'dns', or 'uri'.", Config.SSLClientIdentity)
+		os.Exit(1)
+	}
+	if Config.SSLClientCA != "" {
+		if !Config.UseSSL {
+			logger.Fatalf("Client certificate authentication requires SSL mode.")
+			os.Exit(1)
+		}
+		if !path.IsAbs(Config.SSLClientCA) {
+			Config.SSLClientCA = path.Join(Config.ConfRoot, Config.SSLClientCA)
+		}
+		if Config.SSLClientCRL != "" && !path.IsAbs(Config.SSLClientCRL) {
+			Config.SSLClientCRL = path.Join(Config.ConfRoot, Config.SSLClientCRL)
+		}
+	} else if Config.SSLClientCRL != "" {
+		logger.Fatalf("ssl-client-crl requires ssl-client-ca.")
+		os.Exit(1)
+	}
+
 	if opts.TimeSlew != "" {
 		Config.TimeSlew = opts.TimeSlew
 	}
@@ -661,6 +1113,191 @@ func ParseConfigOptions() error {
 		Config.UseAuth = opts.UseAuth
 	}
 
+	// Password hashing settings.
+	if opts.PasswordHash != "" {
+		Config.PasswordHash = opts.PasswordHash
+	}
+	if Config.PasswordHash == "" {
+		Config.PasswordHash = DefaultPasswordHash
+	}
+	if Config.PasswordHash != "argon2id" && Config.PasswordHash != "bcrypt" {
+		logger.Fatalf("password-hash must be 'argon2id' or 'bcrypt', not '%s'", Config.PasswordHash)
+		os.Exit(1)
+	}
+	if opts.BcryptCost != 0 {
+		Config.BcryptCost = opts.BcryptCost
+	}
+	if Config.BcryptCost == 0 {
+		Config.BcryptCost = DefaultBcryptCost
+	}
+	if Config.BcryptCost < 4 || Config.BcryptCost > 31 {
+		logger.Fatalf("bcrypt-cost must be between 4 and 31, not %d", Config.BcryptCost)
+		os.Exit(1)
+	}
+	if opts.Argon2Time != 0 {
+		Config.Argon2Time = opts.Argon2Time
+	}
+	if Config.Argon2Time == 0 {
+		Config.Argon2Time = DefaultArgon2Time
+	}
+	if opts.Argon2Memory != 0 {
+		Config.Argon2Memory = opts.Argon2Memory
+	}
+	if Config.Argon2Memory == 0 {
+		Config.Argon2Memory = DefaultArgon2Memory
+	}
+	if opts.Argon2Threads != 0 {
+		Config.Argon2Threads = opts.Argon2Threads
+	}
+	if Config.Argon2Threads == 0 {
+		Config.Argon2Threads = DefaultArgon2Threads
+	}
+
+	// Authentication providers for /authenticate_user.
+	if len(opts.AuthProviders) != 0 {
+		Config.AuthProviders = opts.AuthProviders
+	}
+	if len(Config.AuthProviders) == 0 {
+		Config.AuthProviders = []string{"local"}
+	}
+	for _, p := range Config.AuthProviders {
+		if p != "local" && p != "htpasswd" && p != "ldap" {
+			logger.Fatalf("Unknown authentication provider '%s': must be 'local', 'htpasswd', or 'ldap'", p)
+			os.Exit(1)
+		}
+	}
+	if opts.HtpasswdFile != "" {
+		Config.HtpasswdFile = opts.HtpasswdFile
+	}
+	if opts.AuthAutoProvision {
+		Config.AuthAutoProvision = opts.AuthAutoProvision
+	}
+	if opts.LDAP.URL != "" {
+		Config.LDAP.URL = opts.LDAP.URL
+	}
+	if opts.LDAP.StartTLS {
+		Config.LDAP.StartTLS = opts.LDAP.StartTLS
+	}
+	if opts.LDAP.BindDN != "" {
+		Config.LDAP.BindDN = opts.LDAP.BindDN
+	}
+	if opts.LDAP.BindPassword != "" {
+		Config.LDAP.BindPassword = opts.LDAP.BindPassword
+	}
+	if opts.LDAP.BaseDN != "" {
+		Config.LDAP.BaseDN = opts.LDAP.BaseDN
+	}
+	if opts.LDAP.UserFilter != "" {
+		Config.LDAP.UserFilter = opts.LDAP.UserFilter
+	}
+	if opts.LDAP.NameAttr != "" {
+		Config.LDAP.NameAttr = opts.LDAP.NameAttr
+	}
+	if opts.LDAP.EmailAttr != "" {
+		Config.LDAP.EmailAttr = opts.LDAP.EmailAttr
+	}
+	if opts.LDAP.AdminAttr != "" {
+		Config.LDAP.AdminAttr = opts.LDAP.AdminAttr
+	}
+	if opts.LDAP.AdminValue != "" {
+		Config.LDAP.AdminValue = opts.LDAP.AdminValue
+	}
+
+	// Request rate limits. Limits given on the command line are added to
+	// the ones from the config file, replacing them for the same family.
+	if opts.RateLimit.Enable {
+		Config.RateLimit.Enable = opts.RateLimit.Enable
+	}
+	for _, rl := range []struct {
+		conf *map[string]string
+		opt  map[string]string
+	}{
+		{&Config.RateLimit.All, opts.RateLimit.All},
+		{&Config.RateLimit.Admin, opts.RateLimit.Admin},
+		{&Config.RateLimit.Validator, opts.RateLimit.Validator},
+	} {
+		if len(rl.opt) == 0 {
+			continue
+		}
+		if *rl.conf == nil {
+			*rl.conf = make(map[string]string, len(rl.opt))
+		}
+		for k, v := range rl.opt {
+			(*rl.conf)[k] = v
+		}
+	}
+	rateLimits := map[string]map[string]string{"all": Config.RateLimit.All, "admin": Config.RateLimit.Admin, "validator": Config.RateLimit.Validator}
+	for a, al := range Config.RateLimit.Actors {
+		rateLimits[fmt.Sprintf("actor '%s'", a)] = al
+	}
+	for class, limits := range rateLimits {
+		for family, l := range limits {
+			if !validRateLimitFamily(family) {
+				logger.Fatalf("Unknown rate limit endpoint family '%s' for %s. Valid families are: %s", family, class, strings.Join(RateLimitFamilies, ", "))
+				os.Exit(1)
+			}
+			if _, rerr := ParseRateLimit(l); rerr != nil {
+				logger.Fatalf("Error in the %s rate limit for %s: %s", family, class, rerr.Error())
+				os.Exit(1)
+			}
+		}
+	}
+
+	// Locking out actors and addresses after authentication failures.
+	if opts.DisableAuthLockout {
+		Config.DisableAuthLockout = opts.DisableAuthLockout
+	}
+	if opts.AuthLockoutThreshold != 0 {
+		Config.AuthLockoutThreshold = opts.AuthLockoutThreshold
+	}
+	if Config.AuthLockoutThreshold == 0 {
+		Config.AuthLockoutThreshold = DefaultAuthLockoutThreshold
+	} else if Config.AuthLockoutThreshold < 0 {
+		logger.Fatalf("auth-lockout-threshold must be greater than zero")
+		os.Exit(1)
+	}
+	if opts.AuthLockoutWindow != "" {
+		Config.AuthLockoutWindow = opts.AuthLockoutWindow
+	}
+	if opts.AuthLockoutTime != "" {
+		Config.AuthLockoutTime = opts.AuthLockoutTime
+	}
+	if opts.AuthLockoutMax != "" {
+		Config.AuthLockoutMax = opts.AuthLockoutMax
+	}
+	for _, ld := range []struct {
+		name string
+		val  string
+		def  string
+		dur  *time.Duration
+	}{
+		{"auth-lockout-window", Config.AuthLockoutWindow, DefaultAuthLockoutWindow, &Config.AuthLockoutWindowDur},
+		{"auth-lockout-time", Config.AuthLockoutTime, DefaultAuthLockoutTime, &Config.AuthLockoutTimeDur},
+		{"auth-lockout-max", Config.AuthLockoutMax, DefaultAuthLockoutMax, &Config.AuthLockoutMaxDur},
+	} {
+		v := ld.val
+		if v == "" {
+			v = ld.def
+		}
+		d, derr := time.ParseDuration(v)
+		if derr != nil {
+			logger.Fatalf("Error parsing %s: %s", ld.name, derr.Error())
+			os.Exit(1)
+		}
+		if d <= 0 {
+			logger.Fatalf("%s must be greater than zero", ld.name)
+			os.Exit(1)
+		}
+		*ld.dur = d
+	}
+	if Config.AuthLockoutMaxDur < Config.AuthLockoutTimeDur {
+		logger.Fatalf("auth-lockout-max must not be less than auth-lockout-time")
+		os.Exit(1)
+	}
+	if opts.TrustProxy {
+		Config.TrustProxy = opts.TrustProxy
+	}
+
 	if opts.DisableWebUI {
 		Config.DisableWebUI = opts.DisableWebUI
 	}
@@ -729,13 +1366,68 @@ func ParseConfigOptions() error {
 		os.Exit(1)
 	}
 
-	if opts.UseShovey {
-		if !Config.UseSerf {
-			logger.Fatalf("--use-shovey requires --use-serf to be enabled")
+	if opts.NodeCheckIns {
+		Config.NodeCheckIns = opts.NodeCheckIns
+	}
+	if opts.NodeStaleAfter != "" {
+		Config.NodeStaleAfter = opts.NodeStaleAfter
+	}
+	if Config.NodeStaleAfter != "" {
+		d, derr := time.ParseDuration(Config.NodeStaleAfter)
+		if derr != nil {
+			logger.Fatalf("Error parsing node-stale-after: %s", derr.Error())
+			os.Exit(1)
+		}
+		Config.NodeStaleDur = d
+	} else if Config.NodeCheckIns {
+		// chef-client runs every half hour by default, so give it
+		// some slack.
+		Config.NodeStaleDur = time.Hour
+	} else {
+		Config.NodeStaleDur = 10 * time.Minute
+	}
+	if len(opts.EnvStaleAfter) > 0 {
+		Config.EnvStaleAfter = opts.EnvStaleAfter
+	}
+	Config.EnvStaleDurs = make(map[string]time.Duration, len(Config.EnvStaleAfter))
+	for _, es := range Config.EnvStaleAfter {
+		esp := strings.SplitN(es, ":", 2)
+		if len(esp) != 2 || esp[0] == "" {
+			logger.Fatalf("env-stale-after value '%s' is not of the form <environment>:<duration>", es)
 			os.Exit(1)
 		}
+		d, derr := time.ParseDuration(esp[1])
+		if derr != nil {
+			logger.Fatalf("Error parsing env-stale-after duration for %s: %s", esp[0], derr.Error())
+			os.Exit(1)
+		}
+		Config.EnvStaleDurs[esp[0]] = d
+	}
+
+	if opts.ShoveyTransport != "" {
+		Config.ShoveyTransport = opts.ShoveyTransport
+	}
+	if Config.ShoveyTransport == "" {
+		Config.ShoveyTransport = "serf"
+	}
+	if Config.ShoveyTransport != "serf" && Config.ShoveyTransport != "http" {
+		logger.Fatalf("shovey-transport must be 'serf' or 'http', not '%s'", Config.ShoveyTransport)
+		os.Exit(1)
+	}
+
+	if opts.UseShovey {
 		Config.UseShovey = opts.UseShovey
 	}
+	if Config.UseShovey && Config.ShoveyTransport == "serf" && !Config.UseSerf {
+		logger.Fatalf("--use-shovey requires --use-serf to be enabled, unless --shovey-transport is 'http'")
+		os.Exit(1)
+	}
+	if opts.ShoveyTemplatesOnly {
+		Config.ShoveyTemplatesOnly = opts.ShoveyTemplatesOnly
+	}
+	if opts.ShoveyCancelTimedOut {
+		Config.ShoveyCancelTimedOut = opts.ShoveyCancelTimedOut
+	}
 
 	// shovey signing key stuff
 	if opts.SignPrivKey != "" {
@@ -745,6 +1437,51 @@ func ParseConfigOptions() error {
 		Config.VaultShoveyKey = opts.VaultShoveyKey
 	}
 
+	if opts.ShoveyKeyringFile != "" {
+		Config.ShoveyKeyringFile = opts.ShoveyKeyringFile
+	}
+	if Config.ShoveyKeyringFile == "" {
+		Config.ShoveyKeyringFile = path.Join(Config.ConfRoot, "shovey-keyring")
+	} else if !path.IsAbs(Config.ShoveyKeyringFile) {
+		Config.ShoveyKeyringFile = path.Join(Config.ConfRoot, Config.ShoveyKeyringFile)
+	}
+	if opts.ShoveyKeyRotation != "" {
+		Config.ShoveyKeyRotation = opts.ShoveyKeyRotation
+	}
+	if Config.ShoveyKeyRotation == "" {
+		Config.ShoveyKeyRotationDur = 0
+	} else {
+		d, derr := time.ParseDuration(Config.ShoveyKeyRotation)
+		if derr != nil {
+			logger.Fatalf("Error parsing shovey-key-rotation: %s", derr.Error())
+			os.Exit(1)
+		}
+		Config.ShoveyKeyRotationDur = d
+	}
+	if opts.ShoveyKeyOverlap != "" {
+		Config.ShoveyKeyOverlap = opts.ShoveyKeyOverlap
+	}
+	if Config.ShoveyKeyOverlap == "" {
+		Config.ShoveyKeyOverlapDur = 24 * time.Hour
+	} else {
+		d, derr := time.ParseDuration(Config.ShoveyKeyOverlap)
+		if derr != nil {
+			logger.Fatalf("Error parsing shovey-key-overlap: %s", derr.Error())
+			os.Exit(1)
+		}
+		if d <= 0 {
+			logger.Fatalf("shovey-key-overlap must be greater than zero")
+			os.Exit(1)
+		}
+		Config.ShoveyKeyOverlapDur = d
+	}
+	// A new key is made one overlap before the old one's time is up, so
+	// there has to be room for that.
+	if Config.ShoveyKeyRotationDur < 0 || (Config.ShoveyKeyRotationDur > 0 && Config.ShoveyKeyRotationDur <= Config.ShoveyKeyOverlapDur) {
+		logger.Fatalf("shovey-key-rotation must be longer than shovey-key-overlap")
+		os.Exit(1)
+	}
+
 	// if using shovey, open the existing, or create if absent, signing
 	// keys.
 	if Config.UseShovey {
@@ -897,6 +1634,56 @@ func ParseConfigOptions() error {
 		Config.PurgeReportsDur = d
 	}
 
+	if opts.PurgeFailedAfter != "" {
+		Config.PurgeFailedAfter = opts.PurgeFailedAfter
+	}
+	if Config.PurgeFailedAfter != "" {
+		d, derr := time.ParseDuration(Config.PurgeFailedAfter)
+		if derr != nil {
+			logger.Fatalf("Error parsing purge-failed-reports-after: %s", derr.Error())
+			os.Exit(1)
+		}
+		Config.PurgeFailedDur = d
+	}
+
+	if opts.KeepNodeReports != 0 {
+		Config.KeepNodeReports = opts.KeepNodeReports
+	}
+	if Config.KeepNodeReports < 0 {
+		logger.Fatalf("keep-reports-per-node cannot be negative")
+		os.Exit(1)
+	}
+
+	if opts.PurgeShoveyAfter != "" {
+		Config.PurgeShoveyAfter = opts.PurgeShoveyAfter
+	}
+	if Config.PurgeShoveyAfter != "" {
+		d, derr := time.ParseDuration(Config.PurgeShoveyAfter)
+		if derr != nil {
+			logger.Fatalf("Error parsing purge-shovey-after: %s", derr.Error())
+			os.Exit(1)
+		}
+		Config.PurgeShoveyDur = d
+	}
+
+	if opts.PurgeInterval != "" {
+		Config.PurgeInterval = opts.PurgeInterval
+	}
+	if Config.PurgeInterval == "" {
+		Config.PurgeIntervalDur = 2 * time.Hour
+	} else {
+		d, derr := time.ParseDuration(Config.PurgeInterval)
+		if derr != nil {
+			logger.Fatalf("Error parsing purge-interval: %s", derr.Error())
+			os.Exit(1)
+		}
+		if d <= 0 {
+			logger.Fatalf("purge-interval must be greater than zero")
+			os.Exit(1)
+		}
+		Config.PurgeIntervalDur = d
+	}
+
 	if opts.PurgeSandboxesAfter != "" {
 		Config.PurgeSandboxesAfter = opts.PurgeSandboxesAfter
 	}
@@ -946,10 +1733,36 @@ func UsingDB() bool {
 	return Config.UseMySQL || Config.UsePostgreSQL
 }
 
+// TrackingNodeStatus returns true if goiardi is keeping track of whether nodes
+// are up or down, either through serf or through chef-client check-ins.
+func TrackingNodeStatus() bool {
+	return Config.UseSerf || Config.NodeCheckIns
+}
+
 func UsingExternalSecrets() bool {
 	return Config.UseExtSecrets
 }
 
+// DataBagIndexed returns false if the items in the named data bag are not to be
+// indexed for search.
+func DataBagIndexed(name string) bool {
+	for _, d := range Config.UnindexedDataBags {
+		if d == name {
+			return false
+		}
+	}
+	return true
+}
+
+// SecretStoreInUse returns which secret store goiardi is using: builtin, vault,
+// or keystore.
+func SecretStoreInUse() string {
+	if !Config.UseExtSecrets {
+		return SecretStoreBuiltin
+	}
+	return Config.SecretStore
+}
+
 func PprofWhitelisted(remoteIP net.IP) bool {
 	for _, wl := range pprofWhitelist {
 		if remoteIP.Equal(wl) {
@@ -958,3 +1771,12 @@ func PprofWhitelisted(remoteIP net.IP) bool {
 	}
 	return false
 }
+
+func validRateLimitFamily(family string) bool {
+	for _, f := range RateLimitFamilies {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
@@ -1109,7 +1109,6 @@ func (cbv *CookbookVersion) ToJSON(method string) map[string]interface{} {
 
 func methodize(method string, cbThing []map[string]interface{}) []map[string]interface{} {
 	retHash := make([]map[string]interface{}, len(cbThing))
-	baseURL := config.ServerBaseURL()
 	r := regexp.MustCompile(`/file_store/`)
 	for i, v := range cbThing {
 		retHash[i] = make(map[string]interface{})
@@ -1128,7 +1127,7 @@ func methodize(method string, cbThing []map[string]interface{}) []map[string]int
 						logger.Errorf(err.Error())
 					}
 				} else {
-					retHash[i][k] = baseURL + "/file_store/" + chkSum
+					retHash[i][k] = util.FileStoreGetURL(chkSum)
 				}
 			} else {
 				retHash[i][k] = j
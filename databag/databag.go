@@ -275,7 +275,9 @@ func (db *DataBag) NewDBItem(rawDbagItem map[string]interface{}) (*DataBagItem,
 		gerr.SetStatus(http.StatusInternalServerError)
 		return nil, gerr
 	}
-	indexer.IndexObj(dbagItem)
+	if config.DataBagIndexed(db.Name) {
+		indexer.IndexObj(dbagItem)
+	}
 	return dbagItem, nil
 }
 
@@ -301,7 +303,9 @@ func (db *DataBag) UpdateDBItem(dbiID string, rawDbagItem map[string]interface{}
 	if err != nil {
 		return nil, err
 	}
-	indexer.IndexObj(dbItem)
+	if config.DataBagIndexed(db.Name) {
+		indexer.IndexObj(dbItem)
+	}
 	return dbItem, nil
 }
 
@@ -484,6 +488,16 @@ func (dbi *DataBagItem) Flatten() map[string]interface{} {
 	return flatten
 }
 
+// Reencrypt encrypts up to limit data bag items that were saved with an older
+// data encryption master key again with the current key, returning how many
+// were done. Data bag items are only encrypted with an SQL backend.
+func Reencrypt(limit int) (int, error) {
+	if !config.UsingDB() {
+		return 0, nil
+	}
+	return reencryptSQL(limit)
+}
+
 // AllDataBags returns all data bags on this server, and all their items.
 func AllDataBags() []*DataBag {
 	var dataBags []*DataBag
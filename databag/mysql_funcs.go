@@ -18,13 +18,14 @@ package databag
 
 import (
 	"fmt"
+	"github.com/ctdk/goiardi/datacrypt"
 	"github.com/ctdk/goiardi/datastore"
 )
 
 // MySQL-specific functions for data bags & data bag items.
 
 func (db *DataBag) newDBItemMySQL(dbiID string, rawDbagItem map[string]interface{}) (*DataBagItem, error) {
-	rawb, rawerr := datastore.EncodeBlob(&rawDbagItem)
+	rawb, keyID, rawerr := datacrypt.EncodeBlob(&rawDbagItem, itemContext(db.Name, dbiID))
 	if rawerr != nil {
 		return nil, rawerr
 	}
@@ -51,7 +52,7 @@ func (db *DataBag) newDBItemMySQL(dbiID string, rawDbagItem map[string]interface
 		err = fmt.Errorf("aiiiie! The data bag %s was deleted from the db while we were doing something else", db.Name)
 		return nil, err
 	}
-	res, err := tx.Exec("INSERT INTO data_bag_items (name, orig_name, data_bag_id, raw_data, created_at, updated_at) VALUES (?, ?, ?, ?, NOW(), NOW())", dbi.Name, dbi.origName, db.id, rawb)
+	res, err := tx.Exec("INSERT INTO data_bag_items (name, orig_name, data_bag_id, raw_data, enc_key_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?, NOW(), NOW())", dbi.Name, dbi.origName, db.id, rawb, keyID)
 	if err != nil {
 		tx.Rollback()
 		return nil, err
@@ -17,13 +17,14 @@
 package databag
 
 import (
+	"github.com/ctdk/goiardi/datacrypt"
 	"github.com/ctdk/goiardi/datastore"
 )
 
 // PostgreSQL-specific functions for data bags & data bag items.
 
 func (db *DataBag) newDBItemPostgreSQL(dbiID string, rawDbagItem map[string]interface{}) (*DataBagItem, error) {
-	rawb, rawerr := datastore.EncodeBlob(&rawDbagItem)
+	rawb, keyID, rawerr := datacrypt.EncodeBlob(&rawDbagItem, itemContext(db.Name, dbiID))
 	if rawerr != nil {
 		return nil, rawerr
 	}
@@ -50,6 +51,11 @@ func (db *DataBag) newDBItemPostgreSQL(dbiID string, rawDbagItem map[string]inte
 		tx.Rollback()
 		return nil, err
 	}
+	_, err = tx.Exec("UPDATE goiardi.data_bag_items SET enc_key_id = $1 WHERE id = $2", keyID, dbi.id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
 	tx.Commit()
 
 	return dbi, nil
@@ -20,6 +20,7 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datacrypt"
 	"github.com/ctdk/goiardi/datastore"
 	"log"
 	"strings"
@@ -58,6 +59,12 @@ func getDataBagSQL(name string) (*DataBag, error) {
 	return dataBag, nil
 }
 
+// itemContext names a data bag item for datacrypt, so one item's encrypted
+// data can't be passed off as another's.
+func itemContext(bagName string, itemName string) string {
+	return fmt.Sprintf("data_bag_item:%s/%s", bagName, itemName)
+}
+
 func (dbi *DataBagItem) fillDBItemFromSQL(row datastore.ResRow) error {
 	var rawb []byte
 	err := row.Scan(&dbi.id, &dbi.dataBagID, &dbi.Name, &dbi.origName, &dbi.DataBagName, &rawb)
@@ -66,7 +73,7 @@ func (dbi *DataBagItem) fillDBItemFromSQL(row datastore.ResRow) error {
 	}
 	dbi.ChefType = "data_bag_item"
 	dbi.JSONClass = "Chef::DataBagItem"
-	err = datastore.DecodeBlob(rawb, &dbi.RawData)
+	err = datacrypt.DecodeBlob(rawb, &dbi.RawData, itemContext(dbi.DataBagName, dbi.origName))
 	if err != nil {
 		return err
 	}
@@ -168,7 +175,7 @@ func (db *DataBag) getMultiDBItemSQL(dbItemNames []string) ([]*DataBagItem, erro
 }
 
 func (dbi *DataBagItem) updateDBItemSQL() error {
-	rawb, rawerr := datastore.EncodeBlob(&dbi.RawData)
+	rawb, keyID, rawerr := datacrypt.EncodeBlob(&dbi.RawData, itemContext(dbi.DataBagName, dbi.origName))
 	if rawerr != nil {
 		return rawerr
 	}
@@ -177,9 +184,9 @@ func (dbi *DataBagItem) updateDBItemSQL() error {
 		return err
 	}
 	if config.Config.UseMySQL {
-		_, err = tx.Exec("UPDATE data_bag_items SET raw_data = ?, updated_at = NOW() WHERE id = ?", rawb, dbi.id)
+		_, err = tx.Exec("UPDATE data_bag_items SET raw_data = ?, enc_key_id = ?, updated_at = NOW() WHERE id = ?", rawb, keyID, dbi.id)
 	} else if config.Config.UsePostgreSQL {
-		_, err = tx.Exec("UPDATE goiardi.data_bag_items SET raw_data = $1, updated_at = NOW() WHERE id = $2", rawb, dbi.id)
+		_, err = tx.Exec("UPDATE goiardi.data_bag_items SET raw_data = $1, enc_key_id = $2, updated_at = NOW() WHERE id = $3", rawb, keyID, dbi.id)
 	}
 	if err != nil {
 		terr := tx.Rollback()
@@ -192,6 +199,71 @@ func (dbi *DataBagItem) updateDBItemSQL() error {
 	return nil
 }
 
+// reencryptSQL encrypts up to limit data bag items that were saved with an
+// older master key again with the current key, or decrypts them if encryption
+// has been turned off. Each item is locked while it's being done so an update
+// at the same time doesn't get overwritten.
+func reencryptSQL(limit int) (int, error) {
+	var listStmt, getStmt, updateStmt string
+	if config.Config.UseMySQL {
+		listStmt = "SELECT id FROM data_bag_items WHERE enc_key_id <> ? LIMIT ?"
+		getStmt = "SELECT dbi.raw_data, dbi.enc_key_id, dbi.orig_name, (SELECT name FROM data_bags WHERE id = dbi.data_bag_id) FROM data_bag_items dbi WHERE dbi.id = ? FOR UPDATE"
+		updateStmt = "UPDATE data_bag_items SET raw_data = ?, enc_key_id = ? WHERE id = ?"
+	} else if config.Config.UsePostgreSQL {
+		listStmt = "SELECT id FROM goiardi.data_bag_items WHERE enc_key_id <> $1 LIMIT $2"
+		getStmt = "SELECT dbi.raw_data, dbi.enc_key_id, dbi.orig_name, (SELECT name FROM goiardi.data_bags WHERE id = dbi.data_bag_id) FROM goiardi.data_bag_items dbi WHERE dbi.id = $1 FOR UPDATE"
+		updateStmt = "UPDATE goiardi.data_bag_items SET raw_data = $1, enc_key_id = $2 WHERE id = $3"
+	}
+	rows, err := datastore.Dbh.Query(listStmt, datacrypt.CurrentKeyID(), limit)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int32
+	for rows.Next() {
+		var id int32
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, id := range ids {
+		tx, err := datastore.Dbh.Begin()
+		if err != nil {
+			return n, err
+		}
+		var rawb []byte
+		var oldKeyID, itemName, bagName string
+		err = tx.QueryRow(getStmt, id).Scan(&rawb, &oldKeyID, &itemName, &bagName)
+		if err == sql.ErrNoRows || (err == nil && !datacrypt.NeedsReencrypt(oldKeyID)) {
+			// deleted or saved again in the meantime
+			tx.Rollback()
+			continue
+		} else if err != nil {
+			tx.Rollback()
+			return n, err
+		}
+		rawb, keyID, err := datacrypt.Reencrypt(rawb, itemContext(bagName, itemName))
+		if err != nil {
+			tx.Rollback()
+			return n, fmt.Errorf("re-encrypting data bag item id %d: %s", id, err.Error())
+		}
+		if _, err = tx.Exec(updateStmt, rawb, keyID, id); err != nil {
+			tx.Rollback()
+			return n, err
+		}
+		tx.Commit()
+		n++
+	}
+	return n, nil
+}
+
 func (dbi *DataBagItem) deleteDBItemSQL() error {
 	tx, err := datastore.Dbh.Begin()
 	if err != nil {
@@ -0,0 +1,369 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package datacrypt encrypts data bag items and node attributes before they're
+// saved in the database. Each value is encrypted with its own random data key,
+// and the data key is encrypted ("wrapped") with a master key kept in the
+// external secret store. The master keys are identified by a key ID that's
+// saved along with the encrypted data, so older master keys can still decrypt
+// data until it's been encrypted again with the current key.
+//
+// The encrypted data is also bound to the object it belongs to, named by a
+// context string like "node:<name>:automatic" or "data_bag_item:<bag>/<id>",
+// so a blob copied from one row to another in the database won't decrypt.
+package datacrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/secret"
+	"github.com/tideland/golib/logger"
+)
+
+const envelopeVersion = 1
+
+// Encrypted values are saved as JSON objects with just this key, so they still
+// fit in the JSON columns PostgreSQL uses. datastore.EncodeBlob always escapes
+// '<' and '>', so nothing it makes can start like this and be mistaken for
+// encrypted data.
+var envelopePrefix = []byte(`{"<goiardi_encrypted>":`)
+
+type envelope struct {
+	Version    int    `json:"version"`
+	KeyID      string `json:"key_id"`
+	DataKey    []byte `json:"data_key"`
+	KeyNonce   []byte `json:"key_nonce"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type keyring struct {
+	sync.RWMutex
+	// the first key is the current one
+	keys [][]byte
+	ids  []string
+}
+
+var masterKeys = &keyring{}
+
+// Enabled is true if data is being encrypted when it's saved.
+func Enabled() bool {
+	return config.Config.EncryptData && config.UsingDB()
+}
+
+// HaveKeys is true if the master keys have been loaded, either because
+// encryption is turned on or because there's encrypted data left over from
+// when it was.
+func HaveKeys() bool {
+	masterKeys.RLock()
+	defer masterKeys.RUnlock()
+	return len(masterKeys.keys) > 0
+}
+
+// Initialize loads the master keys from the secret store. If encryption is
+// turned on and there aren't any master keys yet, the first one is made and
+// saved. It's safe to call again to pick up a new master key after a rotation.
+func Initialize() error {
+	if !config.UsingDB() || !config.UsingExternalSecrets() {
+		setKeys(nil)
+		return nil
+	}
+	keys, err := secret.GetDataKeys(config.Config.DataKeyPath)
+	if err != nil && err != secret.ErrNotFound && !Enabled() {
+		// only needed to decrypt any data left over from when
+		// encryption was on, so don't keep goiardi from starting
+		logger.Warningf("error getting the data encryption master keys from %s: %s", config.Config.DataKeyPath, err.Error())
+		setKeys(nil)
+		return nil
+	}
+	if err == secret.ErrNotFound {
+		if !Enabled() {
+			setKeys(nil)
+			return nil
+		}
+		// A new key can't decrypt anything already encrypted, so the
+		// old keys must have gone missing (or not been migrated to
+		// this secret store yet).
+		var enc bool
+		if enc, err = HaveEncryptedData(); err != nil {
+			return fmt.Errorf("error checking for encrypted data: %s", err.Error())
+		}
+		if enc {
+			return fmt.Errorf("no data encryption master keys were found at %s, but there is data encrypted with them; refusing to make a new key", config.Config.DataKeyPath)
+		}
+		logger.Infof("No data encryption master key found at %s, making a new one", config.Config.DataKeyPath)
+		var k []byte
+		if k, err = newKey(); err != nil {
+			return err
+		}
+		keys = [][]byte{k}
+		err = secret.SetDataKeys(config.Config.DataKeyPath, keys)
+	}
+	if err != nil {
+		return fmt.Errorf("error getting the data encryption master keys from %s: %s", config.Config.DataKeyPath, err.Error())
+	}
+	if len(keys) == 0 && Enabled() {
+		return fmt.Errorf("no data encryption master keys were found at %s", config.Config.DataKeyPath)
+	}
+	setKeys(keys)
+	return nil
+}
+
+// HaveEncryptedData returns true if any node or data bag item in the database
+// was saved encrypted.
+func HaveEncryptedData() (bool, error) {
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = "SELECT EXISTS (SELECT 1 FROM nodes WHERE enc_key_id <> '') OR EXISTS (SELECT 1 FROM data_bag_items WHERE enc_key_id <> '')"
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = "SELECT EXISTS (SELECT 1 FROM goiardi.nodes WHERE enc_key_id <> '') OR EXISTS (SELECT 1 FROM goiardi.data_bag_items WHERE enc_key_id <> '')"
+	} else {
+		return false, nil
+	}
+	var found bool
+	err := datastore.Dbh.QueryRow(sqlStmt).Scan(&found)
+	return found, err
+}
+
+// Rotate makes a new master key and saves it in the secret store as the
+// current key, keeping the older keys so existing data can still be decrypted.
+// It returns the new key's ID.
+func Rotate() (string, error) {
+	keys, err := secret.GetDataKeys(config.Config.DataKeyPath)
+	if err != nil && err != secret.ErrNotFound {
+		return "", err
+	}
+	k, err := newKey()
+	if err != nil {
+		return "", err
+	}
+	keys = append([][]byte{k}, keys...)
+	if err = secret.SetDataKeys(config.Config.DataKeyPath, keys); err != nil {
+		return "", err
+	}
+	setKeys(keys)
+	return keyID(k), nil
+}
+
+func setKeys(keys [][]byte) {
+	ids := make([]string, len(keys))
+	for i, k := range keys {
+		ids[i] = keyID(k)
+	}
+	masterKeys.Lock()
+	defer masterKeys.Unlock()
+	masterKeys.keys = keys
+	masterKeys.ids = ids
+}
+
+func newKey() ([]byte, error) {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// CurrentKeyID returns the ID of the master key data is encrypted with now, or
+// an empty string if data isn't being encrypted.
+func CurrentKeyID() string {
+	if !Enabled() {
+		return ""
+	}
+	masterKeys.RLock()
+	defer masterKeys.RUnlock()
+	if len(masterKeys.ids) == 0 {
+		return ""
+	}
+	return masterKeys.ids[0]
+}
+
+func (kr *keyring) find(id string) []byte {
+	kr.RLock()
+	defer kr.RUnlock()
+	for i, kid := range kr.ids {
+		if kid == id {
+			return kr.keys[i]
+		}
+	}
+	return nil
+}
+
+// Encrypt encrypts a blob of JSON belonging to the object named by context with
+// a new data key, wrapped with the current master key, and returns the
+// encrypted blob and the master key's ID. If data isn't being encrypted, the
+// blob is returned unchanged with an empty key ID.
+func Encrypt(plain []byte, context string) ([]byte, string, error) {
+	kid := CurrentKeyID()
+	if kid == "" {
+		if Enabled() {
+			return nil, "", fmt.Errorf("data encryption is turned on, but there are no master keys")
+		}
+		return plain, "", nil
+	}
+	master := masterKeys.find(kid)
+	dataKey, err := newKey()
+	if err != nil {
+		return nil, "", err
+	}
+	env := &envelope{Version: envelopeVersion, KeyID: kid}
+	ad := env.additionalData(context)
+	if env.KeyNonce, env.DataKey, err = seal(master, dataKey, ad); err != nil {
+		return nil, "", err
+	}
+	if env.Nonce, env.Ciphertext, err = seal(dataKey, plain, ad); err != nil {
+		return nil, "", err
+	}
+	eb, err := json.Marshal(env)
+	if err != nil {
+		return nil, "", err
+	}
+	b := make([]byte, 0, len(envelopePrefix)+len(eb)+1)
+	b = append(b, envelopePrefix...)
+	b = append(b, eb...)
+	b = append(b, '}')
+	return b, kid, nil
+}
+
+// Decrypt decrypts a blob made by Encrypt for the same context. Blobs that
+// weren't encrypted are returned unchanged.
+func Decrypt(blob []byte, context string) ([]byte, error) {
+	if !IsEncrypted(blob) {
+		return blob, nil
+	}
+	eb := bytes.TrimSpace(blob)
+	eb = bytes.TrimSuffix(bytes.TrimPrefix(eb, envelopePrefix), []byte("}"))
+	env := new(envelope)
+	if err := json.Unmarshal(eb, env); err != nil {
+		return nil, fmt.Errorf("could not read encrypted data: %s", err.Error())
+	}
+	if env.Version != envelopeVersion {
+		return nil, fmt.Errorf("unsupported encrypted data format")
+	}
+	master := masterKeys.find(env.KeyID)
+	if master == nil && config.UsingExternalSecrets() {
+		// another goiardi sharing the database may have rotated the
+		// master key
+		if err := Initialize(); err != nil {
+			return nil, err
+		}
+		master = masterKeys.find(env.KeyID)
+	}
+	if master == nil {
+		return nil, fmt.Errorf("data was encrypted with master key %s, which was not found in the secret store", env.KeyID)
+	}
+	ad := env.additionalData(context)
+	dataKey, err := open(master, env.KeyNonce, env.DataKey, ad)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt the data key for %s: %s", context, err.Error())
+	}
+	plain, err := open(dataKey, env.Nonce, env.Ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt the data for %s: %s", context, err.Error())
+	}
+	return plain, nil
+}
+
+// Reencrypt decrypts a blob from the database and encrypts it again with the
+// current master key, or leaves it decrypted if data isn't being encrypted
+// anymore. It returns the master key ID along with the blob.
+func Reencrypt(blob []byte, context string) ([]byte, string, error) {
+	b, err := Decrypt(blob, context)
+	if err != nil {
+		return nil, "", err
+	}
+	return Encrypt(b, context)
+}
+
+// EncodeBlob encodes an object to save in the database like
+// datastore.EncodeBlob, and encrypts it if data is being encrypted. It returns
+// the master key ID along with the blob.
+func EncodeBlob(obj interface{}, context string) ([]byte, string, error) {
+	b, err := datastore.EncodeBlob(obj)
+	if err != nil {
+		return nil, "", err
+	}
+	return Encrypt(b, context)
+}
+
+// DecodeBlob decrypts a blob from the database, if it was encrypted, and
+// decodes it into obj like datastore.DecodeBlob.
+func DecodeBlob(data []byte, obj interface{}, context string) error {
+	b, err := Decrypt(data, context)
+	if err != nil {
+		return err
+	}
+	return datastore.DecodeBlob(b, obj)
+}
+
+// IsEncrypted is true if the blob was encrypted by Encrypt.
+func IsEncrypted(blob []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(blob), envelopePrefix)
+}
+
+// NeedsReencrypt is true if data saved with the given master key ID should be
+// encrypted again, either with the current master key or, if encryption has
+// been turned off, not at all.
+func NeedsReencrypt(kid string) bool {
+	return kid != CurrentKeyID()
+}
+
+func (e *envelope) additionalData(context string) []byte {
+	return []byte(fmt.Sprintf("goiardi-data:%d:%s:%s", e.Version, e.KeyID, context))
+}
+
+func seal(key []byte, plain []byte, ad []byte) ([]byte, []byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, plain, ad), nil
+}
+
+func open(key []byte, nonce []byte, ciphertext []byte, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package datacrypt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+)
+
+// Encryption's only turned on with a database, but nothing here actually
+// touches it.
+func turnOn(t *testing.T, keys ...[]byte) {
+	config.Config.UseMySQL = true
+	config.Config.EncryptData = true
+	setKeys(keys)
+}
+
+func turnOff() {
+	config.Config.UseMySQL = false
+	config.Config.EncryptData = false
+	setKeys(nil)
+}
+
+const testContext = "data_bag_item:foo/bar"
+
+func testKey(t *testing.T) []byte {
+	k, err := newKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestRoundTrip(t *testing.T) {
+	defer turnOff()
+	key := testKey(t)
+	turnOn(t, key)
+	attrs := map[string]interface{}{"password": "hunter2", "nested": map[string]interface{}{"a": "b"}}
+	b, kid, err := EncodeBlob(&attrs, "node:foo:normal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid != keyID(key) {
+		t.Errorf("key id was %s, expected %s", kid, keyID(key))
+	}
+	if !IsEncrypted(b) || bytes.Contains(b, []byte("hunter2")) {
+		t.Errorf("the data was not encrypted: %s", string(b))
+	}
+	var back map[string]interface{}
+	if err = DecodeBlob(b, &back, "node:foo:normal"); err != nil {
+		t.Fatal(err)
+	}
+	if back["password"] != "hunter2" {
+		t.Errorf("decrypted data did not match: %v", back)
+	}
+}
+
+func TestPlainDataNotEncrypted(t *testing.T) {
+	defer turnOff()
+	turnOff()
+	// even something that looks a lot like an encrypted blob shouldn't
+	// be taken for one
+	attrs := map[string]interface{}{"<goiardi_encrypted>": "gotcha"}
+	b, kid, err := EncodeBlob(&attrs, "node:foo:normal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid != "" {
+		t.Errorf("plain data got a key id: %s", kid)
+	}
+	if IsEncrypted(b) {
+		t.Errorf("plain data was taken for encrypted data: %s", string(b))
+	}
+	var back map[string]interface{}
+	if err = DecodeBlob(b, &back, "node:foo:normal"); err != nil || back["<goiardi_encrypted>"] != "gotcha" {
+		t.Errorf("plain data did not decode: %v %v", back, err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	defer turnOff()
+	oldKey := testKey(t)
+	newKey := testKey(t)
+	turnOn(t, oldKey)
+	b, oldID, err := Encrypt([]byte(`{"a":"b"}`), testContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setKeys([][]byte{newKey, oldKey})
+	if !NeedsReencrypt(oldID) {
+		t.Errorf("data encrypted with the old key should need re-encrypting")
+	}
+	nb, newID, err := Reencrypt(b, testContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newID != keyID(newKey) || NeedsReencrypt(newID) {
+		t.Errorf("data was not re-encrypted with the new key: %s", newID)
+	}
+
+	setKeys([][]byte{newKey})
+	if _, err = Decrypt(b, testContext); err == nil {
+		t.Errorf("data encrypted with a key that's gone should not decrypt")
+	}
+	if p, err := Decrypt(nb, testContext); err != nil || string(p) != `{"a":"b"}` {
+		t.Errorf("re-encrypted data did not decrypt: '%s' %v", string(p), err)
+	}
+
+	// turning encryption off decrypts data as it's re-encrypted
+	config.Config.EncryptData = false
+	if !NeedsReencrypt(newID) {
+		t.Errorf("encrypted data should be decrypted once encryption is off")
+	}
+	pb, kid, err := Reencrypt(nb, testContext)
+	if err != nil || kid != "" || IsEncrypted(pb) {
+		t.Errorf("data was not decrypted: '%s' %s %v", string(pb), kid, err)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	defer turnOff()
+	key := testKey(t)
+	turnOn(t, key)
+	b, _, err := Encrypt([]byte(`{"a":"b"}`), testContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a different key with the same ID
+	other := testKey(t)
+	masterKeys.Lock()
+	masterKeys.keys = [][]byte{other}
+	masterKeys.Unlock()
+	if _, err = Decrypt(b, testContext); err == nil {
+		t.Errorf("data decrypted with the wrong master key")
+	}
+
+	turnOn(t, key)
+	b[len(b)/2] ^= 1
+	if _, err = Decrypt(b, testContext); err == nil {
+		t.Errorf("tampered data decrypted")
+	}
+}
+
+func TestWrongContext(t *testing.T) {
+	defer turnOff()
+	turnOn(t, testKey(t))
+	b, _, err := Encrypt([]byte(`{"a":"b"}`), testContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// moved to a different row
+	for _, ctx := range []string{"data_bag_item:foo/baz", "node:bar:automatic", ""} {
+		if _, err = Decrypt(b, ctx); err == nil {
+			t.Errorf("data encrypted for %s decrypted for %s", testContext, ctx)
+		}
+	}
+	if _, err = Decrypt(b, testContext); err != nil {
+		t.Errorf("data did not decrypt for its own context: %s", err.Error())
+	}
+}
+
+func TestEnabledWithoutKeys(t *testing.T) {
+	defer turnOff()
+	turnOn(t)
+	if _, _, err := Encrypt([]byte(`{}`), testContext); err == nil {
+		t.Errorf("encrypting without master keys should fail")
+	}
+	b, _ := datastore.EncodeBlob(map[string]string{"a": "b"})
+	if p, err := Decrypt(b, testContext); err != nil || !bytes.Equal(p, b) {
+		t.Errorf("plain data should come back unchanged: %v", err)
+	}
+}
@@ -19,6 +19,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/ctdk/goiardi/apitoken"
 	"github.com/ctdk/goiardi/client"
 	"github.com/ctdk/goiardi/cookbook"
 	"github.com/ctdk/goiardi/databag"
@@ -75,6 +76,9 @@ func exportAll(fileName string) error {
 	exportedData.Data["shovey"] = exportTransformSlice(shovey.AllShoveys())
 	exportedData.Data["shovey_run"] = exportTransformSlice(shovey.AllShoveyRuns())
 	exportedData.Data["shovey_run_stream"] = exportTransformSlice(shovey.AllShoveyRunStreams())
+	exportedData.Data["shovey_schedule"] = exportTransformSlice(shovey.AllSchedules())
+	exportedData.Data["shovey_template"] = exportTransformSlice(shovey.AllTemplates())
+	exportedData.Data["api_token"] = exportTransformSlice(apitoken.AllTokens())
 	exportedData.Data["user"] = user.ExportAllUsers()
 
 	fp, err := os.Create(fileName)
@@ -166,6 +170,21 @@ func exportTransformSlice(data interface{}) []interface{} {
 		for i, v := range data {
 			exp[i] = v
 		}
+	case []*shovey.Schedule:
+		exp = make([]interface{}, len(data))
+		for i, v := range data {
+			exp[i] = v
+		}
+	case []*shovey.Template:
+		exp = make([]interface{}, len(data))
+		for i, v := range data {
+			exp[i] = v
+		}
+	case []*apitoken.Token:
+		exp = make([]interface{}, len(data))
+		for i, v := range data {
+			exp[i] = v
+		}
 	default:
 		msg := fmt.Sprintf("Type %t was passed in, but that isn't handled with export.", data)
 		panic(msg)
@@ -24,7 +24,9 @@ import (
 	"fmt"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/filestore"
+	"github.com/ctdk/goiardi/util"
 	"net/http"
+	"time"
 )
 
 func fileStoreHandler(w http.ResponseWriter, r *http.Request) {
@@ -32,6 +34,15 @@ func fileStoreHandler(w http.ResponseWriter, r *http.Request) {
 	 * for obvious reasons. Still do for the PUT/POST though. */
 	chksum := r.URL.Path[12:]
 
+	// Only URLs goiardi handed out in cookbook and sandbox responses are
+	// good, unless the old unsigned URLs are still allowed.
+	if !config.Config.UnsignedFileURLs {
+		if err := util.VerifyFileStoreURL(r.Method, chksum, r.URL.Query()); err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+	}
+
 	/* Eventually, both local storage (in-memory or on disk, depending) or
 	 * uploading to s3 or a similar cloud storage provider needs to be
 	 * supported. */
@@ -43,11 +54,17 @@ func fileStoreHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
-		if r.Method == http.MethodHead {
-			headResponse(w, r, http.StatusOK)
+		fp, err := fileStore.Open()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		w.Write(*fileStore.Data)
+		defer fp.Close()
+		/* A file's contents never change, so its checksum makes a
+		 * fine ETag. ServeContent takes care of HEAD, ranges, and
+		 * conditional requests. */
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, chksum))
+		http.ServeContent(w, r, "", time.Time{}, fp)
 	case http.MethodPut, http.MethodPost: /* Seems like for file uploads we ought to
 		 * support POST too. */
 		w.Header().Set("Content-Type", "application/json")
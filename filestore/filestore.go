@@ -32,6 +32,7 @@ import (
 	"database/sql"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 
@@ -44,52 +45,95 @@ import (
 
 // FileStore is an individual file in the filestore. Note that there is no
 // actual name for the file used, but it is identified by the file's checksum.
-// The file's data is stored as a pointer to an array of bytes.
+// When the files are kept in config.Config.LocalFstoreDir, the file's data is
+// read from and written to disk as it's needed, a piece at a time. Otherwise
+// it's kept in memory as a pointer to an array of bytes.
 type FileStore struct {
 	Chksum string
 	Data   *[]byte
+	// where an uploaded file is waiting on disk until it's saved
+	tmpPath string
+}
+
+// Reader reads a file's contents out of the file store.
+type Reader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+type bytesReader struct {
+	*bytes.Reader
+}
+
+func (b bytesReader) Close() error {
+	return nil
 }
 
 /* New, for this, includes giving it the file data */
 
-// New creates a new filestore item with the given checksum, io.ReadCloser
-// holding the file's data, and the length of the file. If the file data's
-// checksum does not match the provided checksum an error will be trhown.
-func New(chksum string, data io.ReadCloser, dataLength int64) (*FileStore, error) {
-	f, err := Get(chksum)
-	if err == nil {
-		// if err is nil, wait until checking the uploaded content to
-		// see if it's the same as what we have already
-		err = fmt.Errorf("File with checksum %s already exists.", chksum)
+// New creates a new filestore item with the given checksum, io.Reader holding
+// the file's data, and the length of the file, or -1 if the length isn't
+// known. With a local file store directory the data is written to a temporary
+// file there as it's read, rather than held in memory, and moved into place
+// when the file is saved. If the file data's checksum does not match the
+// provided checksum an error will be thrown.
+func New(chksum string, data io.Reader, dataLength int64) (*FileStore, error) {
+	filestore := &FileStore{Chksum: chksum}
+	verChk := md5.New()
+	var n int64
+	var err error
+	if config.Config.LocalFstoreDir != "" {
+		n, err = filestore.writeTmp(io.TeeReader(data, verChk))
+	} else {
+		buf := new(bytes.Buffer)
+		if dataLength > 0 {
+			buf.Grow(int(dataLength))
+		}
+		n, err = io.Copy(io.MultiWriter(buf, verChk), data)
+		fileData := buf.Bytes()
+		filestore.Data = &fileData
+	}
+	if err == nil && dataLength >= 0 && n != dataLength {
+		err = io.ErrUnexpectedEOF
 	}
-	/* Read the data in */
-	fileData := make([]byte, dataLength)
-	if n, err := io.ReadFull(data, fileData); err != nil {
+	if err != nil {
 		/* Something went wrong reading the data! */
-		readErr := fmt.Errorf("Only read %d bytes (out of %d, supposedly) from io.ReadCloser: %s", n, dataLength, err.Error())
+		filestore.discard()
+		readErr := fmt.Errorf("Only read %d bytes (out of %d, supposedly) from io.Reader: %s", n, dataLength, err.Error())
 		return nil, readErr
 	}
-	if f != nil {
-		if !bytes.Equal(fileData, *f.Data) {
-			return nil, err
-		}
-	}
 	/* Verify checksum. May move to a different function later. */
-	verChk := md5.New()
-	/* try writestring first */
-	verChk.Write(fileData)
 	verChksum := fmt.Sprintf("%x", verChk.Sum(nil))
 	if verChksum != chksum {
+		filestore.discard()
 		chkErr := fmt.Errorf("Checksum %s did not match original %s!", verChksum, chksum)
 		return nil, chkErr
 	}
-	filestore := &FileStore{
-		Chksum: chksum,
-		Data:   &fileData,
-	}
 	return filestore, nil
 }
 
+// writeTmp writes an upload to a temporary file in the local file store
+// directory, so it can be renamed into place once it's been checked.
+func (f *FileStore) writeTmp(data io.Reader) (int64, error) {
+	fp, err := ioutil.TempFile(config.Config.LocalFstoreDir, "."+f.Chksum+".upload-")
+	if err != nil {
+		return 0, err
+	}
+	f.tmpPath = fp.Name()
+	n, err := io.Copy(fp, data)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+func (f *FileStore) discard() {
+	if f.tmpPath != "" {
+		os.Remove(f.tmpPath)
+		f.tmpPath = ""
+	}
+}
+
 // Get the file with this checksum.
 func Get(chksum string) (*FileStore, error) {
 	var filestore *FileStore
@@ -119,9 +163,12 @@ func Get(chksum string) (*FileStore, error) {
 		return nil, err
 	}
 	if config.Config.LocalFstoreDir != "" {
-		if err := filestore.loadData(); err != nil {
+		// the data's read when the file's opened, but make sure it's
+		// actually there
+		if _, err := os.Stat(filestore.path()); err != nil {
 			return nil, err
 		}
+		return filestore, nil
 	}
 
 	if filestore.Data == nil {
@@ -132,33 +179,45 @@ func Get(chksum string) (*FileStore, error) {
 	return filestore, nil
 }
 
-func (f *FileStore) loadData() error {
-	/* If this is called, file data is stored on disk */
-	chkPath := path.Join(config.Config.LocalFstoreDir, f.Chksum)
+func (f *FileStore) path() string {
+	return path.Join(config.Config.LocalFstoreDir, f.Chksum)
+}
 
-	fp, err := os.Open(chkPath)
-	if err != nil {
-		return err
+// Open opens the file for reading. The Reader must be closed when done.
+func (f *FileStore) Open() (Reader, error) {
+	if config.Config.LocalFstoreDir != "" {
+		return os.Open(f.path())
 	}
-	defer fp.Close()
-	stat, sterr := fp.Stat()
-	if sterr != nil {
-		return sterr
+	if f.Data == nil {
+		return bytesReader{bytes.NewReader(nil)}, nil
 	}
-	fdata := make([]byte, stat.Size())
-	n, fperr := fp.Read(fdata)
-	if fperr != nil {
-		return fperr
-	} else if int64(n) != stat.Size() {
-		err = fmt.Errorf("only %d bytes were read from the expected %d", n, stat.Size())
+	return bytesReader{bytes.NewReader(*f.Data)}, nil
+}
+
+// loadData reads the whole file into memory, for exporting. Nothing else
+// should need it.
+func (f *FileStore) loadData() error {
+	if config.Config.LocalFstoreDir == "" {
+		return nil
+	}
+	fdata, err := ioutil.ReadFile(f.path())
+	if err != nil {
 		return err
 	}
 	f.Data = &fdata
 	return nil
 }
 
-// Save a file store item.
+// Save a file store item. With a local file store directory, the file is put
+// in place before it's recorded, so nothing can find a file that isn't there
+// yet.
 func (f *FileStore) Save() error {
+	if config.Config.LocalFstoreDir != "" {
+		if err := f.saveFile(); err != nil {
+			f.discard()
+			return err
+		}
+	}
 	if config.Config.UseMySQL {
 		err := f.saveMySQL()
 		if err != nil {
@@ -173,18 +232,27 @@ func (f *FileStore) Save() error {
 		ds := datastore.New()
 		ds.Set("filestore", f.Chksum, f)
 	}
-	if config.Config.LocalFstoreDir != "" {
-		fp, err := os.Create(path.Join(config.Config.LocalFstoreDir, f.Chksum))
-		if err != nil {
-			return err
+	return nil
+}
+
+func (f *FileStore) saveFile() error {
+	if f.tmpPath == "" {
+		// made by hand rather than with New, so write out what
+		// there is
+		var d []byte
+		if f.Data != nil {
+			d = *f.Data
 		}
-		defer fp.Close()
-		_, err = fp.Write(*f.Data)
-		if err != nil {
+		if _, err := f.writeTmp(bytes.NewReader(d)); err != nil {
 			return err
 		}
-		return fp.Close()
 	}
+	if err := os.Rename(f.tmpPath, f.path()); err != nil {
+		return err
+	}
+	f.tmpPath = ""
+	// it's on disk now, so don't keep it in memory too
+	f.Data = nil
 	return nil
 }
 
@@ -262,6 +330,12 @@ func AllFilestores() []*FileStore {
 		fileList := GetList()
 		for _, f := range fileList {
 			fl, err := Get(f)
+			if err == nil {
+				// copied so the data isn't left in the
+				// unsafe mem store afterwards
+				fl = &FileStore{Chksum: fl.Chksum, Data: fl.Data}
+				err = fl.loadData()
+			}
 			if err != nil {
 				logger.Debugf("File checksum %s was in the list of files, but wasn't found when fetched. Continuing.", f)
 				continue
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package filestore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ctdk/goiardi/config"
+)
+
+func init() {
+	gob.Register(new(FileStore))
+}
+
+func checksum(data []byte) string {
+	return fmt.Sprintf("%x", md5.Sum(data))
+}
+
+func readAll(t *testing.T, f *FileStore) []byte {
+	fp, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	b, err := ioutil.ReadAll(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestLocalDirStreaming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goiardi-filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.Config.LocalFstoreDir = dir
+	defer func() { config.Config.LocalFstoreDir = "" }()
+
+	data := bytes.Repeat([]byte("cookbook file "), 10000)
+	chk := checksum(data)
+	f, err := New(chk, bytes.NewReader(data), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Data != nil {
+		t.Errorf("the upload should not have been kept in memory")
+	}
+	if _, err = Get(chk); err == nil {
+		t.Errorf("the file should not be found before it's saved")
+	}
+	if err = f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	g, err := Get(chk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Data != nil {
+		t.Errorf("getting the file should not read it into memory")
+	}
+	if !bytes.Equal(readAll(t, g), data) {
+		t.Errorf("the file read back did not match what was uploaded")
+	}
+	all := AllFilestores()
+	if len(all) != 1 || all[0].Data == nil || !bytes.Equal(*all[0].Data, data) {
+		t.Errorf("exporting should read the file's data")
+	}
+
+	// bad uploads don't leave anything behind
+	if _, err = New(checksum([]byte("other")), strings.NewReader("not other"), 9); err == nil {
+		t.Errorf("an upload with the wrong checksum should have failed")
+	}
+	if _, err = New(chk, bytes.NewReader(data), int64(len(data)+10)); err == nil {
+		t.Errorf("a short upload should have failed")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Name() != chk {
+		t.Errorf("expected only %s in the file store directory, found %d files", chk, len(files))
+	}
+
+	if err = g.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(g.path()); !os.IsNotExist(err) {
+		t.Errorf("the file was not removed")
+	}
+}
+
+func TestInMemory(t *testing.T) {
+	data := []byte("a small file")
+	chk := checksum(data)
+	f, err := New(chk, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	g, err := Get(chk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err := g.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	// ranges need seeking
+	fp.Seek(2, 0)
+	b, _ := ioutil.ReadAll(fp)
+	if string(b) != "small file" {
+		t.Errorf("expected 'small file', got '%s'", string(b))
+	}
+	g.Delete()
+}
@@ -8,6 +8,7 @@ require (
 	github.com/ctdk/chefcrypto v0.2.0
 	github.com/ctdk/go-trie v0.0.0-20161110000926-fe74c509b12e
 	github.com/go-ini/ini v1.55.0 // indirect
+	github.com/go-ldap/ldap v3.0.2+incompatible
 	github.com/go-sql-driver/mysql v1.2.1-0.20160802113842-0b58b37b664c
 	github.com/hashicorp/go-version v1.1.0
 	github.com/hashicorp/memberlist v0.2.0 // indirect
@@ -23,7 +24,9 @@ require (
 	github.com/smartystreets/goconvey v1.6.4 // indirect
 	github.com/tideland/golib v4.2.1-0.20160624201112-2938f1706f66+incompatible
 	github.com/tinylib/msgp v0.0.0-20150805042339-cd4fb1548c31
+	golang.org/x/crypto v0.0.0-20190923035154-9ee001bba392
 	gopkg.in/alexcesaro/statsd.v1 v1.0.0-20160306065229-c289775e46fd // indirect
 	gopkg.in/alexcesaro/statsd.v2 v2.0.0 // indirect
+	gopkg.in/asn1-ber.v1 v1.0.0-20181015200546-f715ec2f112d // indirect
 	gopkg.in/ini.v1 v1.55.0 // indirect
 )
@@ -28,6 +28,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
@@ -35,22 +36,27 @@ import (
 	"os/signal"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/apitoken"
 	"github.com/ctdk/goiardi/authentication"
 	"github.com/ctdk/goiardi/client"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/cookbook"
 	"github.com/ctdk/goiardi/databag"
+	"github.com/ctdk/goiardi/datacrypt"
 	"github.com/ctdk/goiardi/datastore"
 	"github.com/ctdk/goiardi/environment"
 	"github.com/ctdk/goiardi/filestore"
 	"github.com/ctdk/goiardi/indexer"
+	"github.com/ctdk/goiardi/lockout"
 	"github.com/ctdk/goiardi/loginfo"
 	"github.com/ctdk/goiardi/node"
+	"github.com/ctdk/goiardi/ratelimit"
 	"github.com/ctdk/goiardi/report"
 	"github.com/ctdk/goiardi/reqctx"
 	"github.com/ctdk/goiardi/role"
@@ -110,6 +116,33 @@ func main() {
 			os.Exit(1)
 		}
 	}
+	// When moving secrets, the data encryption master keys may not be in
+	// the new secret store until they've been moved there.
+	if config.Config.MigrateSecretsFrom == "" {
+		if err := datacrypt.Initialize(); err != nil {
+			logger.Fatalf(err.Error())
+			os.Exit(1)
+		}
+	}
+	if config.Config.UseShovey {
+		if err := shovey.LoadSigningKeys(); err != nil {
+			logger.Fatalf(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// Resource changes from run reports saved before they were kept
+	// separately need filling in before resource search can find them.
+	if config.UsingDB() {
+		go func() {
+			n, err := report.BackfillResources()
+			if err != nil {
+				logger.Errorf("error filling in resource changes from older run reports: %s", err.Error())
+			} else if n > 0 {
+				logger.Infof("filled in resource changes from %d older run reports", n)
+			}
+		}()
+	}
 
 	gobRegister()
 	ds := datastore.New()
@@ -139,10 +172,21 @@ func main() {
 		if err != nil {
 			logger.Criticalf("cannot init s3")
 		}
+	} else if err := util.InitFileURLKey(config.Config); err != nil {
+		if !config.Config.UnsignedFileURLs {
+			logger.Fatalf(err.Error())
+			os.Exit(1)
+		}
+		logger.Warningf("%s; using a temporary key for signing file store URLs instead", err.Error())
+		if terr := util.UseTemporaryFileURLKey(); terr != nil {
+			logger.Fatalf(terr.Error())
+			os.Exit(1)
+		}
 	}
 	initGeneralStatsd(metricsBackend)
 	report.InitializeMetrics(metricsBackend)
 	search.InitializeMetrics(metricsBackend)
+	ratelimit.InitializeMetrics(metricsBackend)
 	apiChan = make(chan *apiTimerInfo, 10) // unbuffered shouldn't block
 	// anything, but a little buffer
 	// shouldn't hurt
@@ -168,20 +212,26 @@ func main() {
 			logger.Criticalf("Something went wrong during the import: %s", err.Error())
 			os.Exit(1)
 		}
-		if config.Config.FreezeData {
-			if config.Config.DataStoreFile != "" {
-				ds := datastore.New()
-				if err := ds.Save(config.Config.DataStoreFile); err != nil {
-					logger.Errorf(err.Error())
-				}
-			}
-			if err := indexer.SaveIndex(); err != nil {
-				logger.Errorf(err.Error())
-			}
+		saveAndClose()
+		fmt.Println("All done.")
+		os.Exit(0)
+	} else if config.Config.RotateDataKey {
+		kid, err := datacrypt.Rotate()
+		if err != nil {
+			logger.Criticalf("Something went wrong rotating the data encryption master key: %s", err.Error())
+			os.Exit(1)
 		}
-		if config.UsingDB() {
-			datastore.Dbh.Close()
+		saveAndClose()
+		fmt.Printf("The new data encryption master key is %s. Existing data will be encrypted with it in the background once goiardi is running again.\n", kid)
+		os.Exit(0)
+	} else if config.Config.MigrateSecretsFrom != "" {
+		fmt.Printf("Moving secrets from the %s secret store to the %s secret store....\n", config.Config.MigrateSecretsFrom, config.SecretStoreInUse())
+		err := migrateSecrets(config.Config.MigrateSecretsFrom)
+		if err != nil {
+			logger.Criticalf("Something went wrong moving the secrets: %s", err.Error())
+			os.Exit(1)
 		}
+		saveAndClose()
 		fmt.Println("All done.")
 		os.Exit(0)
 	}
@@ -213,17 +263,9 @@ func main() {
 		os.Exit(0)
 	}
 
-	if config.Config.PurgeNodeStatusAfter != "" {
-		startNodeStatusPurge()
-	}
-
-	if config.Config.PurgeReportsAfter != "" {
-		startReportPurge()
-	}
-
-	if config.Config.PurgeSandboxesDur != 0 {
-		startSandboxPurge()
-	}
+	startPurgers()
+	startShoveyScheduler()
+	startShoveySupervisor()
 
 	handleSignals()
 
@@ -256,6 +298,10 @@ func main() {
 	http.HandleFunc("/universe", universeHandler)
 	http.HandleFunc("/shovey/", shoveyHandler)
 	http.HandleFunc("/status/", statusHandler)
+	http.HandleFunc("/tokens", tokenHandler)
+	http.HandleFunc("/tokens/", tokenHandler)
+	http.HandleFunc("/lockouts", lockoutHandler)
+	http.HandleFunc("/lockouts/", lockoutHandler)
 
 	/* TODO: figure out how to handle the root & not found pages */
 	http.HandleFunc("/", rootHandler)
@@ -265,6 +311,12 @@ func main() {
 	srv := &http.Server{Addr: listenAddr, Handler: &interceptHandler{}}
 	if config.Config.UseSSL {
 		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS10}
+		if authentication.ClientCertsEnabled() {
+			if cerr := authentication.ClientCertTLSConfig(srv.TLSConfig); cerr != nil {
+				logger.Fatalf("Error setting up client certificate authentication: %s", cerr.Error())
+				os.Exit(1)
+			}
+		}
 		err = srv.ListenAndServeTLS(config.Config.SSLCert, config.Config.SSLKey)
 	} else {
 		err = srv.ListenAndServe()
@@ -390,8 +442,73 @@ func (h *interceptHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			),
 		)
 	}
+	/* Only perform the authorization check if that's configured. Bomb with
+	 * an error if the check of the headers, timestamps, etc. fails. */
+	/* No clue why /principals doesn't require authorization. Hrmph. */
+	needsAuth := config.Config.UseAuth && !strings.HasPrefix(r.URL.Path, "/file_store") && !strings.HasPrefix(r.URL.Path, "/debug") && !(strings.HasPrefix(r.URL.Path, "/principals") && r.Method == "GET")
+
+	/* Turn away actors and addresses that have failed to authenticate
+	 * too many times before even checking them. */
+	remoteIP := util.RemoteIP(r)
+	if needsAuth {
+		if l := lockout.Check(r.Header.Get("X-OPS-USERID"), remoteIP); l != nil {
+			w.Header().Set("Content-Type", "application/json")
+			logger.Warningf("Refusing request from %s %s, locked out until %s", l.Kind, l.Name, l.LockedUntil)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(l.RetryAfter().Seconds()))))
+			lerr := l.Error()
+			jsonErrorReport(w, r, lerr.Error(), lerr.Status())
+			return
+		}
+	}
+
+	/* With client certificate authentication, a verified certificate
+	 * can stand in for the signed headers or an API token, or be needed
+	 * as well as them, depending on --ssl-client-auth. */
+	var certUser actor.Actor
+	if needsAuth {
+		var cerr util.Gerror
+		certUser, cerr = authentication.CheckClientCert(r)
+		if cerr != nil {
+			w.Header().Set("Content-Type", "application/json")
+			logger.Errorf("Client certificate authorization failure: %s\n", cerr.Error())
+			lockout.Fail(r.Header.Get("X-OPS-USERID"), remoteIP, cerr.Error())
+			jsonErrorReport(w, r, cerr.Error(), cerr.Status())
+			return
+		}
+	}
+	bearer := apitoken.FromHeader(r)
+	useCert := certUser != nil && (config.Config.SSLClientAuth == config.ClientCertOnly || (config.Config.SSLClientAuth == config.ClientCertEither && bearer == ""))
+
+	/* Requests with an API token are checked against the token instead
+	 * of the signed headers, and are made as the token's owner. */
+	var tokenUser actor.Actor
+	if bearer != "" && needsAuth && !useCert {
+		var terr util.Gerror
+		tokenUser, terr = apitoken.Authenticate(bearer, r)
+		if terr != nil {
+			w.Header().Set("Content-Type", "application/json")
+			logger.Errorf("API token authorization failure: %s\n", terr.Error())
+			// a good token used outside of its scopes isn't a
+			// failure to authenticate
+			if terr.Status() == http.StatusUnauthorized {
+				lockout.Fail("", remoteIP, terr.Error())
+			}
+			w.Header().Set("Www-Authenticate", `Bearer realm="goiardi"`)
+			jsonErrorReport(w, r, terr.Error(), terr.Status())
+			return
+		}
+		if merr := authentication.CertMatches(certUser, tokenUser.GetName()); merr != nil {
+			w.Header().Set("Content-Type", "application/json")
+			logger.Errorf("Client certificate authorization failure: %s\n", merr.Error())
+			lockout.Fail(tokenUser.GetName(), remoteIP, merr.Error())
+			jsonErrorReport(w, r, merr.Error(), merr.Status())
+			return
+		}
+	}
+
 	userID := r.Header.Get("X-OPS-USERID")
-	if rs := r.Header.Get("X-Ops-Request-Source"); rs == "web" {
+	webReq := r.Header.Get("X-Ops-Request-Source") == "web" && tokenUser == nil
+	if webReq {
 		/* If use-auth is on and disable-webui is on, and this is a
 		 * webui connection, it needs to fail. */
 		if config.Config.DisableWebUI {
@@ -411,18 +528,32 @@ func (h *interceptHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		userID = "chef-webui"
 	}
-	/* Only perform the authorization check if that's configured. Bomb with
-	 * an error if the check of the headers, timestamps, etc. fails. */
-	/* No clue why /principals doesn't require authorization. Hrmph. */
-	if config.Config.UseAuth && !strings.HasPrefix(r.URL.Path, "/file_store") && !strings.HasPrefix(r.URL.Path, "/debug") && !(strings.HasPrefix(r.URL.Path, "/principals") && r.Method == "GET") {
+	if needsAuth && useCert {
+		/* Only the webui's certificate can make requests for other
+		 * users. */
+		if webReq {
+			if merr := authentication.CertMatches(certUser, userID); merr != nil {
+				w.Header().Set("Content-Type", "application/json")
+				logger.Errorf("Client certificate authorization failure: %s\n", merr.Error())
+				jsonErrorReport(w, r, merr.Error(), merr.Status())
+				return
+			}
+		}
+		lockout.Succeed(certUser.GetName(), remoteIP)
+	} else if needsAuth && tokenUser == nil {
 		herr := authentication.CheckHeader(userID, r)
+		if herr == nil {
+			herr = authentication.CertMatches(certUser, userID)
+		}
 		if herr != nil {
 			w.Header().Set("Content-Type", "application/json")
 			logger.Errorf("Authorization failure: %s\n", herr.Error())
+			lockout.Fail(userID, remoteIP, herr.Error())
 			w.Header().Set("Www-Authenticate", `X-Ops-Sign version="1.0" version="1.1" version="1.2" version="1.3"`)
 			jsonErrorReport(w, r, herr.Error(), herr.Status())
 			return
 		}
+		lockout.Succeed(userID, remoteIP)
 	}
 
 	// Experimental: decompress gzipped requests
@@ -449,8 +580,16 @@ func (h *interceptHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 	}
-	if !skip {
-		opUser, oerr := actor.GetReqUser(r.Header.Get("X-OPS-USERID"))
+	var opUser actor.Actor
+	if tokenUser != nil {
+		opUser = tokenUser
+		ctx = context.WithValue(ctx, reqctx.OpUserKey, tokenUser)
+	} else if useCert && !webReq {
+		opUser = certUser
+		ctx = context.WithValue(ctx, reqctx.OpUserKey, certUser)
+	} else if !skip {
+		var oerr util.Gerror
+		opUser, oerr = actor.GetReqUser(r.Header.Get("X-OPS-USERID"))
 		if oerr != nil {
 			w.Header().Set("Content-Type", "application/json")
 			jsonErrorReport(w, r, oerr.Error(), oerr.Status())
@@ -459,6 +598,34 @@ func (h *interceptHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		ctx = context.WithValue(ctx, reqctx.OpUserKey, opUser)
 	}
 
+	/* Keep any one client or user from making too many requests. This
+	 * happens after authenticating so nobody can use up someone else's
+	 * requests by claiming to be them. Requests that aren't made as
+	 * anyone in particular are limited by address, and so are requests
+	 * to paths that don't look up who made them, since the name in the
+	 * headers might not have been checked. */
+	if ratelimit.Enabled() {
+		limitName := r.Header.Get("X-OPS-USERID")
+		if config.Config.UseAuth {
+			limitName = remoteIP
+			if opUser != nil {
+				limitName = opUser.GetName()
+			}
+		}
+		if limitName == "" {
+			limitName = remoteIP
+		}
+		family := ratelimit.Family(r.URL.Path)
+		if ok, wait := ratelimit.Allow(limitName, ratelimit.Class(opUser), family); !ok {
+			w.Header().Set("Content-Type", "application/json")
+			retry := int(math.Ceil(wait.Seconds()))
+			logger.Infof("Rate limiting %s for %s, retry after %d seconds", limitName, family, retry)
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			jsonErrorReport(w, r, fmt.Sprintf("Too many requests to %s. Try again in %d seconds.", family, retry), http.StatusTooManyRequests)
+			return
+		}
+	}
+
 	http.DefaultServeMux.ServeHTTP(w, r.WithContext(ctx))
 }
 
@@ -597,11 +764,40 @@ func handleSignals() {
 			} else if sig == syscall.SIGHUP {
 				logger.Infof("Reloading configuration...")
 				config.ParseConfigOptions()
+				if err := datacrypt.Initialize(); err != nil {
+					logger.Errorf(err.Error())
+				}
+				if config.Config.UseShovey {
+					if err := shovey.LoadSigningKeys(); err != nil {
+						logger.Errorf(err.Error())
+					}
+				}
+				reloadPurgers()
 			}
 		}
 	}()
 }
 
+// saveAndClose saves the in-memory data store and the index, if they're being
+// saved to disk, and closes the database connection, before exiting after an
+// import or moving secrets.
+func saveAndClose() {
+	if config.Config.FreezeData {
+		if config.Config.DataStoreFile != "" {
+			ds := datastore.New()
+			if err := ds.Save(config.Config.DataStoreFile); err != nil {
+				logger.Errorf(err.Error())
+			}
+		}
+		if err := indexer.SaveIndex(); err != nil {
+			logger.Errorf(err.Error())
+		}
+	}
+	if config.UsingDB() {
+		datastore.Dbh.Close()
+	}
+}
+
 func gobRegister() {
 	e := new(environment.ChefEnvironment)
 	gob.Register(e)
@@ -649,6 +845,14 @@ func gobRegister() {
 	gob.Register(svr)
 	svs := new(shovey.ShoveyRunStream)
 	gob.Register(svs)
+	svsc := new(shovey.Schedule)
+	gob.Register(svsc)
+	svt := new(shovey.Template)
+	gob.Register(svt)
+	at := new(apitoken.Token)
+	gob.Register(at)
+	lo := new(lockout.Lockout)
+	gob.Register(lo)
 	ns := new(node.NodeStatus)
 	gob.Register(ns)
 	msi := make(map[string][]int)
@@ -803,8 +1007,9 @@ func runEventMonitor(sc *serfclient.RPCClient, errch chan<- error) {
 }
 
 func startNodeMonitor() {
-	// Never do this if serf isn't set up
-	if !config.Config.UseSerf {
+	// Never do this if nothing's going to be telling us whether nodes are
+	// up or down
+	if !config.TrackingNodeStatus() {
 		return
 	}
 	go func() {
@@ -830,51 +1035,26 @@ func startNodeMonitor() {
 	return
 }
 
-func startReportPurge() {
-	go func() {
-		// purge reports after 2 hours, I guess.
-		ticker := time.NewTicker(2 * time.Hour)
-		for _ = range ticker.C {
-			del, err := report.DeleteByAge(config.Config.PurgeReportsDur)
-			if err != nil {
-				logger.Errorf("Purging reports had an error: %s", err.Error())
-			} else {
-				logger.Debugf("Purged %d reports", del)
-			}
-		}
-	}()
-}
-
-func startSandboxPurge() {
+func startShoveyScheduler() {
+	if !config.Config.UseShovey {
+		return
+	}
 	go func() {
-		// check for sandboxes to purge every hour
-		ticker := time.NewTicker(time.Hour)
+		ticker := time.NewTicker(shovey.ScheduleCheckInterval)
 		for _ = range ticker.C {
-			del, err := sandbox.Purge(config.Config.PurgeSandboxesDur)
-			if err != nil {
-				logger.Errorf("Purging sandboxes (somehow) had an error: %s", err.Error())
-			} else {
-				logger.Debugf("Purged %d sandboxes", del)
-			}
+			shovey.RunDueSchedules()
 		}
 	}()
 }
 
-func startNodeStatusPurge() {
-	// don't do it if there aren't going to be node statuses to purge
-	if !config.Config.UseSerf || config.Config.PurgeNodeStatusDur == 0 {
+func startShoveySupervisor() {
+	if !config.Config.UseShovey {
 		return
 	}
 	go func() {
-		// check every 2 hours for statuses to purge
-		ticker := time.NewTicker(2 * time.Hour)
+		ticker := time.NewTicker(shovey.SupervisorInterval)
 		for _ = range ticker.C {
-			del, err := node.DeleteNodeStatusesByAge(config.Config.PurgeNodeStatusDur)
-			if err != nil {
-				logger.Errorf("Purging node statuses had an error: %s", err.Error())
-			} else {
-				logger.Debugf("Purged %d node statuses", del)
-			}
+			shovey.SuperviseJobs()
 		}
 	}()
 }
@@ -25,6 +25,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/ctdk/goiardi/apitoken"
 	"github.com/ctdk/goiardi/client"
 	"github.com/ctdk/goiardi/cookbook"
 	"github.com/ctdk/goiardi/databag"
@@ -320,6 +321,30 @@ func importAll(fileName string) error {
 					return err
 				}
 			}
+			logger.Infof("Loading shovey schedules...")
+			for _, v := range exportedData.Data["shovey_schedule"] {
+				s := v.(map[string]interface{})
+				err := shovey.ImportSchedule(s)
+				if err != nil {
+					return err
+				}
+			}
+			logger.Infof("Loading shovey templates...")
+			for _, v := range exportedData.Data["shovey_template"] {
+				s := v.(map[string]interface{})
+				err := shovey.ImportTemplate(s)
+				if err != nil {
+					return err
+				}
+			}
+			logger.Infof("Loading API tokens...")
+			for _, v := range exportedData.Data["api_token"] {
+				t := v.(map[string]interface{})
+				err := apitoken.Import(t)
+				if err != nil {
+					return err
+				}
+			}
 		}
 
 	} else {
@@ -0,0 +1,466 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package lockout counts failed authentication attempts by user or client name
+// and by the address they came from, and locks them out for a while once there
+// have been too many. Since the name a signed request or API token claims to
+// be comes from a header anyone can send, failures for those are counted for
+// the name at that address, so nobody can lock out someone else by failing to
+// authenticate as them. Each lockout after the first, without a successful login
+// in between, lasts twice as long as the one before it, up to a maximum.
+// Failures are also logged as events with loginfo.
+package lockout
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/loginfo"
+	"github.com/ctdk/goiardi/util"
+	"github.com/tideland/golib/logger"
+)
+
+// Kinds of things that get locked out.
+const (
+	KindActor = "actor"
+	KindIP    = "ip"
+)
+
+// Lockout tracks the authentication failures for a user or client name, or an
+// address.
+type Lockout struct {
+	Kind        string    `json:"kind"`
+	Name        string    `json:"name"`
+	Failures    int       `json:"failures"`
+	Lockouts    int       `json:"lockouts"`
+	LastFailure time.Time `json:"last_failure"`
+	LastReason  string    `json:"last_reason"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// failures are recorded one at a time, so two failures at once aren't both
+// counted as the first
+var recordLock sync.Mutex
+
+// The actors this goiardi has recorded failures for, so successful requests
+// don't have to look for failures to clear every time. Failures recorded by
+// another goiardi sharing the database aren't cleared early, but still expire
+// with the window.
+var failing = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: make(map[string]bool)}
+
+// CheckCacheTTL is how long a lockout check from the database is reused for
+// the same actor and address. Lockouts and cleared lockouts made by this
+// goiardi are seen right away, but ones made by another goiardi sharing the
+// database may take this long to be noticed.
+var CheckCacheTTL = 5 * time.Second
+
+// Checked lockouts, so every authenticated request doesn't have to go to the
+// database when nothing's locked out.
+var checked = struct {
+	sync.Mutex
+	entries map[string]checkedLockout
+}{entries: make(map[string]checkedLockout)}
+
+type checkedLockout struct {
+	lockout *Lockout
+	expires time.Time
+}
+
+// maxChecked keeps the cache of checked lockouts from growing without bound.
+const maxChecked = 10000
+
+func resetChecked() {
+	checked.Lock()
+	defer checked.Unlock()
+	checked.entries = make(map[string]checkedLockout)
+}
+
+// Enabled is true if lockouts are turned on.
+func Enabled() bool {
+	return !config.Config.DisableAuthLockout && config.Config.UseAuth
+}
+
+// ActorName is the name failures for an actor at an address are counted
+// under. Without an address, it's just the actor's name.
+func ActorName(name string, ip string) string {
+	if name == "" || ip == "" {
+		return name
+	}
+	return fmt.Sprintf("%s@%s", name, ip)
+}
+
+// Check returns the lockout for the actor at that address, or for the address,
+// if either one is locked out. An empty name or address isn't checked.
+func Check(name string, ip string) *Lockout {
+	if !Enabled() {
+		return nil
+	}
+	actorName := ActorName(name, ip)
+	if actorName == "" && ip == "" {
+		return nil
+	}
+	if config.UsingDB() {
+		return checkSQL(actorName, ip)
+	}
+	for _, k := range []struct{ kind, name string }{{KindActor, actorName}, {KindIP, ip}} {
+		if k.name == "" {
+			continue
+		}
+		l, err := Get(k.kind, k.name)
+		if err != nil {
+			if err.Status() != http.StatusNotFound {
+				logger.Errorf("error checking authentication lockout for %s %s: %s", k.kind, k.name, err.Error())
+			}
+			continue
+		}
+		if l.Locked() {
+			return l
+		}
+	}
+	return nil
+}
+
+// checkSQL looks up lockouts for the actor and address with one query, and
+// keeps the answer for a little while.
+func checkSQL(actorName string, ip string) *Lockout {
+	ck := actorName + " " + ip
+	now := time.Now()
+	checked.Lock()
+	c, ok := checked.entries[ck]
+	checked.Unlock()
+	if ok && now.Before(c.expires) {
+		if c.lockout != nil && c.lockout.Locked() {
+			return c.lockout
+		}
+		return nil
+	}
+	l, err := lockedSQL(actorName, ip, now)
+	if err != nil {
+		logger.Errorf("error checking authentication lockout for %s and %s: %s", actorName, ip, err.Error())
+		return nil
+	}
+	checked.Lock()
+	if len(checked.entries) >= maxChecked {
+		checked.entries = make(map[string]checkedLockout)
+	}
+	checked.entries[ck] = checkedLockout{lockout: l, expires: now.Add(CheckCacheTTL)}
+	checked.Unlock()
+	return l
+}
+
+// Fail records a failed authentication attempt for the actor at that address
+// and for the address, locking them out if there have been too many, and logs
+// it as an event. An empty name or address isn't counted.
+func Fail(name string, ip string, reason string) {
+	fail(name, ip, reason, true)
+}
+
+// FailLogin records a failed /authenticate_user login. Only the user's name is
+// counted, because those requests come from the webui rather than the person
+// logging in, and locking out the webui's address would lock everyone out.
+// The address is still logged with the event.
+func FailLogin(name string, ip string, reason string) {
+	fail(name, ip, reason, false)
+}
+
+func fail(name string, ip string, reason string, countIP bool) {
+	if lerr := loginfo.LogAuthFailure(name, ip, reason); lerr != nil {
+		logger.Errorf("error logging authentication failure for %s from %s: %s", name, ip, lerr.Error())
+	}
+	if !Enabled() {
+		return
+	}
+	if !countIP {
+		ip = ""
+	}
+	actorName := ActorName(name, ip)
+	if actorName != "" {
+		failing.Lock()
+		failing.names[actorName] = true
+		failing.Unlock()
+	}
+	recordLock.Lock()
+	defer recordLock.Unlock()
+	for _, k := range []struct{ kind, name string }{{KindActor, actorName}, {KindIP, ip}} {
+		if k.name == "" {
+			continue
+		}
+		l, err := Get(k.kind, k.name)
+		if err != nil {
+			if err.Status() != http.StatusNotFound {
+				logger.Errorf("error getting authentication lockout for %s %s: %s", k.kind, k.name, err.Error())
+				continue
+			}
+			l = &Lockout{Kind: k.kind, Name: k.name}
+		}
+		locked := l.fail(reason)
+		if locked {
+			logger.Warningf("Locked out %s %s until %s after %d authentication failures", l.Kind, l.Name, l.LockedUntil.Format(time.RFC3339), l.Failures)
+		}
+		if err = l.save(); err != nil {
+			logger.Errorf("error saving authentication lockout for %s %s: %s", k.kind, k.name, err.Error())
+		}
+		if locked {
+			resetChecked()
+		}
+	}
+}
+
+// fail counts a failure, returning true if it locks the actor or address out.
+func (l *Lockout) fail(reason string) bool {
+	now := time.Now()
+	if l.stale(now) {
+		l.Lockouts = 0
+	}
+	// failures from an earlier window, or from before the last lockout
+	// ended, don't count towards the next one
+	if now.Sub(l.LastFailure) > config.Config.AuthLockoutWindowDur || (!l.LockedUntil.IsZero() && l.LastFailure.Before(l.LockedUntil) && now.After(l.LockedUntil)) {
+		l.Failures = 0
+	}
+	l.Failures++
+	l.LastFailure = now
+	l.LastReason = reason
+	if l.Locked() || l.Failures < config.Config.AuthLockoutThreshold {
+		return false
+	}
+	d := config.Config.AuthLockoutTimeDur
+	for i := 0; i < l.Lockouts && d < config.Config.AuthLockoutMaxDur; i++ {
+		d *= 2
+	}
+	if d > config.Config.AuthLockoutMaxDur {
+		d = config.Config.AuthLockoutMaxDur
+	}
+	l.Lockouts++
+	l.LockedUntil = now.Add(d)
+	return true
+}
+
+// stale is true when there haven't been any failures for long enough that a
+// new lockout should start over at the shortest lockout time.
+func (l *Lockout) stale(now time.Time) bool {
+	last := l.LastFailure
+	if l.LockedUntil.After(last) {
+		last = l.LockedUntil
+	}
+	return now.Sub(last) > config.Config.AuthLockoutMaxDur
+}
+
+// Succeed clears the failures for an actor at an address after they've logged
+// in successfully. Failures from their address are left alone, so someone
+// guessing other actors' keys or passwords can't clear their address's count
+// by logging in as themselves.
+func Succeed(name string, ip string) {
+	if !Enabled() || name == "" {
+		return
+	}
+	actorName := ActorName(name, ip)
+	failing.Lock()
+	f := failing.names[actorName]
+	failing.Unlock()
+	if !f {
+		return
+	}
+	l, err := Get(KindActor, actorName)
+	if err != nil {
+		forget(actorName)
+		return
+	}
+	if l.Locked() {
+		return
+	}
+	if err = l.Clear(); err != nil {
+		logger.Errorf("error clearing authentication failures for %s: %s", actorName, err.Error())
+	}
+}
+
+func forget(actorName string) {
+	failing.Lock()
+	defer failing.Unlock()
+	delete(failing.names, actorName)
+}
+
+// Locked is true if the actor or address is currently locked out.
+func (l *Lockout) Locked() bool {
+	return time.Now().Before(l.LockedUntil)
+}
+
+// RetryAfter is how long until the lockout ends.
+func (l *Lockout) RetryAfter() time.Duration {
+	if !l.Locked() {
+		return 0
+	}
+	return time.Until(l.LockedUntil)
+}
+
+// Error returns an error with a 429 status explaining the lockout.
+func (l *Lockout) Error() util.Gerror {
+	what := "address"
+	if l.Kind == KindActor {
+		what = "user or client"
+	}
+	err := util.Errorf("Too many authentication failures for %s '%s'. Try again after %s.", what, l.Name, l.LockedUntil.Format(time.RFC3339))
+	err.SetStatus(http.StatusTooManyRequests)
+	return err
+}
+
+func key(kind string, name string) string {
+	return fmt.Sprintf("%s:%s", kind, name)
+}
+
+func (l *Lockout) save() util.Gerror {
+	if config.UsingDB() {
+		if err := l.saveSQL(); err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return gerr
+		}
+		return nil
+	}
+	ds := datastore.New()
+	ds.Set("auth_lockout", key(l.Kind, l.Name), l)
+	return nil
+}
+
+// Get gets the failure count and lockout for the actor or address.
+func Get(kind string, name string) (*Lockout, util.Gerror) {
+	if kind != KindActor && kind != KindIP {
+		err := util.Errorf("invalid lockout kind '%s'", kind)
+		err.SetStatus(http.StatusBadRequest)
+		return nil, err
+	}
+	var l *Lockout
+	var found bool
+	if config.UsingDB() {
+		var err error
+		l, err = getSQL(kind, name)
+		if err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return nil, gerr
+		}
+		found = l != nil
+	} else {
+		ds := datastore.New()
+		var ll interface{}
+		ll, found = ds.Get("auth_lockout", key(kind, name))
+		if ll != nil {
+			l = ll.(*Lockout)
+		}
+	}
+	if !found {
+		err := util.Errorf("no authentication failures for %s %s", kind, name)
+		err.SetStatus(http.StatusNotFound)
+		return nil, err
+	}
+	return l, nil
+}
+
+// Clear removes the failures and lockout for the actor or address.
+func (l *Lockout) Clear() util.Gerror {
+	if l.Kind == KindActor {
+		forget(l.Name)
+	}
+	defer resetChecked()
+	if config.UsingDB() {
+		if err := l.deleteSQL(); err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return gerr
+		}
+		return nil
+	}
+	ds := datastore.New()
+	ds.Delete("auth_lockout", key(l.Kind, l.Name))
+	return nil
+}
+
+// All returns the failure counts and lockouts for every actor and address that
+// has them, with the ones locked out the longest first.
+func All() []*Lockout {
+	var lockouts []*Lockout
+	if config.UsingDB() {
+		var err error
+		lockouts, err = allSQL()
+		if err != nil {
+			logger.Errorf("error getting authentication lockouts: %s", err.Error())
+		}
+	} else {
+		ds := datastore.New()
+		for _, k := range ds.GetList("auth_lockout") {
+			ll, _ := ds.Get("auth_lockout", k)
+			if l, ok := ll.(*Lockout); ok {
+				lockouts = append(lockouts, l)
+			}
+		}
+	}
+	sort.Sort(byLockedUntil(lockouts))
+	return lockouts
+}
+
+// Purge removes failure counts that have gone stale, so they don't pile up.
+func Purge() (int, error) {
+	recordLock.Lock()
+	defer recordLock.Unlock()
+	now := time.Now()
+	n := 0
+	for _, l := range All() {
+		if l.Locked() || !l.stale(now) {
+			continue
+		}
+		if err := l.Clear(); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+type byLockedUntil []*Lockout
+
+func (b byLockedUntil) Len() int      { return len(b) }
+func (b byLockedUntil) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byLockedUntil) Less(i, j int) bool {
+	if !b[i].LockedUntil.Equal(b[j].LockedUntil) {
+		return b[i].LockedUntil.After(b[j].LockedUntil)
+	}
+	return b[i].LastFailure.After(b[j].LastFailure)
+}
+
+// ToJSON formats a lockout to render as JSON for the client.
+func (l *Lockout) ToJSON() map[string]interface{} {
+	toJSON := make(map[string]interface{})
+	toJSON["kind"] = l.Kind
+	toJSON["name"] = l.Name
+	toJSON["failures"] = l.Failures
+	toJSON["lockouts"] = l.Lockouts
+	toJSON["last_failure"] = l.LastFailure
+	toJSON["last_reason"] = l.LastReason
+	toJSON["locked"] = l.Locked()
+	if !l.LockedUntil.IsZero() {
+		toJSON["locked_until"] = l.LockedUntil
+	} else {
+		toJSON["locked_until"] = nil
+	}
+	return toJSON
+}
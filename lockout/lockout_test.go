@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lockout
+
+import (
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+)
+
+func init() {
+	gob.Register(new(Lockout))
+}
+
+func setConf() func() {
+	config.Config.UseAuth = true
+	config.Config.AuthLockoutThreshold = 3
+	config.Config.AuthLockoutWindowDur = time.Minute
+	config.Config.AuthLockoutTimeDur = time.Minute
+	config.Config.AuthLockoutMaxDur = 3 * time.Minute
+	return func() {
+		config.Config.UseAuth = false
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	defer setConf()()
+	for i := 0; i < 2; i++ {
+		Fail("guessed", "192.0.2.10", "bad signature")
+	}
+	if l := Check("guessed", "192.0.2.10"); l != nil {
+		t.Errorf("locked out too soon: %+v", l)
+	}
+	Fail("guessed", "192.0.2.10", "bad signature")
+	l := Check("guessed", "192.0.2.10")
+	if l == nil {
+		t.Fatalf("guessed should have been locked out")
+	}
+	if l.Kind != KindActor || l.Name != "guessed@192.0.2.10" || l.LastReason != "bad signature" || l.RetryAfter() <= 0 || l.RetryAfter() > time.Minute {
+		t.Errorf("wrong lockout: %+v", l)
+	}
+	if l.Error().Status() != 429 {
+		t.Errorf("lockout error status was %d, not 429", l.Error().Status())
+	}
+	if l = Check("someone-else", "192.0.2.10"); l == nil || l.Kind != KindIP {
+		t.Errorf("the address should have been locked out too, got %+v", l)
+	}
+	// failures from one address don't lock the actor out everywhere
+	if l = Check("guessed", "192.0.2.11"); l != nil {
+		t.Errorf("guessed should not have been locked out from another address, got %+v", l)
+	}
+	// a successful login doesn't end a lockout early
+	Succeed("guessed", "192.0.2.10")
+	if Check("guessed", "192.0.2.10") == nil {
+		t.Errorf("a successful login should not have cleared a lockout")
+	}
+	if len(All()) < 2 {
+		t.Errorf("expected at least two lockouts, got %d", len(All()))
+	}
+
+	l, _ = Get(KindIP, "192.0.2.10")
+	if err := l.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if Check("", "192.0.2.10") != nil {
+		t.Errorf("cleared address was still locked out")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	defer setConf()()
+	l := &Lockout{Kind: KindActor, Name: "backoff"}
+	expected := []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute}
+	for i, exp := range expected {
+		for j := 0; j < 3; j++ {
+			l.fail("bad password")
+		}
+		d := l.LockedUntil.Sub(l.LastFailure)
+		if d != exp {
+			t.Errorf("lockout %d lasted %s, expected %s", i+1, d, exp)
+		}
+		// pretend the lockout just ended
+		l.LockedUntil = time.Now().Add(-time.Second)
+		l.LastFailure = l.LockedUntil.Add(-time.Second)
+	}
+	// after being quiet for long enough, start over
+	l.LockedUntil = time.Now().Add(-4 * time.Minute)
+	l.LastFailure = l.LockedUntil
+	for j := 0; j < 3; j++ {
+		l.fail("bad password")
+	}
+	if d := l.LockedUntil.Sub(l.LastFailure); d != time.Minute || l.Lockouts != 1 {
+		t.Errorf("a stale lockout should have started over, got %s after %d lockouts", d, l.Lockouts)
+	}
+}
+
+func TestWindowAndSucceed(t *testing.T) {
+	defer setConf()()
+	Fail("forgetful", "", "bad password")
+	Fail("forgetful", "", "bad password")
+	l, err := Get(KindActor, "forgetful")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.LastFailure = time.Now().Add(-2 * time.Minute)
+	l.save()
+	Fail("forgetful", "", "bad password")
+	if l, _ = Get(KindActor, "forgetful"); l.Failures != 1 {
+		t.Errorf("failures outside of the window should not count, got %d", l.Failures)
+	}
+	Succeed("forgetful", "")
+	if _, err = Get(KindActor, "forgetful"); err == nil {
+		t.Errorf("a successful login should have cleared the failures")
+	}
+
+	Fail("signer", "192.0.2.21", "bad signature")
+	Succeed("signer", "192.0.2.22")
+	if _, err = Get(KindActor, "signer@192.0.2.21"); err != nil {
+		t.Errorf("a successful request from another address should not have cleared the failures")
+	}
+	Succeed("signer", "192.0.2.21")
+	if _, err = Get(KindActor, "signer@192.0.2.21"); err == nil {
+		t.Errorf("a successful request should have cleared the failures")
+	}
+
+	FailLogin("webui-user", "192.0.2.20", "bad password")
+	if _, err = Get(KindIP, "192.0.2.20"); err == nil {
+		t.Errorf("failed logins should not count against the address")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	defer setConf()()
+	stale := &Lockout{Kind: KindIP, Name: "192.0.2.30", Failures: 1, LastFailure: time.Now().Add(-time.Hour)}
+	stale.save()
+	locked := &Lockout{Kind: KindIP, Name: "192.0.2.31", Lockouts: 5, LastFailure: time.Now().Add(-time.Hour), LockedUntil: time.Now().Add(time.Hour)}
+	locked.save()
+	if _, err := Purge(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(KindIP, "192.0.2.30"); err == nil {
+		t.Errorf("stale failures should have been purged")
+	}
+	if _, err := Get(KindIP, "192.0.2.31"); err != nil {
+		t.Errorf("an active lockout should not have been purged")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	defer setConf()()
+	config.Config.DisableAuthLockout = true
+	defer func() { config.Config.DisableAuthLockout = false }()
+	for i := 0; i < 5; i++ {
+		Fail("unlimited", "192.0.2.40", "bad signature")
+	}
+	if Check("unlimited", "192.0.2.40") != nil {
+		t.Errorf("nothing should be locked out when lockouts are disabled")
+	}
+}
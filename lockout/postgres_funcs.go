@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lockout
+
+/* PostgreSQL funcs for authentication lockouts */
+
+import (
+	"database/sql"
+
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/lib/pq"
+)
+
+func (l *Lockout) fillLockoutFromPostgreSQL(row datastore.ResRow) error {
+	var reason sql.NullString
+	var lf, lu pq.NullTime
+	err := row.Scan(&l.Kind, &l.Name, &l.Failures, &l.Lockouts, &lf, &reason, &lu)
+	if err != nil {
+		return err
+	}
+	l.LastReason = reason.String
+	if lf.Valid {
+		l.LastFailure = lf.Time
+	}
+	if lu.Valid {
+		l.LockedUntil = lu.Time
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lockout
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
+)
+
+const lockoutCols = "kind, name, failures, lockouts, last_failure, last_reason, locked_until"
+
+func (l *Lockout) fillLockoutFromSQL(row datastore.ResRow) error {
+	if config.Config.UseMySQL {
+		return l.fillLockoutFromMySQL(row)
+	} else if config.Config.UsePostgreSQL {
+		return l.fillLockoutFromPostgreSQL(row)
+	}
+	return util.NoDBConfigured
+}
+
+// nullTime stores unset times as NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func (l *Lockout) saveSQL() error {
+	if config.Config.UseMySQL {
+		_, err := datastore.Dbh.Exec("INSERT INTO auth_lockouts (kind, name, failures, lockouts, last_failure, last_reason, locked_until) VALUES (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE failures = VALUES(failures), lockouts = VALUES(lockouts), last_failure = VALUES(last_failure), last_reason = VALUES(last_reason), locked_until = VALUES(locked_until)", l.Kind, l.Name, l.Failures, l.Lockouts, nullTime(l.LastFailure), l.LastReason, nullTime(l.LockedUntil))
+		return err
+	} else if !config.Config.UsePostgreSQL {
+		return util.NoDBConfigured
+	}
+
+	tx, err := datastore.Dbh.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE goiardi.auth_lockouts SET failures = $1, lockouts = $2, last_failure = $3, last_reason = $4, locked_until = $5 WHERE kind = $6 AND name = $7", l.Failures, l.Lockouts, nullTime(l.LastFailure), l.LastReason, nullTime(l.LockedUntil), l.Kind, l.Name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = tx.Exec("INSERT INTO goiardi.auth_lockouts (kind, name, failures, lockouts, last_failure, last_reason, locked_until) VALUES ($1, $2, $3, $4, $5, $6, $7)", l.Kind, l.Name, l.Failures, l.Lockouts, nullTime(l.LastFailure), l.LastReason, nullTime(l.LockedUntil))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func getSQL(kind string, name string) (*Lockout, error) {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "SELECT " + lockoutCols + " FROM auth_lockouts WHERE kind = ? AND name = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "SELECT " + lockoutCols + " FROM goiardi.auth_lockouts WHERE kind = $1 AND name = $2"
+	} else {
+		return nil, util.NoDBConfigured
+	}
+	l := new(Lockout)
+	row := datastore.Dbh.QueryRow(sqlStatement, kind, name)
+	if err := l.fillLockoutFromSQL(row); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return l, nil
+}
+
+// lockedSQL gets whichever of the actor's and the address's lockouts ends
+// last, if either is locked out right now.
+func lockedSQL(actorName string, ip string, now time.Time) (*Lockout, error) {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "SELECT " + lockoutCols + " FROM auth_lockouts WHERE ((kind = ? AND name = ?) OR (kind = ? AND name = ?)) AND locked_until > ? ORDER BY locked_until DESC LIMIT 1"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "SELECT " + lockoutCols + " FROM goiardi.auth_lockouts WHERE ((kind = $1 AND name = $2) OR (kind = $3 AND name = $4)) AND locked_until > $5 ORDER BY locked_until DESC LIMIT 1"
+	} else {
+		return nil, util.NoDBConfigured
+	}
+	l := new(Lockout)
+	row := datastore.Dbh.QueryRow(sqlStatement, KindActor, actorName, KindIP, ip, now)
+	if err := l.fillLockoutFromSQL(row); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Lockout) deleteSQL() error {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "DELETE FROM auth_lockouts WHERE kind = ? AND name = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "DELETE FROM goiardi.auth_lockouts WHERE kind = $1 AND name = $2"
+	} else {
+		return util.NoDBConfigured
+	}
+	_, err := datastore.Dbh.Exec(sqlStatement, l.Kind, l.Name)
+	return err
+}
+
+func allSQL() ([]*Lockout, error) {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "SELECT " + lockoutCols + " FROM auth_lockouts"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "SELECT " + lockoutCols + " FROM goiardi.auth_lockouts"
+	} else {
+		return nil, util.NoDBConfigured
+	}
+	var lockouts []*Lockout
+	rows, err := datastore.Dbh.Query(sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		l := new(Lockout)
+		if err = l.fillLockoutFromSQL(rows); err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, l)
+	}
+	return lockouts, rows.Err()
+}
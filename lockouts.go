@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Listing and clearing authentication lockouts.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/ctdk/goiardi/lockout"
+	"github.com/ctdk/goiardi/reqctx"
+	"github.com/ctdk/goiardi/util"
+)
+
+func lockoutHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	opUser, oerr := reqctx.CtxReqUser(r.Context())
+	if oerr != nil {
+		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
+		return
+	}
+	if !opUser.IsAdmin() {
+		jsonErrorReport(w, r, "You are not allowed to perform that action.", http.StatusForbidden)
+		return
+	}
+	pathArray := splitPath(r.URL.Path)
+
+	var lockoutResponse interface{}
+	switch len(pathArray) {
+	case 1:
+		if r.Method != http.MethodGet {
+			jsonErrorReport(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		lockouts := lockout.All()
+		lr := make([]map[string]interface{}, len(lockouts))
+		for i, l := range lockouts {
+			lr[i] = lockoutJSON(l)
+		}
+		lockoutResponse = lr
+	case 3:
+		l, err := lockout.Get(pathArray[1], pathArray[2])
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			if err = l.Clear(); err != nil {
+				jsonErrorReport(w, r, err.Error(), err.Status())
+				return
+			}
+		default:
+			jsonErrorReport(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		lockoutResponse = lockoutJSON(l)
+	default:
+		jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&lockoutResponse); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func lockoutJSON(l *lockout.Lockout) map[string]interface{} {
+	lr := l.ToJSON()
+	lr["uri"] = util.CustomURL(fmt.Sprintf("/lockouts/%s/%s", l.Kind, l.Name))
+	return lr
+}
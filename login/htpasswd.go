@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package login
+
+// Checking passwords against an Apache style htpasswd file. bcrypt, MD5
+// ("$apr1$"), and SHA-1 ("{SHA}") hashes are supported; crypt(3) and plain
+// text passwords are not.
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type htpasswdProvider struct {
+	path string
+}
+
+// htpasswdFiles holds the htpasswd files that have been read, so they're only
+// read again when they change.
+var htpasswdFiles = struct {
+	sync.Mutex
+	files map[string]*htpasswdFile
+}{files: make(map[string]*htpasswdFile)}
+
+type htpasswdFile struct {
+	modTime time.Time
+	size    int64
+	hashes  map[string]string
+}
+
+func (h *htpasswdProvider) Name() string {
+	return "htpasswd"
+}
+
+func (h *htpasswdProvider) Authenticate(username string, password string) (*Identity, error) {
+	hashes, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+	hash, ok := hashes[username]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	match, err := checkHtpasswd(password, hash)
+	if err != nil {
+		return nil, err
+	}
+	if !match {
+		return nil, ErrBadPassword
+	}
+	return &Identity{Username: username}, nil
+}
+
+func (h *htpasswdProvider) load() (map[string]string, error) {
+	if h.path == "" {
+		return nil, fmt.Errorf("no htpasswd file configured")
+	}
+	st, err := os.Stat(h.path)
+	if err != nil {
+		return nil, err
+	}
+	htpasswdFiles.Lock()
+	defer htpasswdFiles.Unlock()
+	if f, ok := htpasswdFiles.files[h.path]; ok && f.modTime.Equal(st.ModTime()) && f.size == st.Size() {
+		return f.hashes, nil
+	}
+	fp, err := os.Open(h.path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		hashes[parts[0]] = parts[1]
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	htpasswdFiles.files[h.path] = &htpasswdFile{modTime: st.ModTime(), size: st.Size(), hashes: hashes}
+	return hashes, nil
+}
+
+func checkHtpasswd(password string, hash string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.SplitN(hash, "$", 4)
+		if len(parts) != 4 {
+			return false, fmt.Errorf("invalid htpasswd MD5 hash")
+		}
+		return subtle.ConstantTimeCompare([]byte(apr1(password, parts[2])), []byte(hash)) == 1, nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		check := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(check), []byte(hash)) == 1, nil
+	}
+	return false, fmt.Errorf("unsupported htpasswd hash type")
+}
+
+// apr1 hashes the password with Apache's variant of MD5-crypt.
+func apr1(password string, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	s := []byte(salt)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write(s)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(magic))
+	h.Write(s)
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	// deliberately slow it down
+	for i := 0; i < 1000; i++ {
+		r := md5.New()
+		if i&1 == 1 {
+			r.Write(pw)
+		} else {
+			r.Write(final)
+		}
+		if i%3 != 0 {
+			r.Write(s)
+		}
+		if i%7 != 0 {
+			r.Write(pw)
+		}
+		if i&1 == 1 {
+			r.Write(final)
+		} else {
+			r.Write(pw)
+		}
+		final = r.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out []byte
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return magic + salt + "$" + string(out)
+}
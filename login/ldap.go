@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package login
+
+// Checking passwords by binding to an LDAP directory as the user. The user's
+// entry is found by searching under the base DN, binding first with the
+// configured bind DN (or anonymously, without one), and then the password is
+// checked by binding as that entry.
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/go-ldap/ldap"
+)
+
+// ldapTimeout is how long to wait on the LDAP server.
+const ldapTimeout = 10 * time.Second
+
+type ldapProvider struct {
+	conf config.LDAPConf
+}
+
+func (l *ldapProvider) Name() string {
+	return "ldap"
+}
+
+func (l *ldapProvider) Authenticate(username string, password string) (*Identity, error) {
+	// An empty password would be an unauthenticated bind, which many
+	// directories allow, so never let one through.
+	if password == "" {
+		return nil, ErrBadPassword
+	}
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if l.conf.BindDN != "" {
+		if err = conn.Bind(l.conf.BindDN, l.conf.BindPassword); err != nil {
+			return nil, fmt.Errorf("binding as %s: %s", l.conf.BindDN, err.Error())
+		}
+	}
+	attrs := []string{"dn", l.nameAttr(), l.emailAttr()}
+	if l.conf.AdminAttr != "" {
+		attrs = append(attrs, l.conf.AdminAttr)
+	}
+	filter := fmt.Sprintf(l.userFilter(), ldap.EscapeFilter(username))
+	req := ldap.NewSearchRequest(l.conf.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false, filter, attrs, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, fmt.Errorf("searching for %s: %s", username, err.Error())
+	}
+	switch len(res.Entries) {
+	case 0:
+		return nil, ErrUnknownUser
+	case 1:
+	default:
+		return nil, fmt.Errorf("more than one LDAP entry matched %s", username)
+	}
+	entry := res.Entries[0]
+
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrBadPassword
+		}
+		return nil, err
+	}
+
+	id := &Identity{Username: username, Name: entry.GetAttributeValue(l.nameAttr()), Email: entry.GetAttributeValue(l.emailAttr())}
+	if l.conf.AdminAttr != "" {
+		for _, v := range entry.GetAttributeValues(l.conf.AdminAttr) {
+			if strings.EqualFold(v, l.conf.AdminValue) {
+				id.Admin = true
+				break
+			}
+		}
+	}
+	return id, nil
+}
+
+func (l *ldapProvider) dial() (*ldap.Conn, error) {
+	if l.conf.URL == "" {
+		return nil, fmt.Errorf("no LDAP server configured")
+	}
+	conn, err := ldap.DialURL(l.conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if l.conf.StartTLS {
+		u, _ := url.Parse(l.conf.URL)
+		if err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (l *ldapProvider) userFilter() string {
+	if l.conf.UserFilter == "" {
+		return "(uid=%s)"
+	}
+	return l.conf.UserFilter
+}
+
+func (l *ldapProvider) nameAttr() string {
+	if l.conf.NameAttr == "" {
+		return "cn"
+	}
+	return l.conf.NameAttr
+}
+
+func (l *ldapProvider) emailAttr() string {
+	if l.conf.EmailAttr == "" {
+		return "mail"
+	}
+	return l.conf.EmailAttr
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package login checks the user names and passwords given to
+// /authenticate_user against one or more authentication providers: goiardi's
+// own user passwords, an htpasswd file, or an LDAP directory. Providers are
+// tried in the order they're configured, and the first one that knows the
+// user decides whether the password is right.
+package login
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/user"
+	"github.com/ctdk/goiardi/util"
+	"github.com/tideland/golib/logger"
+)
+
+// Errors providers return when they can't log the user in. ErrUnknownUser
+// means the next provider should be tried.
+var (
+	ErrUnknownUser = errors.New("unknown user")
+	ErrBadPassword = errors.New("password did not match")
+)
+
+// Identity is who a provider says a user is once they've logged in. Name,
+// Email, and Admin are only used when creating a goiardi user for them.
+type Identity struct {
+	Username string
+	Name     string
+	Email    string
+	Admin    bool
+}
+
+// Provider checks user names and passwords.
+type Provider interface {
+	// Name returns the provider's name, as used in --auth-providers.
+	Name() string
+	// Authenticate checks the password, returning ErrUnknownUser if the
+	// provider doesn't know the user and ErrBadPassword if the password
+	// is wrong.
+	Authenticate(username string, password string) (*Identity, error)
+}
+
+// Providers returns the configured providers, in the order they're tried.
+func Providers() ([]Provider, error) {
+	names := config.Config.AuthProviders
+	if len(names) == 0 {
+		names = []string{"local"}
+	}
+	providers := make([]Provider, 0, len(names))
+	for _, n := range names {
+		switch n {
+		case "local":
+			providers = append(providers, localProvider{})
+		case "htpasswd":
+			providers = append(providers, &htpasswdProvider{path: config.Config.HtpasswdFile})
+		case "ldap":
+			providers = append(providers, &ldapProvider{conf: config.Config.LDAP})
+		default:
+			return nil, fmt.Errorf("unknown authentication provider '%s'", n)
+		}
+	}
+	return providers, nil
+}
+
+// Authenticate logs the user in with the configured providers, returning the
+// goiardi user. If a provider other than the local one logs in someone who
+// isn't a goiardi user yet, they're created if --auth-auto-provision is set.
+func Authenticate(username string, password string) (*user.User, util.Gerror) {
+	if password == "" {
+		return nil, loginErr(ErrBadPassword)
+	}
+	providers, err := Providers()
+	if err != nil {
+		gerr := util.CastErr(err)
+		gerr.SetStatus(http.StatusInternalServerError)
+		return nil, gerr
+	}
+	for _, p := range providers {
+		id, err := p.Authenticate(username, password)
+		if err == ErrUnknownUser {
+			continue
+		} else if err == ErrBadPassword {
+			return nil, loginErr(err)
+		} else if err != nil {
+			// a directory that's down shouldn't keep users from
+			// logging in with the next provider
+			logger.Errorf("error authenticating %s with the %s provider: %s", username, p.Name(), err.Error())
+			continue
+		}
+		return goiardiUser(p, id)
+	}
+	return nil, loginErr(ErrUnknownUser)
+}
+
+func loginErr(err error) util.Gerror {
+	gerr := util.CastErr(err)
+	gerr.SetStatus(http.StatusUnauthorized)
+	return gerr
+}
+
+// goiardiUser gets the goiardi user someone logged in as, creating it if need
+// be and allowed to.
+func goiardiUser(p Provider, id *Identity) (*user.User, util.Gerror) {
+	u, err := user.Get(id.Username)
+	if err == nil {
+		return u, nil
+	}
+	if err.Status() != http.StatusNotFound {
+		return nil, err
+	}
+	if !config.Config.AuthAutoProvision {
+		logger.Infof("%s logged in with the %s provider, but isn't a goiardi user", id.Username, p.Name())
+		return nil, loginErr(ErrUnknownUser)
+	}
+	u, err = user.New(id.Username)
+	if err != nil {
+		return nil, err
+	}
+	if id.Name != "" {
+		u.Name = id.Name
+	}
+	u.Email = id.Email
+	u.Admin = id.Admin
+	if err = u.Save(); err != nil {
+		return nil, err
+	}
+	logger.Infof("created user %s after logging in with the %s provider (admin: %t)", u.Username, p.Name(), u.Admin)
+	return u, nil
+}
+
+// localProvider checks passwords stored with goiardi's own users.
+type localProvider struct{}
+
+func (l localProvider) Name() string {
+	return "local"
+}
+
+func (l localProvider) Authenticate(username string, password string) (*Identity, error) {
+	u, err := user.Get(username)
+	if err != nil {
+		if err.Status() == http.StatusNotFound {
+			return nil, ErrUnknownUser
+		}
+		return nil, err
+	}
+	// users without a password of their own are left to the other
+	// providers
+	if u.Passwd() == "" {
+		return nil, ErrUnknownUser
+	}
+	if err := u.CheckPasswd(password); err != nil {
+		return nil, ErrBadPassword
+	}
+	return &Identity{Username: u.Username, Name: u.Name, Email: u.Email, Admin: u.Admin}, nil
+}
@@ -0,0 +1,266 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package login
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/user"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/asn1-ber.v1"
+)
+
+func writeHtpasswd(t *testing.T) string {
+	bc, _ := bcrypt.GenerateFromPassword([]byte("bcrypted"), 4)
+	lines := []string{
+		"# a comment",
+		"bc-user:" + strings.Replace(string(bc), "$2a$", "$2y$", 1),
+		"md5-user:$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1",
+		"sha-user:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"local-user:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+	}
+	f, err := ioutil.TempFile("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(strings.Join(lines, "\n") + "\n")
+	f.Close()
+	return f.Name()
+}
+
+func TestHtpasswd(t *testing.T) {
+	path := writeHtpasswd(t)
+	defer os.Remove(path)
+	h := &htpasswdProvider{path: path}
+	good := map[string]string{"bc-user": "bcrypted", "md5-user": "password", "sha-user": "password"}
+	for u, pw := range good {
+		if _, err := h.Authenticate(u, pw); err != nil {
+			t.Errorf("%s should have logged in with %s, but got %v", u, pw, err)
+		}
+		if _, err := h.Authenticate(u, pw+"x"); err != ErrBadPassword {
+			t.Errorf("%s should not have logged in with a bad password, got %v", u, err)
+		}
+	}
+	if _, err := h.Authenticate("nobody", "password"); err != ErrUnknownUser {
+		t.Errorf("expected an unknown user, got %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	gob.Register(new(user.User))
+	path := writeHtpasswd(t)
+	defer os.Remove(path)
+	config.Config.AuthProviders = []string{"local", "htpasswd"}
+	config.Config.HtpasswdFile = path
+	defer func() {
+		config.Config.AuthProviders = nil
+		config.Config.HtpasswdFile = ""
+		config.Config.AuthAutoProvision = false
+	}()
+
+	u, _ := user.New("local-user")
+	u.SetPasswd("localpass")
+	u.Save()
+	if _, err := Authenticate("local-user", "localpass"); err != nil {
+		t.Errorf("local-user should have logged in with the local provider, got %s", err.Error())
+	}
+	// the local provider knows local-user, so htpasswd isn't asked
+	if _, err := Authenticate("local-user", "password"); err == nil {
+		t.Errorf("local-user should not have logged in with the htpasswd password")
+	}
+	if _, err := Authenticate("sha-user", "password"); err == nil {
+		t.Errorf("sha-user isn't a goiardi user, and shouldn't have logged in without auto-provisioning")
+	}
+	config.Config.AuthAutoProvision = true
+	if _, err := Authenticate("sha-user", "wrong"); err == nil {
+		t.Errorf("sha-user should not have logged in with a bad password")
+	}
+	if _, err := user.Get("sha-user"); err == nil {
+		t.Errorf("sha-user should not have been created after a bad password")
+	}
+	nu, err := Authenticate("sha-user", "password")
+	if err != nil {
+		t.Fatalf("sha-user should have been created and logged in, got %s", err.Error())
+	}
+	if nu.Username != "sha-user" || nu.Admin {
+		t.Errorf("sha-user was not created right: %+v", nu)
+	}
+	if _, err := user.Get("sha-user"); err != nil {
+		t.Errorf("sha-user was not saved")
+	}
+	if _, err := Authenticate("sha-user", ""); err == nil {
+		t.Errorf("an empty password should never log in")
+	}
+}
+
+// ldapEntry is a user in the fake LDAP server.
+type ldapEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// fakeLDAP is just enough of an LDAP server to bind and search with equality
+// filters.
+func fakeLDAP(t *testing.T, entries []*ldapEntry) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveLDAP(conn, entries)
+		}
+	}()
+	return "ldap://" + ln.Addr().String()
+}
+
+func ldapResult(msgID int64, app ber.Tag, code int64) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, ""))
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, app, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	p.AppendChild(op)
+	return p
+}
+
+func serveLDAP(conn net.Conn, entries []*ldapEntry) {
+	defer conn.Close()
+	for {
+		req, err := ber.ReadPacket(conn)
+		if err != nil || len(req.Children) < 2 {
+			return
+		}
+		msgID := req.Children[0].Value.(int64)
+		op := req.Children[1]
+		switch op.Tag {
+		case 0: // bind
+			dn := op.Children[1].Value.(string)
+			pw := op.Children[2].Data.String()
+			code := int64(49)
+			for _, e := range entries {
+				if e.dn == dn && e.password == pw && pw != "" {
+					code = 0
+				}
+			}
+			conn.Write(ldapResult(msgID, 1, code).Bytes())
+		case 2: // unbind
+			return
+		case 3: // search
+			filter := op.Children[6]
+			attr := filter.Children[0].Value.(string)
+			val := filter.Children[1].Value.(string)
+			for _, e := range entries {
+				match := false
+				for _, v := range e.attrs[attr] {
+					if v == val {
+						match = true
+					}
+				}
+				if !match {
+					continue
+				}
+				p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, ""))
+				res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 4, nil, "")
+				res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+				attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				for k, vs := range e.attrs {
+					a := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					a.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, k, ""))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, v := range vs {
+						set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+					}
+					a.AppendChild(set)
+					attrs.AppendChild(a)
+				}
+				res.AppendChild(attrs)
+				p.AppendChild(res)
+				conn.Write(p.Bytes())
+			}
+			conn.Write(ldapResult(msgID, 5, 0).Bytes())
+		}
+	}
+}
+
+func TestLDAP(t *testing.T) {
+	gob.Register(new(user.User))
+	admins := "cn=chef-admins,ou=groups,dc=example,dc=com"
+	url := fakeLDAP(t, []*ldapEntry{
+		{dn: "cn=goiardi,dc=example,dc=com", password: "svcpass"},
+		{dn: "uid=alice,ou=people,dc=example,dc=com", password: "alicepass", attrs: map[string][]string{"uid": {"alice"}, "cn": {"Alice Example"}, "mail": {"alice@example.com"}, "memberOf": {admins}}},
+		{dn: "uid=bob,ou=people,dc=example,dc=com", password: "bobpass", attrs: map[string][]string{"uid": {"bob"}, "cn": {"Bob Example"}}},
+	})
+	conf := config.LDAPConf{URL: url, BindDN: "cn=goiardi,dc=example,dc=com", BindPassword: "svcpass", BaseDN: "dc=example,dc=com", AdminAttr: "memberOf", AdminValue: admins}
+	l := &ldapProvider{conf: conf}
+
+	id, err := l.Authenticate("alice", "alicepass")
+	if err != nil {
+		t.Fatalf("alice should have logged in, got %v", err)
+	}
+	if id.Name != "Alice Example" || id.Email != "alice@example.com" || !id.Admin {
+		t.Errorf("wrong identity for alice: %+v", id)
+	}
+	if _, err = l.Authenticate("alice", "wrong"); err != ErrBadPassword {
+		t.Errorf("alice should not have logged in with a bad password, got %v", err)
+	}
+	if _, err = l.Authenticate("alice", ""); err != ErrBadPassword {
+		t.Errorf("an empty password should not have been sent to the directory, got %v", err)
+	}
+	if _, err = l.Authenticate("carol", "carolpass"); err != ErrUnknownUser {
+		t.Errorf("carol isn't in the directory, got %v", err)
+	}
+	id, err = l.Authenticate("bob", "bobpass")
+	if err != nil || id.Admin {
+		t.Errorf("bob should have logged in as a non-admin, got %+v, %v", id, err)
+	}
+
+	bad := &ldapProvider{conf: conf}
+	bad.conf.BindPassword = "wrong"
+	if _, err = bad.Authenticate("alice", "alicepass"); err == nil || err == ErrBadPassword || err == ErrUnknownUser {
+		t.Errorf("a bad bind password should have been an error, got %v", err)
+	}
+
+	config.Config.AuthProviders = []string{"local", "ldap"}
+	config.Config.LDAP = conf
+	config.Config.AuthAutoProvision = true
+	defer func() {
+		config.Config.AuthProviders = nil
+		config.Config.LDAP = config.LDAPConf{}
+		config.Config.AuthAutoProvision = false
+	}()
+	u, gerr := Authenticate("alice", "alicepass")
+	if gerr != nil {
+		t.Fatalf("alice should have been created and logged in, got %s", gerr.Error())
+	}
+	if u.Name != "Alice Example" || u.Email != "alice@example.com" || !u.Admin {
+		t.Errorf("alice was not created right: %+v", u)
+	}
+}
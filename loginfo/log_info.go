@@ -29,9 +29,11 @@ import (
 	"time"
 
 	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/client"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
 	"github.com/ctdk/goiardi/serfin"
+	"github.com/ctdk/goiardi/user"
 	"github.com/ctdk/goiardi/util"
 	"github.com/tideland/golib/logger"
 )
@@ -100,6 +102,58 @@ func LogEvent(doer actor.Actor, obj util.GoiardiObj, action string) error {
 	return le.writeEventInMem()
 }
 
+// AuthFailureObjectType is the object type for failed authentication events.
+const AuthFailureObjectType = "authentication"
+
+// LogAuthFailure writes an event for a failed attempt to authenticate as the
+// named user or client, which may not actually exist. The address the attempt
+// came from and the reason it failed are kept in the event's extended info.
+func LogAuthFailure(name string, ip string, reason string) error {
+	if !config.Config.LogEvents {
+		logger.Debugf("Not logging this event")
+		return nil
+	}
+	le := new(LogInfo)
+	le.Action = "auth_failure"
+	le.ObjectType = AuthFailureObjectType
+	le.ObjectName = name
+	le.Time = time.Now()
+	le.ActorType = "unknown"
+	// the actor is only filled in if there really is a client or user
+	// with that name
+	if c, err := client.Get(name); err == nil {
+		le.Actor = c
+		le.ActorType = "client"
+	} else if u, err := user.Get(name); err == nil {
+		le.Actor = u
+		le.ActorType = "user"
+	}
+	ai, err := json.Marshal(map[string]string{"name": name})
+	if err != nil {
+		return err
+	}
+	le.ActorInfo = string(ai)
+	ext, err := json.Marshal(map[string]string{"name": name, "ip": ip, "reason": reason})
+	if err != nil {
+		return err
+	}
+	le.ExtendedInfo = string(ext)
+
+	if config.Config.SerfEventAnnounce {
+		qle := make(map[string]interface{}, 4)
+		qle["time"] = le.Time
+		qle["action"] = le.Action
+		qle["object_type"] = le.ObjectType
+		qle["object_name"] = le.ObjectName
+		go serfin.SendEvent("log-event", qle)
+	}
+
+	if config.UsingDB() {
+		return le.writeEventSQL()
+	}
+	return le.writeEventInMem()
+}
+
 // Import a log info event from an export dump.
 func Import(logData map[string]interface{}) error {
 	le := new(LogInfo)
@@ -244,7 +298,9 @@ func GetLogInfos(searchParams map[string]string, limits ...int) ([]*LogInfo, err
 	if ot, ok := searchParams["object_type"]; ok {
 		/* If this is false, assume it's not a name of the pointer */
 		if !strings.ContainsAny(ot, "*.") {
-			if ot == "environment" {
+			if ot == AuthFailureObjectType {
+				// auth failures aren't a real object type
+			} else if ot == "environment" {
 				searchParams["object_type"] = "*environment.ChefEnvironment"
 			} else if ot == "cookbook_version" {
 				searchParams["object_type"] = "*cookbook.CookbookVersion"
@@ -279,7 +335,7 @@ func GetLogInfos(searchParams map[string]string, limits ...int) ([]*LogInfo, err
 		k, ok := arr[i]
 		if ok {
 			item := k.(*LogInfo)
-			if item.checkTimeRange(from, until) && (searchParams["action"] == "" || searchParams["action"] == item.Action) && (searchParams["object_type"] == "" || searchParams["object_type"] == item.ObjectType) && (searchParams["object_name"] == "" || searchParams["object_name"] == item.ObjectName) && (searchParams["doer"] == "" || searchParams["doer"] == item.Actor.GetName()) {
+			if item.checkTimeRange(from, until) && (searchParams["action"] == "" || searchParams["action"] == item.Action) && (searchParams["object_type"] == "" || searchParams["object_type"] == item.ObjectType) && (searchParams["object_name"] == "" || searchParams["object_name"] == item.ObjectName) && (searchParams["doer"] == "" || (item.Actor != nil && searchParams["doer"] == item.Actor.GetName())) {
 				item.ID = i
 				lis[n] = item
 				n++
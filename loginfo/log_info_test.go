@@ -23,6 +23,8 @@ import (
 	"github.com/ctdk/goiardi/client"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/indexer"
+	"strings"
 	"testing"
 	"time"
 )
@@ -131,3 +133,45 @@ func TestSkipLogExtended(t *testing.T) {
 		}
 	}
 }
+
+func TestLogAuthFailure(t *testing.T) {
+	config.Config.LogEvents = true
+	indexer.Initialize(config.Config)
+	c, _ := client.New("auth-failer")
+	c.Save()
+	if err := LogAuthFailure("auth-failer", "192.0.2.1", "bad signature"); err != nil {
+		t.Error(err)
+	}
+	if err := LogAuthFailure("nobody-at-all", "192.0.2.2", "no such client or user"); err != nil {
+		t.Error(err)
+	}
+	searchParams := map[string]string{"action": "auth_failure", "object_type": AuthFailureObjectType}
+	failures, err := GetLogInfos(searchParams, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failures) != 2 {
+		t.Fatalf("expected 2 authentication failures, got %d", len(failures))
+	}
+	for _, le := range failures {
+		switch le.ObjectName {
+		case "auth-failer":
+			if le.ActorType != "client" || le.Actor == nil {
+				t.Errorf("auth-failer's failure should have had a client actor, got %s", le.ActorType)
+			}
+			if !strings.Contains(le.ExtendedInfo, "192.0.2.1") || !strings.Contains(le.ExtendedInfo, "bad signature") {
+				t.Errorf("the address and reason weren't logged: %s", le.ExtendedInfo)
+			}
+		case "nobody-at-all":
+			if le.ActorType != "unknown" || le.Actor != nil {
+				t.Errorf("nobody-at-all's failure should have had an unknown actor, got %s", le.ActorType)
+			}
+		default:
+			t.Errorf("unexpected failure for %s", le.ObjectName)
+		}
+	}
+	searchParams = map[string]string{"doer": "auth-failer"}
+	if _, err = GetLogInfos(searchParams, 0); err != nil {
+		t.Errorf("searching by doer with unknown actors failed: %s", err.Error())
+	}
+}
@@ -35,11 +35,15 @@ func (le *LogInfo) writeEventSQL() error {
 	if err != nil {
 		return err
 	}
-	typeTable := fmt.Sprintf("%ss", le.ActorType)
-	actorID, err := datastore.CheckForOne(tx, typeTable, le.Actor.GetName())
-	if err != nil {
-		tx.Rollback()
-		return err
+	// failed authentication attempts may not have a real actor
+	var actorID int32 = -1
+	if le.Actor != nil {
+		typeTable := fmt.Sprintf("%ss", le.ActorType)
+		actorID, err = datastore.CheckForOne(tx, typeTable, le.Actor.GetName())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
 	err = le.actualWriteEventSQL(tx, actorID)
 	if err != nil {
@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Availability and uptime figures computed from node status history.
+
+package node
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ctdk/goiardi/datastore"
+)
+
+// Availability summarizes a node's up and down time over a window of time.
+// Durations are given in seconds. Time before the node's first status in the
+// window, or while it was "new", is counted as unknown rather than up or
+// down, and the uptime percentage is only figured from the known time.
+type Availability struct {
+	NodeName      string    `json:"node_name"`
+	Environment   string    `json:"chef_environment"`
+	From          time.Time `json:"from"`
+	Until         time.Time `json:"until"`
+	Uptime        float64   `json:"uptime_percent"`
+	UpTime        float64   `json:"up_seconds"`
+	DownTime      float64   `json:"down_seconds"`
+	UnknownTime   float64   `json:"unknown_seconds"`
+	Failures      int       `json:"failures"`
+	MTBF          float64   `json:"mtbf_seconds"`
+	CurrentStatus string    `json:"current_status"`
+	CurrentOutage float64   `json:"current_outage_seconds"`
+}
+
+// AvailabilitySummary rolls up the availability of a group of nodes.
+type AvailabilitySummary struct {
+	From         time.Time       `json:"from"`
+	Until        time.Time       `json:"until"`
+	NodeCount    int             `json:"node_count"`
+	NodesUp      int             `json:"nodes_up"`
+	NodesDown    int             `json:"nodes_down"`
+	NodesUnknown int             `json:"nodes_unknown"`
+	Uptime       float64         `json:"uptime_percent"`
+	Failures     int             `json:"failures"`
+	MTBF         float64         `json:"mtbf_seconds"`
+	Nodes        []*Availability `json:"nodes"`
+}
+
+// Availability computes the node's availability between the two given times
+// from its stored statuses. A window running into the future stops at now.
+func (n *Node) Availability(from, until time.Time) (*Availability, error) {
+	now := time.Now()
+	until = clampUntil(until, now)
+	if !until.After(from) {
+		err := fmt.Errorf("end of availability window %s is not after the start %s", until, from)
+		return nil, err
+	}
+	statuses, err := n.AllStatuses()
+	// a node with no statuses at all is just unknown
+	if err != nil && err != datastore.ErrNoStatuses && err != datastore.ErrNoStatusList {
+		return nil, err
+	}
+	return computeAvailability(n, statuses, from, until, now), nil
+}
+
+// Nothing's known about the node's status after now, so counting the rest of
+// the window as unknown time would drag the uptime down for no reason.
+func clampUntil(until, now time.Time) time.Time {
+	if until.After(now) {
+		return now
+	}
+	return until
+}
+
+func computeAvailability(n *Node, statuses []*NodeStatus, from, until, now time.Time) *Availability {
+	a := &Availability{NodeName: n.Name, Environment: n.ChefEnvironment, From: from, Until: until, CurrentStatus: "unknown"}
+	sort.Sort(ByTime(statuses))
+
+	// What the node was doing when the window opened, if we know.
+	state := "unknown"
+	stateStart := from
+	var i int
+	for i = 0; i < len(statuses) && !statuses[i].UpdatedAt.After(from); i++ {
+		state = liveness(statuses[i].Status)
+	}
+
+	addTime := func(st string, d time.Duration) {
+		switch st {
+		case "up":
+			a.UpTime += d.Seconds()
+		case "down":
+			a.DownTime += d.Seconds()
+		default:
+			a.UnknownTime += d.Seconds()
+		}
+	}
+
+	for ; i < len(statuses) && statuses[i].UpdatedAt.Before(until); i++ {
+		newState := liveness(statuses[i].Status)
+		if newState == state {
+			// with serf, every heartbeat gets recorded
+			continue
+		}
+		addTime(state, statuses[i].UpdatedAt.Sub(stateStart))
+		if state == "up" && newState == "down" {
+			a.Failures++
+		}
+		state = newState
+		stateStart = statuses[i].UpdatedAt
+	}
+	addTime(state, until.Sub(stateStart))
+
+	if known := a.UpTime + a.DownTime; known > 0 {
+		a.Uptime = a.UpTime / known * 100
+	}
+	if a.Failures > 0 {
+		a.MTBF = a.UpTime / float64(a.Failures)
+	}
+
+	// The current status and outage go by everything we know, not just
+	// the window.
+	if len(statuses) > 0 {
+		latest := statuses[len(statuses)-1]
+		a.CurrentStatus = latest.Status
+		if latest.Status == "down" {
+			downSince := latest.UpdatedAt
+			for j := len(statuses) - 1; j >= 0 && statuses[j].Status == "down"; j-- {
+				downSince = statuses[j].UpdatedAt
+			}
+			a.CurrentOutage = now.Sub(downSince).Seconds()
+		}
+	}
+	return a
+}
+
+// Nodes that are "new" haven't been heard from yet, so we don't know whether
+// they're up or down.
+func liveness(status string) string {
+	if status == "up" || status == "down" {
+		return status
+	}
+	return "unknown"
+}
+
+// SummarizeAvailability computes the availability of each of the given nodes
+// between the two times, and rolls them up into a summary for the whole
+// group. The summary's uptime is figured from the total known up and down
+// time of all the nodes, so nodes that were around longer count for more.
+func SummarizeAvailability(nodes []*Node, from, until time.Time) (*AvailabilitySummary, error) {
+	until = clampUntil(until, time.Now())
+	summary := &AvailabilitySummary{From: from, Until: until, NodeCount: len(nodes), Nodes: make([]*Availability, 0, len(nodes))}
+	var up, down float64
+	for _, n := range nodes {
+		a, err := n.Availability(from, until)
+		if err != nil {
+			return nil, err
+		}
+		switch a.CurrentStatus {
+		case "up":
+			summary.NodesUp++
+		case "down":
+			summary.NodesDown++
+		default:
+			summary.NodesUnknown++
+		}
+		up += a.UpTime
+		down += a.DownTime
+		summary.Failures += a.Failures
+		summary.Nodes = append(summary.Nodes, a)
+	}
+	if up+down > 0 {
+		summary.Uptime = up / (up + down) * 100
+	}
+	if summary.Failures > 0 {
+		summary.MTBF = up / float64(summary.Failures)
+	}
+	return summary, nil
+}
+
+// HasRole returns true if the node has the given role, either in its run list
+// or in the expanded list of roles from its last chef-client run.
+func (n *Node) HasRole(role string) bool {
+	rr := fmt.Sprintf("role[%s]", role)
+	for _, r := range n.RunList {
+		if r == rr {
+			return true
+		}
+	}
+	if roles, ok := n.Automatic["roles"].([]interface{}); ok {
+		for _, r := range roles {
+			if r == role {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Tracking node liveness from chef-client check-ins, for when serf isn't
+// available to tell us whether nodes are up or down.
+
+package node
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+)
+
+// CheckIn records that the node has been heard from, marking it as up. It
+// does nothing unless goiardi is tracking node liveness from check-ins.
+func (n *Node) CheckIn() error {
+	if !config.Config.NodeCheckIns {
+		return nil
+	}
+	return n.UpdateStatus("up")
+}
+
+// StaleAfter returns how long the node can go without checking in before it's
+// considered to be down. Thresholds set for the node's environment win over
+// the general one.
+func (n *Node) StaleAfter() time.Duration {
+	if d, ok := config.Config.EnvStaleDurs[n.ChefEnvironment]; ok {
+		return d
+	}
+	return config.Config.NodeStaleDur
+}
+
+// OhaiTime returns the node's ohai_time automatic attribute, the time of the
+// last chef-client run that saved the node, or zero if it isn't set.
+func (n *Node) OhaiTime() float64 {
+	switch ot := n.Automatic["ohai_time"].(type) {
+	case float64:
+		return ot
+	case json.Number:
+		f, _ := ot.Float64()
+		return f
+	case int:
+		return float64(ot)
+	case int64:
+		return float64(ot)
+	}
+	return 0
+}
+
+func minStaleAfter() time.Duration {
+	m := config.Config.NodeStaleDur
+	for _, d := range config.Config.EnvStaleDurs {
+		if d < m {
+			m = d
+		}
+	}
+	return m
+}
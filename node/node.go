@@ -296,8 +296,7 @@ func (n *Node) Delete() error {
 	} else {
 		ds := datastore.New()
 		ds.Delete("node", n.Name)
-		// TODO: This may need a different config flag?
-		if config.Config.UseSerf {
+		if config.TrackingNodeStatus() {
 			n.deleteStatuses()
 		}
 	}
@@ -381,6 +380,16 @@ func AllNodes() []*Node {
 	return nodes
 }
 
+// Reencrypt encrypts the attributes of up to limit nodes that were saved with an
+// older data encryption master key again with the current key, returning how
+// many were done. Nodes are only encrypted with an SQL backend.
+func Reencrypt(limit int) (int, error) {
+	if !config.UsingDB() {
+		return 0, nil
+	}
+	return reencryptSQL(limit)
+}
+
 // Count returns a count of all nodes on this server.
 func Count() int64 {
 	if config.UsingDB() {
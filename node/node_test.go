@@ -19,6 +19,7 @@ package node
 
 import (
 	"encoding/gob"
+	"encoding/json"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
 	"github.com/ctdk/goiardi/indexer"
@@ -121,3 +122,132 @@ func TestNodeStatusDelete(t *testing.T) {
 		t.Errorf("expected to have %d statuses left, but there were %d", nStats-del, len(an))
 	}
 }
+
+func TestNodeCheckIns(t *testing.T) {
+	defer func() {
+		config.Config.NodeCheckIns = false
+		config.Config.NodeStaleDur = 0
+		config.Config.EnvStaleDurs = nil
+	}()
+	gob.Register(new(NodeStatus))
+	n, _ := New("checking_in")
+	n.Save()
+	if err := n.CheckIn(); err != nil {
+		t.Error(err)
+	}
+	if _, err := n.LatestStatus(); err == nil {
+		t.Errorf("CheckIn should not have recorded a status with check-ins disabled")
+	}
+
+	config.Config.NodeCheckIns = true
+	config.Config.NodeStaleDur = time.Hour
+	config.Config.EnvStaleDurs = map[string]time.Duration{"production": 10 * time.Minute}
+	if err := n.CheckIn(); err != nil {
+		t.Error(err)
+	}
+	ns, err := n.LatestStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.Status != "up" {
+		t.Errorf("node status should have been 'up' after checking in, got %s", ns.Status)
+	}
+	if n.StaleAfter() != time.Hour {
+		t.Errorf("expected the default staleness threshold of 1h, got %s", n.StaleAfter())
+	}
+
+	// check in 30 minutes ago, which is stale for production but not
+	// for _default.
+	ds := datastore.New()
+	ds.SetNodeStatus(n.Name, &NodeStatus{Node: n, Status: "up", UpdatedAt: time.Now().Add(-30 * time.Minute)})
+	if unseenNode(t, n.Name) {
+		t.Errorf("node %s in _default should not have been stale yet", n.Name)
+	}
+	n.ChefEnvironment = "production"
+	n.Save()
+	if n.StaleAfter() != 10*time.Minute {
+		t.Errorf("expected production's staleness threshold of 10m, got %s", n.StaleAfter())
+	}
+	if !unseenNode(t, n.Name) {
+		t.Errorf("node %s in production should have been stale", n.Name)
+	}
+
+	n.Automatic["ohai_time"] = json.Number("1500000000.5")
+	if n.OhaiTime() != 1500000000.5 {
+		t.Errorf("ohai_time should have been 1500000000.5, got %f", n.OhaiTime())
+	}
+}
+
+func unseenNode(t *testing.T, name string) bool {
+	unseen, err := UnseenNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range unseen {
+		if u.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAvailability(t *testing.T) {
+	n, _ := New("available")
+	now := time.Now()
+	from := now.Add(-10 * time.Hour)
+	at := func(h time.Duration) time.Time { return from.Add(h * time.Hour) }
+	// unknown for the first hour, then up, down for an hour, up again
+	// with a repeated heartbeat, then down for the last two hours
+	statuses := []*NodeStatus{
+		{Node: n, Status: "down", UpdatedAt: at(7)},
+		{Node: n, Status: "up", UpdatedAt: at(1)},
+		{Node: n, Status: "down", UpdatedAt: at(3)},
+		{Node: n, Status: "up", UpdatedAt: at(4)},
+		{Node: n, Status: "up", UpdatedAt: at(5)},
+		{Node: n, Status: "down", UpdatedAt: at(8)},
+	}
+	a := computeAvailability(n, statuses, from, at(9), now)
+	if a.UnknownTime != time.Hour.Seconds() {
+		t.Errorf("expected 1 hour of unknown time, got %f seconds", a.UnknownTime)
+	}
+	if a.UpTime != (5 * time.Hour).Seconds() {
+		t.Errorf("expected 5 hours up, got %f seconds", a.UpTime)
+	}
+	if a.DownTime != (3 * time.Hour).Seconds() {
+		t.Errorf("expected 3 hours down, got %f seconds", a.DownTime)
+	}
+	if a.Failures != 2 {
+		t.Errorf("expected 2 failures, got %d", a.Failures)
+	}
+	if a.Uptime != 62.5 {
+		t.Errorf("expected 62.5%% uptime, got %f", a.Uptime)
+	}
+	if a.MTBF != (150 * time.Minute).Seconds() {
+		t.Errorf("expected a 2.5 hour MTBF, got %f seconds", a.MTBF)
+	}
+	if a.CurrentStatus != "down" || a.CurrentOutage != (3*time.Hour).Seconds() {
+		t.Errorf("expected to be down for 3 hours, got %s for %f seconds", a.CurrentStatus, a.CurrentOutage)
+	}
+
+	empty, _ := New("never_heard_from")
+	empty.Save()
+	summary, err := SummarizeAvailability([]*Node{empty}, from, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.NodesUnknown != 1 || summary.Uptime != 0 {
+		t.Errorf("a node with no statuses should be unknown, got %+v", summary)
+	}
+
+	// a window running into the future stops at now
+	a, err = empty.Availability(from, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Until.After(time.Now()) {
+		t.Errorf("end of the availability window %s should not have been in the future", a.Until)
+	}
+	if a.UnknownTime > (10*time.Hour + time.Minute).Seconds() {
+		t.Errorf("time after now shouldn't have counted as unknown, got %f seconds", a.UnknownTime)
+	}
+}
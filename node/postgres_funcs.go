@@ -23,11 +23,15 @@ import (
 	"strings"
 )
 
-func (n *Node) savePostgreSQL(tx datastore.Dbhandle, rlb, aab, nab, dab, oab []byte) error {
+func (n *Node) savePostgreSQL(tx datastore.Dbhandle, rlb, aab, nab, dab, oab []byte, keyID string) error {
 	_, err := tx.Exec("SELECT goiardi.merge_nodes($1, $2, $3, $4, $5, $6, $7)", n.Name, n.ChefEnvironment, rlb, aab, nab, dab, oab)
 	if err != nil {
 		return err
 	}
+	_, err = tx.Exec("UPDATE goiardi.nodes SET enc_key_id = $1 WHERE name = $2", keyID, n.Name)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -22,6 +22,7 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datacrypt"
 	"github.com/ctdk/goiardi/datastore"
 	"log"
 	"strings"
@@ -63,19 +64,19 @@ func (n *Node) fillNodeFromSQL(row datastore.ResRow) error {
 	if err != nil {
 		return err
 	}
-	err = datastore.DecodeBlob(aa, &n.Automatic)
+	err = datacrypt.DecodeBlob(aa, &n.Automatic, attrContext(n.Name, "automatic"))
 	if err != nil {
 		return err
 	}
-	err = datastore.DecodeBlob(na, &n.Normal)
+	err = datacrypt.DecodeBlob(na, &n.Normal, attrContext(n.Name, "normal"))
 	if err != nil {
 		return err
 	}
-	err = datastore.DecodeBlob(da, &n.Default)
+	err = datacrypt.DecodeBlob(da, &n.Default, attrContext(n.Name, "default"))
 	if err != nil {
 		return err
 	}
-	err = datastore.DecodeBlob(oa, &n.Override)
+	err = datacrypt.DecodeBlob(oa, &n.Override, attrContext(n.Name, "override"))
 	if err != nil {
 		return err
 	}
@@ -152,25 +153,36 @@ func getMultiSQL(nodeNames []string) ([]*Node, error) {
 	return nodes, nil
 }
 
+// the attributes in the order they're kept in the nodes table
+var attrNames = []string{"automatic", "normal", "default", "override"}
+
+// attrContext names a node's attributes for datacrypt, so one node's encrypted
+// attributes can't be passed off as another's.
+func attrContext(nodeName string, attr string) string {
+	return fmt.Sprintf("node:%s:%s", nodeName, attr)
+}
+
 func (n *Node) saveSQL() error {
 	// prepare the complex structures for saving
 	rlb, rlerr := datastore.EncodeBlob(&n.RunList)
 	if rlerr != nil {
 		return rlerr
 	}
-	aab, aaerr := datastore.EncodeBlob(&n.Automatic)
+	// the attributes are encrypted, if that's turned on, but the run
+	// list isn't
+	aab, keyID, aaerr := datacrypt.EncodeBlob(&n.Automatic, attrContext(n.Name, "automatic"))
 	if aaerr != nil {
 		return aaerr
 	}
-	nab, naerr := datastore.EncodeBlob(&n.Normal)
+	nab, _, naerr := datacrypt.EncodeBlob(&n.Normal, attrContext(n.Name, "normal"))
 	if naerr != nil {
 		return naerr
 	}
-	dab, daerr := datastore.EncodeBlob(&n.Default)
+	dab, _, daerr := datacrypt.EncodeBlob(&n.Default, attrContext(n.Name, "default"))
 	if daerr != nil {
 		return daerr
 	}
-	oab, oaerr := datastore.EncodeBlob(&n.Override)
+	oab, _, oaerr := datacrypt.EncodeBlob(&n.Override, attrContext(n.Name, "override"))
 	if oaerr != nil {
 		return oaerr
 	}
@@ -180,9 +192,9 @@ func (n *Node) saveSQL() error {
 		return err
 	}
 	if config.Config.UseMySQL {
-		err = n.saveMySQL(tx, rlb, aab, nab, dab, oab)
+		err = n.saveMySQL(tx, rlb, aab, nab, dab, oab, keyID)
 	} else if config.Config.UsePostgreSQL {
-		err = n.savePostgreSQL(tx, rlb, aab, nab, dab, oab)
+		err = n.savePostgreSQL(tx, rlb, aab, nab, dab, oab, keyID)
 	}
 	if err != nil {
 		tx.Rollback()
@@ -192,6 +204,72 @@ func (n *Node) saveSQL() error {
 	return nil
 }
 
+// reencryptSQL encrypts the attributes of up to limit nodes that were saved
+// with an older master key again with the current key, or decrypts them if
+// encryption has been turned off. Each node is locked while it's being done so
+// a chef-client run saving it at the same time doesn't get overwritten.
+func reencryptSQL(limit int) (int, error) {
+	var listStmt, getStmt, updateStmt string
+	if config.Config.UseMySQL {
+		listStmt = "SELECT id FROM nodes WHERE enc_key_id <> ? LIMIT ?"
+		getStmt = "SELECT name, automatic_attr, normal_attr, default_attr, override_attr, enc_key_id FROM nodes WHERE id = ? FOR UPDATE"
+		updateStmt = "UPDATE nodes SET automatic_attr = ?, normal_attr = ?, default_attr = ?, override_attr = ?, enc_key_id = ? WHERE id = ?"
+	} else if config.Config.UsePostgreSQL {
+		listStmt = "SELECT id FROM goiardi.nodes WHERE enc_key_id <> $1 LIMIT $2"
+		getStmt = "SELECT name, automatic_attr, normal_attr, default_attr, override_attr, enc_key_id FROM goiardi.nodes WHERE id = $1 FOR UPDATE"
+		updateStmt = "UPDATE goiardi.nodes SET automatic_attr = $1, normal_attr = $2, default_attr = $3, override_attr = $4, enc_key_id = $5 WHERE id = $6"
+	}
+	rows, err := datastore.Dbh.Query(listStmt, datacrypt.CurrentKeyID(), limit)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int32
+	for rows.Next() {
+		var id int32
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		tx, err := datastore.Dbh.Begin()
+		if err != nil {
+			return n, err
+		}
+		attrs := make([][]byte, len(attrNames))
+		var name, oldKeyID string
+		err = tx.QueryRow(getStmt, id).Scan(&name, &attrs[0], &attrs[1], &attrs[2], &attrs[3], &oldKeyID)
+		if err == sql.ErrNoRows || (err == nil && !datacrypt.NeedsReencrypt(oldKeyID)) {
+			// deleted or saved again in the meantime
+			tx.Rollback()
+			continue
+		} else if err != nil {
+			tx.Rollback()
+			return n, err
+		}
+		var keyID string
+		for i, a := range attrs {
+			if attrs[i], keyID, err = datacrypt.Reencrypt(a, attrContext(name, attrNames[i])); err != nil {
+				tx.Rollback()
+				return n, fmt.Errorf("re-encrypting the attributes of node id %d: %s", id, err.Error())
+			}
+		}
+		if _, err = tx.Exec(updateStmt, attrs[0], attrs[1], attrs[2], attrs[3], keyID, id); err != nil {
+			tx.Rollback()
+			return n, err
+		}
+		tx.Commit()
+		n++
+	}
+	return n, nil
+}
+
 func (n *Node) deleteSQL() error {
 	tx, err := datastore.Dbh.Begin()
 	if err != nil {
@@ -440,20 +518,20 @@ func (n *Node) allStatusesSQL() ([]*NodeStatus, error) {
 	return nodeStatuses, nil
 }
 
-func unseenNodesSQL() ([]*Node, error) {
+func unseenNodesSQL(cutoff time.Time) ([]*Node, error) {
 	var nodes []*Node
 	var sqlStmt string
 	if config.Config.UseMySQL {
-		sqlStmt = "select n.name, chef_environment, n.run_list, n.automatic_attr, n.normal_attr, n.default_attr, n.override_attr from nodes n join node_statuses ns on n.id = ns.node_id where is_down = 0 group by n.id having max(ns.updated_at) < date_sub(now(), interval 10 minute)"
+		sqlStmt = "select n.name, chef_environment, n.run_list, n.automatic_attr, n.normal_attr, n.default_attr, n.override_attr from nodes n join node_statuses ns on n.id = ns.node_id where is_down = 0 group by n.id having max(ns.updated_at) < ?"
 	} else if config.Config.UsePostgreSQL {
-		sqlStmt = "select n.name, chef_environment, n.run_list, n.automatic_attr, n.normal_attr, n.default_attr, n.override_attr from goiardi.node_latest_statuses n where n.is_down = false AND n.updated_at < now() - interval '10 minute'"
+		sqlStmt = "select n.name, chef_environment, n.run_list, n.automatic_attr, n.normal_attr, n.default_attr, n.override_attr from goiardi.node_latest_statuses n where n.is_down = false AND n.updated_at < $1"
 	}
 	stmt, err := datastore.Dbh.Prepare(sqlStmt)
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
-	rows, qerr := stmt.Query()
+	rows, qerr := stmt.Query(cutoff)
 	if qerr != nil {
 		if qerr == sql.ErrNoRows {
 			return nodes, nil
@@ -155,20 +155,34 @@ func (ns *NodeStatus) ToJSON() map[string]string {
 	return nsmap
 }
 
-// UnseenNodes returns all nodes that have not sent status reports for a while.
+// UnseenNodes returns all nodes that have not sent status reports or checked
+// in for longer than their staleness threshold.
 func UnseenNodes() ([]*Node, error) {
+	now := time.Now()
 	if config.UsingDB() {
-		return unseenNodesSQL()
+		// Get everything past the shortest threshold from the db,
+		// then weed out the nodes in environments with longer ones.
+		nodes, err := unseenNodesSQL(now.Add(-minStaleAfter()))
+		if err != nil || len(config.Config.EnvStaleDurs) == 0 {
+			return nodes, err
+		}
+		var downNodes []*Node
+		for _, n := range nodes {
+			ns, _ := n.LatestStatus()
+			if ns == nil || ns.UpdatedAt.Before(now.Add(-n.StaleAfter())) {
+				downNodes = append(downNodes, n)
+			}
+		}
+		return downNodes, nil
 	}
 	var downNodes []*Node
 	nodes := AllNodes()
-	t := time.Now().Add(-10 * time.Minute)
 	for _, n := range nodes {
 		ns, _ := n.LatestStatus()
 		if ns == nil || n.isDown {
 			continue
 		}
-		if ns.UpdatedAt.Before(t) {
+		if ns.UpdatedAt.Before(now.Add(-n.StaleAfter())) {
 			downNodes = append(downNodes, n)
 		}
 	}
@@ -26,6 +26,7 @@ import (
 	"github.com/ctdk/goiardi/node"
 	"github.com/ctdk/goiardi/reqctx"
 	"github.com/ctdk/goiardi/util"
+	"github.com/tideland/golib/logger"
 	"net/http"
 )
 
@@ -110,6 +111,7 @@ func nodeHandler(w http.ResponseWriter, r *http.Request) {
 		if jsonName == "" {
 			nodeData["name"] = nodeName
 		}
+		oldOhaiTime := chefNode.OhaiTime()
 		nerr := chefNode.UpdateFromJSON(nodeData)
 		if nerr != nil {
 			jsonErrorReport(w, r, nerr.Error(), nerr.Status())
@@ -120,6 +122,13 @@ func nodeHandler(w http.ResponseWriter, r *http.Request) {
 			jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		// A new ohai_time means chef-client actually ran on the node,
+		// rather than someone editing it with knife.
+		if chefNode.OhaiTime() > oldOhaiTime {
+			if err = chefNode.CheckIn(); err != nil {
+				logger.Errorf("Error checking in node %s: %s", chefNode.Name, err.Error())
+			}
+		}
 		if lerr := loginfo.LogEvent(opUser, chefNode, "modify"); lerr != nil {
 			jsonErrorReport(w, r, lerr.Error(), http.StatusInternalServerError)
 			return
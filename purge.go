@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+// Periodic purging of old reports, node statuses, shovey jobs, sandboxes,
+// authentication failure counts, and idle rate limit buckets. The purgers check the configuration every time they run, and are
+// poked when the configuration is reloaded with SIGHUP, so retention settings
+// can be changed without restarting goiardi. Re-encrypting data after the
+// data encryption master key is rotated, and rotating the shovey signing keys,
+// run the same way.
+
+import (
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/databag"
+	"github.com/ctdk/goiardi/datacrypt"
+	"github.com/ctdk/goiardi/lockout"
+	"github.com/ctdk/goiardi/node"
+	"github.com/ctdk/goiardi/ratelimit"
+	"github.com/ctdk/goiardi/report"
+	"github.com/ctdk/goiardi/sandbox"
+	"github.com/ctdk/goiardi/shovey"
+	"github.com/tideland/golib/logger"
+)
+
+type purger struct {
+	name     string
+	enabled  func() bool
+	interval func() time.Duration
+	purge    func() error
+	reload   chan struct{}
+}
+
+var purgers = []*purger{
+	{
+		name: "reports",
+		enabled: func() bool {
+			return config.Config.PurgeReportsDur != 0 || config.Config.PurgeFailedDur != 0 || config.Config.KeepNodeReports > 0
+		},
+		interval: purgeInterval,
+		purge:    purgeReports,
+	},
+	{
+		name: "node statuses",
+		// don't do it if there aren't going to be node statuses to
+		// purge
+		enabled: func() bool {
+			return config.TrackingNodeStatus() && config.Config.PurgeNodeStatusDur != 0
+		},
+		interval: purgeInterval,
+		purge: func() error {
+			del, err := node.DeleteNodeStatusesByAge(config.Config.PurgeNodeStatusDur)
+			if err == nil {
+				logger.Debugf("Purged %d node statuses", del)
+			}
+			return err
+		},
+	},
+	{
+		name: "shovey jobs",
+		enabled: func() bool {
+			return config.Config.PurgeShoveyDur != 0
+		},
+		interval: purgeInterval,
+		purge: func() error {
+			res, err := shovey.PurgeFinished(config.Config.PurgeShoveyDur)
+			if err == nil && res.Jobs > 0 {
+				logger.Infof("Purged %d shovey jobs, with %d node runs and %d output chunks", res.Jobs, res.Runs, res.Streams)
+			}
+			return err
+		},
+	},
+	{
+		name: "sandboxes",
+		enabled: func() bool {
+			return config.Config.PurgeSandboxesDur != 0
+		},
+		// check for sandboxes to purge every hour
+		interval: func() time.Duration { return time.Hour },
+		purge: func() error {
+			del, err := sandbox.Purge(config.Config.PurgeSandboxesDur)
+			if err == nil {
+				logger.Debugf("Purged %d sandboxes", del)
+			}
+			return err
+		},
+	},
+	{
+		name:     "authentication lockouts",
+		enabled:  lockout.Enabled,
+		interval: purgeInterval,
+		purge: func() error {
+			del, err := lockout.Purge()
+			if err == nil {
+				logger.Debugf("Purged %d stale authentication failure counts", del)
+			}
+			return err
+		},
+	},
+	{
+		name:    "rate limit buckets",
+		enabled: ratelimit.Enabled,
+		// buckets fill back up quickly, so check more often
+		interval: func() time.Duration { return time.Minute },
+		purge: func() error {
+			logger.Debugf("Purged %d idle rate limit buckets", ratelimit.Purge())
+			return nil
+		},
+	},
+	{
+		name:    "data re-encryption",
+		enabled: datacrypt.HaveKeys,
+		// done a batch at a time so it doesn't hog the database
+		interval: func() time.Duration { return time.Minute },
+		purge:    reencryptData,
+	},
+	{
+		name: "shovey signing keys",
+		enabled: func() bool {
+			return config.Config.UseShovey
+		},
+		// the keyring's loaded again each time, so keys rotated by
+		// another goiardi server are picked up quickly
+		interval: func() time.Duration { return time.Minute },
+		purge: func() error {
+			kid, err := shovey.RotateSigningKeys()
+			if kid != "" {
+				logger.Infof("Made a new shovey signing key %s", kid)
+			}
+			return err
+		},
+	},
+}
+
+// reencryptBatch is how many nodes and data bag items are encrypted again with
+// a new master key each time.
+const reencryptBatch = 500
+
+func reencryptData() error {
+	n, err := node.Reencrypt(reencryptBatch)
+	if n > 0 {
+		logger.Infof("Re-encrypted the attributes of %d nodes", n)
+	}
+	if err != nil {
+		return err
+	}
+	d, err := databag.Reencrypt(reencryptBatch)
+	if d > 0 {
+		logger.Infof("Re-encrypted %d data bag items", d)
+	}
+	return err
+}
+
+func purgeInterval() time.Duration {
+	return config.Config.PurgeIntervalDur
+}
+
+func purgeReports() error {
+	rp := &report.RetentionPolicy{MaxAge: config.Config.PurgeReportsDur, FailureMaxAge: config.Config.PurgeFailedDur, KeepPerNode: config.Config.KeepNodeReports}
+	res, err := rp.Apply()
+	if err != nil {
+		return err
+	}
+	if res.Total() > 0 {
+		logger.Infof("Purged %d reports: %d by age, %d failed runs by age, %d over the per node limit", res.Total(), res.ByAge, res.FailedByAge, res.OverNodeLimit)
+	}
+	return nil
+}
+
+// startPurgers starts all of the purgers. Purgers that are disabled still run,
+// but skip purging until they're enabled by a configuration reload.
+func startPurgers() {
+	for _, p := range purgers {
+		p.reload = make(chan struct{}, 1)
+		go p.run()
+	}
+}
+
+// reloadPurgers tells the purgers that the configuration has changed, so they
+// can pick up new intervals right away rather than waiting out the old one.
+func reloadPurgers() {
+	for _, p := range purgers {
+		if p.reload == nil {
+			continue
+		}
+		select {
+		case p.reload <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (p *purger) run() {
+	for {
+		t := time.NewTimer(p.interval())
+		select {
+		case <-t.C:
+			if !p.enabled() {
+				continue
+			}
+			if err := p.purge(); err != nil {
+				logger.Errorf("Purging %s had an error: %s", p.name, err.Error())
+			}
+		case <-p.reload:
+			t.Stop()
+			logger.Debugf("Reloaded purge settings for %s", p.name)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package ratelimit limits how fast each client or user can make requests to
+// different families of endpoints, with a token bucket for each actor and
+// family. Limits can be set for everyone, for admins and validators, and for
+// particular actors. Buckets are only kept in memory, so each goiardi server
+// keeps its own counts, and they start over when goiardi restarts.
+package ratelimit
+
+import (
+	"math"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/config"
+	"github.com/raintank/met"
+)
+
+// Endpoint families that can have their own rate limits. Everything not in one
+// of the named families is in FamilyOther.
+const (
+	FamilySearch    = "search"
+	FamilyCookbooks = "cookbooks"
+	FamilyFileStore = "file_store"
+	FamilyReports   = "reports"
+	FamilyOther     = "other"
+)
+
+// Classes of actors that can have their own rate limits.
+const (
+	ClassAdmin     = "admin"
+	ClassValidator = "validator"
+	ClassDefault   = "default"
+)
+
+type bucket struct {
+	limit  string
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+type limiter struct {
+	sync.Mutex
+	buckets map[string]*bucket
+}
+
+var buckets = &limiter{buckets: make(map[string]*bucket)}
+
+type counts struct {
+	allowed met.Count
+	limited met.Count
+}
+
+var metrics map[string]counts
+var bucketGauge met.Gauge
+
+// InitializeMetrics sets up the statsd counts of requests allowed and limited
+// for each endpoint family and class of actor.
+func InitializeMetrics(metricsBackend met.Backend) {
+	m := make(map[string]counts)
+	for _, f := range config.RateLimitFamilies {
+		for _, c := range []string{ClassAdmin, ClassValidator, ClassDefault} {
+			m[f+"."+c] = counts{
+				allowed: metricsBackend.NewCount("ratelimit." + f + "." + c + ".allowed"),
+				limited: metricsBackend.NewCount("ratelimit." + f + "." + c + ".limited"),
+			}
+		}
+	}
+	bucketGauge = metricsBackend.NewGauge("ratelimit.buckets", 0)
+	metrics = m
+}
+
+// Enabled is true if rate limiting is turned on.
+func Enabled() bool {
+	return config.Config.RateLimit.Enable
+}
+
+// Family returns the endpoint family a request path is in.
+func Family(reqPath string) string {
+	p := strings.SplitN(strings.TrimPrefix(path.Clean(reqPath), "/"), "/", 2)
+	switch p[0] {
+	case FamilySearch, FamilyCookbooks, FamilyFileStore, FamilyReports:
+		return p[0]
+	}
+	return FamilyOther
+}
+
+// Class returns the class of actor for rate limits. A nil actor, for requests
+// that aren't made as anyone in particular, is in the default class, as is
+// everyone when goiardi isn't using authentication, since then everyone is an
+// admin.
+func Class(a actor.Actor) string {
+	if a == nil || !config.Config.UseAuth {
+		return ClassDefault
+	}
+	if a.IsAdmin() {
+		return ClassAdmin
+	}
+	if a.IsValidator() {
+		return ClassValidator
+	}
+	return ClassDefault
+}
+
+// Allow takes a request for the named actor from its bucket for the endpoint
+// family. If the bucket is empty, it returns false and how long until there
+// will be room for another request.
+func Allow(name string, class string, family string) (bool, time.Duration) {
+	if !Enabled() {
+		return true, 0
+	}
+	c := class
+	if c == ClassDefault {
+		c = ""
+	}
+	limit := config.Config.RateLimit.LimitFor(name, c, family)
+	allowed, wait := buckets.take(name+"\x00"+family, limit, time.Now())
+	if m, ok := metrics[family+"."+class]; ok {
+		if allowed {
+			m.allowed.Inc(1)
+		} else {
+			m.limited.Inc(1)
+		}
+	}
+	return allowed, wait
+}
+
+func (l *limiter) take(key string, limit string, now time.Time) (bool, time.Duration) {
+	if limit == "" {
+		return true, 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.buckets[key]
+	if !ok || b.limit != limit {
+		// the limit was checked when the configuration was read
+		rl, _ := config.ParseRateLimit(limit)
+		if rl.Unlimited {
+			delete(l.buckets, key)
+			return true, 0
+		}
+		b = &bucket{limit: limit, rate: rl.Rate, burst: float64(rl.Burst), tokens: float64(rl.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
+
+// Purge removes buckets that have filled back up, since a full bucket is the
+// same as not having one at all. Returns the number of buckets removed.
+func Purge() int {
+	return buckets.purge(time.Now())
+}
+
+func (l *limiter) purge(now time.Time) int {
+	l.Lock()
+	defer l.Unlock()
+	n := 0
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(l.buckets, k)
+			n++
+		}
+	}
+	if bucketGauge != nil {
+		bucketGauge.Value(int64(len(l.buckets)))
+	}
+	return n
+}
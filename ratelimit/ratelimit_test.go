@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ctdk/goiardi/client"
+	"github.com/ctdk/goiardi/config"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	good := map[string]config.RateLimit{
+		"10/s":      {Rate: 10, Burst: 10},
+		"60/m:5":    {Rate: 1, Burst: 5},
+		"3600/h":    {Rate: 1, Burst: 3600},
+		"unlimited": {Unlimited: true},
+	}
+	for s, exp := range good {
+		rl, err := config.ParseRateLimit(s)
+		if err != nil {
+			t.Errorf("%s should have parsed, got %s", s, err.Error())
+		} else if rl != exp {
+			t.Errorf("%s parsed as %+v, expected %+v", s, rl, exp)
+		}
+	}
+	for _, s := range []string{"", "10", "10/d", "0/s", "-1/s", "ten/s", "10/s:0", "10/s:x"} {
+		if _, err := config.ParseRateLimit(s); err == nil {
+			t.Errorf("%s should not have parsed", s)
+		}
+	}
+}
+
+func TestFamilyAndClass(t *testing.T) {
+	families := map[string]string{
+		"/search/node":                 FamilySearch,
+		"/search":                      FamilySearch,
+		"/cookbooks/foo/1.0.0":         FamilyCookbooks,
+		"/file_store/abc":              FamilyFileStore,
+		"/reports/nodes/foo/runs":      FamilyReports,
+		"/nodes/foo":                   FamilyOther,
+		"/":                            FamilyOther,
+		"//search/../cookbooks/foo///": FamilyCookbooks,
+	}
+	for p, f := range families {
+		if got := Family(p); got != f {
+			t.Errorf("%s should have been in %s, got %s", p, f, got)
+		}
+	}
+	c, _ := client.New("rl-client")
+	c.Admin = true
+	if Class(c) != ClassDefault {
+		t.Errorf("everyone should be in the default class without authentication")
+	}
+	config.Config.UseAuth = true
+	defer func() { config.Config.UseAuth = false }()
+	c.Admin = false
+	if Class(c) != ClassDefault || Class(nil) != ClassDefault {
+		t.Errorf("a plain client should be in the default class")
+	}
+	c.Validator = true
+	if Class(c) != ClassValidator {
+		t.Errorf("a validator should be in the validator class")
+	}
+	c.Admin = true
+	if Class(c) != ClassAdmin {
+		t.Errorf("an admin should be in the admin class")
+	}
+}
+
+func TestBucket(t *testing.T) {
+	l := &limiter{buckets: make(map[string]*bucket)}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.take("a", "1/s:3", now); !ok {
+			t.Fatalf("request %d should have been allowed", i+1)
+		}
+	}
+	ok, wait := l.take("a", "1/s:3", now)
+	if ok || wait != time.Second {
+		t.Errorf("the fourth request should have waited a second, got %t %s", ok, wait)
+	}
+	if ok, _ = l.take("b", "1/s:3", now); !ok {
+		t.Errorf("another bucket should not have been affected")
+	}
+	if ok, _ = l.take("a", "1/s:3", now.Add(1500*time.Millisecond)); !ok {
+		t.Errorf("the bucket should have refilled")
+	}
+	if ok, _ = l.take("a", "", now); !ok {
+		t.Errorf("no limit should always be allowed")
+	}
+	if ok, _ = l.take("a", "unlimited", now); !ok {
+		t.Errorf("unlimited should always be allowed")
+	}
+	if _, found := l.buckets["a"]; found {
+		t.Errorf("an unlimited bucket should not have been kept")
+	}
+	if n := l.purge(now.Add(time.Minute)); n != 1 {
+		t.Errorf("expected one full bucket to be purged, got %d", n)
+	}
+}
+
+func TestAllow(t *testing.T) {
+	config.Config.RateLimit = config.RateLimitConf{
+		Enable:    true,
+		All:       map[string]string{"search": "1/m:2"},
+		Admin:     map[string]string{"search": "unlimited"},
+		Validator: map[string]string{"other": "1/m:1"},
+		Actors:    map[string]map[string]string{"special": {"search": "1/m:4"}},
+	}
+	defer func() { config.Config.RateLimit = config.RateLimitConf{} }()
+
+	counts := func(name string, class string, family string) int {
+		n := 0
+		for i := 0; i < 10; i++ {
+			if ok, _ := Allow(name, class, family); ok {
+				n++
+			}
+		}
+		return n
+	}
+	checks := []struct {
+		name, class, family string
+		allowed             int
+	}{
+		{"node1", ClassDefault, FamilySearch, 2},
+		{"node2", ClassDefault, FamilySearch, 2},
+		{"node1", ClassDefault, FamilyCookbooks, 10},
+		{"admin", ClassAdmin, FamilySearch, 10},
+		{"chef-validator", ClassValidator, FamilyOther, 1},
+		{"chef-validator", ClassValidator, FamilySearch, 2},
+		{"special", ClassDefault, FamilySearch, 4},
+	}
+	for _, c := range checks {
+		if n := counts(c.name, c.class, c.family); n != c.allowed {
+			t.Errorf("%s (%s) should have been allowed %d %s requests, got %d", c.name, c.class, c.allowed, c.family, n)
+		}
+	}
+	_, wait := Allow("node1", ClassDefault, FamilySearch)
+	if wait <= 0 || wait > time.Minute {
+		t.Errorf("wrong wait: %s", wait)
+	}
+	config.Config.RateLimit.Enable = false
+	if n := counts("node1", ClassDefault, FamilySearch); n != 10 {
+		t.Errorf("nothing should be limited when rate limiting is off, got %d", n)
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package report
+
+// Exporting run reports in formats CI systems and spreadsheets understand.
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export formats for reports.
+const (
+	FormatJSON  = "json"
+	FormatJUnit = "junit"
+	FormatCSV   = "csv"
+)
+
+// ContentType returns the MIME type for the given export format.
+func ContentType(format string) string {
+	switch format {
+	case FormatJUnit:
+		return "application/xml"
+	case FormatCSV:
+		return "text/csv"
+	default:
+		return "application/json"
+	}
+}
+
+// Exception is the error chef-client reported for a failed run, pulled out
+// of the report's data.
+type Exception struct {
+	Class     string
+	Message   string
+	Backtrace []string
+}
+
+// Exception returns the exception from a failed run's data, or nil if there
+// isn't one.
+func (r *Report) Exception() *Exception {
+	exc, ok := r.Data["exception"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	e := &Exception{Class: resString(exc["class"]), Message: resString(exc["message"])}
+	if bt, ok := exc["backtrace"].([]interface{}); ok {
+		for _, b := range bt {
+			e.Backtrace = append(e.Backtrace, resString(b))
+		}
+	}
+	return e
+}
+
+// Duration returns how long the run took, or zero if it hasn't finished.
+func (r *Report) Duration() time.Duration {
+	if r.EndTime.IsZero() || r.EndTime.Before(r.StartTime) {
+		return 0
+	}
+	return r.EndTime.Sub(r.StartTime)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name          `xml:"testsuites"`
+	Suites  []*junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string           `xml:"name,attr"`
+	ID        string           `xml:"id,attr"`
+	Hostname  string           `xml:"hostname,attr"`
+	Tests     int              `xml:"tests,attr"`
+	Failures  int              `xml:"failures,attr"`
+	Errors    int              `xml:"errors,attr"`
+	Time      string           `xml:"time,attr"`
+	Timestamp string           `xml:"timestamp,attr"`
+	Props     []junitProperty  `xml:"properties>property,omitempty"`
+	Cases     []*junitTestCase `xml:"testcase"`
+	SystemErr *junitCharData   `xml:"system-err,omitempty"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:",chardata"`
+}
+
+type junitCharData struct {
+	Body string `xml:",chardata"`
+}
+
+// WriteJUnit writes the given reports out as JUnit XML, with one test suite
+// per run and each of the run's resources as a test case. A failed run gets
+// an extra test case holding the exception chef-client reported, since
+// that's where the useful information about the failure lives.
+func WriteJUnit(w io.Writer, reports []*Report) error {
+	suites := &junitTestSuites{Suites: make([]*junitTestSuite, 0, len(reports))}
+	for _, r := range reports {
+		suites.Suites = append(suites.Suites, r.junitSuite())
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func (r *Report) junitSuite() *junitTestSuite {
+	suite := &junitTestSuite{Name: fmt.Sprintf("chef-client run on %s", r.NodeName), ID: r.RunID, Hostname: r.NodeName, Time: junitSeconds(r.Duration())}
+	if !r.StartTime.IsZero() {
+		suite.Timestamp = r.StartTime.UTC().Format("2006-01-02T15:04:05")
+	}
+	suite.Props = []junitProperty{{Name: "run_id", Value: r.RunID}, {Name: "status", Value: r.Status}, {Name: "run_list", Value: r.RunList}, {Name: "total_res_count", Value: strconv.Itoa(r.TotalResCount)}}
+
+	for _, rc := range r.ResourceChanges() {
+		tc := &junitTestCase{Name: fmt.Sprintf("%s[%s]", rc.Type, rc.Name), ClassName: resourceClassName(rc), Time: junitSeconds(time.Duration(rc.Duration) * time.Millisecond)}
+		if rc.Status == "failed" {
+			tc.Failure = &junitFailure{Message: fmt.Sprintf("%s[%s] failed", rc.Type, rc.Name), Type: "resource"}
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	if r.Status == "failure" {
+		tc := &junitTestCase{Name: "chef-client run", ClassName: "chef_client", Time: suite.Time}
+		f := &junitFailure{Message: "chef-client run failed", Type: "failure"}
+		if e := r.Exception(); e != nil {
+			f.Message = e.Message
+			f.Type = e.Class
+			f.Body = strings.Join(e.Backtrace, "\n")
+			suite.SystemErr = &junitCharData{Body: fmt.Sprintf("%s: %s", e.Class, e.Message)}
+		}
+		tc.Failure = f
+		suite.Cases = append(suite.Cases, tc)
+		suite.Failures++
+	}
+	suite.Tests = len(suite.Cases)
+	return suite
+}
+
+func resourceClassName(rc *ResourceChange) string {
+	if rc.Cookbook == "" {
+		return "chef_client"
+	}
+	if rc.Recipe == "" {
+		return rc.Cookbook
+	}
+	return fmt.Sprintf("%s::%s", rc.Cookbook, rc.Recipe)
+}
+
+func junitSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+var csvHeader = []string{"run_id", "node_name", "status", "start_time", "end_time", "duration", "total_res_count", "updated_res_count", "run_list", "exception"}
+
+// WriteCSV writes a summary of the given reports out as CSV, one run per row
+// after a header row. Times are in RFC 3339 format, and the duration is in
+// seconds.
+func WriteCSV(w io.Writer, reports []*Report) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, r := range reports {
+		var endTime, exc string
+		if !r.EndTime.IsZero() {
+			endTime = r.EndTime.Format(time.RFC3339)
+		}
+		if e := r.Exception(); e != nil {
+			exc = fmt.Sprintf("%s: %s", e.Class, e.Message)
+		}
+		row := []string{r.RunID, r.NodeName, r.Status, r.StartTime.Format(time.RFC3339), endTime, junitSeconds(r.Duration()), strconv.Itoa(r.TotalResCount), strconv.Itoa(r.UpdatedResCount()), r.RunList, exc}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -70,6 +70,29 @@ func (r *Report) savePostgreSQL() error {
 		tx.Rollback()
 		return err
 	}
+	if err = r.saveResourcesSQL(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
 	tx.Commit()
 	return nil
 }
+
+func (rc *ResourceChange) fillResourceChangeFromPostgreSQL(row datastore.ResRow) error {
+	var before, after []byte
+	var st pq.NullTime
+	err := row.Scan(&rc.RunID, &rc.NodeName, &st, &rc.Seq, &rc.Type, &rc.Name, &rc.ID, &rc.Cookbook, &rc.CookbookVersion, &rc.Recipe, &rc.Result, &rc.Status, &rc.Duration, &rc.Delta, &before, &after)
+	if err != nil {
+		return err
+	}
+	if err = datastore.DecodeBlob(before, &rc.Before); err != nil {
+		return err
+	}
+	if err = datastore.DecodeBlob(after, &rc.After); err != nil {
+		return err
+	}
+	if st.Valid {
+		rc.RunStartTime = st.Time
+	}
+	return nil
+}
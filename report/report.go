@@ -451,6 +451,6 @@ func (r *Report) registerMetrics() {
 	if r.Status != "started" {
 		runRunTime.Value(r.EndTime.Sub(r.StartTime))
 		runTotalResCount.Inc(int64(r.TotalResCount))
-		runUpdatedRes.Inc(int64(len(r.Resources)))
+		runUpdatedRes.Inc(int64(r.UpdatedResCount()))
 	}
 }
@@ -17,10 +17,15 @@
 package report
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/gob"
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"github.com/ctdk/goiardi/node"
 	"github.com/pborman/uuid"
+	"strings"
 	"testing"
 	"time"
 )
@@ -144,3 +149,246 @@ func TestReportCleaning(t *testing.T) {
 		t.Errorf("should have had %d reports left after deleting ones older than two weeks, but had %d", len(durations)-gtTwoWeeks, len(z))
 	}
 }
+
+func TestResourceSearch(t *testing.T) {
+	gob.Register(make(map[string]interface{}))
+	gob.Register(make([]interface{}, 0))
+	gob.Register(json.Number(""))
+	dr := AllReports()
+	for _, r := range dr {
+		r.Delete()
+	}
+	resources := []interface{}{
+		map[string]interface{}{"type": "template", "name": "/etc/nginx/nginx.conf", "id": "/etc/nginx/nginx.conf", "duration": "12", "result": "create", "cookbook_name": "nginx", "cookbook_version": "1.0.0", "recipe_name": "default", "before": map[string]interface{}{"checksum": "abc"}, "after": map[string]interface{}{"checksum": "def"}},
+		map[string]interface{}{"type": "package", "name": "openssl", "id": "openssl", "duration": json.Number("3"), "result": "upgrade", "cookbook_name": "base", "recipe_name": "packages"},
+		"not a resource",
+	}
+	for i, nodeName := range []string{"web1", "web2"} {
+		r, _ := New(uuid.New(), nodeName)
+		r.StartTime = time.Now().Add(-time.Duration(i+1) * time.Hour)
+		r.EndTime = r.StartTime.Add(time.Minute)
+		r.Status = "success"
+		r.Resources = resources
+		r.Save()
+	}
+	r, _ := New(uuid.New(), "web3")
+	r.Resources = resources
+	changes := r.ResourceChanges()
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 resource changes, got %d", len(changes))
+	}
+	if changes[0].Duration != 12 || changes[1].Duration != 3 {
+		t.Errorf("durations not normalized correctly: %d, %d", changes[0].Duration, changes[1].Duration)
+	}
+	if changes[0].Before["checksum"] != "abc" || changes[0].After["checksum"] != "def" {
+		t.Errorf("before and after state not carried over: %v %v", changes[0].Before, changes[0].After)
+	}
+
+	rtype, rname, err := ParseResourceSpec("template[/etc/nginx/nginx.conf]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtype != "template" || rname != "/etc/nginx/nginx.conf" {
+		t.Errorf("ParseResourceSpec gave type %q name %q", rtype, rname)
+	}
+	if _, _, err = ParseResourceSpec("openssl"); err == nil {
+		t.Errorf("ParseResourceSpec should have rejected 'openssl'")
+	}
+
+	from := time.Now().Add(-24 * time.Hour)
+	until := time.Now()
+	found, err := SearchResources(&ResourceQuery{Type: rtype, Name: rname, From: from, Until: until, Rows: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Errorf("expected 2 changes to the nginx template, got %d", len(found))
+	}
+	found, _ = SearchResources(&ResourceQuery{Cookbook: "base", NodeName: "web2", From: from, Until: until, Rows: 10})
+	if len(found) != 1 || found[0].Name != "openssl" {
+		t.Errorf("expected 1 openssl change on web2, got %d", len(found))
+	}
+	found, _ = SearchResources(&ResourceQuery{Type: "package", From: time.Now().Add(-90 * time.Minute), Until: until, Rows: 10})
+	if len(found) != 1 {
+		t.Errorf("expected 1 package change in the last 90 minutes, got %d", len(found))
+	}
+	found, _ = SearchResources(&ResourceQuery{From: from, Until: until, Rows: 3})
+	if len(found) != 3 {
+		t.Fatalf("expected the search to be limited to 3 rows, got %d", len(found))
+	}
+	// newest runs first, in the order the resources changed in each run
+	if found[0].NodeName != "web1" || found[0].Seq != 0 || found[1].NodeName != "web1" || found[1].Seq != 1 || found[2].NodeName != "web2" {
+		t.Errorf("resource changes out of order: %s/%d, %s/%d, %s/%d", found[0].NodeName, found[0].Seq, found[1].NodeName, found[1].Seq, found[2].NodeName, found[2].Seq)
+	}
+	// both ends of the time range are included
+	web2, _ := SearchResources(&ResourceQuery{NodeName: "web2", From: from, Until: until, Rows: 10})
+	start := web2[0].RunStartTime
+	found, _ = SearchResources(&ResourceQuery{NodeName: "web2", From: start, Until: start, Rows: 10})
+	if len(found) != 2 {
+		t.Errorf("expected 2 changes from a run starting right at the ends of the time range, got %d", len(found))
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	dr := AllReports()
+	for _, r := range dr {
+		r.Delete()
+	}
+	now := time.Now()
+	day := 24 * time.Hour
+
+	// node "keeper" has six recent successful runs, "failer" has old
+	// failed and successful runs.
+	for i := 0; i < 6; i++ {
+		r, _ := New(uuid.New(), "keeper")
+		r.StartTime = now.Add(-time.Duration(i+1) * time.Hour)
+		r.EndTime = r.StartTime.Add(time.Minute)
+		r.Status = "success"
+		r.Save()
+	}
+	for _, st := range []string{"success", "failure"} {
+		for _, age := range []time.Duration{10 * day, 40 * day} {
+			r, _ := New(uuid.New(), "failer")
+			r.StartTime = now.Add(-age)
+			r.EndTime = r.StartTime.Add(time.Minute)
+			r.Status = st
+			r.Save()
+		}
+	}
+
+	// runs that never finished go by when they started
+	for _, age := range []time.Duration{2 * day, 10 * day} {
+		r, _ := New(uuid.New(), "unfinished")
+		r.StartTime = now.Add(-age)
+		r.Save()
+	}
+
+	rp := &RetentionPolicy{MaxAge: 7 * day, FailureMaxAge: 30 * day, KeepPerNode: 4}
+	res, err := rp.Apply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ByAge != 3 {
+		t.Errorf("expected 2 successful runs and 1 unfinished run to be purged by age, got %d", res.ByAge)
+	}
+	if res.FailedByAge != 1 {
+		t.Errorf("expected 1 failed run to be purged by age, got %d", res.FailedByAge)
+	}
+	if res.OverNodeLimit != 2 {
+		t.Errorf("expected 2 runs to be purged for being over the per node limit, got %d", res.OverNodeLimit)
+	}
+	if res.Total() != 6 {
+		t.Errorf("expected 6 reports purged in total, got %d", res.Total())
+	}
+
+	remaining := make(map[string][]*Report)
+	for _, r := range AllReports() {
+		remaining[r.NodeName] = append(remaining[r.NodeName], r)
+	}
+	if len(remaining["keeper"]) != 4 {
+		t.Errorf("expected 4 reports left for 'keeper', got %d", len(remaining["keeper"]))
+	}
+	for _, r := range remaining["keeper"] {
+		if r.StartTime.Before(now.Add(-5 * time.Hour)) {
+			t.Errorf("an older report for 'keeper' was kept over a newer one: %s", r.StartTime)
+		}
+	}
+	if len(remaining["unfinished"]) != 1 || remaining["unfinished"][0].StartTime.Before(now.Add(-3*day)) {
+		t.Errorf("expected only the newer unfinished report left for 'unfinished', got %v", remaining["unfinished"])
+	}
+	if len(remaining["failer"]) != 1 || remaining["failer"][0].Status != "failure" {
+		t.Errorf("expected only the newer failed report left for 'failer', got %v", remaining["failer"])
+	}
+}
+
+func TestReportExport(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	ok, _ := New(uuid.New(), "exported")
+	ok.StartTime = start
+	ok.EndTime = start.Add(90 * time.Second)
+	ok.Status = "success"
+	ok.RunList = "recipe[nginx]"
+	ok.Resources = []interface{}{
+		map[string]interface{}{"type": "template", "name": "/etc/nginx/nginx.conf", "duration": "1500", "cookbook_name": "nginx", "recipe_name": "default"},
+		map[string]interface{}{"type": "service", "name": "nginx", "duration": "20", "cookbook_name": "nginx", "recipe_name": "default"},
+	}
+	failed, _ := New(uuid.New(), "exported")
+	failed.StartTime = start.Add(10 * time.Minute)
+	failed.EndTime = failed.StartTime.Add(time.Minute)
+	failed.Status = "failure"
+	failed.RunList = "recipe[nginx]"
+	failed.Data = map[string]interface{}{"exception": map[string]interface{}{"class": "Chef::Exceptions::Exec", "message": "returned 1, expected 0", "backtrace": []interface{}{"foo.rb:1", "bar.rb:2"}}}
+
+	var buf bytes.Buffer
+	if err := WriteJUnit(&buf, []*Report{ok, failed}); err != nil {
+		t.Fatal(err)
+	}
+	var suites struct {
+		Suites []struct {
+			Tests    int `xml:"tests,attr"`
+			Failures int `xml:"failures,attr"`
+			Cases    []struct {
+				Name      string `xml:"name,attr"`
+				ClassName string `xml:"classname,attr"`
+				Time      string `xml:"time,attr"`
+				Failure   *struct {
+					Message string `xml:"message,attr"`
+					Type    string `xml:"type,attr"`
+					Body    string `xml:",chardata"`
+				} `xml:"failure"`
+			} `xml:"testcase"`
+		} `xml:"testsuite"`
+	}
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatalf("JUnit output didn't parse: %s\n%s", err, buf.String())
+	}
+	if len(suites.Suites) != 2 {
+		t.Fatalf("expected 2 test suites, got %d", len(suites.Suites))
+	}
+	s := suites.Suites[0]
+	if s.Tests != 2 || s.Failures != 0 {
+		t.Errorf("successful run should have 2 tests and no failures, got %d and %d", s.Tests, s.Failures)
+	}
+	if s.Cases[0].Name != "template[/etc/nginx/nginx.conf]" || s.Cases[0].ClassName != "nginx::default" || s.Cases[0].Time != "1.500" {
+		t.Errorf("resource test case was wrong: %+v", s.Cases[0])
+	}
+	s = suites.Suites[1]
+	if s.Tests != 1 || s.Failures != 1 {
+		t.Fatalf("failed run should have 1 test and 1 failure, got %d and %d", s.Tests, s.Failures)
+	}
+	f := s.Cases[0].Failure
+	if f == nil || f.Type != "Chef::Exceptions::Exec" || f.Message != "returned 1, expected 0" || f.Body != "foo.rb:1\nbar.rb:2" {
+		t.Errorf("failure wasn't filled in from the exception: %+v", f)
+	}
+
+	buf.Reset()
+	if err := WriteCSV(&buf, []*Report{ok, failed}); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(buf.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected a header and 2 rows of CSV, got %d rows", len(records))
+	}
+	if records[1][2] != "success" || records[1][5] != "90.000" || records[1][7] != "2" {
+		t.Errorf("successful run's CSV row was wrong: %v", records[1])
+	}
+	if records[2][9] != "Chef::Exceptions::Exec: returned 1, expected 0" {
+		t.Errorf("failed run's CSV row didn't have the exception: %v", records[2])
+	}
+}
+
+func TestUpdatedResCount(t *testing.T) {
+	r, _ := New(uuid.New(), "counted")
+	r.Resources = []interface{}{
+		map[string]interface{}{"type": "template", "name": "/etc/motd", "status": "updated"},
+		map[string]interface{}{"type": "package", "name": "curl"},
+		map[string]interface{}{"type": "service", "name": "nginx", "status": "up-to-date"},
+		map[string]interface{}{"type": "execute", "name": "migrate", "status": "failed"},
+	}
+	if c := r.UpdatedResCount(); c != 2 {
+		t.Errorf("expected 2 updated resources, got %d", c)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package report
+
+// Normalized resource changes from run reports, so they can be searched
+// across runs.
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+)
+
+// ResourceChange is a single resource from a run report's resource list,
+// pulled out of the opaque JSON and normalized so it can be searched on.
+type ResourceChange struct {
+	RunID           string                 `json:"run_id"`
+	NodeName        string                 `json:"node_name"`
+	RunStartTime    time.Time              `json:"run_start_time"`
+	Seq             int                    `json:"seq"`
+	Type            string                 `json:"type"`
+	Name            string                 `json:"name"`
+	ID              string                 `json:"id"`
+	Cookbook        string                 `json:"cookbook_name"`
+	CookbookVersion string                 `json:"cookbook_version"`
+	Recipe          string                 `json:"recipe_name"`
+	Result          string                 `json:"result"`
+	Status          string                 `json:"status"`
+	Duration        int64                  `json:"duration"`
+	Delta           string                 `json:"delta"`
+	Before          map[string]interface{} `json:"before"`
+	After           map[string]interface{} `json:"after"`
+}
+
+// ResourceQuery holds the criteria for searching resource changes across
+// runs. Empty string fields match anything.
+type ResourceQuery struct {
+	Type     string
+	Name     string
+	Cookbook string
+	Recipe   string
+	NodeName string
+	From     time.Time
+	Until    time.Time
+	Rows     int
+}
+
+var resourceSpecRe = regexp.MustCompile(`^([\w:]+)\[(.+)\]$`)
+
+// ParseResourceSpec splits a resource given in the usual chef style, like
+// "template[/etc/nginx/nginx.conf]", into its type and name.
+func ParseResourceSpec(spec string) (string, string, error) {
+	m := resourceSpecRe.FindStringSubmatch(spec)
+	if m == nil {
+		err := fmt.Errorf("resource %q is not of the form type[name]", spec)
+		return "", "", err
+	}
+	return m[1], m[2], nil
+}
+
+// ResourceChanges returns the report's resources as a slice of normalized
+// ResourceChange objects. Entries in the resource list that are not JSON
+// objects are skipped.
+func (r *Report) ResourceChanges() []*ResourceChange {
+	changes := make([]*ResourceChange, 0, len(r.Resources))
+	for i, res := range r.Resources {
+		resMap, ok := res.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		rc := &ResourceChange{RunID: r.RunID, NodeName: r.NodeName, RunStartTime: r.StartTime, Seq: i}
+		rc.Type = resString(resMap["type"])
+		rc.Name = resString(resMap["name"])
+		rc.ID = resString(resMap["id"])
+		rc.Cookbook = resString(resMap["cookbook_name"])
+		rc.CookbookVersion = resString(resMap["cookbook_version"])
+		rc.Recipe = resString(resMap["recipe_name"])
+		rc.Result = resString(resMap["result"])
+		rc.Status = resString(resMap["status"])
+		rc.Delta = resString(resMap["delta"])
+		rc.Duration = resInt(resMap["duration"])
+		if b, ok := resMap["before"].(map[string]interface{}); ok {
+			rc.Before = b
+		}
+		if a, ok := resMap["after"].(map[string]interface{}); ok {
+			rc.After = a
+		}
+		changes = append(changes, rc)
+	}
+	return changes
+}
+
+// UpdatedResCount returns how many of the report's resources were updated
+// during the run. Chef only reports resources that changed, along with the one
+// that failed if the run failed, but newer clients may also send ones that
+// were skipped or already up to date.
+func (r *Report) UpdatedResCount() int {
+	n := 0
+	for _, rc := range r.ResourceChanges() {
+		switch rc.Status {
+		case "failed", "skipped", "up-to-date", "unprocessed":
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// Matches returns true if the resource change matches the query's criteria.
+// The time range is checked against the start time of the run the resource
+// change was part of.
+func (rc *ResourceChange) Matches(q *ResourceQuery) bool {
+	if q.Type != "" && q.Type != rc.Type {
+		return false
+	}
+	if q.Name != "" && q.Name != rc.Name {
+		return false
+	}
+	if q.Cookbook != "" && q.Cookbook != rc.Cookbook {
+		return false
+	}
+	if q.Recipe != "" && q.Recipe != rc.Recipe {
+		return false
+	}
+	if q.NodeName != "" && q.NodeName != rc.NodeName {
+		return false
+	}
+	return q.inRange(rc.RunStartTime)
+}
+
+// BackfillResources fills in the searchable resource changes for run reports
+// saved in MySQL or Postgres before resource changes were kept separately, so
+// searching finds resources from older runs as well. It returns how many
+// reports were filled in. With the in-memory data store there's nothing to do,
+// since resource changes are always pulled out of the reports themselves.
+func BackfillResources() (int, error) {
+	if !config.UsingDB() {
+		return 0, nil
+	}
+	return backfillResourcesSQL()
+}
+
+// inRange is true if the time is in the query's time range, including either
+// end, the same as with the SQL backends.
+func (q *ResourceQuery) inRange(t time.Time) bool {
+	return !t.Before(q.From) && !t.After(q.Until)
+}
+
+// SearchResources returns resource changes across all runs matching the given
+// query, up to the number of rows in the query. Changes from the most recent
+// runs come first, and changes from the same run are in the order they
+// happened.
+func SearchResources(q *ResourceQuery) ([]*ResourceChange, error) {
+	if config.UsingDB() {
+		return searchResourcesSQL(q)
+	}
+	var changes []*ResourceChange
+	for _, r := range AllReports() {
+		if !q.inRange(r.StartTime) {
+			continue
+		}
+		if q.NodeName != "" && q.NodeName != r.NodeName {
+			continue
+		}
+		for _, rc := range r.ResourceChanges() {
+			if rc.Matches(q) {
+				changes = append(changes, rc)
+			}
+		}
+	}
+	sort.Sort(byRunStart(changes))
+	if q.Rows > 0 && len(changes) > q.Rows {
+		changes = changes[:q.Rows]
+	}
+	return changes, nil
+}
+
+type byRunStart []*ResourceChange
+
+func (b byRunStart) Len() int      { return len(b) }
+func (b byRunStart) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byRunStart) Less(i, j int) bool {
+	if !b[i].RunStartTime.Equal(b[j].RunStartTime) {
+		return b[i].RunStartTime.After(b[j].RunStartTime)
+	}
+	if b[i].RunID != b[j].RunID {
+		return b[i].RunID < b[j].RunID
+	}
+	return b[i].Seq < b[j].Seq
+}
+
+func resString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// Chef sends the duration as a string of milliseconds, but be accommodating.
+func resInt(v interface{}) int64 {
+	switch v := v.(type) {
+	case string:
+		i, _ := strconv.ParseInt(v, 10, 64)
+		return i
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			f, _ := v.Float64()
+			i = int64(f)
+		}
+		return i
+	case float64:
+		return int64(v)
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	}
+	return 0
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package report
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+)
+
+// RetentionPolicy describes how long run reports are kept before being
+// purged. A zero value for any field means that part of the policy is not
+// applied.
+type RetentionPolicy struct {
+	// MaxAge is how long reports of successful and started runs are kept.
+	MaxAge time.Duration
+	// FailureMaxAge is how long reports of failed runs are kept. If it is
+	// zero, failed runs are kept as long as MaxAge.
+	FailureMaxAge time.Duration
+	// KeepPerNode is the most reports kept for any one node. Older reports
+	// past this number are deleted regardless of their age.
+	KeepPerNode int
+}
+
+// PurgeResult records how many reports a purge pass deleted, and why.
+type PurgeResult struct {
+	ByAge         int `json:"by_age"`
+	FailedByAge   int `json:"failed_by_age"`
+	OverNodeLimit int `json:"over_node_limit"`
+}
+
+// Total returns the total number of reports deleted in the purge pass.
+func (p *PurgeResult) Total() int {
+	return p.ByAge + p.FailedByAge + p.OverNodeLimit
+}
+
+// Apply purges reports according to the retention policy, returning what was
+// deleted.
+func (rp *RetentionPolicy) Apply() (*PurgeResult, error) {
+	res := new(PurgeResult)
+	var err error
+
+	if rp.FailureMaxAge != 0 {
+		if rp.MaxAge != 0 {
+			res.ByAge, err = DeleteByAgeStatus(rp.MaxAge, "started", "success")
+			if err != nil {
+				return res, err
+			}
+		}
+		res.FailedByAge, err = DeleteByAgeStatus(rp.FailureMaxAge, "failure")
+		if err != nil {
+			return res, err
+		}
+	} else if rp.MaxAge != 0 {
+		res.ByAge, err = DeleteByAgeStatus(rp.MaxAge, "started", "success", "failure")
+		if err != nil {
+			return res, err
+		}
+	}
+
+	if rp.KeepPerNode > 0 {
+		res.OverNodeLimit, err = DeleteExcessNodeReports(rp.KeepPerNode)
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// DeleteByAgeStatus deletes reports with one of the given statuses that are
+// older than the given duration. A report's age goes by its end time, or its
+// start time if the run never finished. It returns the number of reports
+// deleted, and an error if any.
+func DeleteByAgeStatus(dur time.Duration, statuses ...string) (int, error) {
+	if config.UsingDB() {
+		return deleteByAgeStatusSQL(dur, statuses)
+	}
+	stat := make(map[string]bool, len(statuses))
+	for _, s := range statuses {
+		stat[s] = true
+	}
+	cutoff := time.Now().Add(-dur)
+	i := 0
+	for _, r := range AllReports() {
+		// runs that never finished have no end time to go by
+		t := r.EndTime
+		if t.Before(r.StartTime) {
+			t = r.StartTime
+		}
+		if stat[r.Status] && t.Before(cutoff) {
+			r.Delete()
+			i++
+		}
+	}
+	return i, nil
+}
+
+// DeleteExcessNodeReports deletes each node's oldest reports beyond the given
+// number to keep. It returns the number of reports deleted, and an error if
+// any.
+func DeleteExcessNodeReports(keep int) (int, error) {
+	if config.UsingDB() {
+		return deleteExcessNodeReportsSQL(keep)
+	}
+	nodeReports := make(map[string][]*Report)
+	for _, r := range AllReports() {
+		nodeReports[r.NodeName] = append(nodeReports[r.NodeName], r)
+	}
+	i := 0
+	for _, reports := range nodeReports {
+		if len(reports) <= keep {
+			continue
+		}
+		sort.Sort(sort.Reverse(byStartTime(reports)))
+		for _, r := range reports[keep:] {
+			r.Delete()
+			i++
+		}
+	}
+	return i, nil
+}
+
+type byStartTime []*Report
+
+func (b byStartTime) Len() int           { return len(b) }
+func (b byStartTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byStartTime) Less(i, j int) bool { return b[i].StartTime.Before(b[j].StartTime) }
@@ -24,6 +24,7 @@ import (
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -119,9 +120,9 @@ func deleteByAgeSQL(dur time.Duration) (int, error) {
 
 	var sqlStmt string
 	if config.Config.UseMySQL {
-		sqlStmt = "DELETE FROM reports WHERE end_time >= ?"
+		sqlStmt = "DELETE FROM reports WHERE end_time < ?"
 	} else if config.Config.UsePostgreSQL {
-		sqlStmt = "DELETE FROM goiardi.reports WHERE end_time >= $1"
+		sqlStmt = "DELETE FROM goiardi.reports WHERE end_time < $1"
 	}
 
 	res, err := tx.Exec(sqlStmt, from)
@@ -137,6 +138,105 @@ func deleteByAgeSQL(dur time.Duration) (int, error) {
 	return int(rows), nil
 }
 
+func deleteByAgeStatusSQL(dur time.Duration, statuses []string) (int, error) {
+	if len(statuses) == 0 {
+		return 0, nil
+	}
+	from := time.Now().Add(-dur)
+	args := []interface{}{from}
+	bind := make([]string, len(statuses))
+	for i, st := range statuses {
+		args = append(args, st)
+		if config.Config.UseMySQL {
+			bind[i] = "?"
+		} else {
+			bind[i] = fmt.Sprintf("$%d", i+2)
+		}
+	}
+
+	// Same as with the in-memory reports, runs that never finished go by
+	// when they started.
+	const reportAge = "CASE WHEN end_time IS NULL OR end_time < start_time THEN start_time ELSE end_time END"
+
+	var sqlStmt string
+	if config.Config.UseMySQL {
+		sqlStmt = fmt.Sprintf("DELETE FROM reports WHERE %s < ? AND status IN (%s)", reportAge, strings.Join(bind, ", "))
+	} else if config.Config.UsePostgreSQL {
+		sqlStmt = fmt.Sprintf("DELETE FROM goiardi.reports WHERE %s < $1 AND status IN (%s)", reportAge, strings.Join(bind, ", "))
+	}
+
+	tx, err := datastore.Dbh.Begin()
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(sqlStmt, args...)
+	if err != nil {
+		terr := tx.Rollback()
+		if terr != nil {
+			err = fmt.Errorf("deleting %s reports older than %s had an error '%s', and then rolling back the transaction gave another error '%s'", strings.Join(statuses, ", "), from, err.Error(), terr.Error())
+		}
+		return 0, err
+	}
+	tx.Commit()
+	rows, _ := res.RowsAffected()
+	return int(rows), nil
+}
+
+// MySQL won't let a DELETE have a subquery on the same table with a LIMIT,
+// unless it's wrapped in yet another subquery. Postgres doesn't mind that,
+// so use the same trick for both.
+func deleteExcessNodeReportsSQL(keep int) (int, error) {
+	var nodeStmt, sqlStmt string
+	if config.Config.UseMySQL {
+		nodeStmt = "SELECT node_name FROM reports GROUP BY node_name HAVING count(*) > ?"
+		sqlStmt = "DELETE FROM reports WHERE node_name = ? AND id NOT IN (SELECT id FROM (SELECT id FROM reports WHERE node_name = ? ORDER BY start_time DESC LIMIT ?) AS keepers)"
+	} else if config.Config.UsePostgreSQL {
+		nodeStmt = "SELECT node_name FROM goiardi.reports GROUP BY node_name HAVING count(*) > $1"
+		sqlStmt = "DELETE FROM goiardi.reports WHERE node_name = $1 AND id NOT IN (SELECT id FROM (SELECT id FROM goiardi.reports WHERE node_name = $2 ORDER BY start_time DESC LIMIT $3) AS keepers)"
+	}
+
+	rows, err := datastore.Dbh.Query(nodeStmt, keep)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var nodeNames []string
+	for rows.Next() {
+		var n string
+		if err = rows.Scan(&n); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		nodeNames = append(nodeNames, n)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, n := range nodeNames {
+		tx, err := datastore.Dbh.Begin()
+		if err != nil {
+			return deleted, err
+		}
+		res, err := tx.Exec(sqlStmt, n, n, keep)
+		if err != nil {
+			terr := tx.Rollback()
+			if terr != nil {
+				err = fmt.Errorf("deleting excess reports for node %s had an error '%s', and then rolling back the transaction gave another error '%s'", n, err.Error(), terr.Error())
+			}
+			return deleted, err
+		}
+		tx.Commit()
+		c, _ := res.RowsAffected()
+		deleted += int(c)
+	}
+	return deleted, nil
+}
+
 func getListSQL() []string {
 	var reportList []string
 
@@ -313,3 +413,192 @@ func getReportsSQL() []*Report {
 	}
 	return reports
 }
+
+// Replace the normalized resource changes for this report with the current
+// contents of the report's resources. Called inside the report's save
+// transaction.
+func (r *Report) saveResourcesSQL(tx *sql.Tx) error {
+	var delStmt, insStmt string
+	if config.Config.UseMySQL {
+		delStmt = "DELETE FROM report_resources WHERE run_id = ?"
+		insStmt = "INSERT INTO report_resources (run_id, node_name, seq, resource_type, resource_name, resource_id, cookbook_name, cookbook_version, recipe_name, result, status, duration, delta, before_state, after_state, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())"
+	} else if config.Config.UsePostgreSQL {
+		delStmt = "DELETE FROM goiardi.report_resources WHERE run_id = $1"
+		insStmt = "INSERT INTO goiardi.report_resources (run_id, node_name, seq, resource_type, resource_name, resource_id, cookbook_name, cookbook_version, recipe_name, result, status, duration, delta, before_state, after_state, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, NOW())"
+	}
+	if _, err := tx.Exec(delStmt, r.RunID); err != nil {
+		return err
+	}
+	changes := r.ResourceChanges()
+	if len(changes) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare(insStmt)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, rc := range changes {
+		before, err := datastore.EncodeBlob(&rc.Before)
+		if err != nil {
+			return err
+		}
+		after, err := datastore.EncodeBlob(&rc.After)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.Exec(rc.RunID, rc.NodeName, rc.Seq, rc.Type, rc.Name, rc.ID, rc.Cookbook, rc.CookbookVersion, rc.Recipe, rc.Result, rc.Status, rc.Duration, rc.Delta, before, after)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func backfillResourcesSQL() (int, error) {
+	// An empty resource list is "[]" or "null" once it's encoded, so
+	// anything that short has no resource changes to fill in.
+	var listStmt, lockStmt, countStmt string
+	if config.Config.UseMySQL {
+		listStmt = "SELECT run_id FROM reports r WHERE LENGTH(r.resources) > 5 AND NOT EXISTS (SELECT 1 FROM report_resources rr WHERE rr.run_id = r.run_id)"
+		lockStmt = "SELECT run_id FROM reports WHERE run_id = ? FOR UPDATE"
+		countStmt = "SELECT count(*) FROM report_resources WHERE run_id = ?"
+	} else if config.Config.UsePostgreSQL {
+		listStmt = "SELECT run_id FROM goiardi.reports r WHERE LENGTH(r.resources) > 5 AND NOT EXISTS (SELECT 1 FROM goiardi.report_resources rr WHERE rr.run_id = r.run_id)"
+		lockStmt = "SELECT run_id FROM goiardi.reports WHERE run_id = $1 FOR UPDATE"
+		countStmt = "SELECT count(*) FROM goiardi.report_resources WHERE run_id = $1"
+	}
+
+	rows, err := datastore.Dbh.Query(listStmt)
+	if err != nil {
+		return 0, err
+	}
+	var runIDs []string
+	for rows.Next() {
+		var runID string
+		if err = rows.Scan(&runID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		runIDs = append(runIDs, runID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	filled := 0
+	for _, runID := range runIDs {
+		r, err := getReportSQL(runID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				continue
+			}
+			return filled, err
+		}
+		tx, err := datastore.Dbh.Begin()
+		if err != nil {
+			return filled, err
+		}
+		// Locking the report keeps another goiardi doing the same
+		// thing, or the report being saved again, from filling its
+		// resource changes in twice.
+		var lockedID string
+		var c int
+		err = tx.QueryRow(lockStmt, runID).Scan(&lockedID)
+		if err == nil {
+			err = tx.QueryRow(countStmt, runID).Scan(&c)
+		}
+		if err == nil && c == 0 {
+			err = r.saveResourcesSQL(tx)
+		}
+		if err != nil {
+			tx.Rollback()
+			if err == sql.ErrNoRows {
+				continue
+			}
+			return filled, err
+		}
+		if err = tx.Commit(); err != nil {
+			return filled, err
+		}
+		if c == 0 {
+			filled++
+		}
+	}
+	return filled, nil
+}
+
+func (rc *ResourceChange) fillResourceChangeFromSQL(row datastore.ResRow) error {
+	if config.Config.UseMySQL {
+		return rc.fillResourceChangeFromMySQL(row)
+	} else if config.Config.UsePostgreSQL {
+		return rc.fillResourceChangeFromPostgreSQL(row)
+	}
+	return nil
+}
+
+func searchResourcesSQL(q *ResourceQuery) ([]*ResourceChange, error) {
+	var changes []*ResourceChange
+	var table, reportTable string
+	var bindFmt func(int) string
+
+	if config.Config.UseMySQL {
+		table = "report_resources"
+		reportTable = "reports"
+		bindFmt = func(int) string { return "?" }
+	} else if config.Config.UsePostgreSQL {
+		table = "goiardi.report_resources"
+		reportTable = "goiardi.reports"
+		bindFmt = func(i int) string { return fmt.Sprintf("$%d", i) }
+	}
+
+	where := []string{fmt.Sprintf("r.start_time >= %s", bindFmt(1)), fmt.Sprintf("r.start_time <= %s", bindFmt(2))}
+	args := []interface{}{q.From, q.Until}
+	crit := []struct {
+		col string
+		val string
+	}{
+		{"rr.resource_type", q.Type},
+		{"rr.resource_name", q.Name},
+		{"rr.cookbook_name", q.Cookbook},
+		{"rr.recipe_name", q.Recipe},
+		{"rr.node_name", q.NodeName},
+	}
+	for _, c := range crit {
+		if c.val == "" {
+			continue
+		}
+		args = append(args, c.val)
+		where = append(where, fmt.Sprintf("%s = %s", c.col, bindFmt(len(args))))
+	}
+	args = append(args, q.Rows)
+
+	sqlStmt := fmt.Sprintf("SELECT rr.run_id, rr.node_name, r.start_time, rr.seq, rr.resource_type, rr.resource_name, rr.resource_id, rr.cookbook_name, rr.cookbook_version, rr.recipe_name, rr.result, rr.status, rr.duration, rr.delta, rr.before_state, rr.after_state FROM %s rr JOIN %s r ON rr.run_id = r.run_id WHERE %s ORDER BY r.start_time DESC, rr.run_id, rr.seq LIMIT %s", table, reportTable, strings.Join(where, " AND "), bindFmt(len(args)))
+
+	stmt, err := datastore.Dbh.Prepare(sqlStmt)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return changes, nil
+		}
+		return nil, err
+	}
+	for rows.Next() {
+		rc := new(ResourceChange)
+		if err = rc.fillResourceChangeFromSQL(rows); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		changes = append(changes, rc)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
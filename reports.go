@@ -19,12 +19,15 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/ctdk/goiardi/node"
 	"github.com/ctdk/goiardi/report"
 	"github.com/ctdk/goiardi/reqctx"
 	"github.com/ctdk/goiardi/util"
+	"github.com/tideland/golib/logger"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -63,6 +66,9 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 	pathArray := splitPath(r.URL.Path)
 	pathArrayLen := len(pathArray)
 	reportResponse := make(map[string]interface{})
+	// reports to export when something other than JSON was asked for
+	var exportRuns []*report.Report
+	format := report.FormatJSON
 
 	switch r.Method {
 	case http.MethodHead:
@@ -140,11 +146,18 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		var ferr error
+		format, ferr = reportFormat(r)
+		if ferr != nil {
+			jsonErrorReport(w, r, ferr.Error(), http.StatusNotAcceptable)
+			return
+		}
+
 		if !opUser.IsAdmin() {
 			jsonErrorReport(w, r, "You are not allowed to perform this action", http.StatusForbidden)
 			return
 		}
-		if pathArrayLen < 3 || pathArrayLen > 4 {
+		if pathArrayLen < 3 || pathArrayLen > 5 || (pathArrayLen == 5 && pathArray[1] != "nodes") {
 			jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
 			return
 		}
@@ -157,6 +170,57 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			reportResponse["run_history"] = runs
+			exportRuns = runs
+		} else if op == "nodes" && pathArrayLen == 5 {
+			nodeName := pathArray[2]
+			runID := pathArray[4]
+			run, err := report.Get(runID)
+			if err != nil {
+				jsonErrorReport(w, r, err.Error(), err.Status())
+				return
+			}
+			if run.NodeName != nodeName {
+				jsonErrorReport(w, r, fmt.Sprintf("run %s not found for node %s", runID, nodeName), http.StatusNotFound)
+				return
+			}
+			reportResponse = formatRunShow(run)
+			exportRuns = []*report.Report{run}
+		} else if op == "org" && pathArray[2] == "resources" {
+			if pathArrayLen != 3 {
+				jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+				return
+			}
+			if format != report.FormatJSON {
+				jsonErrorReport(w, r, "resource searches can only be returned as JSON", http.StatusNotAcceptable)
+				return
+			}
+			q := &report.ResourceQuery{From: from, Until: until, Rows: rows}
+			if spec := r.Form.Get("resource"); spec != "" {
+				var perr error
+				q.Type, q.Name, perr = report.ParseResourceSpec(spec)
+				if perr != nil {
+					jsonErrorReport(w, r, perr.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if t := r.Form.Get("type"); t != "" {
+				q.Type = t
+			}
+			if n := r.Form.Get("name"); n != "" {
+				q.Name = n
+			}
+			q.Cookbook = r.Form.Get("cookbook")
+			q.Recipe = r.Form.Get("recipe")
+			q.NodeName = r.Form.Get("node")
+			changes, serr := report.SearchResources(q)
+			if serr != nil {
+				jsonErrorReport(w, r, serr.Error(), http.StatusInternalServerError)
+				return
+			}
+			if changes == nil {
+				changes = make([]*report.ResourceChange, 0)
+			}
+			reportResponse["resources"] = changes
 		} else if op == "org" {
 			if pathArrayLen == 4 {
 				runID := pathArray[3]
@@ -166,6 +230,7 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 				reportResponse = formatRunShow(run)
+				exportRuns = []*report.Report{run}
 			} else {
 				runs, rerr := report.GetReportList(from, until, rows, status)
 				if rerr != nil {
@@ -173,6 +238,7 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 				reportResponse["run_history"] = runs
+				exportRuns = runs
 			}
 		} else {
 			jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
@@ -207,6 +273,7 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 				jsonErrorReport(w, r, serr.Error(), http.StatusInternalServerError)
 				return
 			}
+			reportCheckIn(nodeName)
 			reportResponse["run_detail"] = rep
 		} else {
 			runID := pathArray[4]
@@ -225,6 +292,7 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 				jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			reportCheckIn(nodeName)
 			// .... and?
 			reportResponse["run_detail"] = rep
 		}
@@ -233,12 +301,69 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if format != report.FormatJSON {
+		w.Header().Set("Content-Type", report.ContentType(format))
+		var err error
+		if format == report.FormatJUnit {
+			err = report.WriteJUnit(w, exportRuns)
+		} else {
+			err = report.WriteCSV(w, exportRuns)
+		}
+		if err != nil {
+			logger.Errorf("Error exporting reports as %s: %s", format, err.Error())
+		}
+		return
+	}
+
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(&reportResponse); err != nil {
 		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// reportCheckIn counts a run report as the node checking in. Problems here
+// shouldn't keep the report from being accepted, so they're only logged.
+func reportCheckIn(nodeName string) {
+	n, err := node.Get(nodeName)
+	if err != nil {
+		logger.Debugf("Node %s for run report not found, not checking it in", nodeName)
+		return
+	}
+	if cerr := n.CheckIn(); cerr != nil {
+		logger.Errorf("Error checking in node %s: %s", nodeName, cerr.Error())
+	}
+}
+
+// reportFormat works out what format the client wants reports in, either from
+// the "format" parameter or, failing that, the Accept header. JSON is the
+// default.
+func reportFormat(r *http.Request) (string, error) {
+	if f := r.Form.Get("format"); f != "" {
+		switch f {
+		case report.FormatJSON, report.FormatJUnit, report.FormatCSV:
+			return f, nil
+		case "xml":
+			return report.FormatJUnit, nil
+		}
+		return "", fmt.Errorf("Unsupported report format '%s'", f)
+	}
+	for _, accept := range r.Header["Accept"] {
+		for _, at := range strings.Split(accept, ",") {
+			// ignore any parameters like q=0.9
+			at = strings.TrimSpace(strings.SplitN(at, ";", 2)[0])
+			switch at {
+			case "application/json", "*/*":
+				return report.FormatJSON, nil
+			case "application/xml", "text/xml", "application/junit+xml":
+				return report.FormatJUnit, nil
+			case "text/csv":
+				return report.FormatCSV, nil
+			}
+		}
+	}
+	return report.FormatJSON, nil
+}
+
 // This function is subject to change, depending on what the client actually
 // expects. This may not be entirely correct.
 func formatRunShow(run *report.Report) map[string]interface{} {
@@ -226,8 +226,7 @@ func (s *Sandbox) UploadChkList() map[string]map[string]interface{} {
 					logger.Errorf(err.Error())
 				}
 			} else {
-				itemURL := fmt.Sprintf("/file_store/%s", chk)
-				chksumStats[chk]["url"] = util.CustomURL(itemURL)
+				chksumStats[chk]["url"] = util.FileStorePutURL(chk)
 			}
 			chksumStats[chk]["needs_upload"] = true
 		}
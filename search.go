@@ -297,6 +297,10 @@ func reindexAll() {
 		// for the postgres search index. (Somehow a regression snuck
 		// in here, but what do you do?
 		indexer.CreateNewCollection(dbag.GetName())
+		if !config.DataBagIndexed(dbag.GetName()) {
+			logger.Debugf("not indexing items in data bag %s", dbag.GetName())
+			continue
+		}
 		dbis := make([]indexer.Indexable, dbag.NumDBItems())
 		i := 0
 		allDBItems, derr := dbag.AllDBItems()
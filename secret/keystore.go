@@ -0,0 +1,377 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package secret
+
+// Functions for keeping secrets in a local file encrypted with AES-GCM, for
+// when running vault is more trouble than it's worth.
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/tideland/golib/logger"
+)
+
+// KeystoreKeyEnv is the environment variable the keystore's master keys are
+// read from when there's no key file.
+const KeystoreKeyEnv = "GOIARDI_KEYSTORE_KEY"
+
+const keystoreVersion = 1
+
+type keystoreSecretStore struct {
+	m    sync.RWMutex
+	path string
+	// the first key encrypts the keystore, the rest are older keys that
+	// can still decrypt it.
+	keys    [][]byte
+	secrets map[string]map[string]string
+}
+
+// keystoreFile is how the keystore is saved on disk. The header fields are
+// authenticated along with the ciphertext.
+type keystoreFile struct {
+	Version    int    `json:"version"`
+	KeyID      string `json:"key_id"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func configureKeystore() (*keystoreSecretStore, error) {
+	keys, err := keystoreKeys()
+	if err != nil {
+		return nil, err
+	}
+	return openKeystore(config.Config.KeystoreFile, keys)
+}
+
+// openKeystore opens the keystore at path, or starts a new one if there isn't
+// one yet. If the keystore was encrypted with an older key, it's encrypted
+// again with the current one.
+func openKeystore(path string, keys [][]byte) (*keystoreSecretStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no keystore file was given")
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no master key for the keystore was given. Set --keystore-key-file or the %s environment variable.", KeystoreKeyEnv)
+	}
+	k := &keystoreSecretStore{path: path, keys: keys, secrets: make(map[string]map[string]string)}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		logger.Infof("keystore %s does not exist yet, it will be created when a secret is saved", path)
+		return k, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var kf keystoreFile
+	if err = json.Unmarshal(b, &kf); err != nil {
+		return nil, fmt.Errorf("error reading keystore %s: %s", path, err.Error())
+	}
+	if kf.Version != keystoreVersion {
+		return nil, fmt.Errorf("keystore %s is version %d, but only version %d is supported", path, kf.Version, keystoreVersion)
+	}
+	key := k.findKey(kf.KeyID)
+	if key == nil {
+		return nil, fmt.Errorf("keystore %s was encrypted with key %s, which is not one of the master keys given", path, kf.KeyID)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, kf.Nonce, kf.Ciphertext, kf.additionalData())
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt keystore %s: %s", path, err.Error())
+	}
+	if err = json.Unmarshal(plain, &k.secrets); err != nil {
+		return nil, fmt.Errorf("error reading decrypted keystore %s: %s", path, err.Error())
+	}
+	if kf.KeyID != keyID(keys[0]) {
+		logger.Infof("keystore %s was encrypted with an older master key, encrypting it with the current key %s", path, keyID(keys[0]))
+		if err = k.save(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// keystoreKeys reads the master keys from the key file, or from the
+// environment if there's no key file.
+func keystoreKeys() ([][]byte, error) {
+	var encoded []string
+	if config.Config.KeystoreKeyFile != "" {
+		f, err := os.Open(config.Config.KeystoreKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			encoded = append(encoded, line)
+		}
+		if err = scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if env := os.Getenv(KeystoreKeyEnv); env != "" {
+		for _, e := range strings.Split(env, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				encoded = append(encoded, e)
+			}
+		}
+	}
+	return DecodeKeys(encoded)
+}
+
+// keyID identifies a master key without giving anything away about it.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (k *keystoreSecretStore) findKey(id string) []byte {
+	for _, key := range k.keys {
+		if keyID(key) == id {
+			return key
+		}
+	}
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (kf *keystoreFile) additionalData() []byte {
+	return []byte(fmt.Sprintf("goiardi-keystore:%d:%s", kf.Version, kf.KeyID))
+}
+
+// save encrypts the keystore with the current master key and writes it out.
+// It's written to a temporary file in the same directory first and renamed
+// over the old keystore, so a crash partway through never leaves a broken
+// keystore behind.
+func (k *keystoreSecretStore) save() error {
+	plain, err := json.Marshal(k.secrets)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(k.keys[0])
+	if err != nil {
+		return err
+	}
+	kf := &keystoreFile{Version: keystoreVersion, KeyID: keyID(k.keys[0])}
+	kf.Nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(kf.Nonce); err != nil {
+		return err
+	}
+	kf.Ciphertext = aead.Seal(nil, kf.Nonce, plain, kf.additionalData())
+	b, err := json.Marshal(kf)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(k.path)
+	tmp, err := ioutil.TempFile(dir, ".goiardi-keystore")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), k.path); err != nil {
+		return err
+	}
+	// make sure the rename itself is on disk
+	if d, derr := os.Open(dir); derr == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func (k *keystoreSecretStore) getSecret(path string, secretType string) (string, error) {
+	s, ok := k.secrets[path][secretType]
+	if !ok {
+		return "", fmt.Errorf("no data for %s (%s) in the keystore", path, secretType)
+	}
+	return s, nil
+}
+
+func (k *keystoreSecretStore) setSecret(path string, secretType string, value string) error {
+	logger.Debugf("setting secret for %s (%s) in the keystore", path, secretType)
+	old, had := k.secrets[path]
+	k.secrets[path] = map[string]string{secretType: value}
+	if err := k.save(); err != nil {
+		if had {
+			k.secrets[path] = old
+		} else {
+			delete(k.secrets, path)
+		}
+		return err
+	}
+	return nil
+}
+
+func (k *keystoreSecretStore) deleteSecret(path string) error {
+	old, had := k.secrets[path]
+	if !had {
+		return nil
+	}
+	delete(k.secrets, path)
+	if err := k.save(); err != nil {
+		k.secrets[path] = old
+		return err
+	}
+	return nil
+}
+
+func (k *keystoreSecretStore) getPublicKey(c ActorKeyer) (string, error) {
+	k.m.RLock()
+	defer k.m.RUnlock()
+	return k.getSecret(makePubKeyPath(c), "pubKey")
+}
+
+func (k *keystoreSecretStore) getPublicKeyVersion(c ActorKeyer, version int) (string, error) {
+	return "", ErrNoVersions
+}
+
+func (k *keystoreSecretStore) setPublicKey(c ActorKeyer, pubKey string) error {
+	k.m.Lock()
+	defer k.m.Unlock()
+	return k.setSecret(makePubKeyPath(c), "pubKey", pubKey)
+}
+
+func (k *keystoreSecretStore) deletePublicKey(c ActorKeyer) error {
+	k.m.Lock()
+	defer k.m.Unlock()
+	return k.deleteSecret(makePubKeyPath(c))
+}
+
+func (k *keystoreSecretStore) setPasswdHash(c ActorKeyer, pwhash string) error {
+	k.m.Lock()
+	defer k.m.Unlock()
+	return k.setSecret(makeHashPath(c), "passwd", pwhash)
+}
+
+func (k *keystoreSecretStore) getPasswdHash(c ActorKeyer) (string, error) {
+	k.m.RLock()
+	defer k.m.RUnlock()
+	return k.getSecret(makeHashPath(c), "passwd")
+}
+
+func (k *keystoreSecretStore) deletePasswdHash(c ActorKeyer) error {
+	k.m.Lock()
+	defer k.m.Unlock()
+	return k.deleteSecret(makeHashPath(c))
+}
+
+func (k *keystoreSecretStore) getSigningKey(path string) (*rsa.PrivateKey, error) {
+	k.m.RLock()
+	defer k.m.RUnlock()
+	s, err := k.getSecret(path, "RSAKey")
+	if err != nil {
+		return nil, err
+	}
+	pk, err := secretRSAKey(s)
+	if err != nil {
+		return nil, err
+	}
+	return pk.(*rsa.PrivateKey), nil
+}
+
+func (k *keystoreSecretStore) setSigningKey(path string, pk *rsa.PrivateKey) error {
+	k.m.Lock()
+	defer k.m.Unlock()
+	return k.setSecret(path, "RSAKey", encodeRSAKey(pk))
+}
+
+func (k *keystoreSecretStore) getDataKeys(path string) (string, error) {
+	k.m.RLock()
+	defer k.m.RUnlock()
+	if _, ok := k.secrets[path]; !ok {
+		return "", ErrNotFound
+	}
+	return k.getSecret(path, "dataKeys")
+}
+
+func (k *keystoreSecretStore) setDataKeys(path string, keys string) error {
+	k.m.Lock()
+	defer k.m.Unlock()
+	return k.setSecret(path, "dataKeys", keys)
+}
+
+func (k *keystoreSecretStore) getSigningKeyring(path string) (string, error) {
+	k.m.RLock()
+	defer k.m.RUnlock()
+	if _, ok := k.secrets[path]; !ok {
+		return "", ErrNotFound
+	}
+	return k.getSecret(path, "keyring")
+}
+
+func (k *keystoreSecretStore) setSigningKeyring(path string, keyring string) error {
+	k.m.Lock()
+	defer k.m.Unlock()
+	return k.setSecret(path, "keyring", keyring)
+}
+
+func (k *keystoreSecretStore) health() *Health {
+	k.m.RLock()
+	defer k.m.RUnlock()
+	h := &Health{Store: config.SecretStoreKeystore, Details: make(map[string]interface{})}
+	h.Details["path"] = k.path
+	h.Details["key_id"] = keyID(k.keys[0])
+	h.Details["secrets"] = len(k.secrets)
+	if _, err := os.Stat(k.path); err != nil && !os.IsNotExist(err) {
+		h.Error = err.Error()
+	}
+	h.Healthy = h.Error == ""
+	return h
+}
+
+func (k *keystoreSecretStore) close() {}
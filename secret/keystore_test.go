@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package secret
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// keystoreKeyer is like keyer in the vault tests, but those are left out when
+// building without vault.
+type keystoreKeyer struct {
+	name string
+}
+
+func (k *keystoreKeyer) GetName() string                { return k.name }
+func (k *keystoreKeyer) URLType() string                { return "keyer" }
+func (k *keystoreKeyer) PublicKey() string              { return "" }
+func (k *keystoreKeyer) SetPublicKey(interface{}) error { return nil }
+
+func newMasterKey(t *testing.T) []byte {
+	k := make([]byte, 32)
+	if _, err := rand.Read(k); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goiardi-keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keystore")
+	key := newMasterKey(t)
+
+	k, err := openKeystore(path, [][]byte{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ky := &keystoreKeyer{name: "keystore-client"}
+	if err = k.setPublicKey(ky, "not really a public key"); err != nil {
+		t.Fatal(err)
+	}
+	if err = k.setPasswdHash(ky, "not really a hash"); err != nil {
+		t.Fatal(err)
+	}
+	pk, _ := rsa.GenerateKey(rand.Reader, 1024)
+	if err = k.setSigningKey("keys/shovey/signing", pk); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("keystore permissions were %o, not 0600", fi.Mode().Perm())
+	}
+	b, _ := ioutil.ReadFile(path)
+	if bytes.Contains(b, []byte("not really")) {
+		t.Errorf("the keystore was not encrypted")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("temporary files were left behind: %d files in the keystore directory", len(files))
+	}
+
+	k, err = openKeystore(path, [][]byte{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err := k.getPublicKey(ky); err != nil || p != "not really a public key" {
+		t.Errorf("public key was not read back from the keystore: '%s' %v", p, err)
+	}
+	if h, err := k.getPasswdHash(ky); err != nil || h != "not really a hash" {
+		t.Errorf("password hash was not read back from the keystore: '%s' %v", h, err)
+	}
+	spk, err := k.getSigningKey("keys/shovey/signing")
+	if err != nil || spk.N.Cmp(pk.N) != 0 {
+		t.Errorf("signing key was not read back from the keystore: %v", err)
+	}
+
+	if err = k.deletePublicKey(ky); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = k.getPublicKey(ky); err == nil {
+		t.Errorf("public key was found after being deleted")
+	}
+
+	if _, err = openKeystore(path, [][]byte{newMasterKey(t)}); err == nil {
+		t.Errorf("the keystore should not have opened with the wrong master key")
+	}
+	b[len(b)/2] ^= 1
+	ioutil.WriteFile(path+"-tampered", b, 0600)
+	if _, err = openKeystore(path+"-tampered", [][]byte{key}); err == nil {
+		t.Errorf("a tampered keystore should not have opened")
+	}
+}
+
+func TestKeystoreRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goiardi-keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keystore")
+	oldKey := newMasterKey(t)
+	newKey := newMasterKey(t)
+	ky := &keystoreKeyer{name: "rotated"}
+
+	k, err := openKeystore(path, [][]byte{oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = k.setPublicKey(ky, "rotated key"); err != nil {
+		t.Fatal(err)
+	}
+
+	// opening with a new key first and the old one after moves the
+	// keystore over to the new key
+	if _, err = openKeystore(path, [][]byte{newKey, oldKey}); err != nil {
+		t.Fatal(err)
+	}
+	k, err = openKeystore(path, [][]byte{newKey})
+	if err != nil {
+		t.Fatalf("the keystore was not encrypted with the new key: %s", err.Error())
+	}
+	if p, _ := k.getPublicKey(ky); p != "rotated key" {
+		t.Errorf("public key was lost rotating the master key: '%s'", p)
+	}
+	if _, err = openKeystore(path, [][]byte{oldKey}); err == nil {
+		t.Errorf("the old master key should not open the keystore anymore")
+	}
+}
+
+func TestKeystoreKeys(t *testing.T) {
+	good := base64.StdEncoding.EncodeToString(newMasterKey(t))
+	if keys, err := DecodeKeys([]string{good, good}); err != nil || len(keys) != 2 {
+		t.Errorf("valid master keys were rejected: %v", err)
+	}
+	if _, err := DecodeKeys([]string{base64.StdEncoding.EncodeToString([]byte("too short"))}); err == nil {
+		t.Errorf("a short master key should have been rejected")
+	}
+	if _, err := DecodeKeys([]string{"not base64!"}); err == nil {
+		t.Errorf("a master key that isn't base64 should have been rejected")
+	}
+}
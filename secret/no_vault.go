@@ -40,6 +40,10 @@ func (v *vaultSecretStore) getPublicKey(c ActorKeyer) (string, error) {
 	return "", errNoVault
 }
 
+func (v *vaultSecretStore) getPublicKeyVersion(c ActorKeyer, version int) (string, error) {
+	return "", errNoVault
+}
+
 func (v *vaultSecretStore) setPublicKey(c ActorKeyer, f string) error {
 	return errNoVault
 }
@@ -63,3 +67,29 @@ func (v *vaultSecretStore) deletePasswdHash(c ActorKeyer) error {
 func (v *vaultSecretStore) getSigningKey(f string) (*rsa.PrivateKey, error) {
 	return nil, errNoVault
 }
+
+func (v *vaultSecretStore) setSigningKey(f string, pk *rsa.PrivateKey) error {
+	return errNoVault
+}
+
+func (v *vaultSecretStore) getDataKeys(f string) (string, error) {
+	return "", errNoVault
+}
+
+func (v *vaultSecretStore) setDataKeys(f string, k string) error {
+	return errNoVault
+}
+
+func (v *vaultSecretStore) getSigningKeyring(f string) (string, error) {
+	return "", errNoVault
+}
+
+func (v *vaultSecretStore) setSigningKeyring(f string, k string) error {
+	return errNoVault
+}
+
+func (v *vaultSecretStore) health() *Health {
+	return &Health{Store: "vault", Error: errNoVault.Error()}
+}
+
+func (v *vaultSecretStore) close() {}
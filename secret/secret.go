@@ -20,7 +20,14 @@ package secret
 
 import (
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/util"
+	"strings"
 )
 
 type ActorKeyer interface {
@@ -31,30 +38,91 @@ type ActorKeyer interface {
 
 type secretSource interface {
 	getPublicKey(ActorKeyer) (string, error)
+	getPublicKeyVersion(ActorKeyer, int) (string, error)
 	setPublicKey(ActorKeyer, string) error
 	deletePublicKey(ActorKeyer) error
 	setPasswdHash(ActorKeyer, string) error
 	getPasswdHash(ActorKeyer) (string, error)
 	deletePasswdHash(ActorKeyer) error
 	getSigningKey(string) (*rsa.PrivateKey, error)
+	setSigningKey(string, *rsa.PrivateKey) error
+	getDataKeys(string) (string, error)
+	setDataKeys(string, string) error
+	getSigningKeyring(string) (string, error)
+	setSigningKeyring(string, string) error
+	health() *Health
+	close()
 }
 
+// Health reports on whether the secret store goiardi is using is working, with
+// some details about it that depend on the kind of secret store.
+type Health struct {
+	Store   string                 `json:"store"`
+	Healthy bool                   `json:"healthy"`
+	Error   string                 `json:"error,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// ErrNotFound is returned when there's no secret at all at the given path, as
+// opposed to the secret store having some problem getting it.
+var ErrNotFound = errors.New("secret not found")
+
+// ErrNoVersions is returned when asking for an older version of a secret from
+// a secret store that doesn't keep them.
+var ErrNoVersions = errors.New("older versions of secrets are only kept with version 2 of vault's key/value secrets engine")
+
 var secretStore secretSource
 
+// ConfigureSecretStore sets up the secret store goiardi is configured to use.
 func ConfigureSecretStore() error {
-	// will be a switch here for the type of secret backend
+	return UseSecretStore(config.Config.SecretStore)
+}
+
+// UseSecretStore sets up the given kind of secret store, either vault or
+// keystore, and uses it from then on. Mostly useful when moving secrets from
+// one store to another.
+func UseSecretStore(kind string) error {
+	var s secretSource
 	var err error
-	secretStore, err = configureVault()
+	switch kind {
+	case config.SecretStoreVault, "":
+		s, err = configureVault()
+	case config.SecretStoreKeystore:
+		s, err = configureKeystore()
+	default:
+		err = fmt.Errorf("unknown secret store '%s'", kind)
+	}
 	if err != nil {
 		return err
 	}
+	if secretStore != nil {
+		secretStore.close()
+	}
+	secretStore = s
 	return nil
 }
 
+// GetHealth reports on the secret store goiardi is using.
+func GetHealth() *Health {
+	if !config.UsingExternalSecrets() || secretStore == nil {
+		return &Health{Store: config.SecretStoreBuiltin, Healthy: true}
+	}
+	return secretStore.health()
+}
+
 func GetPublicKey(c ActorKeyer) (string, error) {
 	return secretStore.getPublicKey(c)
 }
 
+// GetPublicKeyVersion gets an older version of a client's or user's public
+// key. Only version 2 of vault's key/value secrets engine keeps them.
+func GetPublicKeyVersion(c ActorKeyer, version int) (string, error) {
+	if !config.UsingExternalSecrets() || secretStore == nil {
+		return "", ErrNoVersions
+	}
+	return secretStore.getPublicKeyVersion(c, version)
+}
+
 func SetPublicKey(c ActorKeyer, pubKey string) error {
 	return secretStore.setPublicKey(c, pubKey)
 }
@@ -67,6 +135,41 @@ func GetSigningKey(path string) (*rsa.PrivateKey, error) {
 	return secretStore.getSigningKey(path)
 }
 
+func SetSigningKey(path string, pk *rsa.PrivateKey) error {
+	return secretStore.setSigningKey(path, pk)
+}
+
+// GetDataKeys gets the master keys used to encrypt data at rest. The first key
+// is the current one, and the rest are older keys.
+func GetDataKeys(path string) ([][]byte, error) {
+	ks, err := secretStore.getDataKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeKeys(strings.Fields(ks))
+}
+
+// SetDataKeys saves the master keys used to encrypt data at rest, with the
+// current key first.
+func SetDataKeys(path string, keys [][]byte) error {
+	encoded := make([]string, len(keys))
+	for i, k := range keys {
+		encoded[i] = base64.StdEncoding.EncodeToString(k)
+	}
+	return secretStore.setDataKeys(path, strings.Join(encoded, "\n"))
+}
+
+// GetSigningKeyring gets the saved shovey signing keyring, or ErrNotFound if
+// there isn't one.
+func GetSigningKeyring(path string) (string, error) {
+	return secretStore.getSigningKeyring(path)
+}
+
+// SetSigningKeyring saves the shovey signing keyring.
+func SetSigningKeyring(path string, keyring string) error {
+	return secretStore.setSigningKeyring(path, keyring)
+}
+
 func GetPasswdHash(c ActorKeyer) (string, error) {
 	return secretStore.getPasswdHash(c)
 }
@@ -78,3 +181,51 @@ func SetPasswdHash(c ActorKeyer, hash string) error {
 func DeletePasswdHash(c ActorKeyer) error {
 	return secretStore.deletePasswdHash(c)
 }
+
+func makePubKeyPath(c ActorKeyer) string {
+	return fmt.Sprintf("keys/%s/%s", c.URLType(), c.GetName())
+}
+
+func makeHashPath(c ActorKeyer) string {
+	// strictly speaking only users actually have passwords, but in case
+	// something else ever comes up, make the path a little longer.
+	return fmt.Sprintf("keys/passwd/%s/%s", c.URLType(), c.GetName())
+}
+
+func secretRSAKey(i interface{}) (interface{}, error) {
+	p, ok := i.(string)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA private key in string form")
+	}
+	pBlock, _ := pem.Decode([]byte(p))
+	if pBlock == nil {
+		return nil, fmt.Errorf("invalid block size for private key for shovey from the secret store")
+	}
+	pk, err := x509.ParsePKCS1PrivateKey(pBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+func encodeRSAKey(pk *rsa.PrivateKey) string {
+	b := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pk)}
+	return string(pem.EncodeToMemory(b))
+}
+
+// DecodeKeys decodes base64 encoded 32 byte AES-256 keys, like the keystore's
+// master keys.
+func DecodeKeys(encoded []string) ([][]byte, error) {
+	keys := make([][]byte, len(encoded))
+	for i, e := range encoded {
+		k, err := base64.StdEncoding.DecodeString(e)
+		if err != nil {
+			return nil, fmt.Errorf("master key #%d is not valid base64: %s", i+1, err.Error())
+		}
+		if len(k) != 32 {
+			return nil, fmt.Errorf("master key #%d is %d bytes long, but must be 32", i+1, len(k))
+		}
+		keys[i] = k
+	}
+	return keys, nil
+}
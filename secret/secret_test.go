@@ -96,7 +96,7 @@ func TestMain(m *testing.M) {
 		vaultInstalled = true
 	} else {
 		log.Printf("Vault is not installed, not running vault tests")
-		return
+		os.Exit(m.Run())
 	}
 	cmd := exec.Command(vaultPath, "server", "-dev", fmt.Sprintf("-dev-listen-address=%s", vaultAddr), fmt.Sprintf("-dev-root-token-id=%s", token))
 
@@ -191,6 +191,9 @@ func TestGetPublicKey(t *testing.T) {
 }
 
 func TestResetPublicKey(t *testing.T) {
+	if !vaultInstalled {
+		return
+	}
 	newKey := "herbaderbaderb"
 	pk, err := GetPublicKey(c)
 	if pk != pubKey {
@@ -207,6 +210,9 @@ func TestResetPublicKey(t *testing.T) {
 }
 
 func TestMultipleObjKeys(t *testing.T) {
+	if !vaultInstalled {
+		return
+	}
 	cs := []*keyer{&keyer{name: "bleek1"}, &keyer{name: "bleek2"}, &keyer{name: "bleek3"}}
 
 	keys := []string{"12345", "abcdef", "eekamouse"}
@@ -229,6 +235,9 @@ func TestMultipleObjKeys(t *testing.T) {
 }
 
 func TestDeleteKey(t *testing.T) {
+	if !vaultInstalled {
+		return
+	}
 	k := &keyer{name: "key_keyerson"}
 	key := "456123000"
 	err := SetPublicKey(k, key)
@@ -246,6 +255,9 @@ func TestDeleteKey(t *testing.T) {
 }
 
 func TestSetPasswdHash(t *testing.T) {
+	if !vaultInstalled {
+		return
+	}
 	k := &keyer{name: "bob_keyman"}
 	pass := "foobarbaz"
 	salt, err := chefcrypto.GenerateSalt()
@@ -263,6 +275,9 @@ func TestSetPasswdHash(t *testing.T) {
 }
 
 func TestGetPasswdHash(t *testing.T) {
+	if !vaultInstalled {
+		return
+	}
 	k := &keyer{name: "jebediah_keyman"}
 	pass := "foobarbaz"
 	salt, err := chefcrypto.GenerateSalt()
@@ -288,6 +303,9 @@ func TestGetPasswdHash(t *testing.T) {
 }
 
 func TestDeletePasswdHash(t *testing.T) {
+	if !vaultInstalled {
+		return
+	}
 	k := &keyer{name: "bill_keyman"}
 	pass := "foobarbaz"
 	salt, err := chefcrypto.GenerateSalt()
@@ -318,6 +336,9 @@ func TestDeletePasswdHash(t *testing.T) {
 }
 
 func TestGetSigningKey(t *testing.T) {
+	if !vaultInstalled {
+		return
+	}
 	_, err := GetSigningKey(signingPath)
 	if err != nil {
 		t.Errorf("error getting signing key: %s", err.Error())
@@ -23,12 +23,11 @@ package secret
 
 import (
 	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
 	"fmt"
 	"github.com/ctdk/goiardi/config"
 	vault "github.com/hashicorp/vault/api"
 	"github.com/tideland/golib/logger"
+	"net/http"
 	"sync"
 	"time"
 )
@@ -36,8 +35,15 @@ import (
 // make this a pool later?
 
 type vaultSecretStore struct {
-	m       sync.RWMutex
-	secrets map[string]*secretVal
+	m sync.RWMutex
+	// cm guards the cache of secrets, which gets changed even when
+	// secrets are only being read. It's never held while talking to
+	// vault.
+	cm       sync.Mutex
+	secrets  map[string]*secretVal
+	kv       *kvEngine
+	auth     *vaultAuth
+	cacheTTL time.Duration
 	*vault.Client
 }
 
@@ -55,6 +61,8 @@ type secretVal struct {
 	stale         bool
 	staleTryAgain time.Time
 	staleTime     time.Time
+	renewing      bool
+	version       int
 	value         interface{}
 }
 
@@ -73,28 +81,75 @@ func configureVault() (*vaultSecretStore, error) {
 		return nil, err
 	}
 
+	auth := newVaultAuth(c)
+	if err = auth.start(); err != nil {
+		return nil, err
+	}
 	secrets := make(map[string]*secretVal)
-	v := &vaultSecretStore{secrets: secrets, Client: c}
+	v := &vaultSecretStore{secrets: secrets, Client: c, kv: newKVEngine(c), auth: auth, cacheTTL: config.Config.VaultCacheTTLDur}
 	return v, nil
 }
 
+func (v *vaultSecretStore) close() {
+	v.auth.close()
+}
+
+// withAuth makes a request to vault, and if vault refuses it because the token
+// has expired or been revoked, logs in again and makes the request once more.
+func (v *vaultSecretStore) withAuth(req func() error) error {
+	err := req()
+	if isPermissionDenied(err) && v.auth.reauthenticate() {
+		err = req()
+	}
+	return err
+}
+
+func isPermissionDenied(err error) bool {
+	rerr, ok := err.(*vault.ResponseError)
+	return ok && rerr.StatusCode == http.StatusForbidden
+}
+
+func (v *vaultSecretStore) readSecret(path string, version int) (*kvSecret, error) {
+	var ks *kvSecret
+	err := v.withAuth(func() error {
+		var rerr error
+		ks, rerr = v.kv.read(path, version)
+		return rerr
+	})
+	return ks, err
+}
+
+func (v *vaultSecretStore) writeSecret(path string, data map[string]interface{}) error {
+	return v.withAuth(func() error {
+		_, werr := v.kv.write(path, data)
+		return werr
+	})
+}
+
 func (v *vaultSecretStore) getSecret(path string, secretType string) (interface{}, error) {
-	if v.secrets[path] == nil {
-		logger.Debugf("secret (%s) for %s is nil, fetching from vault", secretType, path)
-		s, err := v.getSecretPath(path, secretType)
-		if err != nil {
-			return "", err
-		}
-		v.secrets[path] = s
-	} else {
+	v.cm.Lock()
+	s := v.secrets[path]
+	v.cm.Unlock()
+	if s != nil {
 		logger.Debugf("using cached secret for %s", path)
+		return v.secretValue(s)
+	}
+	// Fetched without holding cm, so looking up other secrets doesn't have
+	// to wait on vault.
+	logger.Debugf("secret (%s) for %s is nil, fetching from vault", secretType, path)
+	s, err := v.getSecretPath(path, secretType)
+	if err != nil {
+		return "", err
 	}
-	return v.secretValue(v.secrets[path])
+	v.cm.Lock()
+	v.secrets[path] = s
+	v.cm.Unlock()
+	return s.value, nil
 }
 
 func (v *vaultSecretStore) getSecretPath(path string, secretType string) (*secretVal, error) {
 	t := time.Now()
-	s, err := v.Logical().Read(path)
+	s, err := v.readSecret(path, 0)
 	if err != nil {
 		err := fmt.Errorf("Failed to read %s (%s) from vault: %s", path, secretType, err.Error())
 		return nil, err
@@ -103,7 +158,7 @@ func (v *vaultSecretStore) getSecretPath(path string, secretType string) (*secre
 		err := fmt.Errorf("No secret returned from vault for %s (%s)", path, secretType)
 		return nil, err
 	}
-	p := s.Data[secretType]
+	p := s.data[secretType]
 	if p == nil {
 		err := fmt.Errorf("no data for %s (%s) from vault", path, secretType)
 		return nil, err
@@ -112,35 +167,40 @@ func (v *vaultSecretStore) getSecretPath(path string, secretType string) (*secre
 	if err != nil {
 		return nil, err
 	}
-	sVal := newSecretVal(path, secretType, p, t, s)
+	sVal := v.newSecretVal(path, secretType, p, t, s)
 	return sVal, nil
 }
 
 func (v *vaultSecretStore) setSecret(path string, secretType string, value interface{}) error {
 	logger.Debugf("setting public key for %s (%s)", path, secretType)
 	t := time.Now()
-	_, err := v.Logical().Write(path, map[string]interface{}{
+	err := v.writeSecret(path, map[string]interface{}{
 		secretType: value,
 	})
 	if err != nil {
 		return err
 	}
-	s, err := v.Logical().Read(path)
+	s, err := v.readSecret(path, 0)
 	if err != nil {
 		return fmt.Errorf("Error re-reading secret from vault after setting: %s", err.Error())
 	}
-	sVal := newSecretVal(path, secretType, value, t, s)
+	if s == nil {
+		return fmt.Errorf("Secret for %s (%s) was not found in vault after setting it", path, secretType)
+	}
+	sVal := v.newSecretVal(path, secretType, value, t, s)
+	v.cm.Lock()
 	v.secrets[path] = sVal
+	v.cm.Unlock()
 	return nil
 }
 
 func (v *vaultSecretStore) deleteSecret(path string) error {
+	v.cm.Lock()
 	delete(v.secrets, path)
-	_, err := v.Logical().Delete(path)
-	if err != nil {
-		return err
-	}
-	return nil
+	v.cm.Unlock()
+	return v.withAuth(func() error {
+		return v.kv.delete(path)
+	})
 }
 
 func (v *vaultSecretStore) getPublicKey(c ActorKeyer) (string, error) {
@@ -165,6 +225,29 @@ func (v *vaultSecretStore) getPublicKey(c ActorKeyer) (string, error) {
 	}
 }
 
+// Older versions of public keys are read straight from vault, without
+// touching the cache.
+func (v *vaultSecretStore) getPublicKeyVersion(c ActorKeyer, version int) (string, error) {
+	if v.kv.version != 2 {
+		return "", ErrNoVersions
+	}
+	v.m.RLock()
+	defer v.m.RUnlock()
+	path := makePubKeyPath(c)
+	s, err := v.readSecret(path, version)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read version %d of the public key for %s from vault: %s", version, path, err.Error())
+	}
+	if s == nil {
+		return "", ErrNotFound
+	}
+	pk, ok := s.data["pubKey"].(string)
+	if !ok {
+		return "", fmt.Errorf("The type was wrong fetching version %d of the public key from vault: %T", version, s.data["pubKey"])
+	}
+	return pk, nil
+}
+
 func (v *vaultSecretStore) setPublicKey(c ActorKeyer, pubKey string) error {
 	v.m.Lock()
 	defer v.m.Unlock()
@@ -179,24 +262,20 @@ func (v *vaultSecretStore) deletePublicKey(c ActorKeyer) error {
 	return v.deleteSecret(path)
 }
 
-func makePubKeyPath(c ActorKeyer) string {
-	return fmt.Sprintf("keys/%s/%s", c.URLType(), c.GetName())
-}
-
-func makeHashPath(c ActorKeyer) string {
-	// strictly speaking only users actually have passwords, but in case
-	// something else ever comes up, make the path a little longer.
-	return fmt.Sprintf("keys/passwd/%s/%s", c.URLType(), c.GetName())
-}
-
-func newSecretVal(path string, secretType string, value interface{}, t time.Time, s *vault.Secret) *secretVal {
+func (v *vaultSecretStore) newSecretVal(path string, secretType string, value interface{}, t time.Time, s *kvSecret) *secretVal {
 	sVal := new(secretVal)
 	sVal.path = path
 	sVal.secretType = secretType
 	sVal.created = t
-	sVal.renewable = s.Renewable
-	sVal.ttl = time.Duration(s.LeaseDuration) * time.Second
+	sVal.renewable = s.secret.Renewable
+	sVal.ttl = time.Duration(s.secret.LeaseDuration) * time.Second
+	// Secrets from version 2 of the key/value engine don't have a lease
+	// at all, so without a cache TTL they're kept until goiardi restarts.
+	if v.cacheTTL > 0 && (sVal.ttl == 0 || v.cacheTTL < sVal.ttl) {
+		sVal.ttl = v.cacheTTL
+	}
 	sVal.expires = t.Add(sVal.ttl)
+	sVal.version = s.version
 	sVal.value = value
 	return sVal
 }
@@ -209,9 +288,20 @@ func (s *secretVal) isExpired() bool {
 }
 
 func (v *vaultSecretStore) secretValue(s *secretVal) (interface{}, error) {
-	if s.isExpired() {
+	// Only one lookup renews an expired secret; the others keep using the
+	// cached value until it's done.
+	v.cm.Lock()
+	renew := s.isExpired() && !s.renewing
+	if renew {
+		s.renewing = true
+	}
+	v.cm.Unlock()
+	if renew {
 		logger.Debugf("trying to renew secret for %s", s.path)
 		s2, err := v.getSecretPath(s.path, s.secretType)
+		v.cm.Lock()
+		defer v.cm.Unlock()
+		s.renewing = false
 		if !s.stale {
 			if err != nil {
 				logger.Debugf("error trying to renew the secret for %s: %s -- marking as stale", s.path, err.Error())
@@ -220,28 +310,38 @@ func (v *vaultSecretStore) secretValue(s *secretVal) (interface{}, error) {
 				s.staleTryAgain = time.Now().Add(StaleTryAgainSeconds * time.Second)
 			} else {
 				logger.Debugf("successfully renewed secret for %s", s.path)
-				s = s2
+				s = v.cacheRenewed(s, s2)
 			}
 		} else if time.Now().After(s.staleTime) {
 			if err != nil {
 				err := fmt.Errorf("Couldn't renew the secret for %s before %d seconds ran out, giving up", s.path, MaxStaleAgeSeconds)
 				return nil, err
 			}
-			logger.Debugf("successfully renewed secret for %s beforegiving up due to staleness", s.path)
-			s = s2
+			logger.Debugf("successfully renewed secret for %s before giving up due to staleness", s.path)
+			s = v.cacheRenewed(s, s2)
 		} else if time.Now().After(s.staleTryAgain) {
 			if err != nil {
 				logger.Debugf("error trying to renew the secret for %s: %s -- will renew again in %d seconds", s.path, err.Error(), StaleTryAgainSeconds)
-				s.staleTryAgain = time.Now().Add(StaleTryAgainSeconds)
+				s.staleTryAgain = time.Now().Add(StaleTryAgainSeconds * time.Second)
 			} else {
 				logger.Debugf("successfully renewed secret after being stale")
-				s = s2
+				s = v.cacheRenewed(s, s2)
 			}
 		}
 	}
 	return s.value, nil
 }
 
+// cacheRenewed replaces a cached secret with the one just fetched again from
+// vault.
+func (v *vaultSecretStore) cacheRenewed(old *secretVal, s *secretVal) *secretVal {
+	if s.version != 0 && s.version != old.version {
+		logger.Infof("secret for %s in vault changed from version %d to %d", s.path, old.version, s.version)
+	}
+	v.secrets[s.path] = s
+	return s
+}
+
 func (v *vaultSecretStore) valueStr(s *secretVal) (string, error) {
 	val, err := v.secretValue(s)
 	if err != nil {
@@ -274,6 +374,65 @@ func (v *vaultSecretStore) getSigningKey(path string) (*rsa.PrivateKey, error) {
 	}
 }
 
+func (v *vaultSecretStore) setSigningKey(path string, pk *rsa.PrivateKey) error {
+	v.m.Lock()
+	defer v.m.Unlock()
+	if err := v.writeSecret(path, map[string]interface{}{
+		"RSAKey": encodeRSAKey(pk),
+	}); err != nil {
+		return err
+	}
+	// fetched again, and parsed, the next time it's used
+	v.cm.Lock()
+	delete(v.secrets, path)
+	v.cm.Unlock()
+	return nil
+}
+
+// data encryption master keys and the shovey signing keyring. These are read
+// once and kept by the caller, so they aren't cached here.
+
+func (v *vaultSecretStore) getUncached(path string, secretType string) (string, error) {
+	v.m.RLock()
+	defer v.m.RUnlock()
+	s, err := v.readSecret(path, 0)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read %s (%s) from vault: %s", path, secretType, err.Error())
+	}
+	if s == nil {
+		return "", ErrNotFound
+	}
+	val, ok := s.data[secretType].(string)
+	if !ok {
+		return "", fmt.Errorf("The type was wrong fetching %s (%s) from vault: %T", path, secretType, s.data[secretType])
+	}
+	return val, nil
+}
+
+func (v *vaultSecretStore) setUncached(path string, secretType string, value string) error {
+	v.m.Lock()
+	defer v.m.Unlock()
+	return v.writeSecret(path, map[string]interface{}{
+		secretType: value,
+	})
+}
+
+func (v *vaultSecretStore) getDataKeys(path string) (string, error) {
+	return v.getUncached(path, "dataKeys")
+}
+
+func (v *vaultSecretStore) setDataKeys(path string, keys string) error {
+	return v.setUncached(path, "dataKeys", keys)
+}
+
+func (v *vaultSecretStore) getSigningKeyring(path string) (string, error) {
+	return v.getUncached(path, "keyring")
+}
+
+func (v *vaultSecretStore) setSigningKeyring(path string, keyring string) error {
+	return v.setUncached(path, "keyring", keyring)
+}
+
 // user passwd hash methods
 
 func (v *vaultSecretStore) setPasswdHash(c ActorKeyer, pwhash string) error {
@@ -312,28 +471,43 @@ func (v *vaultSecretStore) deletePasswdHash(c ActorKeyer) error {
 	return v.deleteSecret(path)
 }
 
+func (v *vaultSecretStore) health() *Health {
+	h := &Health{Store: config.SecretStoreVault, Details: make(map[string]interface{})}
+	h.Details["address"] = v.Address()
+	h.Details["kv_version"] = v.kv.version
+	v.cm.Lock()
+	h.Details["cached_secrets"] = len(v.secrets)
+	v.cm.Unlock()
+	if aerr := v.auth.status(h.Details); aerr != nil {
+		h.Error = aerr.Error()
+	}
+	hr, err := v.Sys().Health()
+	if err != nil {
+		if h.Error == "" {
+			h.Error = fmt.Sprintf("error checking vault's health: %s", err.Error())
+		}
+		return h
+	}
+	h.Details["vault_version"] = hr.Version
+	h.Details["sealed"] = hr.Sealed
+	h.Details["standby"] = hr.Standby
+	if h.Error == "" {
+		if !hr.Initialized {
+			h.Error = "vault is not initialized"
+		} else if hr.Sealed {
+			h.Error = "vault is sealed"
+		}
+	}
+	h.Healthy = h.Error == ""
+	return h
+}
+
 // funcs to process secrets after fetching them from vault
 
 func secretPassThrough(i interface{}) (interface{}, error) {
 	return i, nil
 }
 
-func secretRSAKey(i interface{}) (interface{}, error) {
-	p, ok := i.(string)
-	if !ok {
-		return nil, fmt.Errorf("not an RSA private key in string form")
-	}
-	pBlock, _ := pem.Decode([]byte(p))
-	if pBlock == nil {
-		return nil, fmt.Errorf("invalid block size for private key for shovey from vault")
-	}
-	pk, err := x509.ParsePKCS1PrivateKey(pBlock.Bytes)
-	if err != nil {
-		return nil, err
-	}
-	return pk, nil
-}
-
 func convertors(secretType string) secretConvert {
 	switch secretType {
 	case "RSAKey":
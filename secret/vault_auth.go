@@ -0,0 +1,347 @@
+// +build !novault
+
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package secret
+
+// Logging in to vault and keeping the token goiardi uses renewed. With token
+// auth, goiardi uses the token it was given in VAULT_TOKEN, renewing it as
+// long as vault allows. With AppRole auth, goiardi logs in with its role ID and
+// secret ID, and logs in again whenever the token can't be renewed anymore.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+	vault "github.com/hashicorp/vault/api"
+	"github.com/tideland/golib/logger"
+)
+
+// VaultSecretIDEnv is the environment variable the AppRole secret ID is read
+// from when there's no secret ID file.
+const VaultSecretIDEnv = "GOIARDI_VAULT_SECRET_ID"
+
+// How long to wait before trying again after renewing the token or logging in
+// fails. The wait doubles each time, up to maxAuthRetry.
+const (
+	minAuthRetry = 5 * time.Second
+	maxAuthRetry = 5 * time.Minute
+)
+
+type vaultAuth struct {
+	m            sync.Mutex
+	client       *vault.Client
+	method       string
+	mount        string
+	roleID       string
+	secretIDFile string
+
+	ttl         time.Duration
+	renewable   bool
+	expires     time.Time // zero if the token never expires
+	lastLogin   time.Time
+	lastRenewal time.Time
+	lastErr     error
+	lastErrTime time.Time
+	retry       time.Duration
+	retryAt     time.Time
+
+	stop chan struct{}
+	wake chan struct{}
+}
+
+func newVaultAuth(c *vault.Client) *vaultAuth {
+	a := &vaultAuth{
+		client:       c,
+		method:       config.Config.VaultAuthMethod,
+		mount:        config.Config.VaultAppRoleMount,
+		roleID:       config.Config.VaultRoleID,
+		secretIDFile: config.Config.VaultSecretIDFile,
+		retry:        minAuthRetry,
+		stop:         make(chan struct{}),
+		wake:         make(chan struct{}, 1),
+	}
+	if a.method == "" {
+		a.method = config.VaultAuthToken
+	}
+	if a.mount == "" {
+		a.mount = "approle"
+	}
+	return a
+}
+
+// start logs in to vault, or checks the token goiardi was given, and starts
+// keeping the token renewed in the background. Failing to log in with AppRole
+// is an error, but a token that can't be looked up is only warned about, since
+// the token may still be allowed to read goiardi's secrets.
+func (a *vaultAuth) start() error {
+	if err := a.login(); err != nil {
+		if a.method == config.VaultAuthAppRole {
+			return err
+		}
+		logger.Warningf("%s. Will try again in the background.", err.Error())
+	}
+	go a.run()
+	return nil
+}
+
+func (a *vaultAuth) close() {
+	close(a.stop)
+}
+
+func (a *vaultAuth) login() error {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.loginLocked()
+}
+
+func (a *vaultAuth) loginLocked() error {
+	var err error
+	if a.method == config.VaultAuthAppRole {
+		err = a.appRoleLogin()
+	} else {
+		err = a.lookupToken()
+	}
+	a.setErr(err)
+	return err
+}
+
+func (a *vaultAuth) appRoleLogin() error {
+	secretID, err := a.secretID()
+	if err != nil {
+		return err
+	}
+	s, err := a.client.Logical().Write(fmt.Sprintf("auth/%s/login", a.mount), map[string]interface{}{
+		"role_id":   a.roleID,
+		"secret_id": secretID,
+	})
+	if err != nil {
+		return fmt.Errorf("error logging in to vault with AppRole: %s", err.Error())
+	}
+	if s == nil || s.Auth == nil || s.Auth.ClientToken == "" {
+		return fmt.Errorf("logging in to vault with AppRole did not return a token")
+	}
+	a.client.SetToken(s.Auth.ClientToken)
+	now := time.Now()
+	a.lastLogin = now
+	a.setTTL(now, time.Duration(s.Auth.LeaseDuration)*time.Second, s.Auth.Renewable)
+	logger.Infof("Logged in to vault with AppRole, token is good for %s", a.ttl)
+	return nil
+}
+
+// secretID is read again every time goiardi logs in, so a new secret ID can be
+// dropped in place without restarting goiardi.
+func (a *vaultAuth) secretID() (string, error) {
+	if a.secretIDFile != "" {
+		b, err := ioutil.ReadFile(a.secretIDFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading the vault AppRole secret ID: %s", err.Error())
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	if s := os.Getenv(VaultSecretIDEnv); s != "" {
+		return s, nil
+	}
+	return "", fmt.Errorf("no vault AppRole secret ID was given. Set --vault-secret-id-file or the %s environment variable.", VaultSecretIDEnv)
+}
+
+func (a *vaultAuth) lookupToken() error {
+	s, err := a.client.Auth().Token().LookupSelf()
+	if err != nil {
+		return fmt.Errorf("error looking up the vault token: %s", err.Error())
+	}
+	ttl, err := s.TokenTTL()
+	if err != nil {
+		return fmt.Errorf("error looking up the vault token: %s", err.Error())
+	}
+	renewable, err := s.TokenIsRenewable()
+	if err != nil {
+		return fmt.Errorf("error looking up the vault token: %s", err.Error())
+	}
+	now := time.Now()
+	a.lastLogin = now
+	a.setTTL(now, ttl, renewable)
+	return nil
+}
+
+func (a *vaultAuth) renew() error {
+	s, err := a.client.Auth().Token().RenewSelf(0)
+	if err != nil {
+		return fmt.Errorf("error renewing the vault token: %s", err.Error())
+	}
+	if s == nil || s.Auth == nil {
+		return fmt.Errorf("renewing the vault token did not return its new lease")
+	}
+	now := time.Now()
+	ttl := time.Duration(s.Auth.LeaseDuration) * time.Second
+	prevTTL := a.ttl
+	a.lastRenewal = now
+	a.setTTL(now, ttl, s.Auth.Renewable)
+	// A token can't be renewed past its max TTL, so renewing it gets
+	// less and less time once it's close.
+	if ttl <= 0 || ttl < prevTTL/2 {
+		if a.method == config.VaultAuthAppRole {
+			return fmt.Errorf("the vault token is close to its max TTL, with %s left", ttl)
+		}
+		logger.Warningf("The vault token is close to its max TTL, and will expire in %s", ttl)
+	}
+	logger.Debugf("renewed the vault token, good for %s", ttl)
+	return nil
+}
+
+func (a *vaultAuth) setTTL(now time.Time, ttl time.Duration, renewable bool) {
+	a.ttl = ttl
+	a.renewable = renewable
+	if ttl > 0 {
+		a.expires = now.Add(ttl)
+	} else {
+		a.expires = time.Time{}
+	}
+}
+
+// setErr records how the last attempt to renew the token or log in went, and
+// when to try again if it failed.
+func (a *vaultAuth) setErr(err error) {
+	a.lastErr = err
+	if err == nil {
+		a.retry = minAuthRetry
+		a.retryAt = time.Time{}
+		return
+	}
+	now := time.Now()
+	a.lastErrTime = now
+	a.retryAt = now.Add(a.retry)
+	a.retry *= 2
+	if a.retry > maxAuthRetry {
+		a.retry = maxAuthRetry
+	}
+}
+
+// refresh renews the token, or logs in again if the token can't be renewed.
+func (a *vaultAuth) refresh() error {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if a.renewable && a.lastErr == nil {
+		err := a.renew()
+		if err == nil || a.method != config.VaultAuthAppRole {
+			a.setErr(err)
+			return err
+		}
+		logger.Infof("%s, logging in to vault again", err.Error())
+	}
+	return a.loginLocked()
+}
+
+// reauthenticate logs in to vault again after vault refused a request,
+// returning true if the request might work now. Only AppRole auth can log in
+// again.
+func (a *vaultAuth) reauthenticate() bool {
+	if a.method != config.VaultAuthAppRole {
+		return false
+	}
+	a.m.Lock()
+	defer a.m.Unlock()
+	// another request may have just done it
+	if time.Since(a.lastLogin) < minAuthRetry {
+		return a.lastErr == nil
+	}
+	logger.Infof("vault refused a request, logging in again")
+	if err := a.loginLocked(); err != nil {
+		logger.Errorf("%s", err)
+		return false
+	}
+	// the token changed, so the renewal schedule needs to as well
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// nextRefresh is how long to wait before renewing the token or logging in
+// again, or -1 if there's nothing to do.
+func (a *vaultAuth) nextRefresh() time.Duration {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if !a.retryAt.IsZero() {
+		return time.Until(a.retryAt)
+	}
+	if a.expires.IsZero() || (!a.renewable && a.method != config.VaultAuthAppRole) {
+		return -1
+	}
+	// renew once two thirds of the token's time is up
+	return time.Until(a.expires.Add(-a.ttl / 3))
+}
+
+func (a *vaultAuth) run() {
+	for {
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if wait := a.nextRefresh(); wait >= 0 {
+			timer = time.NewTimer(wait)
+			fire = timer.C
+		}
+		select {
+		case <-a.stop:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-a.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		case <-fire:
+		}
+		if err := a.refresh(); err != nil {
+			a.m.Lock()
+			logger.Errorf("%s. Trying again in %s.", err.Error(), time.Until(a.retryAt).Round(time.Second))
+			a.m.Unlock()
+		}
+	}
+}
+
+// status reports on the token for the secret store's health.
+func (a *vaultAuth) status(details map[string]interface{}) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+	details["auth_method"] = a.method
+	details["token_renewable"] = a.renewable
+	if !a.lastLogin.IsZero() {
+		details["last_login"] = a.lastLogin.UTC().Format(time.RFC3339)
+	}
+	if !a.lastRenewal.IsZero() {
+		details["last_renewal"] = a.lastRenewal.UTC().Format(time.RFC3339)
+	}
+	if !a.expires.IsZero() {
+		details["token_expires"] = a.expires.UTC().Format(time.RFC3339)
+	}
+	if a.lastErr != nil {
+		details["last_auth_error_time"] = a.lastErrTime.UTC().Format(time.RFC3339)
+		return a.lastErr
+	}
+	if !a.expires.IsZero() && time.Now().After(a.expires) {
+		return fmt.Errorf("the vault token expired at %s", a.expires.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
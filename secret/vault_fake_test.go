@@ -0,0 +1,500 @@
+// +build !novault
+
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package secret
+
+// Tests against a small fake of vault's HTTP API, so the AppRole login, token
+// renewal, and key/value version 2 handling can be tested without vault
+// installed.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+)
+
+type fakeToken struct {
+	expires    time.Time
+	maxExpires time.Time
+}
+
+type fakeVault struct {
+	mu        sync.Mutex
+	kvVersion int
+	mount     string
+	roleID    string
+	secretID  string
+	// a zero TTL makes tokens that never expire
+	tokenTTL    time.Duration
+	tokenMaxTTL time.Duration
+	tokens      map[string]*fakeToken
+	// every version of each secret, with nil for deleted versions
+	data     map[string][]map[string]interface{}
+	logins   int
+	renewals int
+	sealed   bool
+	// requests for these paths wait until the channel's closed
+	held    map[string]chan struct{}
+	arrived map[string]chan struct{}
+}
+
+func newFakeVault(kvVersion int) *fakeVault {
+	return &fakeVault{
+		kvVersion: kvVersion,
+		mount:     "keys",
+		roleID:    "goiardi-role",
+		secretID:  "goiardi-secret",
+		tokens:    make(map[string]*fakeToken),
+		data:      make(map[string][]map[string]interface{}),
+		held:      make(map[string]chan struct{}),
+		arrived:   make(map[string]chan struct{}),
+	}
+}
+
+func (f *fakeVault) newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	tok := hex.EncodeToString(b)
+	ft := &fakeToken{}
+	if f.tokenTTL > 0 {
+		now := time.Now()
+		ft.expires = now.Add(f.tokenTTL)
+		ft.maxExpires = now.Add(f.tokenMaxTTL)
+	}
+	f.tokens[tok] = ft
+	return tok
+}
+
+func (f *fakeVault) revokeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokens = make(map[string]*fakeToken)
+}
+
+func (f *fakeVault) counts() (int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.logins, f.renewals
+}
+
+func (f *fakeVault) put(path string, data map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data[path] = append(f.data[path], data)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func seconds(d time.Duration) int {
+	return int(d.Round(time.Second) / time.Second)
+}
+
+// hold makes requests for the path wait until the returned channel's closed,
+// sending on the other one when a request for it comes in.
+func (f *fakeVault) hold(path string) (chan struct{}, chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := make(chan struct{})
+	f.held[path] = c
+	arrived := make(chan struct{}, 1)
+	f.arrived[path] = arrived
+	return arrived, c
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, "/v1/")
+	f.mu.Lock()
+	c, arrived := f.held[p], f.arrived[p]
+	f.mu.Unlock()
+	if c != nil {
+		arrived <- struct{}{}
+		<-c
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch p {
+	case "sys/health":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"initialized": true, "sealed": f.sealed, "version": "fake"})
+		return
+	case "auth/approle/login":
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["role_id"] != f.roleID || body["secret_id"] != f.secretID {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"invalid secret id"}})
+			return
+		}
+		f.logins++
+		tok := f.newToken()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"auth": map[string]interface{}{"client_token": tok, "lease_duration": seconds(f.tokenTTL), "renewable": f.tokenTTL > 0}})
+		return
+	}
+
+	ft, ok := f.tokens[r.Header.Get("X-Vault-Token")]
+	if !ok || (!ft.expires.IsZero() && time.Now().After(ft.expires)) {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+		return
+	}
+
+	switch p {
+	case "auth/token/lookup-self":
+		ttl := 0
+		if !ft.expires.IsZero() {
+			ttl = seconds(time.Until(ft.expires))
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"ttl": ttl, "renewable": !ft.expires.IsZero()}})
+		return
+	case "auth/token/renew-self":
+		f.renewals++
+		ft.expires = time.Now().Add(f.tokenTTL)
+		if ft.expires.After(ft.maxExpires) {
+			ft.expires = ft.maxExpires
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"auth": map[string]interface{}{"client_token": r.Header.Get("X-Vault-Token"), "lease_duration": seconds(time.Until(ft.expires)), "renewable": true}})
+		return
+	}
+
+	if f.kvVersion == 2 {
+		f.serveKV2(w, r, p)
+	} else {
+		f.serveKV1(w, r, p)
+	}
+}
+
+func (f *fakeVault) serveKV1(w http.ResponseWriter, r *http.Request, p string) {
+	switch r.Method {
+	case http.MethodGet:
+		vers := f.data[p]
+		if len(vers) == 0 || vers[len(vers)-1] == nil {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": vers[len(vers)-1], "lease_duration": 2764800})
+	case http.MethodPut:
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.data[p] = []map[string]interface{}{body}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		delete(f.data, p)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeVault) serveKV2(w http.ResponseWriter, r *http.Request, p string) {
+	dataPrefix := f.mount + "/data/"
+	metaPrefix := f.mount + "/metadata/"
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(p, dataPrefix):
+		key := f.mount + "/" + strings.TrimPrefix(p, dataPrefix)
+		vers := f.data[key]
+		v := len(vers)
+		if vs := r.URL.Query().Get("version"); vs != "" {
+			v, _ = strconv.Atoi(vs)
+		}
+		if v < 1 || v > len(vers) {
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{}})
+			return
+		}
+		md := map[string]interface{}{"version": v, "deletion_time": ""}
+		if vers[v-1] == nil {
+			md["deletion_time"] = time.Now().UTC().Format(time.RFC3339)
+			writeJSON(w, http.StatusNotFound, map[string]interface{}{"data": map[string]interface{}{"data": nil, "metadata": md}})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"data": vers[v-1], "metadata": md}})
+	case r.Method == http.MethodPut && strings.HasPrefix(p, dataPrefix):
+		key := f.mount + "/" + strings.TrimPrefix(p, dataPrefix)
+		var body map[string]map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.data[key] = append(f.data[key], body["data"])
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"version": len(f.data[key])}})
+	case r.Method == http.MethodDelete && strings.HasPrefix(p, metaPrefix):
+		delete(f.data, f.mount+"/"+strings.TrimPrefix(p, metaPrefix))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{"no handler for route"}})
+	}
+}
+
+// useFakeVault points goiardi's vault settings at the fake, putting them back
+// the way they were when the test's done.
+func useFakeVault(t *testing.T, f *fakeVault, authMethod string) *httptest.Server {
+	ts := httptest.NewServer(f)
+	dir, err := ioutil.TempDir("", "goiardi-fake-vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretIDFile := filepath.Join(dir, "secret-id")
+	if err = ioutil.WriteFile(secretIDFile, []byte(f.secretID+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	saved := config.Config
+	config.Config.VaultAddr = ts.URL
+	config.Config.VaultAuthMethod = authMethod
+	config.Config.VaultAppRoleMount = "approle"
+	config.Config.VaultRoleID = f.roleID
+	config.Config.VaultSecretIDFile = secretIDFile
+	config.Config.VaultKVVersion = f.kvVersion
+	config.Config.VaultKVMount = f.mount
+	config.Config.VaultCacheTTLDur = 0
+	t.Cleanup(func() {
+		config.Config = saved
+		ts.Close()
+		os.RemoveAll(dir)
+	})
+	return ts
+}
+
+func fakeVaultStore(t *testing.T) *vaultSecretStore {
+	v, err := configureVault()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(v.close)
+	return v
+}
+
+func TestFakeVaultAppRoleKV2(t *testing.T) {
+	f := newFakeVault(2)
+	useFakeVault(t, f, config.VaultAuthAppRole)
+	v := fakeVaultStore(t)
+	if logins, _ := f.counts(); logins != 1 {
+		t.Errorf("expected to log in to vault once, logged in %d times", logins)
+	}
+
+	k := &keystoreKeyer{name: "approle-client"}
+	if err := v.setPublicKey(k, "first key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.setPublicKey(k, "second key"); err != nil {
+		t.Fatal(err)
+	}
+	if pk, err := v.getPublicKey(k); err != nil || pk != "second key" {
+		t.Errorf("public key was not the latest version: '%s' %v", pk, err)
+	}
+	old, err := v.getPublicKeyVersion(k, 1)
+	if err != nil || old != "first key" {
+		t.Errorf("the first version of the public key was not read: '%s' %v", old, err)
+	}
+	if _, err = v.getPublicKeyVersion(k, 3); err != ErrNotFound {
+		t.Errorf("a version of the public key that doesn't exist should have been ErrNotFound, got %v", err)
+	}
+	if err = v.deletePublicKey(k); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = v.getPublicKey(k); err == nil {
+		t.Errorf("public key was found after being deleted")
+	}
+
+	if _, err = v.getDataKeys("keys/encryption/data"); err != ErrNotFound {
+		t.Errorf("missing data keys should have been ErrNotFound, got %v", err)
+	}
+	if err = v.setDataKeys("keys/encryption/data", "abc\ndef"); err != nil {
+		t.Fatal(err)
+	}
+	if ks, err := v.getDataKeys("keys/encryption/data"); err != nil || ks != "abc\ndef" {
+		t.Errorf("data keys were not read back: '%s' %v", ks, err)
+	}
+	if err = v.setDataKeys("elsewhere/data", "abc"); err == nil {
+		t.Errorf("a path outside the key/value mount should have been rejected")
+	}
+	if _, err = v.getSigningKeyring("keys/shovey/signing/keyring"); err != ErrNotFound {
+		t.Errorf("a missing signing keyring should have been ErrNotFound, got %v", err)
+	}
+	if err = v.setSigningKeyring("keys/shovey/signing/keyring", `{"version":1}`); err != nil {
+		t.Fatal(err)
+	}
+	if kr, err := v.getSigningKeyring("keys/shovey/signing/keyring"); err != nil || kr != `{"version":1}` {
+		t.Errorf("the signing keyring was not read back: '%s' %v", kr, err)
+	}
+
+	h := v.health()
+	if !h.Healthy || h.Details["kv_version"] != 2 || h.Details["auth_method"] != config.VaultAuthAppRole {
+		t.Errorf("vault health was wrong: %+v", h)
+	}
+	f.mu.Lock()
+	f.sealed = true
+	f.mu.Unlock()
+	if h = v.health(); h.Healthy {
+		t.Errorf("a sealed vault was reported healthy")
+	}
+}
+
+func TestFakeVaultReloginAfterRevoke(t *testing.T) {
+	f := newFakeVault(1)
+	useFakeVault(t, f, config.VaultAuthAppRole)
+	v := fakeVaultStore(t)
+	k := &keystoreKeyer{name: "revoked"}
+	if err := v.setPasswdHash(k, "hash"); err != nil {
+		t.Fatal(err)
+	}
+	v.secrets = make(map[string]*secretVal)
+	f.revokeAll()
+	// logging in again too quickly is skipped
+	v.auth.m.Lock()
+	v.auth.lastLogin = time.Now().Add(-time.Minute)
+	v.auth.m.Unlock()
+
+	if h, err := v.getPasswdHash(k); err != nil || h != "hash" {
+		t.Errorf("secret was not read after logging in again: '%s' %v", h, err)
+	}
+	if logins, _ := f.counts(); logins != 2 {
+		t.Errorf("expected to log in to vault twice, logged in %d times", logins)
+	}
+}
+
+func TestFakeVaultTokenRenewal(t *testing.T) {
+	f := newFakeVault(1)
+	f.tokenTTL = time.Second
+	f.tokenMaxTTL = 2 * time.Second
+	useFakeVault(t, f, config.VaultAuthAppRole)
+	v := fakeVaultStore(t)
+
+	// the token gets renewed, and once it can't be renewed anymore
+	// goiardi logs in again
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if logins, renewals := f.counts(); logins >= 2 && renewals >= 1 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	logins, renewals := f.counts()
+	if renewals < 1 {
+		t.Errorf("the vault token was never renewed")
+	}
+	if logins < 2 {
+		t.Errorf("goiardi did not log in to vault again when the token reached its max TTL")
+	}
+	k := &keystoreKeyer{name: "renewed"}
+	if err := v.setPublicKey(k, "still works"); err != nil {
+		t.Errorf("vault could not be used after renewing the token: %s", err.Error())
+	}
+}
+
+func TestFakeVaultToken(t *testing.T) {
+	f := newFakeVault(1)
+	useFakeVault(t, f, config.VaultAuthToken)
+	f.mu.Lock()
+	tok := f.newToken()
+	f.mu.Unlock()
+	oldTok, hadTok := os.LookupEnv("VAULT_TOKEN")
+	os.Setenv("VAULT_TOKEN", tok)
+	defer func() {
+		if hadTok {
+			os.Setenv("VAULT_TOKEN", oldTok)
+		} else {
+			os.Unsetenv("VAULT_TOKEN")
+		}
+	}()
+	v := fakeVaultStore(t)
+	if h := v.health(); !h.Healthy || h.Details["auth_method"] != config.VaultAuthToken {
+		t.Errorf("vault health was wrong: %+v", h)
+	}
+	k := &keystoreKeyer{name: "token-client"}
+	if err := v.setPublicKey(k, "pubkey"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.getPublicKeyVersion(k, 1); err != ErrNoVersions {
+		t.Errorf("version 1 of the key/value engine should not have had older versions of secrets, got %v", err)
+	}
+	// there's no logging in again with a plain token
+	v.secrets = make(map[string]*secretVal)
+	f.revokeAll()
+	if _, err := v.getPublicKey(k); err == nil {
+		t.Errorf("a revoked token should not have been able to read secrets")
+	}
+}
+
+func TestFakeVaultCacheTTL(t *testing.T) {
+	f := newFakeVault(2)
+	useFakeVault(t, f, config.VaultAuthAppRole)
+	config.Config.VaultCacheTTLDur = 50 * time.Millisecond
+	v := fakeVaultStore(t)
+	k := &keystoreKeyer{name: "cached"}
+	if err := v.setPublicKey(k, "before"); err != nil {
+		t.Fatal(err)
+	}
+	// changed behind goiardi's back
+	f.put(makePubKeyPath(k), map[string]interface{}{"pubKey": "after"})
+	if pk, _ := v.getPublicKey(k); pk != "before" {
+		t.Errorf("the cached public key was not used: '%s'", pk)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if pk, _ := v.getPublicKey(k); pk != "after" {
+		t.Errorf("the public key was not fetched again after the cache TTL: '%s'", pk)
+	}
+	if s := v.secrets[makePubKeyPath(k)]; s == nil || s.version != 2 {
+		t.Errorf("the refetched secret was not cached with its new version: %+v", s)
+	}
+}
+
+func TestFakeVaultLookupsDontWait(t *testing.T) {
+	f := newFakeVault(2)
+	useFakeVault(t, f, config.VaultAuthAppRole)
+	v := fakeVaultStore(t)
+	cached := &keystoreKeyer{name: "cached"}
+	slow := &keystoreKeyer{name: "slow"}
+	if err := v.setPublicKey(cached, "cached key"); err != nil {
+		t.Fatal(err)
+	}
+	f.put(makePubKeyPath(slow), map[string]interface{}{"pubKey": "slow key"})
+
+	// fetching the slow key from vault shouldn't hold up a cached one
+	arrived, release := f.hold("keys/data/keyer/slow")
+	done := make(chan error)
+	go func() {
+		_, err := v.getPublicKey(slow)
+		done <- err
+	}()
+	<-arrived
+	found := make(chan string)
+	go func() {
+		pk, _ := v.getPublicKey(cached)
+		found <- pk
+	}()
+	select {
+	case pk := <-found:
+		if pk != "cached key" {
+			t.Errorf("the cached public key was wrong: '%s'", pk)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("looking up a cached public key waited on fetching another from vault")
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,153 @@
+// +build !novault
+
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package secret
+
+// Reading and writing secrets with either version of vault's key/value secrets
+// engine. Version 1 keeps secrets right at the path given, while version 2
+// keeps them under <mount>/data/ and <mount>/metadata/, and keeps older
+// versions of them around.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ctdk/goiardi/config"
+	vault "github.com/hashicorp/vault/api"
+)
+
+type kvEngine struct {
+	version int
+	mount   string
+	logical *vault.Logical
+}
+
+type kvSecret struct {
+	data map[string]interface{}
+	// always 0 with version 1 of the secrets engine
+	version int
+	secret  *vault.Secret
+}
+
+func newKVEngine(c *vault.Client) *kvEngine {
+	kv := &kvEngine{version: 1, mount: "keys", logical: c.Logical()}
+	if config.Config.VaultKVVersion == 2 {
+		kv.version = 2
+	}
+	if config.Config.VaultKVMount != "" {
+		kv.mount = config.Config.VaultKVMount
+	}
+	return kv
+}
+
+// apiPath turns the path of a secret into the path to use with vault's API.
+// With version 2, kind is either "data" or "metadata".
+func (kv *kvEngine) apiPath(path string, kind string) (string, error) {
+	if kv.version != 2 {
+		return path, nil
+	}
+	prefix := kv.mount + "/"
+	if !strings.HasPrefix(path, prefix) {
+		return "", fmt.Errorf("secret path %s is not under the key/value secrets engine mounted at %s", path, kv.mount)
+	}
+	return prefix + kind + "/" + strings.TrimPrefix(path, prefix), nil
+}
+
+// read gets a secret from vault, or nil if there isn't one. With version 2 of
+// the secrets engine, an older version of the secret can be read by giving its
+// version number; 0 gets the latest version.
+func (kv *kvEngine) read(path string, version int) (*kvSecret, error) {
+	p, err := kv.apiPath(path, "data")
+	if err != nil {
+		return nil, err
+	}
+	if kv.version != 2 {
+		if version != 0 {
+			return nil, fmt.Errorf("reading older versions of secrets needs version 2 of the key/value secrets engine")
+		}
+		s, err := kv.logical.Read(p)
+		if err != nil || s == nil {
+			return nil, err
+		}
+		return &kvSecret{data: s.Data, secret: s}, nil
+	}
+
+	var params map[string][]string
+	if version > 0 {
+		params = map[string][]string{"version": {strconv.Itoa(version)}}
+	}
+	s, err := kv.logical.ReadWithData(p, params)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	data, _ := s.Data["data"].(map[string]interface{})
+	if data == nil {
+		// this version was deleted or destroyed
+		return nil, nil
+	}
+	ks := &kvSecret{data: data, secret: s}
+	if md, ok := s.Data["metadata"].(map[string]interface{}); ok {
+		ks.version = jsonInt(md["version"])
+	}
+	return ks, nil
+}
+
+// write saves a secret in vault, returning its new version number with version
+// 2 of the secrets engine.
+func (kv *kvEngine) write(path string, data map[string]interface{}) (int, error) {
+	p, err := kv.apiPath(path, "data")
+	if err != nil {
+		return 0, err
+	}
+	if kv.version != 2 {
+		_, err = kv.logical.Write(p, data)
+		return 0, err
+	}
+	s, err := kv.logical.Write(p, map[string]interface{}{"data": data})
+	if err != nil || s == nil {
+		return 0, err
+	}
+	return jsonInt(s.Data["version"]), nil
+}
+
+// delete removes a secret from vault. With version 2 of the secrets engine,
+// every version of it is removed.
+func (kv *kvEngine) delete(path string) error {
+	p, err := kv.apiPath(path, "metadata")
+	if err != nil {
+		return err
+	}
+	_, err = kv.logical.Delete(p)
+	return err
+}
+
+func jsonInt(i interface{}) int {
+	switch i := i.(type) {
+	case json.Number:
+		n, _ := i.Int64()
+		return int(n)
+	case float64:
+		return int(i)
+	case int:
+		return i
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Moving public keys, password hashes, the shovey signing keys, and the data
+// encryption master keys from one secret store to another.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/ctdk/goiardi/client"
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datacrypt"
+	"github.com/ctdk/goiardi/secret"
+	"github.com/ctdk/goiardi/shovey"
+	"github.com/ctdk/goiardi/user"
+	"github.com/tideland/golib/logger"
+)
+
+// migrateSecrets copies every client's and user's secrets, the shovey signing
+// key and keyring, and the data encryption master keys, from the given secret
+// store into the one goiardi is configured to use. When they're moved out of
+// goiardi's own storage, the copies kept there are cleared.
+func migrateSecrets(from string) error {
+	to := config.SecretStoreInUse()
+	if from == to {
+		return fmt.Errorf("goiardi is already using the %s secret store", from)
+	}
+	// put things back the way they were configured when done
+	defer func(useExt bool) {
+		config.Config.UseExtSecrets = useExt
+	}(config.Config.UseExtSecrets)
+
+	if err := useSecretStore(from); err != nil {
+		return err
+	}
+	clients := client.AllClients()
+	clientKeys := make([]string, len(clients))
+	for i, c := range clients {
+		clientKeys[i] = c.PublicKey()
+	}
+	users := user.AllUsers()
+	userKeys := make([]string, len(users))
+	userPasswds := make([]string, len(users))
+	for i, u := range users {
+		userKeys[i] = u.PublicKey()
+		userPasswds[i] = u.Passwd()
+	}
+	// With the builtin store, the signing key has to be in its file
+	// already for goiardi to start at all, so it's only moved out of it.
+	var signingKey *rsa.PrivateKey
+	if config.Config.UseShovey && to != config.SecretStoreBuiltin {
+		var err error
+		if signingKey, err = migrationSigningKey(from); err != nil {
+			return err
+		}
+	}
+	// Rotated signing keys are kept in a keyring, which goes everywhere.
+	var keyring string
+	if config.Config.UseShovey {
+		var err error
+		if keyring, err = shovey.SigningKeyring(); err != nil {
+			return fmt.Errorf("error getting the shovey signing keyring from the %s secret store: %s", from, err.Error())
+		}
+	}
+
+	dataKeys, err := migrationDataKeys(from, to)
+	if err != nil {
+		return err
+	}
+
+	if err := useSecretStore(to); err != nil {
+		return err
+	}
+	for i, c := range clients {
+		if clientKeys[i] == "" {
+			logger.Warningf("client %s has no public key in the %s secret store, skipping it", c.Name, from)
+			continue
+		}
+		var err error
+		if to == config.SecretStoreBuiltin {
+			err = c.SetPublicKey(clientKeys[i])
+		} else {
+			err = secret.SetPublicKey(c, clientKeys[i])
+			c.ClearStoredSecrets()
+		}
+		if err != nil {
+			return fmt.Errorf("error moving the public key for client %s: %s", c.Name, err.Error())
+		}
+		if to == config.SecretStoreBuiltin || from == config.SecretStoreBuiltin {
+			if gerr := c.Save(); gerr != nil {
+				return gerr
+			}
+		}
+	}
+	for i, u := range users {
+		if userKeys[i] == "" {
+			logger.Warningf("user %s has no public key in the %s secret store, skipping it", u.Username, from)
+			continue
+		}
+		var err error
+		if to == config.SecretStoreBuiltin {
+			if err = u.SetPublicKey(userKeys[i]); err == nil {
+				u.SetPasswdHash(userPasswds[i])
+			}
+		} else {
+			err = secret.SetPublicKey(u, userKeys[i])
+			if err == nil && userPasswds[i] != "" {
+				err = secret.SetPasswdHash(u, userPasswds[i])
+			}
+			u.ClearStoredSecrets()
+		}
+		if err != nil {
+			return fmt.Errorf("error moving the secrets for user %s: %s", u.Username, err.Error())
+		}
+		if to == config.SecretStoreBuiltin || from == config.SecretStoreBuiltin {
+			if gerr := u.Save(); gerr != nil {
+				return gerr
+			}
+		}
+	}
+	if signingKey != nil {
+		if err := secret.SetSigningKey(config.Config.VaultShoveyKey, signingKey); err != nil {
+			return fmt.Errorf("error moving the shovey signing key: %s", err.Error())
+		}
+	}
+	if keyring != "" {
+		if err := shovey.SetSigningKeyring(keyring); err != nil {
+			return fmt.Errorf("error moving the shovey signing keyring: %s", err.Error())
+		}
+	}
+	if len(dataKeys) != 0 {
+		if err := moveDataKeys(dataKeys); err != nil {
+			return fmt.Errorf("error moving the data encryption master keys: %s", err.Error())
+		}
+	}
+	fmt.Printf("Moved the secrets for %d clients and %d users from the %s secret store to the %s secret store.\n", len(clients), len(users), from, to)
+	if from != config.SecretStoreBuiltin {
+		fmt.Printf("The secrets are still in the %s secret store, and can be removed from it once everything's working.\n", from)
+	}
+	return nil
+}
+
+// useSecretStore switches where secrets are read from and saved to.
+func useSecretStore(kind string) error {
+	if kind == config.SecretStoreBuiltin {
+		config.Config.UseExtSecrets = false
+		return nil
+	}
+	config.Config.UseExtSecrets = true
+	return secret.UseSecretStore(kind)
+}
+
+func migrationSigningKey(from string) (*rsa.PrivateKey, error) {
+	if from != config.SecretStoreBuiltin {
+		pk, err := secret.GetSigningKey(config.Config.VaultShoveyKey)
+		if err != nil {
+			return nil, fmt.Errorf("error getting the shovey signing key from the %s secret store: %s", from, err.Error())
+		}
+		return pk, nil
+	}
+	keyPath := config.Config.SignPrivKey
+	if keyPath == "" {
+		keyPath = path.Join(config.Config.ConfRoot, "shovey-sign_rsa")
+	} else if !path.IsAbs(keyPath) {
+		keyPath = path.Join(config.Config.ConfRoot, keyPath)
+	}
+	privPem, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	privBlock, _ := pem.Decode(privPem)
+	if privBlock == nil {
+		return nil, fmt.Errorf("invalid block size for private key %s for shovey", keyPath)
+	}
+	return x509.ParsePKCS1PrivateKey(privBlock.Bytes)
+}
+
+// migrationDataKeys gets the data encryption master keys to move. They're only
+// ever kept in an external secret store, so there's nowhere to put them if
+// the secrets are moving back into goiardi's own storage; that's only allowed
+// if nothing was encrypted with them.
+func migrationDataKeys(from string, to string) ([][]byte, error) {
+	if from == config.SecretStoreBuiltin || !config.UsingDB() {
+		return nil, nil
+	}
+	keys, err := secret.GetDataKeys(config.Config.DataKeyPath)
+	if err == secret.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting the data encryption master keys from the %s secret store: %s", from, err.Error())
+	}
+	if to == config.SecretStoreBuiltin && len(keys) != 0 {
+		enc, err := datacrypt.HaveEncryptedData()
+		if err != nil {
+			return nil, err
+		}
+		if enc {
+			return nil, fmt.Errorf("there is data encrypted with the data encryption master keys in the %s secret store, which can't be moved into goiardi's own storage", from)
+		}
+		logger.Warningf("not moving the data encryption master keys into goiardi's own storage, since nothing is encrypted with them")
+		return nil, nil
+	}
+	return keys, nil
+}
+
+// moveDataKeys saves the data encryption master keys in the secret store being
+// moved to. Any keys already there that aren't being moved are kept after
+// them, so whatever they encrypted can still be decrypted.
+func moveDataKeys(keys [][]byte) error {
+	existing, err := secret.GetDataKeys(config.Config.DataKeyPath)
+	if err != nil && err != secret.ErrNotFound {
+		return err
+	}
+	for _, ek := range existing {
+		found := false
+		for _, k := range keys {
+			if bytes.Equal(k, ek) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			keys = append(keys, ek)
+		}
+	}
+	return secret.SetDataKeys(config.Config.DataKeyPath, keys)
+}
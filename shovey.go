@@ -19,13 +19,18 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/client"
 	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/node"
 	"github.com/ctdk/goiardi/reqctx"
 	"github.com/ctdk/goiardi/shovey"
 	"github.com/ctdk/goiardi/util"
 	"github.com/tideland/golib/logger"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func shoveyHandler(w http.ResponseWriter, r *http.Request) {
@@ -35,7 +40,20 @@ func shoveyHandler(w http.ResponseWriter, r *http.Request) {
 		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
 		return
 	}
-	if !opUser.IsAdmin() && r.Method != http.MethodPut {
+	pathArray := splitPath(r.URL.Path)
+	pathArrayLen := len(pathArray)
+
+	// Node agents polling for jobs over HTTP may only get their own node's
+	// jobs.
+	if pathArrayLen == 3 && pathArray[1] == "queue" {
+		if !opUser.IsAdmin() && !(opUser.IsClient() && opUser.(*client.Client).NodeName == pathArray[2]) {
+			jsonErrorReport(w, r, "you cannot perform this action", http.StatusForbidden)
+			return
+		}
+	} else if pathArrayLen == 2 && pathArray[1] == "keys" && r.Method == http.MethodGet {
+		// Any client or user may fetch the public signing keys, so
+		// node agents can keep up with key rotation.
+	} else if !opUser.IsAdmin() && r.Method != http.MethodPut {
 		jsonErrorReport(w, r, "you cannot perform this action", http.StatusForbidden)
 		return
 	}
@@ -45,9 +63,6 @@ func shoveyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pathArray := splitPath(r.URL.Path)
-	pathArrayLen := len(pathArray)
-
 	if pathArrayLen < 2 || pathArrayLen > 4 || pathArray[1] == "" {
 		jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
 		return
@@ -91,6 +106,17 @@ func shoveyHandler(w http.ResponseWriter, r *http.Request) {
 					jsonErrorReport(w, r, err.Error(), err.Status())
 					return
 				}
+				// Reading every node's output is expensive
+				// with lots of nodes, so it's only grouped
+				// when asked for.
+				if outType := r.URL.Query().Get("output_groups"); outType != "" {
+					groups, err := shove.GroupOutputs(outType)
+					if err != nil {
+						jsonErrorReport(w, r, err.Error(), err.Status())
+						return
+					}
+					shoveyResponse["output_groups"] = groups
+				}
 			default:
 				shoveyIDs, err := shovey.AllShoveyIDs()
 				if err != nil {
@@ -104,6 +130,33 @@ func shoveyHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 		case http.MethodPost:
+			// approving or rejecting a job made from a template
+			if pathArrayLen == 4 {
+				shove, err := shovey.Get(pathArray[2])
+				if err != nil {
+					jsonErrorReport(w, r, err.Error(), err.Status())
+					return
+				}
+				switch pathArray[3] {
+				case "approve":
+					err = shove.Approve(opUser.GetName())
+				case "reject":
+					err = shove.Reject(opUser.GetName())
+				default:
+					jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+					return
+				}
+				if err != nil {
+					jsonErrorReport(w, r, err.Error(), err.Status())
+					return
+				}
+				shoveyResponse, err = shove.ToJSON()
+				if err != nil {
+					jsonErrorReport(w, r, err.Error(), err.Status())
+					return
+				}
+				break
+			}
 			if pathArrayLen != 2 {
 				jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
 				return
@@ -114,39 +167,13 @@ func shoveyHandler(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			logger.Debugf("shvData: %v", shvData)
-			var quorum string
-			var timeout int
-			var ok bool
-			if quorum, ok = shvData["quorum"].(string); !ok {
-				quorum = "100%"
-			}
-			logger.Debugf("run_timeout is a %T", shvData["run_timeout"])
-			switch t := shvData["run_timeout"].(type) {
-			case json.Number:
-				tj, _ := t.Int64()
-				timeout = int(tj)
-			case float64:
-				timeout = int(t)
-			default:
-				timeout = 300
-			}
-			var nodeNames []string
-
-			if shvNodes, ok := shvData["nodes"].([]interface{}); ok {
-				if len(shvNodes) == 0 {
-					jsonErrorReport(w, r, "no nodes provided", http.StatusBadRequest)
-					return
-				}
-				nodeNames = make([]string, len(shvNodes))
-				for i, v := range shvNodes {
-					nodeNames[i] = v.(string)
-				}
-			} else {
-				jsonErrorReport(w, r, "node list not an array", http.StatusBadRequest)
+			spec, serr := parseJobSpec(shvData)
+			if serr != nil {
+				jsonErrorReport(w, r, serr.Error(), serr.Status())
 				return
 			}
-
-			s, gerr := shovey.New(shvData["command"].(string), timeout, quorum, nodeNames)
+			spec.RequestedBy = opUser.GetName()
+			s, gerr := spec.NewJob()
 			if gerr != nil {
 				jsonErrorReport(w, r, gerr.Error(), gerr.Status())
 				return
@@ -159,6 +186,9 @@ func shoveyHandler(w http.ResponseWriter, r *http.Request) {
 
 			shoveyResponse["id"] = s.RunID
 			shoveyResponse["uri"] = util.CustomURL(fmt.Sprintf("/shovey/jobs/%s", s.RunID))
+			if s.Status == "awaiting_approval" {
+				shoveyResponse["status"] = s.Status
+			}
 		case http.MethodPut:
 			switch pathArrayLen {
 			case 3:
@@ -243,7 +273,9 @@ func shoveyHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	case "stream":
-		if pathArrayLen != 4 {
+		// The whole job's output can only be followed, not fetched all
+		// at once.
+		if pathArrayLen != 4 && !(pathArrayLen == 3 && r.Method == http.MethodGet) {
 			jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
 			return
 		}
@@ -285,6 +317,19 @@ func shoveyHandler(w http.ResponseWriter, r *http.Request) {
 				jsonErrorReport(w, r, err.Error(), err.Status())
 				return
 			}
+			if pathArrayLen == 3 {
+				followShoveyOutput(w, r, shove, nil, outType, seq)
+				return
+			}
+			if wantsFollow(r) {
+				// make sure the node's part of the job first
+				if _, err = shove.GetRun(pathArray[3]); err != nil {
+					jsonErrorReport(w, r, err.Error(), err.Status())
+					return
+				}
+				followShoveyOutput(w, r, shove, []string{pathArray[3]}, outType, seq)
+				return
+			}
 			sj, err := shove.GetRun(pathArray[3])
 			if err != nil {
 				jsonErrorReport(w, r, err.Error(), err.Status())
@@ -371,6 +416,105 @@ func shoveyHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+	case "queue":
+		if pathArrayLen != 3 {
+			jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+			return
+		}
+		nodeName := pathArray[2]
+		if _, nerr := node.Get(nodeName); nerr != nil {
+			jsonErrorReport(w, r, nerr.Error(), nerr.Status())
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			// default to waiting 30 seconds for jobs to come in
+			wait := 30
+			if ws := r.FormValue("wait"); ws != "" {
+				var err error
+				wait, err = strconv.Atoi(ws)
+				if err != nil || wait < 0 {
+					jsonErrorReport(w, r, "invalid wait", http.StatusBadRequest)
+					return
+				}
+			}
+			msgs, err := shovey.PollJobs(nodeName, time.Duration(wait)*time.Second)
+			if err != nil {
+				jsonErrorReport(w, r, err.Error(), err.Status())
+				return
+			}
+			shoveyResponse["jobs"] = msgs
+		case http.MethodPut:
+			ackData, perr := parseObjJSON(r.Body)
+			if perr != nil {
+				jsonErrorReport(w, r, perr.Error(), http.StatusBadRequest)
+				return
+			}
+			id, ok := ackData["id"].(string)
+			if !ok {
+				jsonErrorReport(w, r, "No job message id provided, or provided id was invalid", http.StatusBadRequest)
+				return
+			}
+			if err := shovey.AckJob(nodeName, id); err != nil {
+				jsonErrorReport(w, r, err.Error(), err.Status())
+				return
+			}
+			shoveyResponse["response"] = "ok"
+		default:
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+	case "keys":
+		if pathArrayLen != 2 {
+			jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			if !opUser.IsAdmin() {
+				jsonErrorReport(w, r, "you cannot perform this action", http.StatusForbidden)
+				return
+			}
+			kid, err := shovey.RotateSigningKeyNow()
+			if err != nil {
+				jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			logger.Infof("%s rotated the shovey signing key, the new key is %s", opUser.GetName(), kid)
+		default:
+			jsonErrorReport(w, r, "Unrecognized method", http.StatusMethodNotAllowed)
+			return
+		}
+		cur, keys, err := shovey.PublicSigningKeys()
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		shoveyResponse["current"] = cur
+		shoveyResponse["keys"] = keys
+	case "schedules":
+		if !opUser.IsAdmin() {
+			jsonErrorReport(w, r, "you cannot perform this action", http.StatusForbidden)
+			return
+		}
+		var err util.Gerror
+		shoveyResponse, err = shoveySchedules(r, pathArray, opUser)
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+	case "templates":
+		if !opUser.IsAdmin() {
+			jsonErrorReport(w, r, "you cannot perform this action", http.StatusForbidden)
+			return
+		}
+		var err util.Gerror
+		shoveyResponse, err = shoveyTemplates(r, pathArray)
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
 	default:
 		jsonErrorReport(w, r, "Unrecognized operation", http.StatusBadRequest)
 		return
@@ -383,3 +527,416 @@ func shoveyHandler(w http.ResponseWriter, r *http.Request) {
 
 	return
 }
+
+// parseJobSpec pulls what's needed to create a shovey job out of a request:
+// the command, either a list of nodes or a search query to find them, and
+// the quorum, timeout, and rolling execution settings.
+func parseJobSpec(shvData map[string]interface{}) (*shovey.JobSpec, util.Gerror) {
+	spec := &shovey.JobSpec{Quorum: "100%", Timeout: 300, MaxFailures: -1}
+	var ok bool
+	// Jobs run either a command, or a command made from a template and
+	// its arguments.
+	if tmpl, found := shvData["template"]; found {
+		if spec.Template, ok = tmpl.(string); !ok {
+			return nil, badJobSpec("the template name isn't a string")
+		}
+		if a, found := shvData["args"]; found {
+			args, ok := a.(map[string]interface{})
+			if !ok {
+				return nil, badJobSpec("template arguments must be an object")
+			}
+			spec.Args = make(map[string]string, len(args))
+			for k, v := range args {
+				switch v := v.(type) {
+				case string:
+					spec.Args[k] = v
+				case json.Number:
+					spec.Args[k] = v.String()
+				default:
+					return nil, badJobSpec(fmt.Sprintf("template argument %s must be a string or a number", k))
+				}
+			}
+		}
+	} else if spec.Command, ok = shvData["command"].(string); !ok {
+		return nil, badJobSpec("no command given, or the command isn't a string")
+	}
+	if q, ok := shvData["quorum"].(string); ok {
+		spec.Quorum = q
+	}
+	logger.Debugf("run_timeout is a %T", shvData["run_timeout"])
+	switch t := shvData["run_timeout"].(type) {
+	case json.Number:
+		tj, _ := t.Int64()
+		spec.Timeout = int(tj)
+	case float64:
+		spec.Timeout = int(t)
+	}
+
+	// Jobs can be aimed at either a list of nodes or the nodes matching a
+	// search query.
+	if query, ok := shvData["search"].(string); ok {
+		if _, ok := shvData["nodes"]; ok {
+			return nil, badJobSpec("give either a node list or a search query, not both")
+		}
+		if query == "" {
+			return nil, badJobSpec("empty search query")
+		}
+		spec.Search = query
+		spec.ResolveAtStart, _ = shvData["resolve_at_start"].(bool)
+	} else if shvNodes, ok := shvData["nodes"].([]interface{}); ok {
+		if len(shvNodes) == 0 {
+			return nil, badJobSpec("no nodes provided")
+		}
+		spec.NodeNames = make([]string, len(shvNodes))
+		for i, v := range shvNodes {
+			if spec.NodeNames[i], ok = v.(string); !ok {
+				return nil, badJobSpec("node names must be strings")
+			}
+		}
+	} else {
+		return nil, badJobSpec("node list not an array")
+	}
+
+	if bs, ok := shvData["batch_size"]; ok {
+		switch bs := bs.(type) {
+		case string:
+			spec.BatchSize = bs
+		case json.Number:
+			spec.BatchSize = bs.String()
+		default:
+			return nil, badJobSpec("batch_size must be a number of nodes or a percentage")
+		}
+		if bw, ok := shvData["batch_wait"].(json.Number); ok {
+			bwi, _ := bw.Int64()
+			spec.BatchWait = int(bwi)
+		}
+		if mf, ok := shvData["max_failures"].(json.Number); ok {
+			mfi, _ := mf.Int64()
+			spec.MaxFailures = int(mfi)
+		}
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+func badJobSpec(msg string) util.Gerror {
+	err := util.Errorf("%s", msg)
+	err.SetStatus(http.StatusBadRequest)
+	return err
+}
+
+// shoveySchedules handles creating, changing, and running shovey schedules.
+func shoveySchedules(r *http.Request, pathArray []string, opUser actor.Actor) (map[string]interface{}, util.Gerror) {
+	pathArrayLen := len(pathArray)
+	schedResponse := make(map[string]interface{})
+
+	if pathArrayLen == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			for _, name := range shovey.ScheduleList() {
+				schedResponse[name] = util.CustomURL(fmt.Sprintf("/shovey/schedules/%s", name))
+			}
+		case http.MethodPost:
+			schedData, err := parseObjJSON(r.Body)
+			if err != nil {
+				return nil, badJobSpec(err.Error())
+			}
+			name, ok := schedData["name"].(string)
+			if !ok {
+				return nil, badJobSpec("no schedule name given")
+			}
+			spec, cron, interval, gerr := parseScheduleData(schedData)
+			if gerr != nil {
+				return nil, gerr
+			}
+			spec.RequestedBy = opUser.GetName()
+			enabled := true
+			if e, ok := schedData["enabled"].(bool); ok {
+				enabled = e
+			}
+			sc, gerr := shovey.NewSchedule(name, spec, cron, interval, enabled)
+			if gerr != nil {
+				return nil, gerr
+			}
+			schedResponse["name"] = sc.Name
+			schedResponse["uri"] = util.CustomURL(fmt.Sprintf("/shovey/schedules/%s", sc.Name))
+		default:
+			err := util.Errorf("Unrecognized method")
+			err.SetStatus(http.StatusMethodNotAllowed)
+			return nil, err
+		}
+		return schedResponse, nil
+	}
+
+	sc, gerr := shovey.GetSchedule(pathArray[2])
+	if gerr != nil {
+		return nil, gerr
+	}
+
+	if pathArrayLen == 4 {
+		action := pathArray[3]
+		switch {
+		case action == "history" && r.Method == http.MethodGet:
+			hist, err := sc.History()
+			if err != nil {
+				return nil, err
+			}
+			jobs := make([]map[string]interface{}, 0, len(hist))
+			for _, s := range hist {
+				sj, err := s.ToJSON()
+				if err != nil {
+					return nil, err
+				}
+				jobs = append(jobs, sj)
+			}
+			schedResponse["jobs"] = jobs
+			return schedResponse, nil
+		case r.Method != http.MethodPost:
+			err := util.Errorf("Unrecognized method")
+			err.SetStatus(http.StatusMethodNotAllowed)
+			return nil, err
+		case action == "enable" || action == "disable":
+			if err := sc.SetEnabled(action == "enable"); err != nil {
+				return nil, err
+			}
+		case action == "run":
+			s, err := sc.RunNow()
+			if err != nil {
+				return nil, err
+			}
+			schedResponse["id"] = s.RunID
+			schedResponse["uri"] = util.CustomURL(fmt.Sprintf("/shovey/jobs/%s", s.RunID))
+			return schedResponse, nil
+		default:
+			return nil, badJobSpec(fmt.Sprintf("unknown shovey schedule action '%s'", action))
+		}
+		return sc.ToJSON(), nil
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		schedData, err := parseObjJSON(r.Body)
+		if err != nil {
+			return nil, badJobSpec(err.Error())
+		}
+		if name, ok := schedData["name"].(string); ok && name != sc.Name {
+			return nil, badJobSpec("shovey schedules cannot be renamed")
+		}
+		spec, cron, interval, gerr := parseScheduleData(schedData)
+		if gerr != nil {
+			return nil, gerr
+		}
+		spec.RequestedBy = opUser.GetName()
+		if gerr = sc.Update(spec, cron, interval); gerr != nil {
+			return nil, gerr
+		}
+		if e, ok := schedData["enabled"].(bool); ok {
+			if gerr = sc.SetEnabled(e); gerr != nil {
+				return nil, gerr
+			}
+		}
+	case http.MethodDelete:
+		if err := sc.Delete(); err != nil {
+			return nil, err
+		}
+	default:
+		err := util.Errorf("Unrecognized method")
+		err.SetStatus(http.StatusMethodNotAllowed)
+		return nil, err
+	}
+	return sc.ToJSON(), nil
+}
+
+func parseScheduleData(schedData map[string]interface{}) (*shovey.JobSpec, string, int, util.Gerror) {
+	jobData, ok := schedData["job"].(map[string]interface{})
+	if !ok {
+		return nil, "", 0, badJobSpec("no job given for the schedule")
+	}
+	spec, err := parseJobSpec(jobData)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	var cron string
+	if c, ok := schedData["cron"]; ok {
+		if cron, ok = c.(string); !ok {
+			return nil, "", 0, badJobSpec("cron must be a string")
+		}
+	}
+	var interval int
+	if i, ok := schedData["interval"]; ok {
+		in, ok := i.(json.Number)
+		if !ok {
+			return nil, "", 0, badJobSpec("interval must be a number of seconds")
+		}
+		iv, _ := in.Int64()
+		interval = int(iv)
+	}
+	return spec, cron, interval, nil
+}
+
+// shoveyTemplates handles creating, changing, and deleting shovey command
+// templates.
+func shoveyTemplates(r *http.Request, pathArray []string) (map[string]interface{}, util.Gerror) {
+	tmplResponse := make(map[string]interface{})
+
+	switch len(pathArray) {
+	case 2:
+		switch r.Method {
+		case http.MethodGet:
+			for _, name := range shovey.TemplateList() {
+				tmplResponse[name] = util.CustomURL(fmt.Sprintf("/shovey/templates/%s", name))
+			}
+		case http.MethodPost:
+			tmplData, err := parseObjJSON(r.Body)
+			if err != nil {
+				return nil, badJobSpec(err.Error())
+			}
+			name, ok := tmplData["name"].(string)
+			if !ok {
+				return nil, badJobSpec("no template name given")
+			}
+			t, gerr := shovey.NewTemplate(name)
+			if gerr != nil {
+				return nil, gerr
+			}
+			if gerr = t.UpdateFromJSON(tmplData); gerr != nil {
+				return nil, gerr
+			}
+			if gerr = t.Save(); gerr != nil {
+				return nil, gerr
+			}
+			tmplResponse["name"] = t.Name
+			tmplResponse["uri"] = util.CustomURL(fmt.Sprintf("/shovey/templates/%s", t.Name))
+		default:
+			err := util.Errorf("Unrecognized method")
+			err.SetStatus(http.StatusMethodNotAllowed)
+			return nil, err
+		}
+		return tmplResponse, nil
+	case 3:
+	default:
+		return nil, badJobSpec("Bad request")
+	}
+
+	t, gerr := shovey.GetTemplate(pathArray[2])
+	if gerr != nil {
+		return nil, gerr
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		tmplData, err := parseObjJSON(r.Body)
+		if err != nil {
+			return nil, badJobSpec(err.Error())
+		}
+		if gerr = t.UpdateFromJSON(tmplData); gerr != nil {
+			return nil, gerr
+		}
+		if gerr = t.Save(); gerr != nil {
+			return nil, gerr
+		}
+	case http.MethodDelete:
+		if gerr = t.Delete(); gerr != nil {
+			return nil, gerr
+		}
+	default:
+		err := util.Errorf("Unrecognized method")
+		err.SetStatus(http.StatusMethodNotAllowed)
+		return nil, err
+	}
+	return t.ToJSON(), nil
+}
+
+// How often to send something to clients following shovey output when there's
+// no new output, so proxies don't give up on the connection.
+const shoveyKeepalive = 15 * time.Second
+
+// wantsFollow is true if the client asked to follow a node's output as it
+// comes in, rather than get what's there now.
+func wantsFollow(r *http.Request) bool {
+	if f, _ := strconv.ParseBool(r.Form.Get("follow")); f {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// followShoveyOutput sends shovey output to the client as server-sent events
+// as it comes in, until the runs being followed have all finished or the
+// client goes away. Each chunk of output is an "output" event, and a final
+// "done" event has the job's information.
+func followShoveyOutput(w http.ResponseWriter, r *http.Request, shove *shovey.Shovey, nodeNames []string, outType string, seq int) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		jsonErrorReport(w, r, "streaming output is not supported on this connection", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events := make(chan *shovey.ShoveyRunStream)
+	stop := make(chan struct{})
+	errCh := make(chan util.Gerror, 1)
+	go func() {
+		errCh <- shove.Follow(nodeNames, outType, seq, events, stop)
+	}()
+	keepalive := time.NewTicker(shoveyKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case chunk, ok := <-events:
+			if !ok {
+				var data map[string]interface{}
+				event := "done"
+				if ferr := <-errCh; ferr != nil {
+					event = "error"
+					data = map[string]interface{}{"error": []string{ferr.Error()}}
+				} else if s, gerr := shovey.Get(shove.RunID); gerr != nil {
+					event = "error"
+					data = map[string]interface{}{"error": []string{gerr.Error()}}
+				} else if data, gerr = s.ToJSON(); gerr != nil {
+					event = "error"
+					data = map[string]interface{}{"error": []string{gerr.Error()}}
+				}
+				writeShoveyEvent(w, "", event, data)
+				flusher.Flush()
+				return
+			}
+			data := map[string]interface{}{
+				"run_id":      chunk.ShoveyUUID,
+				"node_name":   chunk.NodeName,
+				"seq":         chunk.Seq,
+				"output_type": chunk.OutputType,
+				"output":      chunk.Output,
+				"is_last":     chunk.IsLast,
+			}
+			id := fmt.Sprintf("%s:%s:%d", chunk.NodeName, chunk.OutputType, chunk.Seq)
+			writeShoveyEvent(w, id, "output", data)
+			flusher.Flush()
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			close(stop)
+			return
+		}
+	}
+}
+
+func writeShoveyEvent(w http.ResponseWriter, id string, event string, data map[string]interface{}) {
+	jdata, err := json.Marshal(data)
+	if err != nil {
+		logger.Errorf("error encoding shovey output event: %s", err.Error())
+		return
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, jdata)
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shovey
+
+// Following a job's output as it comes in, rather than polling for it.
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ctdk/goiardi/util"
+)
+
+// FollowPollInterval is how often output being followed is checked for even
+// without being told that there's more. New output saved by this goiardi wakes
+// up anything following the job right away, but output saved by another
+// goiardi sharing the same database only shows up when it's polled for.
+var FollowPollInterval = time.Second
+
+// jobWatchers keeps track of the channels to poke when a job has new output or
+// one of its runs changes status.
+type jobWatchers struct {
+	sync.Mutex
+	watchers map[string]map[chan struct{}]struct{}
+}
+
+var watchers = &jobWatchers{watchers: make(map[string]map[chan struct{}]struct{})}
+
+func (jw *jobWatchers) watch(runID string) chan struct{} {
+	jw.Lock()
+	defer jw.Unlock()
+	ch := make(chan struct{}, 1)
+	if jw.watchers[runID] == nil {
+		jw.watchers[runID] = make(map[chan struct{}]struct{})
+	}
+	jw.watchers[runID][ch] = struct{}{}
+	return ch
+}
+
+func (jw *jobWatchers) unwatch(runID string, ch chan struct{}) {
+	jw.Lock()
+	defer jw.Unlock()
+	delete(jw.watchers[runID], ch)
+	if len(jw.watchers[runID]) == 0 {
+		delete(jw.watchers, runID)
+	}
+}
+
+func (jw *jobWatchers) notify(runID string) {
+	jw.Lock()
+	defer jw.Unlock()
+	for ch := range jw.watchers[runID] {
+		// there's already a wakeup waiting if this would block
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// followedRun tracks how far along a node's output has been sent.
+type followedRun struct {
+	nodeName string
+	nextSeq  map[string]int
+	done     bool
+}
+
+// Follow sends the output from the job's runs on the given nodes, or all of
+// the job's nodes if none are given, to the events channel as it comes in,
+// starting at sequence seq. Output of both types is sent if outputType is
+// "both". It returns when every run has finished and all of its output has
+// been sent, when the job itself is over, or when the stop channel is closed.
+// The events channel is closed when Follow returns.
+func (s *Shovey) Follow(nodeNames []string, outputType string, seq int, events chan<- *ShoveyRunStream, stop <-chan struct{}) util.Gerror {
+	defer close(events)
+	if len(nodeNames) == 0 {
+		nodeNames = s.NodeNames
+	}
+	outTypes := []string{outputType}
+	if outputType == "both" {
+		outTypes = []string{"stdout", "stderr"}
+	}
+	runs := make([]*followedRun, len(nodeNames))
+	for i, n := range nodeNames {
+		runs[i] = &followedRun{nodeName: n, nextSeq: make(map[string]int, len(outTypes))}
+		for _, o := range outTypes {
+			runs[i].nextSeq[o] = seq
+		}
+	}
+
+	wake := watchers.watch(s.RunID)
+	defer watchers.unwatch(s.RunID, wake)
+	ticker := time.NewTicker(FollowPollInterval)
+	defer ticker.Stop()
+
+	for {
+		// Check whether the job is over before looking for output, so
+		// any output saved before it ended is still sent.
+		job, err := Get(s.RunID)
+		if err != nil {
+			return err
+		}
+		jobOver := jobFinished(job.Status)
+		remaining := 0
+		for _, fr := range runs {
+			if fr.done {
+				continue
+			}
+			if err := s.sendNewOutput(fr, outTypes, events, stop); err != nil {
+				return err
+			}
+			if !fr.done {
+				remaining++
+			}
+		}
+		if remaining == 0 || jobOver {
+			return nil
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendNewOutput sends any output from the node's run that hasn't been sent yet,
+// and marks the run as done if it's finished and there's nothing left to send.
+func (s *Shovey) sendNewOutput(fr *followedRun, outTypes []string, events chan<- *ShoveyRunStream, stop <-chan struct{}) util.Gerror {
+	sr, err := s.GetRun(fr.nodeName)
+	if err != nil {
+		if err.Status() == http.StatusNotFound {
+			// no run for this node yet
+			return nil
+		}
+		return err
+	}
+	// as above, get the status first
+	finished := sr.finished()
+	sent := 0
+	for _, o := range outTypes {
+		stream, err := sr.GetStreamOutput(o, fr.nextSeq[o])
+		if err != nil {
+			return err
+		}
+		sort.Sort(BySeq(stream))
+		for _, chunk := range stream {
+			// Chunks can come in out of order; wait for any gaps
+			// to be filled in before going on.
+			if chunk.Seq != fr.nextSeq[o] {
+				break
+			}
+			select {
+			case events <- chunk:
+			case <-stop:
+				return nil
+			}
+			fr.nextSeq[o]++
+			sent++
+		}
+	}
+	if finished && sent == 0 {
+		fr.done = true
+	}
+	return nil
+}
+
+func jobFinished(status string) bool {
+	switch status {
+	case "complete", "cancelled", "job_failed", "quorum_failed", "rejected":
+		return true
+	}
+	return false
+}
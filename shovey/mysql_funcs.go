@@ -19,6 +19,8 @@ package shovey
 /* MySQL funcs for shovey */
 
 import (
+	"database/sql"
+	"encoding/json"
 	"github.com/ctdk/goiardi/datastore"
 	"github.com/ctdk/goiardi/util"
 	"github.com/go-sql-driver/mysql"
@@ -29,7 +31,9 @@ import (
 func (s *Shovey) fillShoveyFromMySQL(row datastore.ResRow) error {
 	var ca, ua mysql.NullTime
 	var tm int64
-	err := row.Scan(&s.RunID, &s.Command, &ca, &ua, &s.Status, &tm, &s.Quorum)
+	var sq, bs, sn, tn, ta, rb, ab sql.NullString
+	var bw int64
+	err := row.Scan(&s.RunID, &s.Command, &ca, &ua, &s.Status, &tm, &s.Quorum, &sq, &s.ResolveAtStart, &bs, &bw, &s.MaxFailures, &s.CurrentBatch, &s.TotalBatches, &sn, &tn, &ta, &rb, &ab)
 	if err != nil {
 		return err
 	}
@@ -40,13 +44,31 @@ func (s *Shovey) fillShoveyFromMySQL(row datastore.ResRow) error {
 		s.UpdatedAt = ua.Time
 	}
 	s.Timeout = time.Duration(tm)
+	if sq.Valid {
+		s.Search = sq.String
+	}
+	if bs.Valid {
+		s.BatchSize = bs.String
+	}
+	s.BatchWait = time.Duration(bw)
+	if sn.Valid {
+		s.ScheduleName = sn.String
+	}
+	s.Template = tn.String
+	s.RequestedBy = rb.String
+	s.ApprovedBy = ab.String
+	if ta.Valid && ta.String != "" {
+		if err = json.Unmarshal([]byte(ta.String), &s.TemplateArgs); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
 func (sr *ShoveyRun) fillShoveyRunFromMySQL(row datastore.ResRow) error {
-	var at, et mysql.NullTime
-	err := row.Scan(&sr.ID, &sr.ShoveyUUID, &sr.NodeName, &sr.Status, &at, &et, &sr.Error, &sr.ExitStatus)
+	var at, et, sa mysql.NullTime
+	err := row.Scan(&sr.ID, &sr.ShoveyUUID, &sr.NodeName, &sr.Status, &at, &et, &sr.Error, &sr.ExitStatus, &sa)
 	if err != nil {
 		return err
 	}
@@ -56,6 +78,9 @@ func (sr *ShoveyRun) fillShoveyRunFromMySQL(row datastore.ResRow) error {
 	if et.Valid {
 		sr.EndTime = et.Time
 	}
+	if sa.Valid {
+		sr.SentAt = sa.Time
+	}
 	return nil
 }
 
@@ -78,7 +103,7 @@ func (s *Shovey) saveMySQL() util.Gerror {
 		gerr.SetStatus(http.StatusInternalServerError)
 		return gerr
 	}
-	_, err = tx.Exec("INSERT INTO shoveys (run_id, command, status, timeout, quorum, created_at, updated_at) VALUES (?, ?, ?, ?, ?, NOW(), NOW()) ON DUPLICATE KEY UPDATE status = ?, updated_at = NOW()", s.RunID, s.Command, s.Status, s.Timeout, s.Quorum, s.Status)
+	_, err = tx.Exec("INSERT INTO shoveys (run_id, command, status, timeout, quorum, search_query, resolve_at_start, batch_size, batch_wait, max_failures, current_batch, total_batches, schedule_name, template_name, template_args, requested_by, approved_by, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW()) ON DUPLICATE KEY UPDATE status = ?, batch_size = ?, batch_wait = ?, max_failures = ?, current_batch = ?, total_batches = ?, approved_by = ?, updated_at = NOW()", s.RunID, s.Command, s.Status, s.Timeout, s.Quorum, s.Search, s.ResolveAtStart, s.BatchSize, s.BatchWait, s.MaxFailures, s.CurrentBatch, s.TotalBatches, s.ScheduleName, s.Template, s.templateArgsJSON(), s.RequestedBy, s.ApprovedBy, s.Status, s.BatchSize, s.BatchWait, s.MaxFailures, s.CurrentBatch, s.TotalBatches, s.ApprovedBy)
 	if err != nil {
 		tx.Rollback()
 		gerr := util.CastErr(err)
@@ -95,7 +120,7 @@ func (sr *ShoveyRun) saveMySQL() util.Gerror {
 		gerr.SetStatus(http.StatusInternalServerError)
 		return gerr
 	}
-	_, err = tx.Exec("INSERT INTO shovey_runs (shovey_uuid, shovey_id, node_name, status, ack_time, end_time, error, exit_status) SELECT ?, id, ?, ?, NULLIF(?, '0001-01-01 00:00:00 +0000'), NULLIF(?, '0001-01-01 00:00:00 +0000'), ?, ? FROM shoveys WHERE shoveys.run_id = ? ON DUPLICATE KEY UPDATE status = ?, ack_time = NULLIF(?, '0001-01-01 00:00:00 +0000'), end_time = NULLIF(?, '0001-01-01 00:00:00 +0000'), error = ?, exit_status = ?", sr.ShoveyUUID, sr.NodeName, sr.Status, sr.AckTime, sr.EndTime, sr.Error, sr.ExitStatus, sr.ShoveyUUID, sr.Status, sr.AckTime, sr.EndTime, sr.Error, sr.ExitStatus)
+	_, err = tx.Exec("INSERT INTO shovey_runs (shovey_uuid, shovey_id, node_name, status, ack_time, end_time, error, exit_status, sent_at) SELECT ?, id, ?, ?, NULLIF(?, '0001-01-01 00:00:00 +0000'), NULLIF(?, '0001-01-01 00:00:00 +0000'), ?, ?, NULLIF(?, '0001-01-01 00:00:00 +0000') FROM shoveys WHERE shoveys.run_id = ? ON DUPLICATE KEY UPDATE status = ?, ack_time = NULLIF(?, '0001-01-01 00:00:00 +0000'), end_time = NULLIF(?, '0001-01-01 00:00:00 +0000'), error = ?, exit_status = ?, sent_at = NULLIF(?, '0001-01-01 00:00:00 +0000')", sr.ShoveyUUID, sr.NodeName, sr.Status, sr.AckTime, sr.EndTime, sr.Error, sr.ExitStatus, sr.SentAt, sr.ShoveyUUID, sr.Status, sr.AckTime, sr.EndTime, sr.Error, sr.ExitStatus, sr.SentAt)
 	if err != nil {
 		tx.Rollback()
 		gerr := util.CastErr(err)
@@ -104,3 +129,56 @@ func (sr *ShoveyRun) saveMySQL() util.Gerror {
 	tx.Commit()
 	return nil
 }
+
+func (sc *Schedule) fillScheduleFromMySQL(row datastore.ResRow) error {
+	var job []byte
+	var cron, lastRunID, requestedBy sql.NullString
+	var nr, lr, ca, ua mysql.NullTime
+	var ivl int64
+	err := row.Scan(&sc.Name, &job, &cron, &ivl, &sc.Enabled, &nr, &lr, &lastRunID, &requestedBy, &ca, &ua)
+	if err != nil {
+		return err
+	}
+	sc.Job = new(JobSpec)
+	if err = json.Unmarshal(job, sc.Job); err != nil {
+		return err
+	}
+	sc.Cron = cron.String
+	sc.LastRunID = lastRunID.String
+	sc.RequestedBy = requestedBy.String
+	sc.Interval = time.Duration(ivl)
+	if nr.Valid {
+		sc.NextRun = nr.Time
+	}
+	if lr.Valid {
+		sc.LastRun = lr.Time
+	}
+	if ca.Valid {
+		sc.CreatedAt = ca.Time
+	}
+	if ua.Valid {
+		sc.UpdatedAt = ua.Time
+	}
+	return nil
+}
+
+func (t *Template) fillTemplateFromMySQL(row datastore.ResRow) error {
+	var params, envs, roles []byte
+	var desc sql.NullString
+	var ca, ua mysql.NullTime
+	err := row.Scan(&t.Name, &desc, &t.Command, &params, &envs, &roles, &t.RequireApproval, &ca, &ua)
+	if err != nil {
+		return err
+	}
+	t.Description = desc.String
+	if err = t.decodeTemplateJSON(params, envs, roles); err != nil {
+		return err
+	}
+	if ca.Valid {
+		t.CreatedAt = ca.Time
+	}
+	if ua.Valid {
+		t.UpdatedAt = ua.Time
+	}
+	return nil
+}
@@ -19,6 +19,8 @@ package shovey
 /* PostgreSQL funcs for shovey */
 
 import (
+	"database/sql"
+	"encoding/json"
 	"github.com/ctdk/goiardi/datastore"
 	"github.com/ctdk/goiardi/util"
 	"github.com/lib/pq"
@@ -30,7 +32,9 @@ func (s *Shovey) fillShoveyFromPostgreSQL(row datastore.ResRow) error {
 	var ca, ua pq.NullTime
 	var nn util.StringSlice
 	var tm int64
-	err := row.Scan(&s.RunID, &nn, &s.Command, &ca, &ua, &s.Status, &tm, &s.Quorum)
+	var sq, bs, sn, tn, ta, rb, ab sql.NullString
+	var bw int64
+	err := row.Scan(&s.RunID, &nn, &s.Command, &ca, &ua, &s.Status, &tm, &s.Quorum, &sq, &s.ResolveAtStart, &bs, &bw, &s.MaxFailures, &s.CurrentBatch, &s.TotalBatches, &sn, &tn, &ta, &rb, &ab)
 	if err != nil {
 		return err
 	}
@@ -41,6 +45,24 @@ func (s *Shovey) fillShoveyFromPostgreSQL(row datastore.ResRow) error {
 		s.UpdatedAt = ua.Time
 	}
 	s.Timeout = time.Duration(tm)
+	if sq.Valid {
+		s.Search = sq.String
+	}
+	if bs.Valid {
+		s.BatchSize = bs.String
+	}
+	s.BatchWait = time.Duration(bw)
+	if sn.Valid {
+		s.ScheduleName = sn.String
+	}
+	s.Template = tn.String
+	s.RequestedBy = rb.String
+	s.ApprovedBy = ab.String
+	if ta.Valid && ta.String != "" {
+		if err = json.Unmarshal([]byte(ta.String), &s.TemplateArgs); err != nil {
+			return err
+		}
+	}
 
 	s.NodeNames = nn
 
@@ -48,8 +70,8 @@ func (s *Shovey) fillShoveyFromPostgreSQL(row datastore.ResRow) error {
 }
 
 func (sr *ShoveyRun) fillShoveyRunFromPostgreSQL(row datastore.ResRow) error {
-	var at, et pq.NullTime
-	err := row.Scan(&sr.ID, &sr.ShoveyUUID, &sr.NodeName, &sr.Status, &at, &et, &sr.Error, &sr.ExitStatus)
+	var at, et, sa pq.NullTime
+	err := row.Scan(&sr.ID, &sr.ShoveyUUID, &sr.NodeName, &sr.Status, &at, &et, &sr.Error, &sr.ExitStatus, &sa)
 	if err != nil {
 		return err
 	}
@@ -59,6 +81,9 @@ func (sr *ShoveyRun) fillShoveyRunFromPostgreSQL(row datastore.ResRow) error {
 	if et.Valid {
 		sr.EndTime = et.Time
 	}
+	if sa.Valid {
+		sr.SentAt = sa.Time
+	}
 	return nil
 }
 
@@ -81,7 +106,7 @@ func (s *Shovey) savePostgreSQL() util.Gerror {
 		gerr.SetStatus(http.StatusInternalServerError)
 		return gerr
 	}
-	_, err = tx.Exec("SELECT goiardi.merge_shoveys($1, $2, $3, $4, $5)", s.RunID, s.Command, s.Status, s.Timeout, s.Quorum)
+	_, err = tx.Exec("SELECT goiardi.merge_shoveys($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)", s.RunID, s.Command, s.Status, s.Timeout, s.Quorum, s.Search, s.ResolveAtStart, s.BatchSize, s.BatchWait, s.MaxFailures, s.CurrentBatch, s.TotalBatches, s.ScheduleName, s.Template, s.templateArgsJSON(), s.RequestedBy, s.ApprovedBy)
 	if err != nil {
 		gerr := util.CastErr(err)
 		gerr.SetStatus(http.StatusInternalServerError)
@@ -98,7 +123,7 @@ func (sr *ShoveyRun) savePostgreSQL() util.Gerror {
 		gerr.SetStatus(http.StatusInternalServerError)
 		return gerr
 	}
-	_, err = tx.Exec("SELECT goiardi.merge_shovey_runs($1, $2, $3, $4, $5, $6, $7)", sr.ShoveyUUID, sr.NodeName, sr.Status, sr.AckTime, sr.EndTime, sr.Error, sr.ExitStatus)
+	_, err = tx.Exec("SELECT goiardi.merge_shovey_runs($1, $2, $3, $4, $5, $6, $7, $8)", sr.ShoveyUUID, sr.NodeName, sr.Status, sr.AckTime, sr.EndTime, sr.Error, sr.ExitStatus, sr.SentAt)
 	if err != nil {
 		gerr := util.CastErr(err)
 		gerr.SetStatus(http.StatusInternalServerError)
@@ -107,3 +132,56 @@ func (sr *ShoveyRun) savePostgreSQL() util.Gerror {
 	tx.Commit()
 	return nil
 }
+
+func (sc *Schedule) fillScheduleFromPostgreSQL(row datastore.ResRow) error {
+	var job []byte
+	var cron, lastRunID, requestedBy sql.NullString
+	var nr, lr, ca, ua pq.NullTime
+	var ivl int64
+	err := row.Scan(&sc.Name, &job, &cron, &ivl, &sc.Enabled, &nr, &lr, &lastRunID, &requestedBy, &ca, &ua)
+	if err != nil {
+		return err
+	}
+	sc.Job = new(JobSpec)
+	if err = json.Unmarshal(job, sc.Job); err != nil {
+		return err
+	}
+	sc.Cron = cron.String
+	sc.LastRunID = lastRunID.String
+	sc.RequestedBy = requestedBy.String
+	sc.Interval = time.Duration(ivl)
+	if nr.Valid {
+		sc.NextRun = nr.Time
+	}
+	if lr.Valid {
+		sc.LastRun = lr.Time
+	}
+	if ca.Valid {
+		sc.CreatedAt = ca.Time
+	}
+	if ua.Valid {
+		sc.UpdatedAt = ua.Time
+	}
+	return nil
+}
+
+func (t *Template) fillTemplateFromPostgreSQL(row datastore.ResRow) error {
+	var params, envs, roles []byte
+	var desc sql.NullString
+	var ca, ua pq.NullTime
+	err := row.Scan(&t.Name, &desc, &t.Command, &params, &envs, &roles, &t.RequireApproval, &ca, &ua)
+	if err != nil {
+		return err
+	}
+	t.Description = desc.String
+	if err = t.decodeTemplateJSON(params, envs, roles); err != nil {
+		return err
+	}
+	if ca.Valid {
+		t.CreatedAt = ca.Time
+	}
+	if ua.Valid {
+		t.UpdatedAt = ua.Time
+	}
+	return nil
+}
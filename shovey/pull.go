@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shovey
+
+// The HTTP pull transport, for nodes that can't be part of a serf cluster.
+// Instead of goiardi pushing commands out, the node's agent long-polls
+// goiardi for any commands waiting for it, and acknowledges them once it has
+// them. Nodes that have polled recently are considered to be up.
+//
+// The queues, acknowledgements, and poll times are all kept in memory, so the
+// pull transport only works with a single goiardi process. With several
+// goiardis behind a load balancer, a node could poll one that doesn't have
+// its jobs, or ack a job to one that isn't waiting for it.
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/util"
+	"github.com/pborman/uuid"
+)
+
+// MaxPollWait is the longest a node's agent can wait for commands in one
+// poll.
+const MaxPollWait = 60 * time.Second
+
+// A node that hasn't polled in this long is considered to be down. Agents
+// should be polling again as soon as a poll returns, so this allows for a
+// full poll and some slack.
+const pollLiveness = 2 * MaxPollWait
+
+// PullMessage is a signed shovey command waiting for a node to pick it up.
+// The payload is the same signed JSON that would have been sent over serf.
+type PullMessage struct {
+	ID      string          `json:"id"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type pullDelivery struct {
+	ackCh   chan string
+	waiting map[string]bool
+	timer   *time.Timer
+}
+
+type pullTransport struct {
+	m          sync.Mutex
+	queues     map[string][]*PullMessage
+	waiters    map[string]chan struct{}
+	lastPoll   map[string]time.Time
+	deliveries map[string]*pullDelivery
+}
+
+var pullQueue = &pullTransport{queues: make(map[string][]*PullMessage), waiters: make(map[string]chan struct{}), lastPoll: make(map[string]time.Time), deliveries: make(map[string]*pullDelivery)}
+
+func (pt *pullTransport) UpNodes(nodeNames []string) ([]string, error) {
+	pt.m.Lock()
+	defer pt.m.Unlock()
+	cutoff := time.Now().Add(-pollLiveness)
+	var up []string
+	for _, n := range nodeNames {
+		if lp, ok := pt.lastPoll[n]; ok && lp.After(cutoff) {
+			up = append(up, n)
+		}
+	}
+	return up, nil
+}
+
+func (pt *pullTransport) Send(payload []byte, nodeNames []string, ackCh chan string) error {
+	msg := &PullMessage{ID: uuid.New(), Payload: json.RawMessage(payload)}
+	d := &pullDelivery{ackCh: ackCh, waiting: make(map[string]bool, len(nodeNames))}
+
+	pt.m.Lock()
+	defer pt.m.Unlock()
+	for _, n := range nodeNames {
+		d.waiting[n] = true
+		pt.queues[n] = append(pt.queues[n], msg)
+		if w, ok := pt.waiters[n]; ok {
+			close(w)
+			delete(pt.waiters, n)
+		}
+	}
+	pt.deliveries[msg.ID] = d
+	d.timer = time.AfterFunc(pollLiveness, func() { pt.expire(msg.ID) })
+	return nil
+}
+
+// expire gives up on nodes that haven't acknowledged a message in time, and
+// takes the message out of their queues so they don't get a stale command
+// much later.
+func (pt *pullTransport) expire(id string) {
+	pt.m.Lock()
+	defer pt.m.Unlock()
+	d, ok := pt.deliveries[id]
+	if !ok {
+		return
+	}
+	for n := range d.waiting {
+		q := pt.queues[n]
+		for i, msg := range q {
+			if msg.ID == id {
+				pt.queues[n] = append(q[:i], q[i+1:]...)
+				break
+			}
+		}
+	}
+	delete(pt.deliveries, id)
+	close(d.ackCh)
+}
+
+// poll hands over the messages waiting for the node, waiting up to the given
+// time for one to show up if there aren't any.
+func (pt *pullTransport) poll(nodeName string, wait time.Duration) []*PullMessage {
+	pt.m.Lock()
+	pt.lastPoll[nodeName] = time.Now()
+	if len(pt.queues[nodeName]) == 0 && wait > 0 {
+		w, ok := pt.waiters[nodeName]
+		if !ok {
+			w = make(chan struct{})
+			pt.waiters[nodeName] = w
+		}
+		pt.m.Unlock()
+		select {
+		case <-w:
+		case <-time.After(wait):
+		}
+		pt.m.Lock()
+		pt.lastPoll[nodeName] = time.Now()
+	}
+	msgs := pt.queues[nodeName]
+	delete(pt.queues, nodeName)
+	pt.m.Unlock()
+
+	if msgs == nil {
+		msgs = make([]*PullMessage, 0)
+	}
+	return msgs
+}
+
+func (pt *pullTransport) ack(nodeName string, id string) util.Gerror {
+	pt.m.Lock()
+	defer pt.m.Unlock()
+	d, ok := pt.deliveries[id]
+	if !ok || !d.waiting[nodeName] {
+		err := util.Errorf("no message %s waiting for acknowledgement from %s", id, nodeName)
+		err.SetStatus(http.StatusNotFound)
+		return err
+	}
+	delete(d.waiting, nodeName)
+	d.ackCh <- nodeName
+	if len(d.waiting) == 0 {
+		d.timer.Stop()
+		delete(pt.deliveries, id)
+		close(d.ackCh)
+	}
+	return nil
+}
+
+// PollJobs returns any signed shovey commands waiting for the given node,
+// waiting up to the given time (capped at MaxPollWait) for one to arrive if
+// there aren't any yet. Polling also marks the node as up for the HTTP
+// transport.
+func PollJobs(nodeName string, wait time.Duration) ([]*PullMessage, util.Gerror) {
+	if err := checkPullTransport(); err != nil {
+		return nil, err
+	}
+	if wait > MaxPollWait {
+		wait = MaxPollWait
+	}
+	return pullQueue.poll(nodeName, wait), nil
+}
+
+// AckJob acknowledges that the node received the shovey command with the
+// given message id.
+func AckJob(nodeName string, id string) util.Gerror {
+	if err := checkPullTransport(); err != nil {
+		return err
+	}
+	return pullQueue.ack(nodeName, id)
+}
+
+func checkPullTransport() util.Gerror {
+	if config.Config.ShoveyTransport != "http" {
+		err := util.Errorf("shovey is using the %s transport, not http", config.Config.ShoveyTransport)
+		err.SetStatus(http.StatusPreconditionFailed)
+		return err
+	}
+	return nil
+}
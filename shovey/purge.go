@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shovey
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+)
+
+// finishedStatuses are the job statuses a shovey job will never leave, and
+// thus are safe to purge.
+var finishedStatuses = []string{"complete", "cancelled", "job_failed", "quorum_failed"}
+
+// PurgeResult holds the counts of shovey jobs, node runs, and output stream
+// chunks removed by PurgeFinished.
+type PurgeResult struct {
+	Jobs    int
+	Runs    int
+	Streams int
+}
+
+// PurgeFinished removes finished shovey jobs that have not been updated in
+// longer than the given duration, along with their node runs and output.
+// Jobs that are still submitted or running are left alone regardless of age.
+func PurgeFinished(dur time.Duration) (*PurgeResult, error) {
+	if config.UsingDB() {
+		return purgeFinishedSQL(dur)
+	}
+	res := new(PurgeResult)
+	cutoff := time.Now().Add(-dur)
+	ds := datastore.New()
+	for _, s := range AllShoveys() {
+		if !isFinished(s.Status) || !s.UpdatedAt.Before(cutoff) {
+			continue
+		}
+		runs, err := s.GetNodeRuns()
+		if err != nil {
+			return res, err
+		}
+		for _, sr := range runs {
+			for _, t := range []string{"stdout", "stderr"} {
+				streams, err := sr.GetStreamOutput(t, 0)
+				if err != nil {
+					return res, err
+				}
+				for _, srs := range streams {
+					ds.Delete("shovey_run_stream", fmt.Sprintf("%s_%s_%s_%d", srs.ShoveyUUID, srs.NodeName, srs.OutputType, srs.Seq))
+					res.Streams++
+				}
+			}
+			ds.Delete("shovey_run", sr.ShoveyUUID+sr.NodeName)
+			res.Runs++
+		}
+		ds.Delete("shovey", s.RunID)
+		res.Jobs++
+	}
+	return res, nil
+}
+
+func isFinished(status string) bool {
+	for _, st := range finishedStatuses {
+		if status == st {
+			return true
+		}
+	}
+	return false
+}
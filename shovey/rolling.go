@@ -0,0 +1,284 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shovey
+
+// Rolling execution of shovey jobs, sending the command out to a batch of
+// nodes at a time rather than all of them at once.
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/util"
+	"github.com/tideland/golib/logger"
+)
+
+// How often to check whether the nodes in a batch have finished, and how
+// long past the job's timeout to wait for them before giving up.
+const (
+	batchPollInterval = time.Second
+	batchGrace        = 60 * time.Second
+)
+
+var batchSizeRe = regexp.MustCompile(`^(\d+\.?\d?)%$`)
+
+// SetRolling makes the job run on batchSize nodes at a time, which may be a
+// number of nodes or a percentage of the nodes that are up, waiting batchWait
+// seconds between batches. If more than maxFailures nodes fail or exit with a
+// non-zero status, the remaining batches are cancelled; a negative
+// maxFailures means no limit. It must be called before the job is started.
+func (s *Shovey) SetRolling(batchSize string, batchWait int, maxFailures int) util.Gerror {
+	if s.Status != "submitted" {
+		err := util.Errorf("job %s has already been started", s.RunID)
+		err.SetStatus(http.StatusConflict)
+		return err
+	}
+	if err := s.setRolling(batchSize, batchWait, maxFailures); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+func (s *Shovey) setRolling(batchSize string, batchWait int, maxFailures int) util.Gerror {
+	if _, err := getBatchSize(batchSize, 1); err != nil {
+		gerr := util.CastErr(err)
+		gerr.SetStatus(http.StatusBadRequest)
+		return gerr
+	}
+	if batchWait < 0 {
+		err := util.Errorf("batch wait cannot be negative")
+		err.SetStatus(http.StatusBadRequest)
+		return err
+	}
+	s.BatchSize = batchSize
+	s.BatchWait = time.Duration(batchWait)
+	s.MaxFailures = maxFailures
+	return nil
+}
+
+// Rolling returns true if the job is run in batches.
+func (s *Shovey) Rolling() bool {
+	return s.BatchSize != ""
+}
+
+func getBatchSize(batchSize string, numNodes int) (int, error) {
+	if z := batchSizeRe.FindStringSubmatch(batchSize); z != nil {
+		p, err := strconv.ParseFloat(z[1], 64)
+		if err != nil {
+			return 0, err
+		}
+		if p <= 0 || p > 100 {
+			return 0, fmt.Errorf("batch size '%s' must be more than 0%% and no more than 100%%", batchSize)
+		}
+		// small percentages of a few nodes still get one at a time
+		return int(math.Max(1, math.Ceil((p/100.0)*float64(numNodes)))), nil
+	}
+	size, err := strconv.Atoi(batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid batch size '%s'", batchSize)
+	}
+	if size < 1 {
+		return 0, fmt.Errorf("batch size '%s' must be at least one node", batchSize)
+	}
+	return size, nil
+}
+
+// splitBatches divides the nodes up into batches of the given size.
+func splitBatches(nodeNames []string, batchSize string) ([][]string, error) {
+	size, err := getBatchSize(batchSize, len(nodeNames))
+	if err != nil {
+		return nil, err
+	}
+	if len(nodeNames) == 0 {
+		return [][]string{nodeNames}, nil
+	}
+	var batches [][]string
+	for i := 0; i < len(nodeNames); i += size {
+		end := i + size
+		if end > len(nodeNames) {
+			end = len(nodeNames)
+		}
+		batches = append(batches, nodeNames[i:end])
+	}
+	return batches, nil
+}
+
+// rollBatches waits for each batch to finish before sending the command to
+// the next one, until either they've all run, the job's cancelled, or too many
+// nodes have failed. The first batch has already been sent, and failures is
+// how many nodes failed before it.
+func (s *Shovey) rollBatches(transport Transport, batches [][]string, failures int) {
+	rollers.add(s.RunID)
+	defer rollers.remove(s.RunID)
+	for i := 1; i < len(batches); i++ {
+		failures += s.waitForBatch(batches[i-1])
+		if s.MaxFailures >= 0 && failures > s.MaxFailures {
+			logger.Infof("shovey job %s: %d nodes failed, more than the %d allowed; cancelling the remaining batches", s.RunID, failures, s.MaxFailures)
+			s.abortBatches(batches[i:])
+			return
+		}
+		time.Sleep(s.BatchWait * time.Second)
+
+		// Get the job again, since it may have been cancelled or had
+		// some runs cancelled while we were waiting.
+		cur, err := Get(s.RunID)
+		if err != nil {
+			logger.Errorf("shovey job %s went away while rolling: %s", s.RunID, err.Error())
+			return
+		}
+		if cur.Status == "cancelled" || cur.Status == "job_failed" {
+			return
+		}
+		next, cerr := cur.claimBatch(batches[i])
+		if cerr != nil {
+			logger.Errorf("shovey job %s: error claiming batch %d: %s", s.RunID, cur.CurrentBatch+1, cerr.Error())
+			return
+		}
+		cur.CurrentBatch++
+		cur.save()
+		if len(next) == 0 {
+			continue
+		}
+		if err := cur.sendBatch(transport, next); err != nil {
+			logger.Errorf("shovey job %s: error sending batch %d: %s", s.RunID, cur.CurrentBatch, err.Error())
+			cur.abortBatches(batches[i:])
+			return
+		}
+	}
+}
+
+// claimBatch marks the batch's pending runs as sent, and returns the nodes
+// that this goiardi needs to send the job to. When several goiardis share a
+// database and are all rolling the same job, only the one whose update changed
+// the runs gets them, so no node gets sent the job twice.
+func (s *Shovey) claimBatch(nodeNames []string) ([]string, error) {
+	if len(nodeNames) == 0 {
+		return nil, nil
+	}
+	now := time.Now()
+	if config.UsingDB() {
+		claimed, err := s.claimBatchSQL(nodeNames, now)
+		if err != nil || !claimed {
+			return nil, err
+		}
+		watchers.notify(s.RunID)
+		var sent []string
+		for _, n := range nodeNames {
+			sr, err := s.GetRun(n)
+			if err == nil && sr.Status == "created" {
+				sent = append(sent, n)
+			}
+		}
+		return sent, nil
+	}
+	batchMutex.Lock()
+	defer batchMutex.Unlock()
+	var sent []string
+	for _, n := range nodeNames {
+		sr, err := s.GetRun(n)
+		if err != nil || sr.Status != "pending" {
+			continue
+		}
+		sr.Status = "created"
+		sr.SentAt = now
+		if err := sr.save(); err != nil {
+			logger.Errorf("error saving shovey run: %s", err.Error())
+			continue
+		}
+		sent = append(sent, n)
+	}
+	return sent, nil
+}
+
+var batchMutex sync.Mutex
+
+// waitForBatch waits for every node in the batch to finish, and returns how
+// many of them failed. Nodes that haven't finished by the time the job's
+// timeout and a grace period have gone by count as failed.
+func (s *Shovey) waitForBatch(nodeNames []string) int {
+	deadline := time.Now().Add(s.Timeout*time.Second + batchGrace)
+	for {
+		failed, finished := 0, 0
+		for _, n := range nodeNames {
+			sr, err := s.GetRun(n)
+			if err != nil {
+				finished++
+				failed++
+				continue
+			}
+			if sr.finished() {
+				finished++
+				if sr.failed() {
+					failed++
+				}
+			}
+		}
+		if finished == len(nodeNames) {
+			return failed
+		}
+		if time.Now().After(deadline) {
+			return failed + len(nodeNames) - finished
+		}
+		time.Sleep(batchPollInterval)
+	}
+}
+
+// abortBatches cancels the runs in batches that haven't been sent yet, and
+// marks the job as failed.
+func (s *Shovey) abortBatches(batches [][]string) {
+	for _, batch := range batches {
+		for _, n := range batch {
+			sr, err := s.GetRun(n)
+			if err != nil || sr.Status != "pending" {
+				continue
+			}
+			sr.Status = "cancelled"
+			sr.EndTime = time.Now()
+			sr.save()
+		}
+	}
+	cur, err := Get(s.RunID)
+	if err != nil {
+		return
+	}
+	cur.Status = "job_failed"
+	cur.save()
+}
+
+func (sr *ShoveyRun) finished() bool {
+	switch sr.Status {
+	case "invalid", "succeeded", "failed", "down", "nacked", "cancelled", "timed_out":
+		return true
+	}
+	return false
+}
+
+func (sr *ShoveyRun) failed() bool {
+	switch sr.Status {
+	case "invalid", "failed", "nacked", "timed_out":
+		return true
+	case "succeeded":
+		return sr.ExitStatus != 0
+	}
+	return false
+}
@@ -0,0 +1,603 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shovey
+
+// Scheduled and recurring shovey jobs.
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/util"
+	"github.com/tideland/golib/logger"
+)
+
+// ScheduleCheckInterval is how often goiardi looks for schedules that are due
+// to run.
+const ScheduleCheckInterval = 15 * time.Second
+
+// MinScheduleInterval is the shortest interval a schedule can run on.
+const MinScheduleInterval = time.Minute
+
+// JobSpec describes a shovey job to create: the command, which nodes to run
+// it on, and how to run it.
+type JobSpec struct {
+	Command        string            `json:"command,omitempty"`
+	Template       string            `json:"template,omitempty"`
+	Args           map[string]string `json:"args,omitempty"`
+	Timeout        int               `json:"run_timeout"`
+	Quorum         string            `json:"quorum"`
+	NodeNames      []string          `json:"nodes,omitempty"`
+	Search         string            `json:"search,omitempty"`
+	ResolveAtStart bool              `json:"resolve_at_start,omitempty"`
+	BatchSize      string            `json:"batch_size,omitempty"`
+	BatchWait      int               `json:"batch_wait,omitempty"`
+	MaxFailures    int               `json:"max_failures"`
+	// Who asked for the job. Not saved with the spec; schedules keep
+	// track of that themselves.
+	RequestedBy string `json:"-"`
+}
+
+// Validate checks that the job spec makes sense, without resolving any
+// searches.
+func (js *JobSpec) Validate() util.Gerror {
+	var msg string
+	switch {
+	case js.Command == "" && js.Template == "":
+		msg = "no command or template given"
+	case js.Command != "" && js.Template != "":
+		msg = "give either a command or a template, not both"
+	case js.Template == "" && len(js.Args) != 0:
+		msg = "arguments can only be given with a template"
+	case js.Search == "" && len(js.NodeNames) == 0:
+		msg = "no nodes or search query given"
+	case js.Search != "" && len(js.NodeNames) != 0:
+		msg = "give either a node list or a search query, not both"
+	case js.Timeout < 0:
+		msg = "run timeout cannot be negative"
+	case js.BatchWait < 0:
+		msg = "batch wait cannot be negative"
+	}
+	if msg == "" && js.BatchSize != "" {
+		if _, err := getBatchSize(js.BatchSize, 1); err != nil {
+			msg = err.Error()
+		}
+	}
+	if msg != "" {
+		err := util.Errorf("%s", msg)
+		err.SetStatus(http.StatusBadRequest)
+		return err
+	}
+	if js.Template == "" && config.Config.ShoveyTemplatesOnly {
+		err := util.Errorf("only shovey jobs made from a template are allowed")
+		err.SetStatus(http.StatusForbidden)
+		return err
+	}
+	return nil
+}
+
+// NewJob creates a new shovey job from the spec. The job still needs to be
+// started.
+func (js *JobSpec) NewJob() (*Shovey, util.Gerror) {
+	return js.newJob("")
+}
+
+// newJob makes the job, marking it as started by the named schedule if
+// scheduleName isn't empty.
+func (js *JobSpec) newJob(scheduleName string) (*Shovey, util.Gerror) {
+	if err := js.Validate(); err != nil {
+		return nil, err
+	}
+	command := js.Command
+	if js.Template != "" {
+		t, err := GetTemplate(js.Template)
+		if err != nil {
+			if err.Status() == http.StatusNotFound {
+				err.SetStatus(http.StatusBadRequest)
+			}
+			return nil, err
+		}
+		if command, err = t.Render(js.Args); err != nil {
+			return nil, err
+		}
+		// check the nodes now if we know them, rather than waiting
+		// for an approval that can't be used
+		if len(js.NodeNames) != 0 {
+			if err = t.CheckTargets(js.NodeNames); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// Everything gets filled in before the job's saved the first time.
+	// Once the job exists, saving it again with SQL only updates the
+	// fields that can change after it's made.
+	var s *Shovey
+	var err util.Gerror
+	if js.Search != "" {
+		s, err = newShoveyFromSearch(command, js.Timeout, js.Quorum, js.Search, js.ResolveAtStart)
+	} else {
+		s, err = newShovey(command, js.Timeout, js.Quorum, js.NodeNames)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Template = js.Template
+	s.TemplateArgs = js.Args
+	s.RequestedBy = js.RequestedBy
+	s.ScheduleName = scheduleName
+	if js.BatchSize != "" {
+		if err = s.setRolling(js.BatchSize, js.BatchWait, js.MaxFailures); err != nil {
+			return nil, err
+		}
+	}
+	if err = s.save(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Schedule runs a shovey job on a cron schedule or at a regular interval.
+// Each time it comes due, a new shovey job is made from the schedule's job
+// spec and started, unless the job it started last time is still going.
+type Schedule struct {
+	Name      string        `json:"name"`
+	Job       *JobSpec      `json:"job"`
+	Cron      string        `json:"cron,omitempty"`
+	Interval  time.Duration `json:"interval,omitempty"`
+	Enabled   bool          `json:"enabled"`
+	NextRun   time.Time     `json:"next_run"`
+	LastRun   time.Time     `json:"last_run"`
+	LastRunID string        `json:"last_run_id"`
+	// Whoever created the schedule or last changed its job. The jobs the
+	// schedule starts are requested by them.
+	RequestedBy string    `json:"requested_by,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// the in-memory datastore doesn't have anything like the atomic update the
+// SQL backends use to claim a schedule, so take a lock instead.
+var schedMutex sync.Mutex
+
+// NewSchedule creates a new schedule. Exactly one of cron or interval (in
+// seconds) should be given.
+func NewSchedule(name string, job *JobSpec, cron string, interval int, enabled bool) (*Schedule, util.Gerror) {
+	if err := validateScheduleName(name); err != nil {
+		return nil, err
+	}
+	found, err := scheduleExists(name)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		err := util.Errorf("shovey schedule %s already exists", name)
+		err.SetStatus(http.StatusConflict)
+		return nil, err
+	}
+	sc := &Schedule{Name: name, Enabled: enabled, CreatedAt: time.Now()}
+	if err := sc.update(job, cron, interval); err != nil {
+		return nil, err
+	}
+	if err := sc.save(); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+func validateScheduleName(name string) util.Gerror {
+	if !util.ValidateName(name) {
+		err := util.Errorf("invalid shovey schedule name '%s'", name)
+		err.SetStatus(http.StatusBadRequest)
+		return err
+	}
+	return nil
+}
+
+// Update replaces the schedule's job spec and timing.
+func (sc *Schedule) Update(job *JobSpec, cron string, interval int) util.Gerror {
+	if err := sc.update(job, cron, interval); err != nil {
+		return err
+	}
+	return sc.save()
+}
+
+func (sc *Schedule) update(job *JobSpec, cron string, interval int) util.Gerror {
+	if job == nil {
+		err := util.Errorf("no job given for shovey schedule %s", sc.Name)
+		err.SetStatus(http.StatusBadRequest)
+		return err
+	}
+	if err := job.Validate(); err != nil {
+		return err
+	}
+	var msg string
+	ivl := time.Duration(interval) * time.Second
+	switch {
+	case cron == "" && interval == 0:
+		msg = "a schedule needs either a cron expression or an interval"
+	case cron != "" && interval != 0:
+		msg = "give either a cron expression or an interval, not both"
+	case cron == "" && ivl < MinScheduleInterval:
+		msg = "schedule interval must be at least " + MinScheduleInterval.String()
+	}
+	if msg == "" && cron != "" {
+		if _, err := parseCron(cron); err != nil {
+			msg = err.Error()
+		}
+	}
+	if msg != "" {
+		err := util.Errorf("%s", msg)
+		err.SetStatus(http.StatusBadRequest)
+		return err
+	}
+	sc.Job = job
+	sc.RequestedBy = job.RequestedBy
+	sc.Cron = cron
+	sc.Interval = time.Duration(interval)
+	sc.NextRun = sc.nextAfter(time.Now())
+	return nil
+}
+
+// nextAfter figures out when the schedule should next run after the given
+// time. Times are kept to the second, so they survive a trip through the
+// database unchanged.
+func (sc *Schedule) nextAfter(t time.Time) time.Time {
+	if sc.Cron != "" {
+		c, err := parseCron(sc.Cron)
+		if err != nil {
+			return time.Time{}
+		}
+		return c.next(t).Truncate(time.Second)
+	}
+	return t.Add(sc.Interval * time.Second).Truncate(time.Second)
+}
+
+// ToJSON formats a schedule to render as JSON for the client.
+func (sc *Schedule) ToJSON() map[string]interface{} {
+	toJSON := make(map[string]interface{})
+	toJSON["name"] = sc.Name
+	toJSON["job"] = sc.Job
+	if sc.Cron != "" {
+		toJSON["cron"] = sc.Cron
+	} else {
+		toJSON["interval"] = sc.Interval
+	}
+	toJSON["enabled"] = sc.Enabled
+	if sc.Enabled && !sc.NextRun.IsZero() {
+		toJSON["next_run"] = sc.NextRun
+	}
+	if sc.LastRunID != "" {
+		toJSON["last_run"] = sc.LastRun
+		toJSON["last_run_id"] = sc.LastRunID
+	}
+	if sc.RequestedBy != "" {
+		toJSON["requested_by"] = sc.RequestedBy
+	}
+	toJSON["created_at"] = sc.CreatedAt
+	toJSON["updated_at"] = sc.UpdatedAt
+	return toJSON
+}
+
+// SetEnabled turns the schedule on or off. A schedule that's turned back on
+// next runs at its next regular time from now, rather than making up for the
+// runs it missed.
+func (sc *Schedule) SetEnabled(enabled bool) util.Gerror {
+	if enabled && !sc.Enabled {
+		sc.NextRun = sc.nextAfter(time.Now())
+	}
+	sc.Enabled = enabled
+	return sc.save()
+}
+
+// RunNow starts a job for the schedule right away, without changing when it
+// next runs on its own. Like a regular run, it won't start a new job if the
+// last one is still running.
+func (sc *Schedule) RunNow() (*Shovey, util.Gerror) {
+	return sc.fire()
+}
+
+// fire starts a new job from the schedule, unless the last job it started is
+// still going.
+func (sc *Schedule) fire() (*Shovey, util.Gerror) {
+	if sc.LastRunID != "" {
+		last, err := Get(sc.LastRunID)
+		if err == nil && (last.Status == "submitted" || last.Status == "running" || last.Status == "awaiting_approval") {
+			err := util.Errorf("the last job for shovey schedule %s, %s, is still %s", sc.Name, last.RunID, last.Status)
+			err.SetStatus(http.StatusConflict)
+			return nil, err
+		}
+	}
+	job := *sc.Job
+	job.RequestedBy = sc.RequestedBy
+	s, err := job.newJob(sc.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err = sc.recordRun(s.RunID, time.Now()); err != nil {
+		return nil, err
+	}
+	// A job that fails to start still counts as a run, and the error is
+	// in its status.
+	if serr := s.Start(); serr != nil {
+		logger.Errorf("shovey schedule %s: job %s didn't start: %s", sc.Name, s.RunID, serr.Error())
+	}
+	return s, nil
+}
+
+// claim advances the schedule's next run time, if nothing else has done so
+// since we read it. Only the goiardi process that successfully claims a run
+// starts the job, which keeps several goiardis sharing a database from all
+// running the same scheduled job.
+func (sc *Schedule) claim(now time.Time) (bool, util.Gerror) {
+	prev := sc.NextRun
+	next := sc.nextAfter(now)
+	if config.UsingDB() {
+		claimed, err := sc.claimSQL(prev, next)
+		if err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return false, gerr
+		}
+		if claimed {
+			sc.NextRun = next
+		}
+		return claimed, nil
+	}
+	schedMutex.Lock()
+	defer schedMutex.Unlock()
+	cur, err := GetSchedule(sc.Name)
+	if err != nil {
+		return false, err
+	}
+	if !cur.NextRun.Equal(prev) || !cur.Enabled {
+		return false, nil
+	}
+	cur.NextRun = next
+	sc.NextRun = next
+	ds := datastore.New()
+	ds.Set("shovey_schedule", cur.Name, cur)
+	return true, nil
+}
+
+// recordRun notes the job the schedule just started. Only the last run fields
+// are touched, so enabling or disabling the schedule at the same time isn't
+// lost.
+func (sc *Schedule) recordRun(runID string, at time.Time) util.Gerror {
+	sc.LastRun = at
+	sc.LastRunID = runID
+	if config.UsingDB() {
+		if err := sc.recordRunSQL(); err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return gerr
+		}
+		return nil
+	}
+	schedMutex.Lock()
+	defer schedMutex.Unlock()
+	cur, err := GetSchedule(sc.Name)
+	if err != nil {
+		return err
+	}
+	cur.LastRun = sc.LastRun
+	cur.LastRunID = sc.LastRunID
+	ds := datastore.New()
+	ds.Set("shovey_schedule", cur.Name, cur)
+	return nil
+}
+
+// RunDueSchedules starts jobs for any enabled schedules whose next run time
+// has come.
+func RunDueSchedules() {
+	now := time.Now()
+	for _, sc := range AllSchedules() {
+		if !sc.Enabled || sc.NextRun.IsZero() || sc.NextRun.After(now) {
+			continue
+		}
+		claimed, err := sc.claim(now)
+		if err != nil {
+			logger.Errorf("error claiming shovey schedule %s: %s", sc.Name, err.Error())
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		logger.Debugf("running shovey schedule %s", sc.Name)
+		if _, err := sc.fire(); err != nil {
+			if err.Status() == http.StatusConflict {
+				logger.Infof("skipping shovey schedule %s: %s", sc.Name, err.Error())
+			} else {
+				logger.Errorf("error running shovey schedule %s: %s", sc.Name, err.Error())
+			}
+		}
+	}
+}
+
+// History returns the jobs the schedule has started that are still around,
+// newest first.
+func (sc *Schedule) History() ([]*Shovey, util.Gerror) {
+	if config.UsingDB() {
+		return shoveysByScheduleSQL(sc.Name)
+	}
+	var hist []*Shovey
+	for _, s := range AllShoveys() {
+		if s.ScheduleName == sc.Name {
+			hist = append(hist, s)
+		}
+	}
+	sort.Sort(sort.Reverse(byCreatedAt(hist)))
+	return hist, nil
+}
+
+type byCreatedAt []*Shovey
+
+func (b byCreatedAt) Len() int           { return len(b) }
+func (b byCreatedAt) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byCreatedAt) Less(i, j int) bool { return b[i].CreatedAt.Before(b[j].CreatedAt) }
+
+func (sc *Schedule) save() util.Gerror {
+	sc.UpdatedAt = time.Now()
+	if config.UsingDB() {
+		if err := sc.saveSQL(); err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return gerr
+		}
+		return nil
+	}
+	ds := datastore.New()
+	ds.Set("shovey_schedule", sc.Name, sc)
+	return nil
+}
+
+// GetSchedule gets the shovey schedule with the given name.
+func GetSchedule(name string) (*Schedule, util.Gerror) {
+	var sc *Schedule
+	var found bool
+	if config.UsingDB() {
+		var err error
+		sc, err = getScheduleSQL(name)
+		if err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return nil, gerr
+		}
+		found = sc != nil
+	} else {
+		ds := datastore.New()
+		var s interface{}
+		s, found = ds.Get("shovey_schedule", name)
+		if s != nil {
+			sc = s.(*Schedule)
+		}
+	}
+	if !found {
+		err := util.Errorf("shovey schedule %s not found", name)
+		err.SetStatus(http.StatusNotFound)
+		return nil, err
+	}
+	return sc, nil
+}
+
+func scheduleExists(name string) (bool, util.Gerror) {
+	_, err := GetSchedule(name)
+	if err != nil {
+		if err.Status() == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Delete removes the schedule. Jobs it already started are left alone.
+func (sc *Schedule) Delete() util.Gerror {
+	if config.UsingDB() {
+		if err := sc.deleteSQL(); err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return gerr
+		}
+		return nil
+	}
+	ds := datastore.New()
+	ds.Delete("shovey_schedule", sc.Name)
+	return nil
+}
+
+// ScheduleList returns the names of all the shovey schedules.
+func ScheduleList() []string {
+	if config.UsingDB() {
+		return scheduleListSQL()
+	}
+	ds := datastore.New()
+	list := ds.GetList("shovey_schedule")
+	sort.Strings(list)
+	return list
+}
+
+// AllSchedules returns all the shovey schedules.
+func AllSchedules() []*Schedule {
+	if config.UsingDB() {
+		return allSchedulesSQL()
+	}
+	var schedules []*Schedule
+	for _, name := range ScheduleList() {
+		sc, err := GetSchedule(name)
+		if err != nil {
+			continue
+		}
+		schedules = append(schedules, sc)
+	}
+	return schedules
+}
+
+// ImportSchedule is used to import shovey schedules from the exported JSON
+// dump.
+func ImportSchedule(scheduleJSON map[string]interface{}) error {
+	sc := &Schedule{Name: scheduleJSON["name"].(string)}
+	sc.Enabled, _ = scheduleJSON["enabled"].(bool)
+	sc.Cron, _ = scheduleJSON["cron"].(string)
+	ivl, _ := intify(scheduleJSON["interval"])
+	sc.Interval = time.Duration(ivl)
+	sc.LastRunID, _ = scheduleJSON["last_run_id"].(string)
+	sc.RequestedBy, _ = scheduleJSON["requested_by"].(string)
+	for k, t := range map[string]*time.Time{"next_run": &sc.NextRun, "last_run": &sc.LastRun, "created_at": &sc.CreatedAt, "updated_at": &sc.UpdatedAt} {
+		if ts, ok := scheduleJSON[k].(string); ok {
+			*t, _ = time.Parse(time.RFC3339, ts)
+		}
+	}
+	jm, ok := scheduleJSON["job"].(map[string]interface{})
+	if !ok {
+		return util.Errorf("shovey schedule %s has no job", sc.Name)
+	}
+	js := &JobSpec{}
+	js.Command, _ = jm["command"].(string)
+	js.Template, _ = jm["template"].(string)
+	if args, ok := jm["args"].(map[string]interface{}); ok {
+		js.Args = make(map[string]string, len(args))
+		for k, v := range args {
+			js.Args[k], _ = v.(string)
+		}
+	}
+	js.Quorum, _ = jm["quorum"].(string)
+	js.Search, _ = jm["search"].(string)
+	js.ResolveAtStart, _ = jm["resolve_at_start"].(bool)
+	js.BatchSize, _ = jm["batch_size"].(string)
+	t, _ := intify(jm["run_timeout"])
+	js.Timeout = int(t)
+	bw, _ := intify(jm["batch_wait"])
+	js.BatchWait = int(bw)
+	mf, _ := intify(jm["max_failures"])
+	js.MaxFailures = int(mf)
+	if nn, ok := jm["nodes"].([]interface{}); ok {
+		for _, n := range nn {
+			js.NodeNames = append(js.NodeNames, n.(string))
+		}
+	}
+	sc.Job = js
+	if config.UsingDB() {
+		return sc.importSaveSQL()
+	}
+	ds := datastore.New()
+	ds.Set("shovey_schedule", sc.Name, sc)
+	return nil
+}
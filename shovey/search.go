@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shovey
+
+// Targeting shovey jobs with a node search query, rather than a list of
+// node names.
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/search"
+	"github.com/ctdk/goiardi/util"
+)
+
+// how many nodes to ask the searcher for at a time when resolving a query
+const searchPageSize = 1000
+
+// NewFromSearch creates a new shovey instance targeting the nodes matching
+// the given node search query. The query is resolved right away and the
+// matching nodes are recorded on the job, but if resolveAtStart is true the
+// query will be run again when the job is started and the job will go to
+// whichever nodes match then instead.
+func NewFromSearch(command string, timeout int, quorumStr string, query string, resolveAtStart bool) (*Shovey, util.Gerror) {
+	s, err := newShoveyFromSearch(command, timeout, quorumStr, query, resolveAtStart)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.save(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newShoveyFromSearch(command string, timeout int, quorumStr string, query string, resolveAtStart bool) (*Shovey, util.Gerror) {
+	nodeNames, err := ResolveSearch(query)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newShovey(command, timeout, quorumStr, nodeNames)
+	if err != nil {
+		return nil, err
+	}
+	s.Search = query
+	s.ResolveAtStart = resolveAtStart
+	return s, nil
+}
+
+// ResolveSearch runs the given query against the node index with the
+// configured searcher, and returns the names of the matching nodes. It's an
+// error for the query to match no nodes at all.
+func ResolveSearch(query string) ([]string, util.Gerror) {
+	var searcher search.Searcher
+	if config.Config.PgSearch {
+		searcher = &search.PostgresSearch{}
+	} else {
+		searcher = &search.TrieSearch{}
+	}
+
+	var nodeNames []string
+	for start := 0; ; start += searchPageSize {
+		res, err := searcher.Search("node", query, searchPageSize, "id ASC", start, nil)
+		if err != nil {
+			gerr := util.Errorf("error resolving node search '%s': %s", query, err.Error())
+			gerr.SetStatus(http.StatusBadRequest)
+			return nil, gerr
+		}
+		for _, r := range res {
+			if name, ok := r["name"].(string); ok {
+				nodeNames = append(nodeNames, name)
+			}
+		}
+		if len(res) < searchPageSize {
+			break
+		}
+	}
+	if len(nodeNames) == 0 {
+		err := util.Errorf("no nodes matched the search '%s'", query)
+		err.SetStatus(http.StatusBadRequest)
+		return nil, err
+	}
+	sort.Strings(nodeNames)
+	return nodeNames, nil
+}
+
+// resolveNodes re-runs the job's search query if it's supposed to be resolved
+// when the job starts, and updates the job's nodes with the results.
+func (s *Shovey) resolveNodes() util.Gerror {
+	if s.Search == "" || !s.ResolveAtStart {
+		return nil
+	}
+	nodeNames, err := ResolveSearch(s.Search)
+	if err != nil {
+		return err
+	}
+	s.NodeNames = nodeNames
+	return nil
+}
@@ -20,7 +20,6 @@ package shovey
 
 import (
 	"bytes"
-	"crypto/rsa"
 	"encoding/json"
 	"fmt"
 	"math"
@@ -36,11 +35,7 @@ import (
 	"github.com/ctdk/chefcrypto"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
-	"github.com/ctdk/goiardi/node"
-	"github.com/ctdk/goiardi/secret"
-	"github.com/ctdk/goiardi/serfin"
 	"github.com/ctdk/goiardi/util"
-	serfclient "github.com/hashicorp/serf/client"
 	"github.com/pborman/uuid"
 	"github.com/tideland/golib/logger"
 )
@@ -56,6 +51,24 @@ type Shovey struct {
 	Status    string        `json:"status"`
 	Timeout   time.Duration `json:"timeout"`
 	Quorum    string        `json:"quorum"`
+	// The node search query the job's nodes were found with, if any.
+	Search         string `json:"search,omitempty"`
+	ResolveAtStart bool   `json:"resolve_at_start,omitempty"`
+	// Rolling execution settings, and how far along the job is. See
+	// SetRolling.
+	BatchSize    string        `json:"batch_size,omitempty"`
+	BatchWait    time.Duration `json:"batch_wait,omitempty"`
+	MaxFailures  int           `json:"max_failures,omitempty"`
+	CurrentBatch int           `json:"current_batch,omitempty"`
+	TotalBatches int           `json:"total_batches,omitempty"`
+	// The schedule that started this job, if any.
+	ScheduleName string `json:"schedule,omitempty"`
+	// The template the job's command was made from, if any, and who asked
+	// for and approved the job. See Approve.
+	Template     string            `json:"template,omitempty"`
+	TemplateArgs map[string]string `json:"template_args,omitempty"`
+	RequestedBy  string            `json:"requested_by,omitempty"`
+	ApprovedBy   string            `json:"approved_by,omitempty"`
 }
 
 // ShoveyRun represents a node's shovey run.
@@ -68,6 +81,8 @@ type ShoveyRun struct {
 	EndTime    time.Time `json:"end_time"`
 	Error      string    `json:"error"`
 	ExitStatus uint8     `json:"exit_status"`
+	// When the command was sent to the node. See SuperviseJobs.
+	SentAt time.Time `json:"sent_at"`
 }
 
 // ShoveyRunStream holds a chunk of output from a shovey run.
@@ -161,6 +176,17 @@ func (e *qerror) SetDownNodes(d []string) {
 
 // New creates a new shovey instance.
 func New(command string, timeout int, quorumStr string, nodeNames []string) (*Shovey, util.Gerror) {
+	s, err := newShovey(command, timeout, quorumStr, nodeNames)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.save(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newShovey(command string, timeout int, quorumStr string, nodeNames []string) (*Shovey, util.Gerror) {
 	var found bool
 	runID := uuid.New()
 
@@ -189,16 +215,39 @@ func New(command string, timeout int, quorumStr string, nodeNames []string) (*Sh
 	s.CreatedAt = time.Now()
 	s.UpdatedAt = time.Now()
 
-	err := s.save()
-	if err != nil {
-		return nil, err
-	}
-
 	return s, nil
 }
 
-// Start kicks off all the shovey runs for this shovey instance.
+// Start kicks off all the shovey runs for this shovey instance. Jobs made
+// from a template that needs approval wait with the "awaiting_approval" status
+// until they're approved instead.
 func (s *Shovey) Start() util.Gerror {
+	if s.Template != "" {
+		t, terr := GetTemplate(s.Template)
+		if terr != nil {
+			s.Status = "job_failed"
+			s.save()
+			return terr
+		}
+		if t.RequireApproval && s.ApprovedBy == "" {
+			s.Status = "awaiting_approval"
+			return s.save()
+		}
+		if rerr := s.resolveNodes(); rerr != nil {
+			s.Status = "job_failed"
+			s.save()
+			return rerr
+		}
+		if terr = t.CheckTargets(s.NodeNames); terr != nil {
+			s.Status = "job_failed"
+			s.save()
+			return terr
+		}
+	} else if rerr := s.resolveNodes(); rerr != nil {
+		s.Status = "job_failed"
+		s.save()
+		return rerr
+	}
 	err := s.startJobs()
 	if err != nil {
 		s.Status = err.Status()
@@ -211,6 +260,7 @@ func (s *Shovey) Start() util.Gerror {
 }
 
 func (s *Shovey) save() util.Gerror {
+	defer watchers.notify(s.RunID)
 	if config.UsingDB() {
 		return s.saveSQL()
 	}
@@ -223,6 +273,7 @@ func (s *Shovey) save() util.Gerror {
 }
 
 func (sr *ShoveyRun) save() util.Gerror {
+	defer watchers.notify(sr.ShoveyUUID)
 	if config.UsingDB() {
 		return sr.saveSQL()
 	}
@@ -306,6 +357,11 @@ func DoesExist(runID string) (bool, util.Gerror) {
 
 // Cancel cancels all ShoveyRuns associated with this shovey instance.
 func (s *Shovey) Cancel() util.Gerror {
+	// nothing's been sent out yet
+	if s.Status == "awaiting_approval" {
+		s.Status = "cancelled"
+		return s.save()
+	}
 	err := s.CancelRuns(s.NodeNames)
 	if err != nil {
 		return err
@@ -333,7 +389,7 @@ func (s *Shovey) CancelRuns(nodeNames []string) util.Gerror {
 			if err != nil {
 				return err
 			}
-			if sr.Status != "invalid" && sr.Status != "succeeded" && sr.Status != "failed" && sr.Status != "down" && sr.Status != "nacked" {
+			if sr.Status != "invalid" && sr.Status != "succeeded" && sr.Status != "failed" && sr.Status != "down" && sr.Status != "nacked" && sr.Status != "timed_out" {
 				sr.EndTime = time.Now()
 				sr.Status = "cancelled"
 				err = sr.save()
@@ -353,7 +409,12 @@ func (s *Shovey) CancelRuns(nodeNames []string) util.Gerror {
 	} else {
 		s.checkCompleted()
 	}
+	return s.sendCancel(nodeNames)
+}
 
+// sendCancel tells the given nodes to stop running the job, and waits a little
+// while for them to acknowledge it.
+func (s *Shovey) sendCancel(nodeNames []string) util.Gerror {
 	payload := make(map[string]string)
 	payload["action"] = "cancel"
 	payload["run_id"] = s.RunID
@@ -365,11 +426,7 @@ func (s *Shovey) CancelRuns(nodeNames []string) util.Gerror {
 	payload["signature"] = sig
 	jsonPayload, _ := json.Marshal(payload)
 	ackCh := make(chan string, len(nodeNames))
-	q := &serfclient.QueryParam{Name: "shovey", Payload: jsonPayload, FilterNodes: nodeNames, RequestAck: true, AckCh: ackCh}
-	errch := make(chan error)
-	go serfin.Query(q, errch)
-	err := <-errch
-
+	err := getTransport().Send(jsonPayload, nodeNames, ackCh)
 	if err != nil {
 		return util.CastErr(err)
 	}
@@ -398,8 +455,9 @@ func (s *Shovey) startJobs() Qerror {
 	if err != nil {
 		return err
 	}
-	// query node statuses to see if enough are up
-	upNodes, nerr := node.GetNodesByStatus(s.NodeNames, "up")
+	// ask the transport which nodes are up
+	transport := getTransport()
+	upNodes, nerr := transport.UpNodes(s.NodeNames)
 	if nerr != nil {
 		return CastErr(nerr)
 	}
@@ -410,20 +468,39 @@ func (s *Shovey) startJobs() Qerror {
 		return err
 	}
 
+	// Without a batch size, every node is in the first and only batch.
+	batches := [][]string{upNodes}
+	if s.Rolling() {
+		var berr error
+		batches, berr = splitBatches(upNodes, s.BatchSize)
+		if berr != nil {
+			return CastErr(berr)
+		}
+		s.CurrentBatch = 1
+		s.TotalBatches = len(batches)
+	}
+
 	// if that all worked, send the commands
 	errch := make(chan error)
 	go func() {
-		tagNodes := make([]string, len(upNodes))
 		d := make(map[string]bool)
-		for i, n := range upNodes {
-			tagNodes[i] = n.Name
-			d[n.Name] = true
-			sr := &ShoveyRun{ShoveyUUID: s.RunID, NodeName: n.Name, Status: "created"}
-			err := sr.save()
-			if err != nil {
-				logger.Errorf("error saving shovey run: %s", err.Error())
-				errch <- err
-				return
+		for i, batch := range batches {
+			status := "created"
+			var sentAt time.Time
+			if i > 0 {
+				status = "pending"
+			} else {
+				sentAt = time.Now()
+			}
+			for _, n := range batch {
+				d[n] = true
+				sr := &ShoveyRun{ShoveyUUID: s.RunID, NodeName: n, Status: status, SentAt: sentAt}
+				err := sr.save()
+				if err != nil {
+					logger.Errorf("error saving shovey run: %s", err.Error())
+					errch <- err
+					return
+				}
 			}
 		}
 		for _, n := range s.NodeNames {
@@ -437,34 +514,47 @@ func (s *Shovey) startJobs() Qerror {
 				}
 			}
 		}
-		// make sure this is the right amount of buffering
-		payload := make(map[string]string)
-		payload["run_id"] = s.RunID
-		payload["command"] = s.Command
-		payload["action"] = "start"
-		payload["time"] = time.Now().Format(time.RFC3339)
-		payload["timeout"] = fmt.Sprintf("%d", s.Timeout)
-		sig, serr := s.signRequest(payload)
-		if serr != nil {
-			errch <- serr
-			return
-		}
-		payload["signature"] = sig
-		jsonPayload, _ := json.Marshal(payload)
-		ackCh := make(chan string, len(tagNodes))
-		respCh := make(chan serfclient.NodeResponse, len(tagNodes))
-
-		q := &serfclient.QueryParam{Name: "shovey", Payload: jsonPayload, FilterNodes: tagNodes, RequestAck: true, AckCh: ackCh, RespCh: respCh}
-		qerrch := make(chan error)
-		go serfin.Query(q, qerrch)
-		qerr := <-qerrch
-		if qerr != nil {
+		if qerr := s.sendBatch(transport, batches[0]); qerr != nil {
 			errch <- qerr
 			return
 		}
-
 		errch <- nil
-		srCh := make(chan *ShoveyRun, len(upNodes)*2)
+		if len(batches) > 1 {
+			s.rollBatches(transport, batches, 0)
+		}
+	}()
+	grerr := <-errch
+	if grerr != nil {
+		return CastErr(grerr)
+	}
+
+	return nil
+}
+
+// sendBatch sends the start command to the given nodes, and records when
+// each of them acknowledges it.
+func (s *Shovey) sendBatch(transport Transport, nodeNames []string) error {
+	// make sure this is the right amount of buffering
+	payload := make(map[string]string)
+	payload["run_id"] = s.RunID
+	payload["command"] = s.Command
+	payload["action"] = "start"
+	payload["time"] = time.Now().Format(time.RFC3339)
+	payload["timeout"] = fmt.Sprintf("%d", s.Timeout)
+	sig, serr := s.signRequest(payload)
+	if serr != nil {
+		return serr
+	}
+	payload["signature"] = sig
+	jsonPayload, _ := json.Marshal(payload)
+	ackCh := make(chan string, len(nodeNames))
+	qerr := transport.Send(jsonPayload, nodeNames, ackCh)
+	if qerr != nil {
+		return qerr
+	}
+
+	go func() {
+		srCh := make(chan *ShoveyRun, len(nodeNames)*2)
 
 		go func() {
 			for sr := range srCh {
@@ -472,9 +562,19 @@ func (s *Shovey) startJobs() Qerror {
 			}
 		}()
 
-		for i := 0; i < len(upNodes)*2; i++ {
+		// One timer for the whole batch, so acknowledgements coming
+		// in don't keep pushing the deadline back. Nodes that don't
+		// acknowledge in time are dealt with by SuperviseJobs.
+		timer := time.NewTimer(s.Timeout * time.Second)
+		defer timer.Stop()
+	ackLoop:
+		for acked := 0; acked < len(nodeNames); {
 			select {
-			case a := <-ackCh:
+			case a, ok := <-ackCh:
+				if !ok {
+					// the transport's done collecting them
+					break ackLoop
+				}
 				if a == "" {
 					continue
 				}
@@ -485,27 +585,25 @@ func (s *Shovey) startJobs() Qerror {
 				}
 				sr.AckTime = time.Now()
 				srCh <- sr
-			case r := <-respCh:
-				logger.Debugf("got a response: %v", r)
-				break
-			case <-time.After(s.Timeout * time.Second):
-				logger.Debugf("timed out, might not be appropriate")
-				break
+				acked++
+			case <-timer.C:
+				logger.Debugf("shovey job %s: timed out waiting for acknowledgements", s.RunID)
+				break ackLoop
 			}
 		}
 		close(srCh)
 
 		logger.Debugf("out of for/select loop for shovey responses")
 	}()
-	grerr := <-errch
-	if grerr != nil {
-		return CastErr(grerr)
-	}
-
 	return nil
 }
 
 func (s *Shovey) checkCompleted() {
+	// a rolling job that was stopped for having too many failures stays
+	// failed once its last runs finish
+	if s.Status == "job_failed" {
+		return
+	}
 	if config.UsingDB() {
 		s.checkCompletedSQL()
 		return
@@ -517,7 +615,7 @@ func (s *Shovey) checkCompleted() {
 	}
 	c := 0
 	for _, sr := range srs {
-		if sr.Status == "invalid" || sr.Status == "succeeded" || sr.Status == "failed" || sr.Status == "down" || sr.Status == "nacked" || sr.Status == "cancelled" {
+		if sr.finished() {
 			c++
 		}
 	}
@@ -536,6 +634,30 @@ func (s *Shovey) ToJSON() (map[string]interface{}, util.Gerror) {
 	toJSON["status"] = s.Status
 	toJSON["created_at"] = s.CreatedAt
 	toJSON["updated_at"] = s.UpdatedAt
+	if s.Search != "" {
+		toJSON["search"] = s.Search
+		toJSON["resolve_at_start"] = s.ResolveAtStart
+	}
+	if s.ScheduleName != "" {
+		toJSON["schedule"] = s.ScheduleName
+	}
+	if s.Template != "" {
+		toJSON["template"] = s.Template
+		toJSON["template_args"] = s.TemplateArgs
+	}
+	if s.RequestedBy != "" {
+		toJSON["requested_by"] = s.RequestedBy
+	}
+	if s.ApprovedBy != "" {
+		toJSON["approved_by"] = s.ApprovedBy
+	}
+	if s.Rolling() {
+		toJSON["batch_size"] = s.BatchSize
+		toJSON["batch_wait"] = s.BatchWait
+		toJSON["max_failures"] = s.MaxFailures
+		toJSON["current_batch"] = s.CurrentBatch
+		toJSON["total_batches"] = s.TotalBatches
+	}
 	tjnodes := make(map[string][]string)
 
 	// we can totally do this more efficiently in SQL mode. Do so when we're
@@ -548,6 +670,7 @@ func (s *Shovey) ToJSON() (map[string]interface{}, util.Gerror) {
 		tjnodes[sr.Status] = append(tjnodes[sr.Status], sr.NodeName)
 	}
 	toJSON["nodes"] = tjnodes
+	toJSON["summary"] = summarizeRuns(srs)
 
 	return toJSON, nil
 }
@@ -651,6 +774,7 @@ func (sr *ShoveyRun) notifyParent() {
 // AddStreamOutput adds a chunk of output from the job to the output list on the
 // server stored in the ShoveyRunStream objects.
 func (sr *ShoveyRun) AddStreamOutput(output string, outputType string, seq int, isLast bool) util.Gerror {
+	defer watchers.notify(sr.ShoveyUUID)
 	if config.UsingDB() {
 		return sr.addStreamOutSQL(output, outputType, seq, isLast)
 	}
@@ -716,6 +840,7 @@ func (sr *ShoveyRun) ToJSON() (map[string]interface{}, util.Gerror) {
 	toJSON["end_time"] = sr.EndTime
 	toJSON["error"] = sr.Error
 	toJSON["exit_status"] = sr.ExitStatus
+	toJSON["sent_at"] = sr.SentAt
 	toJSON["output"], err = sr.CombineStreamOutput("stdout", 0)
 	if err != nil {
 		return nil, err
@@ -761,10 +886,17 @@ func getQuorum(quorum string, numNodes int) (int, Qerror) {
 	return int(qnum), nil
 }
 
+// signRequest signs a request to node agents, adding the ID of the key it was
+// signed with to the payload so agents know which key to check it with.
 func (s *Shovey) signRequest(payload map[string]string) (string, error) {
 	if payload == nil {
 		return "", fmt.Errorf("No payload given to sign!")
 	}
+	sk, err := currentSigningKey()
+	if err != nil {
+		return "", err
+	}
+	payload["key_id"] = sk.ID
 	pkeys := make([]string, len(payload))
 	i := 0
 	for k := range payload {
@@ -778,20 +910,7 @@ func (s *Shovey) signRequest(payload map[string]string) (string, error) {
 	}
 	payloadBlock := strings.Join(parr, "\n")
 
-	var pk *rsa.PrivateKey
-	if config.UsingExternalSecrets() {
-		var err error
-		pk, err = secret.GetSigningKey(config.Config.VaultShoveyKey)
-		if err != nil {
-			return "", err
-		}
-	} else {
-		config.Key.RLock()
-		defer config.Key.RUnlock()
-		j := *config.Key.PrivKey
-		pk = &j
-	}
-	sig, err := chefcrypto.SignTextBlock(payloadBlock, pk)
+	sig, err := chefcrypto.SignTextBlock(payloadBlock, sk.key)
 	if err != nil {
 		return "", err
 	}
@@ -822,6 +941,31 @@ func ImportShovey(shoveyJSON map[string]interface{}) error {
 	timeout := time.Duration(ttmp)
 	quorum := shoveyJSON["quorum"].(string)
 	s := &Shovey{RunID: runID, NodeNames: nodeNames, Command: command, CreatedAt: createdAt, UpdatedAt: updatedAt, Status: status, Timeout: timeout, Quorum: quorum}
+	if q, ok := shoveyJSON["search"].(string); ok {
+		s.Search = q
+		s.ResolveAtStart, _ = shoveyJSON["resolve_at_start"].(bool)
+	}
+	s.ScheduleName, _ = shoveyJSON["schedule"].(string)
+	s.Template, _ = shoveyJSON["template"].(string)
+	if ta, ok := shoveyJSON["template_args"].(map[string]interface{}); ok {
+		s.TemplateArgs = make(map[string]string, len(ta))
+		for k, v := range ta {
+			s.TemplateArgs[k], _ = v.(string)
+		}
+	}
+	s.RequestedBy, _ = shoveyJSON["requested_by"].(string)
+	s.ApprovedBy, _ = shoveyJSON["approved_by"].(string)
+	if bs, ok := shoveyJSON["batch_size"].(string); ok {
+		s.BatchSize = bs
+		bw, _ := intify(shoveyJSON["batch_wait"])
+		s.BatchWait = time.Duration(bw)
+		mf, _ := intify(shoveyJSON["max_failures"])
+		s.MaxFailures = int(mf)
+		cb, _ := intify(shoveyJSON["current_batch"])
+		s.CurrentBatch = int(cb)
+		tb, _ := intify(shoveyJSON["total_batches"])
+		s.TotalBatches = int(tb)
+	}
 	return s.importSave()
 }
 
@@ -830,7 +974,7 @@ func ImportShoveyRun(sRunJSON map[string]interface{}) error {
 	shoveyUUID := sRunJSON["run_id"].(string)
 	nodeName := sRunJSON["node_name"].(string)
 	status := sRunJSON["status"].(string)
-	var ackTime, endTime time.Time
+	var ackTime, endTime, sentAt time.Time
 	if at, ok := sRunJSON["ack_time"].(string); ok {
 		var err error
 		if ackTime, err = time.Parse(time.RFC3339, at); err != nil {
@@ -843,10 +987,16 @@ func ImportShoveyRun(sRunJSON map[string]interface{}) error {
 			return err
 		}
 	}
+	if st, ok := sRunJSON["sent_at"].(string); ok {
+		var err error
+		if sentAt, err = time.Parse(time.RFC3339, st); err != nil {
+			return err
+		}
+	}
 	errMsg := sRunJSON["error"].(string)
 	extmp, _ := intify(sRunJSON["exit_status"])
 	exitStatus := uint8(extmp)
-	sr := &ShoveyRun{ShoveyUUID: shoveyUUID, NodeName: nodeName, Status: status, AckTime: ackTime, EndTime: endTime, Error: errMsg, ExitStatus: exitStatus}
+	sr := &ShoveyRun{ShoveyUUID: shoveyUUID, NodeName: nodeName, Status: status, AckTime: ackTime, EndTime: endTime, Error: errMsg, ExitStatus: exitStatus, SentAt: sentAt}
 	// This can use the normal save function
 	return sr.save()
 }
@@ -17,12 +17,28 @@
 package shovey
 
 import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/gob"
+	"encoding/pem"
 	"fmt"
 	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
 	"github.com/ctdk/goiardi/indexer"
 	"github.com/ctdk/goiardi/node"
+	"github.com/pborman/uuid"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestShoveyCreation(t *testing.T) {
@@ -64,3 +80,920 @@ func TestShoveyCreation(t *testing.T) {
 	//	t.Errorf(err.Error())
 	//}
 }
+
+func TestShoveyPurge(t *testing.T) {
+	gob.Register(new(ShoveyRunStream))
+	nodeNames := []string{"node-purge-0", "node-purge-1"}
+	old := &Shovey{RunID: "purge-old", NodeNames: nodeNames, Command: "/bin/ls", Status: "complete"}
+	old.save()
+	// save() sets UpdatedAt, so backdate these behind its back
+	ds := datastore.New()
+	old.UpdatedAt = time.Now().Add(-48 * time.Hour)
+	ds.Set("shovey", old.RunID, old)
+	running := &Shovey{RunID: "purge-running", NodeNames: nodeNames, Command: "/bin/ls", Status: "running"}
+	running.save()
+	running.UpdatedAt = time.Now().Add(-48 * time.Hour)
+	ds.Set("shovey", running.RunID, running)
+	recent := &Shovey{RunID: "purge-recent", NodeNames: nodeNames, Command: "/bin/ls", Status: "complete"}
+	recent.save()
+	for _, s := range []*Shovey{old, running, recent} {
+		for _, n := range nodeNames {
+			sr := &ShoveyRun{ShoveyUUID: s.RunID, NodeName: n, Status: "succeeded"}
+			sr.save()
+			sr.AddStreamOutput("some output", "stdout", 0, false)
+			sr.AddStreamOutput("more output", "stdout", 1, true)
+		}
+	}
+
+	res, err := PurgeFinished(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Jobs != 1 || res.Runs != 2 || res.Streams != 4 {
+		t.Errorf("expected to purge 1 job, 2 runs, and 4 streams, got %d, %d, and %d", res.Jobs, res.Runs, res.Streams)
+	}
+	if _, gerr := Get(old.RunID); gerr == nil {
+		t.Errorf("old finished shovey job %s should have been purged", old.RunID)
+	}
+	for _, s := range []*Shovey{running, recent} {
+		s2, gerr := Get(s.RunID)
+		if gerr != nil {
+			t.Errorf("shovey job %s should not have been purged", s.RunID)
+			continue
+		}
+		runs, _ := s2.GetNodeRuns()
+		if len(runs) != 2 {
+			t.Errorf("shovey job %s should still have 2 node runs, had %d", s.RunID, len(runs))
+		}
+	}
+}
+
+func TestPullTransport(t *testing.T) {
+	config.Config.ShoveyTransport = "http"
+	defer func() { config.Config.ShoveyTransport = "" }()
+
+	nodeNames := []string{"node-pull-0", "node-pull-1", "node-pull-2"}
+	PollJobs(nodeNames[0], 0)
+	PollJobs(nodeNames[1], 0)
+	up, _ := getTransport().UpNodes(nodeNames)
+	if len(up) != 2 {
+		t.Errorf("expected the 2 nodes that polled to be up, got %v", up)
+	}
+
+	// a waiting poll should get woken up by a job being sent
+	polled := make(chan []*PullMessage)
+	go func() {
+		msgs, _ := PollJobs(nodeNames[0], 10*time.Second)
+		polled <- msgs
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ackCh := make(chan string, len(up))
+	if err := getTransport().Send([]byte(`{"action":"start"}`), up, ackCh); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*PullMessage
+	select {
+	case msgs = <-polled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("waiting poll wasn't woken up by a new job")
+	}
+	if len(msgs) != 1 || string(msgs[0].Payload) != `{"action":"start"}` {
+		t.Fatalf("got the wrong jobs from polling: %v", msgs)
+	}
+	if more, _ := PollJobs(nodeNames[0], 0); len(more) != 0 {
+		t.Errorf("jobs should only be handed out once, got %d more", len(more))
+	}
+	msgs1, _ := PollJobs(nodeNames[1], 0)
+	if len(msgs1) != 1 || msgs1[0].ID != msgs[0].ID {
+		t.Fatalf("second node didn't get the same job: %v", msgs1)
+	}
+
+	if err := AckJob(nodeNames[2], msgs[0].ID); err == nil {
+		t.Errorf("a node the job wasn't sent to should not be able to acknowledge it")
+	}
+	for _, n := range up {
+		if err := AckJob(n, msgs[0].ID); err != nil {
+			t.Error(err)
+		}
+	}
+	var acked []string
+	for a := range ackCh {
+		acked = append(acked, a)
+	}
+	if len(acked) != 2 {
+		t.Errorf("expected 2 acknowledgements before the channel closed, got %v", acked)
+	}
+}
+
+func TestSearchTargeting(t *testing.T) {
+	indexer.Initialize(config.Config)
+	gob.Register(new(node.Node))
+	gob.Register(new(Shovey))
+	objs := make([]indexer.Indexable, 0, 4)
+	for i := 0; i < 4; i++ {
+		n, _ := node.New(fmt.Sprintf("search-shove-%d", i))
+		if i%2 == 0 {
+			n.ChefEnvironment = "shoveprod"
+		}
+		n.Save()
+		objs = append(objs, n)
+	}
+	rCh := make(chan struct{})
+	indexer.ReIndex(objs, rCh)
+	<-rCh
+
+	s, err := NewFromSearch("/bin/ls", 300, "100%", "chef_environment:shoveprod", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.NodeNames) != 2 || s.NodeNames[0] != "search-shove-0" || s.NodeNames[1] != "search-shove-2" {
+		t.Errorf("search should have resolved to search-shove-0 and search-shove-2, got %v", s.NodeNames)
+	}
+	s2, err := Get(s.RunID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2.Search != "chef_environment:shoveprod" || !s2.ResolveAtStart {
+		t.Errorf("search query wasn't recorded on the job: %q %v", s2.Search, s2.ResolveAtStart)
+	}
+
+	// a node joining the environment later gets picked up when the search
+	// is resolved again at start time
+	n, _ := node.Get("search-shove-1")
+	n.ChefEnvironment = "shoveprod"
+	n.Save()
+	indexer.ReIndex([]indexer.Indexable{n}, rCh)
+	<-rCh
+	if err := s2.resolveNodes(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s2.NodeNames) != 3 {
+		t.Errorf("re-resolving the search should have found 3 nodes, got %v", s2.NodeNames)
+	}
+
+	if _, err := NewFromSearch("/bin/ls", 300, "100%", "chef_environment:nowhere", false); err == nil {
+		t.Errorf("a search matching no nodes should not have made a job")
+	}
+}
+
+func TestRollingExecution(t *testing.T) {
+	config.Config.ShoveyTransport = "http"
+	defer func() { config.Config.ShoveyTransport = "" }()
+	if config.Key.PrivKey == nil {
+		pk, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Key.PrivKey = pk
+	}
+	gob.Register(new(Shovey))
+	gob.Register(new(ShoveyRun))
+
+	nodeNames := []string{"node-roll-0", "node-roll-1", "node-roll-2", "node-roll-3"}
+	for _, n := range nodeNames {
+		PollJobs(n, 0)
+	}
+
+	waitFor := func(what string, check func() bool) {
+		deadline := time.Now().Add(10 * time.Second)
+		for !check() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	finishRun := func(s *Shovey, nodeName string, status string) {
+		sr, err := s.GetRun(nodeName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = sr.UpdateFromJSON(map[string]interface{}{"status": status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runStatus := func(s *Shovey, nodeName string) string {
+		sr, err := s.GetRun(nodeName)
+		if err != nil {
+			return ""
+		}
+		return sr.Status
+	}
+
+	// a failure in the first batch stops the job when none are allowed
+	s, err := New("/bin/ls", 300, "100%", nodeNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetRolling("50%", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s, _ = Get(s.RunID)
+	if s.CurrentBatch != 1 || s.TotalBatches != 2 {
+		t.Errorf("expected to be on batch 1 of 2, got %d of %d", s.CurrentBatch, s.TotalBatches)
+	}
+	if st := runStatus(s, "node-roll-0"); st != "created" {
+		t.Errorf("node-roll-0 should have been sent the job, but its run is %q", st)
+	}
+	if st := runStatus(s, "node-roll-2"); st != "pending" {
+		t.Errorf("node-roll-2 should be waiting for the next batch, but its run is %q", st)
+	}
+	if msgs, _ := PollJobs("node-roll-2", 0); len(msgs) != 0 {
+		t.Errorf("node-roll-2 got a job before its batch started")
+	}
+	finishRun(s, "node-roll-0", "failed")
+	finishRun(s, "node-roll-1", "succeeded")
+	waitFor("the job to fail", func() bool {
+		s, _ = Get(s.RunID)
+		return s.Status == "job_failed"
+	})
+	if st := runStatus(s, "node-roll-3"); st != "cancelled" {
+		t.Errorf("node-roll-3's run should have been cancelled, but is %q", st)
+	}
+
+	// with no failure threshold, the next batch goes out
+	for _, n := range nodeNames {
+		PollJobs(n, 0)
+	}
+	s, _ = New("/bin/ls", 300, "100%", nodeNames)
+	s.SetRolling("2", 0, -1)
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	finishRun(s, "node-roll-0", "failed")
+	finishRun(s, "node-roll-1", "succeeded")
+	waitFor("the second batch", func() bool {
+		return runStatus(s, "node-roll-2") == "created"
+	})
+	if msgs, _ := PollJobs("node-roll-2", 0); len(msgs) != 1 {
+		t.Errorf("node-roll-2 should have gotten the job in the second batch, got %v", msgs)
+	}
+	s, _ = Get(s.RunID)
+	if s.CurrentBatch != 2 {
+		t.Errorf("expected to be on batch 2, got %d", s.CurrentBatch)
+	}
+}
+
+func TestCron(t *testing.T) {
+	base := time.Date(2017, time.March, 4, 10, 7, 30, 0, time.UTC) // a Saturday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2017, time.March, 4, 10, 15, 0, 0, time.UTC)},
+		{"0 9 * * 1-5", time.Date(2017, time.March, 6, 9, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2017, time.March, 5, 0, 0, 0, 0, time.UTC)},
+		{"30 2 1,15 * *", time.Date(2017, time.March, 15, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2017, time.March, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 12 29 2 *", time.Date(2020, time.February, 29, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parsing '%s': %s", tt.expr, err.Error())
+			continue
+		}
+		if got := c.next(base); !got.Equal(tt.want) {
+			t.Errorf("next time for '%s' should have been %s, got %s", tt.expr, tt.want, got)
+		}
+	}
+	for _, bad := range []string{"61 * * * *", "* * *", "*/0 * * * *", "5-1 * * * *", "a b c d e"} {
+		if _, err := parseCron(bad); err == nil {
+			t.Errorf("'%s' should not have parsed", bad)
+		}
+	}
+	c, _ := parseCron("0 0 31 2 *")
+	if got := c.next(base); !got.IsZero() {
+		t.Errorf("a cron expression that never matches gave a next time of %s", got)
+	}
+}
+
+func TestSchedules(t *testing.T) {
+	config.Config.ShoveyTransport = "http"
+	defer func() { config.Config.ShoveyTransport = "" }()
+	if config.Key.PrivKey == nil {
+		pk, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Key.PrivKey = pk
+	}
+	gob.Register(new(Shovey))
+	gob.Register(new(ShoveyRun))
+	gob.Register(new(Schedule))
+	nodeNames := []string{"node-sched-0", "node-sched-1"}
+	for _, n := range nodeNames {
+		PollJobs(n, 0)
+	}
+
+	job := &JobSpec{Command: "/bin/ls", Timeout: 300, Quorum: "100%", NodeNames: nodeNames, MaxFailures: -1}
+	if _, err := NewSchedule("bad-interval", job, "", 5, true); err == nil {
+		t.Errorf("a schedule with an interval under a minute should not have been made")
+	}
+	if _, err := NewSchedule("bad-cron", job, "* * *", 0, true); err == nil {
+		t.Errorf("a schedule with a bad cron expression should not have been made")
+	}
+	sc, err := NewSchedule("ls-nodes", job, "", 3600, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSchedule("ls-nodes", job, "", 3600, true); err == nil {
+		t.Errorf("a schedule with the same name should not have been made")
+	}
+
+	// make it due
+	ds := datastore.New()
+	sc.NextRun = time.Now().Add(-time.Second).Truncate(time.Second)
+	ds.Set("shovey_schedule", sc.Name, sc)
+
+	// a copy read before the schedule ran can't claim the same run
+	stale, _ := GetSchedule("ls-nodes")
+	RunDueSchedules()
+	if claimed, _ := stale.claim(time.Now()); claimed {
+		t.Errorf("a stale copy of the schedule should not have been able to claim it")
+	}
+	sc, _ = GetSchedule("ls-nodes")
+	if sc.LastRunID == "" || !sc.NextRun.After(time.Now()) {
+		t.Fatalf("the schedule didn't run: last run id %q, next run %s", sc.LastRunID, sc.NextRun)
+	}
+	s, err := Get(sc.LastRunID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ScheduleName != "ls-nodes" || s.Status != "running" {
+		t.Errorf("the scheduled job should be running and linked to its schedule, got %q %q", s.ScheduleName, s.Status)
+	}
+
+	// the last job's still running, so it shouldn't run again
+	sc.NextRun = time.Now().Add(-time.Second).Truncate(time.Second)
+	ds.Set("shovey_schedule", sc.Name, sc)
+	RunDueSchedules()
+	if _, err := sc.RunNow(); err == nil || err.Status() != http.StatusConflict {
+		t.Errorf("running the schedule while its last job is running should have been a conflict, got %v", err)
+	}
+	if hist, _ := sc.History(); len(hist) != 1 {
+		t.Errorf("expected one job in the schedule's history, got %d", len(hist))
+	}
+
+	s.Status = "complete"
+	s.save()
+	s2, err := sc.RunNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hist, _ := sc.History()
+	if len(hist) != 2 || hist[0].RunID != s2.RunID {
+		t.Errorf("the history should have both jobs, newest first: %v", hist)
+	}
+
+	// disabled schedules don't run
+	s2.Status = "complete"
+	s2.save()
+	sc, _ = GetSchedule("ls-nodes")
+	sc.SetEnabled(false)
+	sc.NextRun = time.Now().Add(-time.Second).Truncate(time.Second)
+	ds.Set("shovey_schedule", sc.Name, sc)
+	RunDueSchedules()
+	if hist, _ := sc.History(); len(hist) != 2 {
+		t.Errorf("a disabled schedule ran")
+	}
+	if err := sc.Delete(); err != nil {
+		t.Error(err)
+	}
+	if _, err := GetSchedule("ls-nodes"); err == nil {
+		t.Errorf("the schedule should have been deleted")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	config.Config.ShoveyTransport = "http"
+	defer func() { config.Config.ShoveyTransport = "" }()
+	if config.Key.PrivKey == nil {
+		pk, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Key.PrivKey = pk
+	}
+	gob.Register(new(node.Node))
+	gob.Register(new(Shovey))
+	gob.Register(new(ShoveyRun))
+	gob.Register(new(Template))
+	for i := 0; i < 3; i++ {
+		n, _ := node.New(fmt.Sprintf("tmpl-node-%d", i))
+		n.ChefEnvironment = "tmplprod"
+		if i == 2 {
+			n.ChefEnvironment = "tmpldev"
+		}
+		n.RunList = []string{"role[web]"}
+		n.Save()
+		PollJobs(n.Name, 0)
+	}
+
+	tmpl, err := NewTemplate("restart-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.Command = "restart {{service}} {{delay}} {{mode}} {{tag}}"
+	var zero, sixty int64 = 0, 60
+	tmpl.Params = []*TemplateParam{
+		{Name: "service", Type: ParamRegex, Pattern: `[a-z][a-z0-9-]*`, Required: true},
+		{Name: "delay", Type: ParamInteger, Min: &zero, Max: &sixty, Default: "5"},
+		{Name: "mode", Type: ParamEnum, Values: []string{"graceful", "hard"}, Default: "graceful"},
+		{Name: "tag", Type: ParamString},
+	}
+	tmpl.Environments = []string{"tmplprod"}
+	tmpl.Roles = []string{"web"}
+	tmpl.RequireApproval = true
+	if err = tmpl.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, err := tmpl.Render(map[string]string{"service": "nginx", "delay": "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd != "restart nginx 10 graceful" {
+		t.Errorf("rendered command was %q", cmd)
+	}
+	for _, bad := range []map[string]string{
+		{},
+		{"service": "Nginx"},
+		{"service": "nginx", "delay": "61"},
+		{"service": "nginx", "delay": "soon"},
+		{"service": "nginx", "mode": "gentle"},
+		{"service": "nginx", "tag": "x; rm -rf /"},
+		{"service": "nginx", "user": "root"},
+	} {
+		if _, err := tmpl.Render(bad); err == nil || err.Status() != http.StatusBadRequest {
+			t.Errorf("rendering with %v should have failed", bad)
+		}
+	}
+	broken := &Template{Name: "broken", Command: "echo {{missing}}"}
+	if err := broken.Validate(); err == nil {
+		t.Errorf("a template using an undefined parameter should not have validated")
+	}
+
+	// the dev node isn't allowed
+	js := &JobSpec{Template: "restart-service", Args: map[string]string{"service": "nginx"}, Timeout: 300, Quorum: "100%", NodeNames: []string{"tmpl-node-0", "tmpl-node-2"}, MaxFailures: -1, RequestedBy: "alice"}
+	if _, err := js.NewJob(); err == nil || err.Status() != http.StatusForbidden {
+		t.Errorf("a job on a node outside the template's environments should have been forbidden, got %v", err)
+	}
+
+	js.NodeNames = []string{"tmpl-node-0", "tmpl-node-1"}
+	s, err := js.NewJob()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s, _ = Get(s.RunID)
+	if s.Status != "awaiting_approval" || s.Command != "restart nginx 5 graceful" || s.RequestedBy != "alice" {
+		t.Errorf("job should be waiting for approval: status %q, command %q, requested by %q", s.Status, s.Command, s.RequestedBy)
+	}
+	if err = s.Approve("alice"); err == nil || err.Status() != http.StatusForbidden {
+		t.Errorf("the admin who asked for the job should not be able to approve it, got %v", err)
+	}
+	if err = s.Approve("bob"); err != nil {
+		t.Fatal(err)
+	}
+	s, _ = Get(s.RunID)
+	if s.Status != "running" || s.ApprovedBy != "bob" {
+		t.Errorf("approved job should be running, got %q approved by %q", s.Status, s.ApprovedBy)
+	}
+	if err = s.Reject("carol"); err == nil || err.Status() != http.StatusConflict {
+		t.Errorf("rejecting a running job should have been a conflict, got %v", err)
+	}
+
+	// jobs started by a schedule are requested by whoever set it up
+	sjs := &JobSpec{Template: "restart-service", Args: map[string]string{"service": "nginx"}, Timeout: 300, Quorum: "100%", NodeNames: []string{"tmpl-node-0"}, MaxFailures: -1, RequestedBy: "dave"}
+	sc, err := NewSchedule("tmpl-sched", sjs, "", 3600, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Delete()
+	sc, _ = GetSchedule("tmpl-sched")
+	if sc.RequestedBy != "dave" {
+		t.Errorf("schedule should have been requested by dave, got %q", sc.RequestedBy)
+	}
+	s, err = sc.RunNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.RequestedBy != "dave" || s.Status != "awaiting_approval" {
+		t.Errorf("scheduled job should be waiting for approval requested by dave: status %q, requested by %q", s.Status, s.RequestedBy)
+	}
+	if err = s.Approve("dave"); err == nil || err.Status() != http.StatusForbidden {
+		t.Errorf("the admin who set up the schedule should not be able to approve its jobs, got %v", err)
+	}
+
+	config.Config.ShoveyTemplatesOnly = true
+	defer func() { config.Config.ShoveyTemplatesOnly = false }()
+	plain := &JobSpec{Command: "/bin/ls", Timeout: 300, Quorum: "100%", NodeNames: []string{"tmpl-node-0"}, MaxFailures: -1}
+	if _, err := plain.NewJob(); err == nil || err.Status() != http.StatusForbidden {
+		t.Errorf("a plain command should not be allowed with templates only, got %v", err)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	gob.Register(new(Shovey))
+	gob.Register(new(ShoveyRun))
+	gob.Register(new(ShoveyRunStream))
+	nodeNames := []string{"node-follow-0", "node-follow-1"}
+	s := &Shovey{RunID: uuid.New(), NodeNames: nodeNames, Command: "/bin/ls", Status: "running"}
+	s.save()
+	runs := make([]*ShoveyRun, len(nodeNames))
+	for i, n := range nodeNames {
+		runs[i] = &ShoveyRun{ShoveyUUID: s.RunID, NodeName: n, Status: "running"}
+		runs[i].save()
+	}
+	runs[0].AddStreamOutput("already here\n", "stdout", 0, false)
+
+	events := make(chan *ShoveyRunStream)
+	stop := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		if err := s.Follow(nil, "stdout", 0, events, stop); err != nil {
+			errCh <- err
+		}
+		close(errCh)
+	}()
+
+	next := func() *ShoveyRunStream {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			return ev
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for shovey output")
+		}
+		return nil
+	}
+	if ev := next(); ev == nil || ev.NodeName != "node-follow-0" || ev.Output != "already here\n" {
+		t.Fatalf("expected the existing output first, got %v", ev)
+	}
+
+	// output sent out of order waits for the gap to be filled
+	runs[1].AddStreamOutput("second", "stdout", 1, true)
+	runs[1].AddStreamOutput("first ", "stdout", 0, false)
+	for _, want := range []string{"first ", "second"} {
+		if ev := next(); ev == nil || ev.NodeName != "node-follow-1" || ev.Output != want {
+			t.Errorf("expected %q from node-follow-1, got %v", want, ev)
+		}
+	}
+
+	// stderr isn't being followed
+	runs[0].AddStreamOutput("oops", "stderr", 0, true)
+	runs[0].AddStreamOutput("done\n", "stdout", 1, true)
+	if ev := next(); ev == nil || ev.Output != "done\n" {
+		t.Errorf("expected the rest of node-follow-0's output, got %v", ev)
+	}
+
+	for _, sr := range runs {
+		sr.Status = "succeeded"
+		sr.save()
+	}
+	if ev := next(); ev != nil {
+		t.Errorf("following should have ended once the runs finished, got %v", ev)
+	}
+	if err := <-errCh; err != nil {
+		t.Error(err)
+	}
+
+	// stopping early closes the events channel too
+	s2 := &Shovey{RunID: uuid.New(), NodeNames: nodeNames[:1], Command: "/bin/ls", Status: "running"}
+	s2.save()
+	(&ShoveyRun{ShoveyUUID: s2.RunID, NodeName: nodeNames[0], Status: "running"}).save()
+	events = make(chan *ShoveyRunStream)
+	go s2.Follow(nil, "both", 0, events, stop)
+	close(stop)
+	if ev := next(); ev != nil {
+		t.Errorf("stopped follow should not have sent anything, got %v", ev)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	gob.Register(new(Shovey))
+	gob.Register(new(ShoveyRun))
+	gob.Register(new(ShoveyRunStream))
+	s := &Shovey{RunID: uuid.New(), Command: "/bin/ls", Status: "complete"}
+	start := time.Now().Add(-time.Hour)
+	runs := []struct {
+		node   string
+		status string
+		exit   uint8
+		secs   int
+		output string
+	}{
+		{"node-sum-0", "succeeded", 0, 2, "ok\n"},
+		{"node-sum-1", "succeeded", 0, 4, "ok\n"},
+		{"node-sum-2", "succeeded", 0, 6, "ok\n"},
+		{"node-sum-3", "failed", 2, 10, "no such file\n"},
+		{"node-sum-4", "succeeded", 1, 8, "no such file\n"},
+		{"node-sum-5", "down", 0, 0, ""},
+		{"node-sum-6", "running", 0, 0, "partial"},
+	}
+	for _, r := range runs {
+		s.NodeNames = append(s.NodeNames, r.node)
+		sr := &ShoveyRun{ShoveyUUID: s.RunID, NodeName: r.node, Status: r.status, ExitStatus: r.exit, AckTime: start}
+		if r.secs != 0 {
+			sr.EndTime = start.Add(time.Duration(r.secs) * time.Second)
+		}
+		sr.save()
+		if r.output != "" {
+			sr.AddStreamOutput(r.output, "stdout", 0, true)
+		}
+	}
+	s.save()
+
+	sj, err := s.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sj["summary"].(*RunSummary)
+	if sum.Total != 7 || sum.ByStatus["succeeded"] != 4 || sum.ByStatus["failed"] != 1 {
+		t.Errorf("wrong status counts: %v", sum.ByStatus)
+	}
+	if sum.ByExitStatus["0"] != 3 || sum.ByExitStatus["1"] != 1 || sum.ByExitStatus["2"] != 1 {
+		t.Errorf("wrong exit status counts: %v", sum.ByExitStatus)
+	}
+	if nodes := sum.NodesByExitStatus["1"]; len(nodes) != 1 || nodes[0] != "node-sum-4" {
+		t.Errorf("wrong nodes for exit status 1: %v", nodes)
+	}
+	want := map[string]int{OutcomeSucceeded: 3, OutcomeFailed: 2, OutcomeNotRun: 1, OutcomeInProgress: 1}
+	for o, n := range want {
+		if len(sum.Outcomes[o]) != n {
+			t.Errorf("expected %d nodes with outcome %s, got %v", n, o, sum.Outcomes[o])
+		}
+	}
+	d := sum.Duration
+	if d == nil || d.Count != 5 || d.Min != 2 || d.Max != 10 || d.Mean != 6 || d.Median != 6 || d.P95 != 10 {
+		t.Errorf("wrong duration stats: %+v", d)
+	}
+
+	groups, err := s.GroupOutputs("stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 4 {
+		t.Fatalf("expected 4 output groups, got %d", len(groups))
+	}
+	if groups[0].Output != "ok\n" || len(groups[0].Nodes) != 3 || groups[1].Output != "no such file\n" || len(groups[1].Nodes) != 2 {
+		t.Errorf("output groups should be largest first: %v, %v", groups[0], groups[1])
+	}
+	if _, err := s.GroupOutputs("both"); err == nil {
+		t.Errorf("grouping 'both' outputs should have been an error")
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	config.Config.ShoveyTransport = "http"
+	defer func() { config.Config.ShoveyTransport = "" }()
+	if config.Key.PrivKey == nil {
+		pk, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Key.PrivKey = pk
+	}
+	gob.Register(new(Shovey))
+	gob.Register(new(ShoveyRun))
+	now := time.Now()
+	runStatus := func(s *Shovey, nodeName string) string {
+		sr, err := s.GetRun(nodeName)
+		if err != nil {
+			return ""
+		}
+		return sr.Status
+	}
+
+	s := &Shovey{RunID: uuid.New(), Command: "/bin/ls", Status: "running", Timeout: 60, CreatedAt: now}
+	runs := []*ShoveyRun{
+		{NodeName: "node-sup-0", Status: "created", SentAt: now.Add(-3 * time.Minute)},
+		{NodeName: "node-sup-1", Status: "created", SentAt: now.Add(-30 * time.Second)},
+		{NodeName: "node-sup-2", Status: "running", SentAt: now.Add(-10 * time.Minute), AckTime: now.Add(-10 * time.Minute)},
+		{NodeName: "node-sup-3", Status: "succeeded", SentAt: now.Add(-10 * time.Minute), AckTime: now.Add(-10 * time.Minute), EndTime: now.Add(-9 * time.Minute)},
+	}
+	for _, sr := range runs {
+		sr.ShoveyUUID = s.RunID
+		s.NodeNames = append(s.NodeNames, sr.NodeName)
+		sr.save()
+	}
+	s.save()
+
+	SuperviseJobs()
+	want := map[string]string{"node-sup-0": "timed_out", "node-sup-1": "created", "node-sup-2": "timed_out", "node-sup-3": "succeeded"}
+	for n, st := range want {
+		if got := runStatus(s, n); got != st {
+			t.Errorf("expected %s's run to be %q, got %q", n, st, got)
+		}
+	}
+	s, _ = Get(s.RunID)
+	if s.Status != "running" {
+		t.Errorf("job should still be running with node-sup-1 left, but is %q", s.Status)
+	}
+	sr, _ := s.GetRun("node-sup-1")
+	sr.SentAt = now.Add(-time.Hour)
+	sr.save()
+	SuperviseJobs()
+	s, _ = Get(s.RunID)
+	if s.Status != "complete" {
+		t.Errorf("job should have been completed once every run timed out or finished, but is %q", s.Status)
+	}
+	sj, _ := s.ToJSON()
+	if n := len(sj["summary"].(*RunSummary).Outcomes[OutcomeFailed]); n != 3 {
+		t.Errorf("timed out runs should count as failed, got %d", n)
+	}
+
+	// a rolling job left with unsent batches gets picked back up
+	for _, n := range []string{"node-sup-4", "node-sup-5"} {
+		PollJobs(n, 0)
+	}
+	r := &Shovey{RunID: uuid.New(), Command: "/bin/ls", Status: "running", Timeout: 60, CreatedAt: now, BatchSize: "1", CurrentBatch: 1, TotalBatches: 2, MaxFailures: -1, NodeNames: []string{"node-sup-4", "node-sup-5"}}
+	r.save()
+	(&ShoveyRun{ShoveyUUID: r.RunID, NodeName: "node-sup-4", Status: "succeeded", EndTime: now.Add(-5 * time.Minute)}).save()
+	(&ShoveyRun{ShoveyUUID: r.RunID, NodeName: "node-sup-5", Status: "pending"}).save()
+	SuperviseJobs()
+	deadline := time.Now().Add(10 * time.Second)
+	for runStatus(r, "node-sup-5") != "created" || r.CurrentBatch != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the rest of the rolling job wasn't sent out: node-sup-5's run is %q, on batch %d", runStatus(r, "node-sup-5"), r.CurrentBatch)
+		}
+		time.Sleep(50 * time.Millisecond)
+		r, _ = Get(r.RunID)
+	}
+}
+
+func TestClaimBatch(t *testing.T) {
+	gob.Register(new(ShoveyRun))
+	s := &Shovey{RunID: uuid.New()}
+	for _, n := range []string{"node-claim-0", "node-claim-1"} {
+		(&ShoveyRun{ShoveyUUID: s.RunID, NodeName: n, Status: "pending"}).save()
+	}
+	(&ShoveyRun{ShoveyUUID: s.RunID, NodeName: "node-claim-2", Status: "cancelled"}).save()
+	batch := []string{"node-claim-0", "node-claim-1", "node-claim-2"}
+	sent, err := s.claimBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 {
+		t.Errorf("expected the 2 pending runs to be claimed, got %v", sent)
+	}
+	if sr, _ := s.GetRun("node-claim-0"); sr.Status != "created" || sr.SentAt.IsZero() {
+		t.Errorf("a claimed run should have been marked as sent, got %q sent at %s", sr.Status, sr.SentAt)
+	}
+	if sent, _ = s.claimBatch(batch); len(sent) != 0 {
+		t.Errorf("a batch should only be claimed once, but was claimed again for %v", sent)
+	}
+}
+
+func verifySigned(t *testing.T, payload map[string]string, sig string, pubs []*PublicSigningKey) {
+	var pub *PublicSigningKey
+	for _, p := range pubs {
+		if p.ID == payload["key_id"] {
+			pub = p
+		}
+	}
+	if pub == nil {
+		t.Fatalf("the key %q the payload was signed with wasn't published", payload["key_id"])
+	}
+	keys := make([]string, 0, len(payload))
+	for k := range payload {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		lines[i] = fmt.Sprintf("%s: %s", k, payload[k])
+	}
+	sum := sha1.Sum([]byte(strings.Join(lines, "\n")))
+	rawSig, _ := base64.StdEncoding.DecodeString(sig)
+	block, _ := pem.Decode([]byte(pub.PublicKey))
+	pk, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rsa.VerifyPKCS1v15(pk.(*rsa.PublicKey), crypto.SHA1, sum[:], rawSig); err != nil {
+		t.Errorf("the signature didn't verify with key %s: %s", pub.ID, err.Error())
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	if config.Key.PrivKey == nil {
+		pk, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Key.PrivKey = pk
+	}
+	dir, err := ioutil.TempDir("", "goiardi-keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldBits := signingKeyBits
+	signingKeyBits = 1024
+	config.Config.ShoveyKeyringFile = filepath.Join(dir, "shovey-keyring")
+	config.Config.ShoveyKeyOverlapDur = time.Hour
+	defer func() {
+		signingKeyBits = oldBits
+		config.Config.ShoveyKeyringFile = ""
+		config.Config.ShoveyKeyRotationDur = 0
+		config.Config.ShoveyKeyOverlapDur = 0
+		setKeyring(nil)
+	}()
+
+	// before anything's rotated, the original key is used and published
+	legacyID, _ := SigningKeyID(&config.Key.PrivKey.PublicKey)
+	s := new(Shovey)
+	payload := map[string]string{"action": "start", "run_id": "abc"}
+	sig, err := s.signRequest(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload["key_id"] != legacyID {
+		t.Errorf("expected key_id %s, got %s", legacyID, payload["key_id"])
+	}
+	cur, pubs, err := PublicSigningKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur != legacyID || len(pubs) != 1 || !pubs[0].Current {
+		t.Errorf("only the original key should be published, got %s and %d keys", cur, len(pubs))
+	}
+	verifySigned(t, payload, sig, pubs)
+
+	// nothing happens with rotation turned off
+	start := time.Now()
+	if kid, err := rotateSigningKeys(start, false); err != nil || kid != "" {
+		t.Errorf("keys were rotated with rotation turned off: %q %v", kid, err)
+	}
+	if _, err = os.Stat(config.Config.ShoveyKeyringFile); !os.IsNotExist(err) {
+		t.Errorf("the keyring should not have been saved")
+	}
+
+	// the first rotation check just starts the keyring off
+	config.Config.ShoveyKeyRotationDur = 24 * time.Hour
+	if kid, err := rotateSigningKeys(start, false); err != nil || kid != "" {
+		t.Errorf("a new key was made too soon: %q %v", kid, err)
+	}
+	// a new key is published an overlap before the old one's time is up
+	newID, err := rotateSigningKeys(start.Add(23*time.Hour), false)
+	if err != nil || newID == "" {
+		t.Fatalf("no new key was made: %v", err)
+	}
+	if kid, _ := rotateSigningKeys(start.Add(23*time.Hour+time.Minute), false); kid != "" {
+		t.Errorf("another key was made while one was pending: %s", kid)
+	}
+	cur, pubs, _ = PublicSigningKeys()
+	if cur != legacyID || len(pubs) != 2 {
+		t.Errorf("the new key should be published but not used yet, got %s and %d keys", cur, len(pubs))
+	}
+
+	// the new key's used once its time comes, and the old one's still
+	// good for the overlap
+	keys, _ := loadKeyring()
+	k, _ := currentKey(keys, start.Add(24*time.Hour+time.Second))
+	if k.ID != newID {
+		t.Errorf("expected the new key %s to be current, got %s", newID, k.ID)
+	}
+	if !keys[0].NotAfter.Equal(start.Add(25 * time.Hour)) {
+		t.Errorf("the old key should be good until an overlap after the new key's used, but is good until %s", keys[0].NotAfter)
+	}
+	if _, err = rotateSigningKeys(start.Add(25*time.Hour+time.Second), false); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ = loadKeyring()
+	if len(keys) != 1 || keys[0].ID != newID {
+		t.Errorf("the old key should have been dropped, have %d keys", len(keys))
+	}
+
+	// a forced rotation takes effect right away, even with nothing
+	// rotated yet
+	config.Config.ShoveyKeyRotationDur = 0
+	os.Remove(config.Config.ShoveyKeyringFile)
+	setKeyring(nil)
+	forcedID, err := RotateSigningKeyNow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload = map[string]string{"action": "cancel", "run_id": "abc"}
+	sig, err = s.signRequest(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload["key_id"] != forcedID {
+		t.Errorf("expected the request to be signed with %s, got %s", forcedID, payload["key_id"])
+	}
+	cur, pubs, _ = PublicSigningKeys()
+	if cur != forcedID || len(pubs) != 2 {
+		t.Errorf("expected %s to be current with 2 keys, got %s and %d keys", forcedID, cur, len(pubs))
+	}
+	verifySigned(t, payload, sig, pubs)
+}
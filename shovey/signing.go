@@ -0,0 +1,443 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shovey
+
+// The keys shovey requests are signed with. To start with there's only the
+// one key from --sign-priv-key or --vault-shovey-key, but once keys are
+// rotated they're kept in a keyring, either in the secret store or in a file
+// next to the old key. Each key has a window of time it's good for: a new key
+// is published a while before anything's signed with it, and the key it
+// replaces is still published for a while afterwards, so node agents that
+// pick up the published keys every so often always have the key a request was
+// signed with.
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/secret"
+)
+
+// SigningKey is one of the keys shovey requests are signed with, and when
+// it's good for.
+type SigningKey struct {
+	ID        string
+	CreatedAt time.Time
+	// Requests are signed with the newest key whose NotBefore has passed.
+	NotBefore time.Time
+	// Zero until the key's been replaced.
+	NotAfter time.Time
+	key      *rsa.PrivateKey
+}
+
+// PublicSigningKey is a signing key's public half, as published for node
+// agents.
+type PublicSigningKey struct {
+	ID        string     `json:"id"`
+	PublicKey string     `json:"public_key"`
+	NotBefore time.Time  `json:"not_before"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	Current   bool       `json:"current"`
+}
+
+type storedKeyring struct {
+	Version int                 `json:"version"`
+	Keys    []*storedSigningKey `json:"keys"`
+}
+
+type storedSigningKey struct {
+	ID         string     `json:"id"`
+	PrivateKey string     `json:"private_key"`
+	CreatedAt  time.Time  `json:"created_at"`
+	NotBefore  time.Time  `json:"not_before"`
+	NotAfter   *time.Time `json:"not_after,omitempty"`
+}
+
+const keyringVersion = 1
+
+// signingKeyBits is the size of new signing keys.
+var signingKeyBits = 2048
+
+// keyring is nil until keys have been rotated for the first time.
+var keyring struct {
+	sync.RWMutex
+	keys []*SigningKey
+}
+
+// rotating keeps scheduled and forced rotations from running at once.
+var rotating sync.Mutex
+
+// SigningKeyID is the ID for a signing key: the start of the SHA-256 hash of
+// its public key.
+func SigningKeyID(pub *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// LoadSigningKeys loads the signing keyring, if keys have been rotated.
+func LoadSigningKeys() error {
+	keys, err := loadKeyring()
+	if err != nil {
+		return err
+	}
+	setKeyring(keys)
+	return nil
+}
+
+func setKeyring(keys []*SigningKey) {
+	keyring.Lock()
+	defer keyring.Unlock()
+	keyring.keys = keys
+}
+
+// currentSigningKey gets the key to sign requests with now: the newest key
+// in the keyring that's good yet, or the original signing key if keys have
+// never been rotated.
+func currentSigningKey() (*SigningKey, error) {
+	keyring.RLock()
+	if len(keyring.keys) != 0 {
+		defer keyring.RUnlock()
+		return currentKey(keyring.keys, time.Now())
+	}
+	keyring.RUnlock()
+	return legacySigningKey()
+}
+
+func currentKey(keys []*SigningKey, now time.Time) (*SigningKey, error) {
+	for i := len(keys) - 1; i >= 0; i-- {
+		if !keys[i].NotBefore.After(now) {
+			return keys[i], nil
+		}
+	}
+	return nil, fmt.Errorf("none of the shovey signing keys are good yet")
+}
+
+func legacySigningKey() (*SigningKey, error) {
+	var pk *rsa.PrivateKey
+	if config.UsingExternalSecrets() {
+		var err error
+		pk, err = secret.GetSigningKey(config.Config.VaultShoveyKey)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		config.Key.RLock()
+		defer config.Key.RUnlock()
+		if config.Key.PrivKey == nil {
+			return nil, fmt.Errorf("no shovey signing key has been loaded")
+		}
+		j := *config.Key.PrivKey
+		pk = &j
+	}
+	id, err := SigningKeyID(&pk.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{ID: id, key: pk}, nil
+}
+
+// RotateSigningKeys makes a new signing key when the current one's time is
+// nearly up, and drops keys that aren't good anymore. It's run every so often
+// while goiardi's running, and returns the ID of the new key if it made one.
+// The keyring is loaded again first, in case another goiardi server sharing
+// the secret store already rotated the keys.
+func RotateSigningKeys() (string, error) {
+	return rotateSigningKeys(time.Now(), false)
+}
+
+// RotateSigningKeyNow makes a new signing key and starts signing requests with
+// it right away, rather than waiting for the next scheduled rotation. The key
+// it replaces is still good for --shovey-key-overlap.
+func RotateSigningKeyNow() (string, error) {
+	return rotateSigningKeys(time.Now(), true)
+}
+
+func rotateSigningKeys(now time.Time, force bool) (string, error) {
+	rotating.Lock()
+	defer rotating.Unlock()
+	keys, err := loadKeyring()
+	if err != nil {
+		return "", err
+	}
+	interval := config.Config.ShoveyKeyRotationDur
+	overlap := config.Config.ShoveyKeyOverlapDur
+	changed := false
+
+	// the first rotation starts the keyring off with the original key
+	if len(keys) == 0 {
+		if interval == 0 && !force {
+			setKeyring(nil)
+			return "", nil
+		}
+		k, err := legacySigningKey()
+		if err != nil {
+			return "", err
+		}
+		k.CreatedAt = now
+		k.NotBefore = now
+		keys = []*SigningKey{k}
+		changed = true
+	}
+
+	var newID string
+	cur, err := currentKey(keys, now)
+	if err != nil {
+		return "", err
+	}
+	pending := keys[len(keys)-1] != cur
+	var notBefore time.Time
+	if force {
+		// a key that's pending was never used, so it's replaced too
+		if pending {
+			for i, k := range keys {
+				if k == cur {
+					keys = keys[:i+1]
+					break
+				}
+			}
+			changed = true
+		}
+		notBefore = now
+	} else if interval != 0 && !pending && !now.Before(cur.NotBefore.Add(interval-overlap)) {
+		// publish the new key at least one overlap before it's used
+		notBefore = cur.NotBefore.Add(interval)
+		if earliest := now.Add(overlap); notBefore.Before(earliest) {
+			notBefore = earliest
+		}
+	}
+	if !notBefore.IsZero() {
+		k, err := newSigningKey(now, notBefore)
+		if err != nil {
+			return "", err
+		}
+		for _, o := range keys {
+			if o.NotAfter.IsZero() || o.NotAfter.After(notBefore.Add(overlap)) {
+				o.NotAfter = notBefore.Add(overlap)
+			}
+		}
+		keys = append(keys, k)
+		newID = k.ID
+		changed = true
+	}
+
+	live := keys[:0]
+	for _, k := range keys {
+		if !k.NotAfter.IsZero() && !k.NotAfter.After(now) {
+			changed = true
+			continue
+		}
+		live = append(live, k)
+	}
+	keys = live
+
+	if changed {
+		if err := saveKeyring(keys); err != nil {
+			return "", err
+		}
+	}
+	setKeyring(keys)
+	return newID, nil
+}
+
+func newSigningKey(now time.Time, notBefore time.Time) (*SigningKey, error) {
+	pk, err := rsa.GenerateKey(rand.Reader, signingKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	id, err := SigningKeyID(&pk.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{ID: id, CreatedAt: now, NotBefore: notBefore, key: pk}, nil
+}
+
+// PublicSigningKeys returns the ID of the key requests are being signed with
+// now, and the public halves of every key node agents should accept.
+func PublicSigningKeys() (string, []*PublicSigningKey, error) {
+	keyring.RLock()
+	keys := keyring.keys
+	keyring.RUnlock()
+	var cur *SigningKey
+	var err error
+	if len(keys) == 0 {
+		cur, err = legacySigningKey()
+		keys = []*SigningKey{cur}
+	} else {
+		cur, err = currentKey(keys, time.Now())
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	pubs := make([]*PublicSigningKey, len(keys))
+	for i, k := range keys {
+		der, err := x509.MarshalPKIXPublicKey(&k.key.PublicKey)
+		if err != nil {
+			return "", nil, err
+		}
+		p := &PublicSigningKey{
+			ID:        k.ID,
+			PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+			NotBefore: k.NotBefore,
+			Current:   k == cur,
+		}
+		if !k.NotAfter.IsZero() {
+			na := k.NotAfter
+			p.NotAfter = &na
+		}
+		pubs[i] = p
+	}
+	return cur.ID, pubs, nil
+}
+
+// SigningKeyring gets the saved signing keyring as it's stored, or an empty
+// string if keys have never been rotated. Used when moving secrets from one
+// secret store to another.
+func SigningKeyring() (string, error) {
+	if config.UsingExternalSecrets() {
+		kr, err := secret.GetSigningKeyring(keyringPath())
+		if err == secret.ErrNotFound {
+			return "", nil
+		}
+		return kr, err
+	}
+	b, err := ioutil.ReadFile(config.Config.ShoveyKeyringFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(b), err
+}
+
+// SetSigningKeyring saves a signing keyring gotten from SigningKeyring.
+func SetSigningKeyring(kr string) error {
+	if _, err := decodeKeyring(kr); err != nil {
+		return err
+	}
+	return writeKeyring(kr)
+}
+
+func keyringPath() string {
+	return config.Config.VaultShoveyKey + "/keyring"
+}
+
+func loadKeyring() ([]*SigningKey, error) {
+	kr, err := SigningKeyring()
+	if err != nil {
+		return nil, fmt.Errorf("error loading the shovey signing keyring: %s", err.Error())
+	}
+	if kr == "" {
+		return nil, nil
+	}
+	return decodeKeyring(kr)
+}
+
+func decodeKeyring(kr string) ([]*SigningKey, error) {
+	var stored storedKeyring
+	if err := json.Unmarshal([]byte(kr), &stored); err != nil {
+		return nil, fmt.Errorf("error decoding the shovey signing keyring: %s", err.Error())
+	}
+	if stored.Version != keyringVersion {
+		return nil, fmt.Errorf("unknown shovey signing keyring version %d", stored.Version)
+	}
+	keys := make([]*SigningKey, len(stored.Keys))
+	for i, s := range stored.Keys {
+		block, _ := pem.Decode([]byte(s.PrivateKey))
+		if block == nil {
+			return nil, fmt.Errorf("invalid private key for shovey signing key %s", s.ID)
+		}
+		pk, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key for shovey signing key %s: %s", s.ID, err.Error())
+		}
+		k := &SigningKey{ID: s.ID, CreatedAt: s.CreatedAt, NotBefore: s.NotBefore, key: pk}
+		if s.NotAfter != nil {
+			k.NotAfter = *s.NotAfter
+		}
+		keys[i] = k
+	}
+	sort.Stable(byNotBefore(keys))
+	return keys, nil
+}
+
+func saveKeyring(keys []*SigningKey) error {
+	stored := &storedKeyring{Version: keyringVersion, Keys: make([]*storedSigningKey, len(keys))}
+	for i, k := range keys {
+		s := &storedSigningKey{
+			ID:         k.ID,
+			PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k.key)})),
+			CreatedAt:  k.CreatedAt,
+			NotBefore:  k.NotBefore,
+		}
+		if !k.NotAfter.IsZero() {
+			na := k.NotAfter
+			s.NotAfter = &na
+		}
+		stored.Keys[i] = s
+	}
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return writeKeyring(string(b))
+}
+
+func writeKeyring(kr string) error {
+	if config.UsingExternalSecrets() {
+		return secret.SetSigningKeyring(keyringPath(), kr)
+	}
+	// write it to a temporary file first, so a crash partway through
+	// doesn't lose the keys
+	fn := config.Config.ShoveyKeyringFile
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(0600); err == nil {
+		_, err = tmp.WriteString(kr)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fn)
+}
+
+type byNotBefore []*SigningKey
+
+func (k byNotBefore) Len() int           { return len(k) }
+func (k byNotBefore) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+func (k byNotBefore) Less(i, j int) bool { return k[i].NotBefore.Before(k[j].NotBefore) }
@@ -18,10 +18,15 @@ package shovey
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/datastore"
 	"github.com/ctdk/goiardi/util"
+	"github.com/tideland/golib/logger"
 	"net/http"
+	"strings"
+	"time"
 )
 
 func checkForShoveySQL(runID string) (bool, error) {
@@ -81,9 +86,9 @@ func getShoveySQL(runID string) (*Shovey, util.Gerror) {
 	s := new(Shovey)
 	var sqlStatement string
 	if config.Config.UseMySQL {
-		sqlStatement = "SELECT run_id, command, created_at, updated_at, status, timeout, quorum from shoveys WHERE run_id = ?"
+		sqlStatement = "SELECT run_id, command, created_at, updated_at, status, timeout, quorum, search_query, resolve_at_start, batch_size, batch_wait, max_failures, current_batch, total_batches, schedule_name, template_name, template_args, requested_by, approved_by from shoveys WHERE run_id = ?"
 	} else if config.Config.UsePostgreSQL {
-		sqlStatement = "SELECT run_id, ARRAY(SELECT node_name FROM goiardi.shovey_runs WHERE shovey_uuid = $1), command, created_at, updated_at, status, timeout, quorum FROM goiardi.shoveys WHERE run_id = $1"
+		sqlStatement = "SELECT run_id, ARRAY(SELECT node_name FROM goiardi.shovey_runs WHERE shovey_uuid = $1), command, created_at, updated_at, status, timeout, quorum, search_query, resolve_at_start, batch_size, batch_wait, max_failures, current_batch, total_batches, schedule_name, template_name, template_args, requested_by, approved_by FROM goiardi.shoveys WHERE run_id = $1"
 	} else {
 		return nil, util.NoDBConfigured
 	}
@@ -148,9 +153,9 @@ func (s *Shovey) getShoveyRunSQL(nodeName string) (*ShoveyRun, util.Gerror) {
 	sr := new(ShoveyRun)
 	var sqlStatement string
 	if config.Config.UseMySQL {
-		sqlStatement = "SELECT id, shovey_uuid, node_name, status, ack_time, end_time, error, exit_status FROM shovey_runs WHERE shovey_uuid = ? AND node_name = ?"
+		sqlStatement = "SELECT id, shovey_uuid, node_name, status, ack_time, end_time, error, exit_status, sent_at FROM shovey_runs WHERE shovey_uuid = ? AND node_name = ?"
 	} else if config.Config.UsePostgreSQL {
-		sqlStatement = "SELECT id, shovey_uuid, node_name, status, ack_time, end_time, error, exit_status FROM goiardi.shovey_runs WHERE shovey_uuid = $1 and node_name = $2"
+		sqlStatement = "SELECT id, shovey_uuid, node_name, status, ack_time, end_time, error, exit_status, sent_at FROM goiardi.shovey_runs WHERE shovey_uuid = $1 and node_name = $2"
 	} else {
 		return nil, util.NoDBConfigured
 	}
@@ -181,9 +186,9 @@ func (s *Shovey) getShoveyNodeRunsSQL() ([]*ShoveyRun, util.Gerror) {
 	var shoveyRuns []*ShoveyRun
 	var sqlStatement string
 	if config.Config.UseMySQL {
-		sqlStatement = "SELECT id, shovey_uuid, node_name, status, ack_time, end_time, error, exit_status FROM shovey_runs WHERE shovey_uuid = ?"
+		sqlStatement = "SELECT id, shovey_uuid, node_name, status, ack_time, end_time, error, exit_status, sent_at FROM shovey_runs WHERE shovey_uuid = ?"
 	} else if config.Config.UsePostgreSQL {
-		sqlStatement = "SELECT id, shovey_uuid, node_name, status, ack_time, end_time, error, exit_status FROM goiardi.shovey_runs WHERE shovey_uuid = $1"
+		sqlStatement = "SELECT id, shovey_uuid, node_name, status, ack_time, end_time, error, exit_status, sent_at FROM goiardi.shovey_runs WHERE shovey_uuid = $1"
 	} else {
 		return nil, util.NoDBConfigured
 	}
@@ -245,9 +250,9 @@ func (sr *ShoveyRun) saveSQL() util.Gerror {
 func (s *Shovey) cancelRunsSQL() util.Gerror {
 	var sqlStatement string
 	if config.Config.UseMySQL {
-		sqlStatement = "UPDATE shovey_runs SET status = 'cancelled', end_time = NOW() WHERE shovey_uuid = ? AND status NOT IN ('invalid', 'succeeded', 'failed', 'down', 'nacked')"
+		sqlStatement = "UPDATE shovey_runs SET status = 'cancelled', end_time = NOW() WHERE shovey_uuid = ? AND status NOT IN ('invalid', 'succeeded', 'failed', 'down', 'nacked', 'timed_out')"
 	} else if config.Config.UsePostgreSQL {
-		sqlStatement = "UPDATE goiardi.shovey_runs SET status = 'cancelled', end_time = NOW() WHERE shovey_uuid = $1 AND status NOT IN ('invalid', 'succeeded', 'failed', 'down', 'nacked')"
+		sqlStatement = "UPDATE goiardi.shovey_runs SET status = 'cancelled', end_time = NOW() WHERE shovey_uuid = $1 AND status NOT IN ('invalid', 'succeeded', 'failed', 'down', 'nacked', 'timed_out')"
 	} else {
 		return util.NoDBConfigured
 	}
@@ -275,9 +280,9 @@ func (s *Shovey) checkCompletedSQL() util.Gerror {
 	var c int
 	var sqlStatement string
 	if config.Config.UseMySQL {
-		sqlStatement = "SELECT count(id) FROM shovey_runs WHERE shovey_uuid = ? AND status IN ('invalid', 'succeeded', 'failed', 'down', 'nacked')"
+		sqlStatement = "SELECT count(id) FROM shovey_runs WHERE shovey_uuid = ? AND status IN ('invalid', 'succeeded', 'failed', 'down', 'nacked', 'cancelled', 'timed_out')"
 	} else if config.Config.UsePostgreSQL {
-		sqlStatement = "SELECT count(id) FROM goiardi.shovey_runs WHERE shovey_uuid = $1 AND status IN ('invalid', 'succeeded', 'failed', 'down', 'nacked')"
+		sqlStatement = "SELECT count(id) FROM goiardi.shovey_runs WHERE shovey_uuid = $1 AND status IN ('invalid', 'succeeded', 'failed', 'down', 'nacked', 'cancelled', 'timed_out')"
 	} else {
 		return util.NoDBConfigured
 	}
@@ -353,9 +358,9 @@ func allShoveysSQL() []*Shovey {
 	shoveys := make([]*Shovey, 0)
 	var sqlStatement string
 	if config.Config.UseMySQL {
-		sqlStatement = "SELECT run_id, command, created_at, updated_at, status, timeout, quorum from shoveys"
+		sqlStatement = "SELECT run_id, command, created_at, updated_at, status, timeout, quorum, search_query, resolve_at_start, batch_size, batch_wait, max_failures, current_batch, total_batches, schedule_name, template_name, template_args, requested_by, approved_by from shoveys"
 	} else if config.Config.UsePostgreSQL {
-		sqlStatement = "SELECT run_id, ARRAY(SELECT node_name FROM goiardi.shovey_runs WHERE shovey_uuid = goiardi.shoveys.run_id), command, created_at, updated_at, status, timeout, quorum FROM goiardi.shoveys"
+		sqlStatement = "SELECT run_id, ARRAY(SELECT node_name FROM goiardi.shovey_runs WHERE shovey_uuid = goiardi.shoveys.run_id), command, created_at, updated_at, status, timeout, quorum, search_query, resolve_at_start, batch_size, batch_wait, max_failures, current_batch, total_batches, schedule_name, template_name, template_args, requested_by, approved_by FROM goiardi.shoveys"
 	}
 
 	stmt, err := datastore.Dbh.Prepare(sqlStatement)
@@ -463,14 +468,14 @@ func (s *Shovey) importSaveSQL() error {
 	}
 	var sqlStatement string
 	if config.Config.UseMySQL {
-		sqlStatement = "INSERT INTO shoveys (run_id, command, status, timeout, quorum, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+		sqlStatement = "INSERT INTO shoveys (run_id, command, status, timeout, quorum, search_query, resolve_at_start, batch_size, batch_wait, max_failures, current_batch, total_batches, schedule_name, template_name, template_args, requested_by, approved_by, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
 	} else if config.Config.UsePostgreSQL {
-		sqlStatement = "INSERT INTO goiardi.shoveys (run_id, command, status, timeout, quorum, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+		sqlStatement = "INSERT INTO goiardi.shoveys (run_id, command, status, timeout, quorum, search_query, resolve_at_start, batch_size, batch_wait, max_failures, current_batch, total_batches, schedule_name, template_name, template_args, requested_by, approved_by, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)"
 	} else {
 		return util.NoDBConfigured
 	}
 
-	_, err = tx.Exec(sqlStatement, s.RunID, s.Command, s.Status, s.Timeout, s.Quorum, s.CreatedAt, s.UpdatedAt)
+	_, err = tx.Exec(sqlStatement, s.RunID, s.Command, s.Status, s.Timeout, s.Quorum, s.Search, s.ResolveAtStart, s.BatchSize, s.BatchWait, s.MaxFailures, s.CurrentBatch, s.TotalBatches, s.ScheduleName, s.Template, s.templateArgsJSON(), s.RequestedBy, s.ApprovedBy, s.CreatedAt, s.UpdatedAt)
 	if err != nil {
 		tx.Rollback()
 		return err
@@ -510,3 +515,439 @@ func (srs *ShoveyRunStream) importSaveSQL() error {
 	tx.Commit()
 	return nil
 }
+
+// Streams reference runs and runs reference shoveys without cascading, so
+// they have to be removed in order.
+func purgeFinishedSQL(dur time.Duration) (*PurgeResult, error) {
+	var streamStmt, runStmt, shoveyStmt string
+	if config.Config.UseMySQL {
+		streamStmt = "DELETE FROM shovey_run_streams WHERE shovey_run_id IN (SELECT r.id FROM shovey_runs r JOIN shoveys s ON r.shovey_id = s.id WHERE s.updated_at < ? AND s.status IN ('complete', 'cancelled', 'job_failed', 'quorum_failed'))"
+		runStmt = "DELETE FROM shovey_runs WHERE shovey_id IN (SELECT id FROM shoveys WHERE updated_at < ? AND status IN ('complete', 'cancelled', 'job_failed', 'quorum_failed'))"
+		shoveyStmt = "DELETE FROM shoveys WHERE updated_at < ? AND status IN ('complete', 'cancelled', 'job_failed', 'quorum_failed')"
+	} else if config.Config.UsePostgreSQL {
+		streamStmt = "DELETE FROM goiardi.shovey_run_streams WHERE shovey_run_id IN (SELECT r.id FROM goiardi.shovey_runs r JOIN goiardi.shoveys s ON r.shovey_id = s.id WHERE s.updated_at < $1 AND s.status IN ('complete', 'cancelled', 'job_failed', 'quorum_failed'))"
+		runStmt = "DELETE FROM goiardi.shovey_runs WHERE shovey_id IN (SELECT id FROM goiardi.shoveys WHERE updated_at < $1 AND status IN ('complete', 'cancelled', 'job_failed', 'quorum_failed'))"
+		shoveyStmt = "DELETE FROM goiardi.shoveys WHERE updated_at < $1 AND status IN ('complete', 'cancelled', 'job_failed', 'quorum_failed')"
+	} else {
+		return nil, util.NoDBConfigured
+	}
+	cutoff := time.Now().Add(-dur)
+	res := new(PurgeResult)
+
+	tx, err := datastore.Dbh.Begin()
+	if err != nil {
+		return nil, err
+	}
+	counts := []*int{&res.Streams, &res.Runs, &res.Jobs}
+	for i, stmt := range []string{streamStmt, runStmt, shoveyStmt} {
+		r, err := tx.Exec(stmt, cutoff)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		c, _ := r.RowsAffected()
+		*counts[i] = int(c)
+	}
+	tx.Commit()
+	return res, nil
+}
+
+func shoveysByScheduleSQL(name string) ([]*Shovey, util.Gerror) {
+	return shoveysWhereSQL("schedule_name", name, "ORDER BY created_at DESC")
+}
+
+func shoveysByStatusSQL(status string) ([]*Shovey, util.Gerror) {
+	return shoveysWhereSQL("status", status, "")
+}
+
+// shoveysWhereSQL gets the jobs whose column col has the given value.
+func shoveysWhereSQL(col string, val string, order string) ([]*Shovey, util.Gerror) {
+	shoveys := make([]*Shovey, 0)
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = fmt.Sprintf("SELECT run_id, command, created_at, updated_at, status, timeout, quorum, search_query, resolve_at_start, batch_size, batch_wait, max_failures, current_batch, total_batches, schedule_name, template_name, template_args, requested_by, approved_by from shoveys WHERE %s = ? %s", col, order)
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = fmt.Sprintf("SELECT run_id, ARRAY(SELECT node_name FROM goiardi.shovey_runs WHERE shovey_uuid = goiardi.shoveys.run_id), command, created_at, updated_at, status, timeout, quorum, search_query, resolve_at_start, batch_size, batch_wait, max_failures, current_batch, total_batches, schedule_name, template_name, template_args, requested_by, approved_by FROM goiardi.shoveys WHERE %s = $1 %s", col, order)
+	} else {
+		return nil, util.NoDBConfigured
+	}
+
+	rows, err := datastore.Dbh.Query(sqlStatement, val)
+	if err != nil {
+		gerr := util.CastErr(err)
+		gerr.SetStatus(http.StatusInternalServerError)
+		return nil, gerr
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s := new(Shovey)
+		if err = s.fillShoveyFromSQL(rows); err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return nil, gerr
+		}
+		shoveys = append(shoveys, s)
+	}
+	if err = rows.Err(); err != nil {
+		gerr := util.CastErr(err)
+		gerr.SetStatus(http.StatusInternalServerError)
+		return nil, gerr
+	}
+	// MySQL doesn't fill in the node names with the rest of the job
+	if config.Config.UseMySQL {
+		for i, s := range shoveys {
+			full, gerr := Get(s.RunID)
+			if gerr != nil {
+				return nil, gerr
+			}
+			shoveys[i] = full
+		}
+	}
+	return shoveys, nil
+}
+
+func (sc *Schedule) fillScheduleFromSQL(row datastore.ResRow) error {
+	if config.Config.UseMySQL {
+		return sc.fillScheduleFromMySQL(row)
+	} else if config.Config.UsePostgreSQL {
+		return sc.fillScheduleFromPostgreSQL(row)
+	}
+	return util.NoDBConfigured
+}
+
+// nullTime lets zero times be stored as NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func (sc *Schedule) saveSQL() error {
+	job, err := json.Marshal(sc.Job)
+	if err != nil {
+		return err
+	}
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "INSERT INTO shovey_schedules (name, job, cron, run_interval, enabled, next_run, last_run, last_run_id, requested_by, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE job = VALUES(job), cron = VALUES(cron), run_interval = VALUES(run_interval), enabled = VALUES(enabled), next_run = VALUES(next_run), last_run = VALUES(last_run), last_run_id = VALUES(last_run_id), requested_by = VALUES(requested_by), updated_at = VALUES(updated_at)"
+		_, err = datastore.Dbh.Exec(sqlStatement, sc.Name, job, sc.Cron, sc.Interval, sc.Enabled, nullTime(sc.NextRun), nullTime(sc.LastRun), sc.LastRunID, sc.RequestedBy, sc.CreatedAt, sc.UpdatedAt)
+		return err
+	} else if !config.Config.UsePostgreSQL {
+		return util.NoDBConfigured
+	}
+
+	tx, err := datastore.Dbh.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE goiardi.shovey_schedules SET job = $1, cron = $2, run_interval = $3, enabled = $4, next_run = $5, last_run = $6, last_run_id = $7, requested_by = $8, updated_at = $9 WHERE name = $10", job, sc.Cron, sc.Interval, sc.Enabled, nullTime(sc.NextRun), nullTime(sc.LastRun), sc.LastRunID, sc.RequestedBy, sc.UpdatedAt, sc.Name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = tx.Exec("INSERT INTO goiardi.shovey_schedules (name, job, cron, run_interval, enabled, next_run, last_run, last_run_id, requested_by, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)", sc.Name, job, sc.Cron, sc.Interval, sc.Enabled, nullTime(sc.NextRun), nullTime(sc.LastRun), sc.LastRunID, sc.RequestedBy, sc.CreatedAt, sc.UpdatedAt)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (sc *Schedule) importSaveSQL() error {
+	return sc.saveSQL()
+}
+
+// claimSQL moves the schedule's next run time forward, but only if it's still
+// what we think it is. If another goiardi got there first, nothing is updated
+// and the claim fails.
+func (sc *Schedule) claimSQL(prev time.Time, next time.Time) (bool, error) {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "UPDATE shovey_schedules SET next_run = ? WHERE name = ? AND next_run = ? AND enabled = 1"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "UPDATE goiardi.shovey_schedules SET next_run = $1 WHERE name = $2 AND next_run = $3 AND enabled = true"
+	} else {
+		return false, util.NoDBConfigured
+	}
+	res, err := datastore.Dbh.Exec(sqlStatement, nullTime(next), sc.Name, prev)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// claimBatchSQL marks the pending runs in the batch as sent in one update, so
+// if another goiardi's claiming the same batch only one of the two changes any
+// rows.
+func (s *Shovey) claimBatchSQL(nodeNames []string, sentAt time.Time) (bool, error) {
+	args := []interface{}{sentAt, s.RunID}
+	bind := make([]string, len(nodeNames))
+	for i, n := range nodeNames {
+		args = append(args, n)
+		if config.Config.UseMySQL {
+			bind[i] = "?"
+		} else {
+			bind[i] = fmt.Sprintf("$%d", i+3)
+		}
+	}
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = fmt.Sprintf("UPDATE shovey_runs SET status = 'created', sent_at = ? WHERE shovey_uuid = ? AND node_name IN (%s) AND status = 'pending'", strings.Join(bind, ", "))
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = fmt.Sprintf("UPDATE goiardi.shovey_runs SET status = 'created', sent_at = $1 WHERE shovey_uuid = $2 AND node_name IN (%s) AND status = 'pending'", strings.Join(bind, ", "))
+	} else {
+		return false, util.NoDBConfigured
+	}
+	res, err := datastore.Dbh.Exec(sqlStatement, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (sc *Schedule) recordRunSQL() error {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "UPDATE shovey_schedules SET last_run = ?, last_run_id = ? WHERE name = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "UPDATE goiardi.shovey_schedules SET last_run = $1, last_run_id = $2 WHERE name = $3"
+	} else {
+		return util.NoDBConfigured
+	}
+	_, err := datastore.Dbh.Exec(sqlStatement, sc.LastRun, sc.LastRunID, sc.Name)
+	return err
+}
+
+func getScheduleSQL(name string) (*Schedule, error) {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "SELECT name, job, cron, run_interval, enabled, next_run, last_run, last_run_id, requested_by, created_at, updated_at FROM shovey_schedules WHERE name = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "SELECT name, job, cron, run_interval, enabled, next_run, last_run, last_run_id, requested_by, created_at, updated_at FROM goiardi.shovey_schedules WHERE name = $1"
+	} else {
+		return nil, util.NoDBConfigured
+	}
+	sc := new(Schedule)
+	row := datastore.Dbh.QueryRow(sqlStatement, name)
+	if err := sc.fillScheduleFromSQL(row); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return sc, nil
+}
+
+func (sc *Schedule) deleteSQL() error {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "DELETE FROM shovey_schedules WHERE name = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "DELETE FROM goiardi.shovey_schedules WHERE name = $1"
+	} else {
+		return util.NoDBConfigured
+	}
+	_, err := datastore.Dbh.Exec(sqlStatement, sc.Name)
+	return err
+}
+
+func scheduleListSQL() []string {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "SELECT name FROM shovey_schedules ORDER BY name"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "SELECT name FROM goiardi.shovey_schedules ORDER BY name"
+	}
+	var names []string
+	rows, err := datastore.Dbh.Query(sqlStatement)
+	if err != nil {
+		logger.Errorf("error listing shovey schedules: %s", err.Error())
+		return names
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			logger.Errorf("error listing shovey schedules: %s", err.Error())
+			return names
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func allSchedulesSQL() []*Schedule {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "SELECT name, job, cron, run_interval, enabled, next_run, last_run, last_run_id, requested_by, created_at, updated_at FROM shovey_schedules ORDER BY name"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "SELECT name, job, cron, run_interval, enabled, next_run, last_run, last_run_id, requested_by, created_at, updated_at FROM goiardi.shovey_schedules ORDER BY name"
+	}
+	var schedules []*Schedule
+	rows, err := datastore.Dbh.Query(sqlStatement)
+	if err != nil {
+		logger.Errorf("error getting shovey schedules: %s", err.Error())
+		return schedules
+	}
+	defer rows.Close()
+	for rows.Next() {
+		sc := new(Schedule)
+		if err = sc.fillScheduleFromSQL(rows); err != nil {
+			logger.Errorf("error getting shovey schedules: %s", err.Error())
+			return schedules
+		}
+		schedules = append(schedules, sc)
+	}
+	return schedules
+}
+
+// templateArgsJSON encodes the job's template arguments for the database, or
+// NULL if it wasn't made from a template.
+func (s *Shovey) templateArgsJSON() interface{} {
+	if len(s.TemplateArgs) == 0 {
+		return nil
+	}
+	ta, err := json.Marshal(s.TemplateArgs)
+	if err != nil {
+		logger.Errorf("error encoding template args for shovey job %s: %s", s.RunID, err.Error())
+		return nil
+	}
+	return ta
+}
+
+func (t *Template) fillTemplateFromSQL(row datastore.ResRow) error {
+	if config.Config.UseMySQL {
+		return t.fillTemplateFromMySQL(row)
+	} else if config.Config.UsePostgreSQL {
+		return t.fillTemplateFromPostgreSQL(row)
+	}
+	return util.NoDBConfigured
+}
+
+// decodeTemplateJSON fills in the parts of the template that are stored as
+// JSON.
+func (t *Template) decodeTemplateJSON(params, envs, roles []byte) error {
+	t.Params = make([]*TemplateParam, 0)
+	t.Environments = make([]string, 0)
+	t.Roles = make([]string, 0)
+	for _, d := range []struct {
+		b   []byte
+		obj interface{}
+	}{{params, &t.Params}, {envs, &t.Environments}, {roles, &t.Roles}} {
+		if len(d.b) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(d.b, d.obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Template) saveSQL() error {
+	params, err := json.Marshal(t.Params)
+	if err != nil {
+		return err
+	}
+	envs, err := json.Marshal(t.Environments)
+	if err != nil {
+		return err
+	}
+	roles, err := json.Marshal(t.Roles)
+	if err != nil {
+		return err
+	}
+	if config.Config.UseMySQL {
+		_, err = datastore.Dbh.Exec("INSERT INTO shovey_templates (name, description, command, params, environments, roles, require_approval, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE description = VALUES(description), command = VALUES(command), params = VALUES(params), environments = VALUES(environments), roles = VALUES(roles), require_approval = VALUES(require_approval), updated_at = VALUES(updated_at)", t.Name, t.Description, t.Command, params, envs, roles, t.RequireApproval, t.CreatedAt, t.UpdatedAt)
+		return err
+	} else if !config.Config.UsePostgreSQL {
+		return util.NoDBConfigured
+	}
+
+	tx, err := datastore.Dbh.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE goiardi.shovey_templates SET description = $1, command = $2, params = $3, environments = $4, roles = $5, require_approval = $6, updated_at = $7 WHERE name = $8", t.Description, t.Command, params, envs, roles, t.RequireApproval, t.UpdatedAt, t.Name)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = tx.Exec("INSERT INTO goiardi.shovey_templates (name, description, command, params, environments, roles, require_approval, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)", t.Name, t.Description, t.Command, params, envs, roles, t.RequireApproval, t.CreatedAt, t.UpdatedAt)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func getTemplateSQL(name string) (*Template, error) {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "SELECT name, description, command, params, environments, roles, require_approval, created_at, updated_at FROM shovey_templates WHERE name = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "SELECT name, description, command, params, environments, roles, require_approval, created_at, updated_at FROM goiardi.shovey_templates WHERE name = $1"
+	} else {
+		return nil, util.NoDBConfigured
+	}
+	t := new(Template)
+	row := datastore.Dbh.QueryRow(sqlStatement, name)
+	if err := t.fillTemplateFromSQL(row); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Template) deleteSQL() error {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "DELETE FROM shovey_templates WHERE name = ?"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "DELETE FROM goiardi.shovey_templates WHERE name = $1"
+	} else {
+		return util.NoDBConfigured
+	}
+	_, err := datastore.Dbh.Exec(sqlStatement, t.Name)
+	return err
+}
+
+func templateListSQL() []string {
+	var sqlStatement string
+	if config.Config.UseMySQL {
+		sqlStatement = "SELECT name FROM shovey_templates ORDER BY name"
+	} else if config.Config.UsePostgreSQL {
+		sqlStatement = "SELECT name FROM goiardi.shovey_templates ORDER BY name"
+	}
+	var names []string
+	rows, err := datastore.Dbh.Query(sqlStatement)
+	if err != nil {
+		logger.Errorf("error listing shovey templates: %s", err.Error())
+		return names
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			logger.Errorf("error listing shovey templates: %s", err.Error())
+			return names
+		}
+		names = append(names, name)
+	}
+	return names
+}
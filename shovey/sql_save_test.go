@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shovey
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+)
+
+// A database/sql driver that records what's executed against it instead of
+// needing a real database. Queries return a single row with a 0 in it, which
+// is enough for checking whether a shovey run id's already taken.
+
+type recordedExec struct {
+	query string
+	args  []driver.Value
+}
+
+type recordingDriver struct {
+	sync.Mutex
+	execs []recordedExec
+	// make updates act like another goiardi got there first
+	noUpdates bool
+}
+
+type recordingConn struct{ d *recordingDriver }
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+type recordingRows struct{ done bool }
+
+var recDriver = &recordingDriver{}
+
+func init() {
+	sql.Register("shovey-recording", recDriver)
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) {
+	return &recordingConn{d: d}, nil
+}
+
+func (d *recordingDriver) inserts(table string) []recordedExec {
+	return d.matching("INSERT INTO " + table + " ")
+}
+
+func (d *recordingDriver) matching(prefix string) []recordedExec {
+	d.Lock()
+	defer d.Unlock()
+	var ins []recordedExec
+	for _, e := range d.execs {
+		if strings.HasPrefix(e.query, prefix) {
+			ins = append(ins, e)
+		}
+	}
+	return ins
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{d: c.d, query: query}, nil
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *recordingConn) Commit() error             { return nil }
+func (c *recordingConn) Rollback() error           { return nil }
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.Lock()
+	defer s.d.Unlock()
+	s.d.execs = append(s.d.execs, recordedExec{query: s.query, args: args})
+	if s.d.noUpdates && strings.HasPrefix(s.query, "UPDATE ") {
+		return driver.RowsAffected(0), nil
+	}
+	return driver.RowsAffected(1), nil
+}
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &recordingRows{}, nil
+}
+
+func (r *recordingRows) Columns() []string { return []string{"c"} }
+func (r *recordingRows) Close() error      { return nil }
+func (r *recordingRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(0)
+	return nil
+}
+
+func useRecordingDB(t *testing.T) func() {
+	db, err := sql.Open("shovey-recording", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recDriver.Lock()
+	recDriver.execs = nil
+	recDriver.noUpdates = false
+	recDriver.Unlock()
+	oldDbh := datastore.Dbh
+	datastore.Dbh = db
+	config.Config.UseMySQL = true
+	return func() {
+		config.Config.UseMySQL = false
+		datastore.Dbh = oldDbh
+		db.Close()
+	}
+}
+
+// With MySQL and Postgres, saving a job that already exists only updates the
+// fields that can change afterwards, so everything else has to be there the
+// first time it's saved.
+func TestNewJobSQLFirstSave(t *testing.T) {
+	defer useRecordingDB(t)()
+
+	js := &JobSpec{Command: "uptime", Quorum: "100%", NodeNames: []string{"sql-node"}, BatchSize: "2", BatchWait: 5, MaxFailures: 1, RequestedBy: "requester"}
+	s, err := js.NewJob()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ins := recDriver.inserts("shoveys")
+	if len(ins) != 1 {
+		t.Fatalf("expected the job to be inserted once, got %d inserts", len(ins))
+	}
+	args := ins[0].args
+	if args[0] != s.RunID {
+		t.Errorf("inserted run id %v, expected %s", args[0], s.RunID)
+	}
+	if args[7] != "2" {
+		t.Errorf("batch size on first save was %v, expected 2", args[7])
+	}
+	if args[15] != "requester" {
+		t.Errorf("requested_by on first save was %v, expected 'requester'", args[15])
+	}
+}
+
+func TestScheduledJobSQLFirstSave(t *testing.T) {
+	defer useRecordingDB(t)()
+
+	js := &JobSpec{Command: "uptime", Quorum: "100%", NodeNames: []string{"sql-node"}}
+	if _, err := js.newJob("nightly"); err != nil {
+		t.Fatal(err)
+	}
+	ins := recDriver.inserts("shoveys")
+	if len(ins) != 1 {
+		t.Fatalf("expected the job to be inserted once, got %d inserts", len(ins))
+	}
+	if ins[0].args[12] != "nightly" {
+		t.Errorf("schedule_name on first save was %v, expected 'nightly'", ins[0].args[12])
+	}
+}
+
+// Only the goiardi whose update actually changed a batch's runs sends it.
+func TestClaimBatchSQL(t *testing.T) {
+	defer useRecordingDB(t)()
+
+	s := &Shovey{RunID: "claimed-job"}
+	claimed, err := s.claimBatchSQL([]string{"node-a", "node-b"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed {
+		t.Errorf("the batch should have been claimed")
+	}
+	ups := recDriver.matching("UPDATE shovey_runs ")
+	if len(ups) != 1 {
+		t.Fatalf("expected the batch to be claimed with one update, got %d", len(ups))
+	}
+	if !strings.Contains(ups[0].query, "node_name IN (?, ?) AND status = 'pending'") || ups[0].args[1] != "claimed-job" || ups[0].args[3] != "node-b" {
+		t.Errorf("the claiming update was wrong: %s %v", ups[0].query, ups[0].args)
+	}
+
+	recDriver.Lock()
+	recDriver.noUpdates = true
+	recDriver.Unlock()
+	sent, err := s.claimBatch([]string{"node-a", "node-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 0 {
+		t.Errorf("a batch another goiardi claimed should not have been sent, but was sent to %v", sent)
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shovey
+
+// Summing up how a job's runs went, so a job on hundreds of nodes can be
+// read at a glance.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ctdk/goiardi/util"
+)
+
+// Run outcomes, grouping the more detailed run statuses.
+const (
+	OutcomeSucceeded  = "succeeded"
+	OutcomeFailed     = "failed"
+	OutcomeNotRun     = "not_run"
+	OutcomeInProgress = "in_progress"
+)
+
+// RunSummary sums up the runs of a shovey job.
+type RunSummary struct {
+	Total             int                 `json:"total"`
+	ByStatus          map[string]int      `json:"by_status"`
+	ByExitStatus      map[string]int      `json:"by_exit_status"`
+	NodesByExitStatus map[string][]string `json:"nodes_by_exit_status"`
+	Outcomes          map[string][]string `json:"outcomes"`
+	Duration          *DurationStats      `json:"duration,omitempty"`
+}
+
+// DurationStats are statistics, in seconds, on how long the runs that finished
+// took from when the node acknowledged the job to when it ended.
+type DurationStats struct {
+	Count  int     `json:"count"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	P95    float64 `json:"p95"`
+}
+
+// OutputGroup is a piece of output that one or more nodes printed, identified
+// by its SHA-256 hash.
+type OutputGroup struct {
+	Hash   string   `json:"hash"`
+	Output string   `json:"output"`
+	Nodes  []string `json:"nodes"`
+}
+
+// outcome sorts the run into one of the run outcomes.
+func (sr *ShoveyRun) outcome() string {
+	switch {
+	case sr.failed():
+		return OutcomeFailed
+	case sr.Status == "succeeded":
+		return OutcomeSucceeded
+	case sr.finished():
+		// down or cancelled
+		return OutcomeNotRun
+	}
+	return OutcomeInProgress
+}
+
+// summarizeRuns sums up a job's runs by status, exit status, and outcome, and
+// how long they took.
+func summarizeRuns(runs []*ShoveyRun) *RunSummary {
+	sum := &RunSummary{Total: len(runs), ByStatus: make(map[string]int), ByExitStatus: make(map[string]int), NodesByExitStatus: make(map[string][]string), Outcomes: make(map[string][]string)}
+	var durs []time.Duration
+	for _, sr := range runs {
+		sum.ByStatus[sr.Status]++
+		o := sr.outcome()
+		sum.Outcomes[o] = append(sum.Outcomes[o], sr.NodeName)
+		// only runs the node reported back on have an exit status
+		if sr.Status == "succeeded" || sr.Status == "failed" {
+			es := strconv.Itoa(int(sr.ExitStatus))
+			sum.ByExitStatus[es]++
+			sum.NodesByExitStatus[es] = append(sum.NodesByExitStatus[es], sr.NodeName)
+		}
+		if sr.finished() && !sr.AckTime.IsZero() && !sr.EndTime.IsZero() && !sr.EndTime.Before(sr.AckTime) {
+			durs = append(durs, sr.EndTime.Sub(sr.AckTime))
+		}
+	}
+	for _, m := range []map[string][]string{sum.NodesByExitStatus, sum.Outcomes} {
+		for _, nodes := range m {
+			sort.Strings(nodes)
+		}
+	}
+	sum.Duration = durationStats(durs)
+	return sum
+}
+
+func durationStats(durs []time.Duration) *DurationStats {
+	if len(durs) == 0 {
+		return nil
+	}
+	sort.Sort(byDuration(durs))
+	var total time.Duration
+	for _, d := range durs {
+		total += d
+	}
+	ds := &DurationStats{Count: len(durs), Min: durs[0].Seconds(), Max: durs[len(durs)-1].Seconds()}
+	ds.Mean = (total / time.Duration(len(durs))).Seconds()
+	if n := len(durs); n%2 == 1 {
+		ds.Median = durs[n/2].Seconds()
+	} else {
+		ds.Median = ((durs[n/2-1] + durs[n/2]) / 2).Seconds()
+	}
+	// nearest rank
+	rank := int(math.Ceil(0.95*float64(len(durs)))) - 1
+	ds.P95 = durs[rank].Seconds()
+	return ds
+}
+
+// GroupOutputs groups the job's nodes by the output of the given type that
+// each one printed, so nodes that all printed the same thing only show up
+// once. Groups with the most nodes come first. Nodes that haven't printed
+// anything are grouped together with an empty output.
+func (s *Shovey) GroupOutputs(outputType string) ([]*OutputGroup, util.Gerror) {
+	if outputType != "stdout" && outputType != "stderr" {
+		err := util.Errorf("output type must be 'stdout' or 'stderr'")
+		err.SetStatus(http.StatusBadRequest)
+		return nil, err
+	}
+	runs, err := s.GetNodeRuns()
+	if err != nil {
+		return nil, err
+	}
+	groups := make(map[string]*OutputGroup)
+	for _, sr := range runs {
+		out, err := sr.CombineStreamOutput(outputType, 0)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256([]byte(out))
+		h := hex.EncodeToString(sum[:])
+		g, ok := groups[h]
+		if !ok {
+			g = &OutputGroup{Hash: h, Output: out}
+			groups[h] = g
+		}
+		g.Nodes = append(g.Nodes, sr.NodeName)
+	}
+	outputGroups := make([]*OutputGroup, 0, len(groups))
+	for _, g := range groups {
+		sort.Strings(g.Nodes)
+		outputGroups = append(outputGroups, g)
+	}
+	sort.Sort(byGroupSize(outputGroups))
+	return outputGroups, nil
+}
+
+type byDuration []time.Duration
+
+func (b byDuration) Len() int           { return len(b) }
+func (b byDuration) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byDuration) Less(i, j int) bool { return b[i] < b[j] }
+
+type byGroupSize []*OutputGroup
+
+func (b byGroupSize) Len() int      { return len(b) }
+func (b byGroupSize) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byGroupSize) Less(i, j int) bool {
+	if len(b[i].Nodes) != len(b[j].Nodes) {
+		return len(b[i].Nodes) > len(b[j].Nodes)
+	}
+	return b[i].Hash < b[j].Hash
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shovey
+
+// Keeping an eye on running jobs, so nodes that never acknowledge a job or
+// never report back on it can't leave it running forever.
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/tideland/golib/logger"
+)
+
+// SupervisorInterval is how often running jobs are checked for runs that are
+// past their deadlines.
+var SupervisorInterval = 15 * time.Second
+
+// AckTimeout is how long a node has to acknowledge a job after it's been sent
+// before its run times out.
+var AckTimeout = 2 * time.Minute
+
+// rollers keeps track of the rolling jobs this goiardi is sending batches out
+// for, so the supervisor doesn't pick them up as stalled.
+type rollerSet struct {
+	sync.Mutex
+	jobs map[string]bool
+}
+
+var rollers = &rollerSet{jobs: make(map[string]bool)}
+
+func (r *rollerSet) add(runID string) {
+	r.Lock()
+	defer r.Unlock()
+	r.jobs[runID] = true
+}
+
+func (r *rollerSet) remove(runID string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.jobs, runID)
+}
+
+func (r *rollerSet) active(runID string) bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.jobs[runID]
+}
+
+// SuperviseJobs checks every running job for node runs that are past their
+// deadlines, marks them as timed out, and completes jobs that have nothing
+// left running. A run's node has AckTimeout to acknowledge the job after it's
+// sent, and the job's timeout plus a grace period after that to report back.
+// Rolling jobs whose remaining batches were left unsent, because the goiardi
+// sending them went away, are picked back up. Everything it goes on is saved
+// with the jobs, so it carries on where it left off after a restart.
+func SuperviseJobs() {
+	now := time.Now()
+	shoveys, err := runningShoveys()
+	if err != nil {
+		logger.Errorf("error getting running shovey jobs: %s", err.Error())
+		return
+	}
+	for _, s := range shoveys {
+		s.supervise(now)
+	}
+}
+
+func runningShoveys() ([]*Shovey, error) {
+	if config.UsingDB() {
+		return shoveysByStatusSQL("running")
+	}
+	var running []*Shovey
+	for _, s := range AllShoveys() {
+		if s.Status == "running" {
+			running = append(running, s)
+		}
+	}
+	return running, nil
+}
+
+func (s *Shovey) supervise(now time.Time) {
+	runs, err := s.GetNodeRuns()
+	if err != nil {
+		logger.Errorf("error getting runs for shovey job %s: %s", s.RunID, err.Error())
+		return
+	}
+	var timedOut []string
+	for _, sr := range runs {
+		reason := sr.overdue(s, now)
+		if reason == "" {
+			continue
+		}
+		sr.Status = "timed_out"
+		sr.EndTime = now
+		sr.Error = reason
+		if err := sr.save(); err != nil {
+			logger.Errorf("error saving shovey run: %s", err.Error())
+			continue
+		}
+		timedOut = append(timedOut, sr.NodeName)
+	}
+	if len(timedOut) > 0 {
+		logger.Infof("shovey job %s: runs on %d nodes timed out", s.RunID, len(timedOut))
+		if config.Config.ShoveyCancelTimedOut {
+			go func() {
+				if err := s.sendCancel(timedOut); err != nil {
+					logger.Errorf("error cancelling timed out runs of shovey job %s: %s", s.RunID, err.Error())
+				}
+			}()
+		}
+	}
+	if s.Rolling() {
+		s.resumeRolling(runs, now)
+	}
+	s.checkCompleted()
+}
+
+// overdue returns why the run has timed out, or an empty string if it hasn't.
+func (sr *ShoveyRun) overdue(s *Shovey, now time.Time) string {
+	if sr.finished() || sr.Status == "pending" {
+		return ""
+	}
+	sent := sr.SentAt
+	if sent.IsZero() {
+		// runs from before sending times were kept
+		sent = s.CreatedAt
+	}
+	if sr.AckTime.IsZero() && sr.Status == "created" {
+		if now.After(sent.Add(AckTimeout)) {
+			return fmt.Sprintf("node did not acknowledge the job within %s", AckTimeout)
+		}
+		return ""
+	}
+	start := sr.AckTime
+	if start.IsZero() {
+		start = sent
+	}
+	if now.After(start.Add(s.Timeout*time.Second + batchGrace)) {
+		return fmt.Sprintf("node did not report back within %s of starting the job", s.Timeout*time.Second+batchGrace)
+	}
+	return ""
+}
+
+// resumeRolling starts sending the rest of a rolling job's batches again if
+// nothing's been sent out since the last batch finished, and nothing in this
+// goiardi is sending them. Other goiardis sharing the database may pick the
+// job up at the same time, but each batch is claimed before it's sent, so only
+// one of them sends it.
+func (s *Shovey) resumeRolling(runs []*ShoveyRun, now time.Time) {
+	if rollers.active(s.RunID) {
+		return
+	}
+	var pending []string
+	var lastEnd time.Time
+	failures, up := 0, 0
+	for _, sr := range runs {
+		switch {
+		case sr.Status == "pending":
+			pending = append(pending, sr.NodeName)
+			up++
+		case !sr.finished():
+			// a batch is still going
+			return
+		default:
+			if sr.Status != "down" {
+				up++
+			}
+			if sr.failed() {
+				failures++
+			}
+			if sr.EndTime.After(lastEnd) {
+				lastEnd = sr.EndTime
+			}
+		}
+	}
+	if len(pending) == 0 || now.Before(lastEnd.Add(s.BatchWait*time.Second+batchGrace)) {
+		return
+	}
+	// Batch sizes given as a percentage are of all the nodes that were up
+	// when the job started, not just the ones left.
+	size, err := getBatchSize(s.BatchSize, up)
+	if err != nil {
+		logger.Errorf("shovey job %s: %s", s.RunID, err.Error())
+		return
+	}
+	batches, err := splitBatches(pending, strconv.Itoa(size))
+	if err != nil {
+		logger.Errorf("shovey job %s: %s", s.RunID, err.Error())
+		return
+	}
+	logger.Infof("shovey job %s: resuming rolling execution with %d nodes left", s.RunID, len(pending))
+	// the empty first batch stands in for the ones already run
+	go s.rollBatches(getTransport(), append([][]string{nil}, batches...), failures)
+}
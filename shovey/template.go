@@ -0,0 +1,566 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shovey
+
+// Named shovey command templates, with typed parameters, limits on which
+// nodes they may run on, and optionally needing a second admin to approve
+// each job.
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/datastore"
+	"github.com/ctdk/goiardi/node"
+	"github.com/ctdk/goiardi/util"
+)
+
+// Template parameter types.
+const (
+	ParamString  = "string"
+	ParamEnum    = "enum"
+	ParamInteger = "integer"
+	ParamRegex   = "regex"
+)
+
+// Template is a named shovey command with {{param}} placeholders filled in
+// from arguments given when a job is made from it.
+type Template struct {
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	Command     string           `json:"command"`
+	Params      []*TemplateParam `json:"params"`
+	// If set, the nodes a job from this template runs on must be in one
+	// of these environments, and have one of these roles.
+	Environments []string `json:"environments"`
+	Roles        []string `json:"roles"`
+	// Jobs from this template wait for a different admin than the one
+	// who made the job to approve them before they start.
+	RequireApproval bool      `json:"require_approval"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// TemplateParam is one of a template's parameters. Enum params take one of
+// Values, regex params must entirely match Pattern, and integer params must be
+// between Min and Max if they're set. String params may not contain shell
+// metacharacters or control characters; use a regex param for anything more
+// unusual.
+type TemplateParam struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Required bool     `json:"required"`
+	Default  string   `json:"default,omitempty"`
+	Values   []string `json:"values,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+	Min      *int64   `json:"min,omitempty"`
+	Max      *int64   `json:"max,omitempty"`
+	re       *regexp.Regexp
+}
+
+var placeholderRe = regexp.MustCompile(`{{\s*([A-Za-z0-9_-]+)\s*}}`)
+
+var paramNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+const unsafeStringChars = "`$;&|<>(){}[]\\\"'*?!~#\n\r\t"
+
+// NewTemplate creates a new shovey command template.
+func NewTemplate(name string) (*Template, util.Gerror) {
+	if !util.ValidateName(name) {
+		err := util.Errorf("invalid shovey template name '%s'", name)
+		err.SetStatus(http.StatusBadRequest)
+		return nil, err
+	}
+	found, err := templateExists(name)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		err := util.Errorf("shovey template %s already exists", name)
+		err.SetStatus(http.StatusConflict)
+		return nil, err
+	}
+	t := &Template{Name: name, Params: make([]*TemplateParam, 0), Environments: make([]string, 0), Roles: make([]string, 0), CreatedAt: time.Now()}
+	return t, nil
+}
+
+// Validate checks that the template's parameters make sense, and that every
+// placeholder in the command has a parameter.
+func (t *Template) Validate() util.Gerror {
+	var msg string
+	if t.Command == "" {
+		msg = "no command given for the template"
+	}
+	seen := make(map[string]bool)
+	for _, p := range t.Params {
+		if msg != "" {
+			break
+		}
+		if !paramNameRe.MatchString(p.Name) {
+			msg = fmt.Sprintf("invalid parameter name '%s'", p.Name)
+			break
+		}
+		if seen[p.Name] {
+			msg = fmt.Sprintf("parameter %s is given more than once", p.Name)
+			break
+		}
+		seen[p.Name] = true
+		if err := p.compile(); err != nil {
+			msg = err.Error()
+			break
+		}
+		if p.Default != "" {
+			if err := p.check(p.Default); err != nil {
+				msg = fmt.Sprintf("default for parameter %s: %s", p.Name, err.Error())
+			}
+		}
+	}
+	if msg == "" {
+		for _, m := range placeholderRe.FindAllStringSubmatch(t.Command, -1) {
+			if !seen[m[1]] {
+				msg = fmt.Sprintf("the command uses {{%s}}, but there's no parameter with that name", m[1])
+				break
+			}
+		}
+	}
+	if msg != "" {
+		err := util.Errorf("%s", msg)
+		err.SetStatus(http.StatusBadRequest)
+		return err
+	}
+	return nil
+}
+
+func (p *TemplateParam) compile() error {
+	switch p.Type {
+	case ParamString, ParamInteger:
+	case ParamEnum:
+		if len(p.Values) == 0 {
+			return fmt.Errorf("enum parameter %s has no values", p.Name)
+		}
+	case ParamRegex:
+		if p.Pattern == "" {
+			return fmt.Errorf("regex parameter %s has no pattern", p.Name)
+		}
+		re, err := regexp.Compile(`^(?:` + p.Pattern + `)$`)
+		if err != nil {
+			return fmt.Errorf("regex parameter %s: %s", p.Name, err.Error())
+		}
+		p.re = re
+	default:
+		return fmt.Errorf("parameter %s has unknown type '%s'", p.Name, p.Type)
+	}
+	if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+		return fmt.Errorf("parameter %s has a min greater than its max", p.Name)
+	}
+	return nil
+}
+
+// check makes sure a value is acceptable for the parameter. The parameter
+// must have been compiled first.
+func (p *TemplateParam) check(val string) error {
+	switch p.Type {
+	case ParamString:
+		if strings.ContainsAny(val, unsafeStringChars) {
+			return fmt.Errorf("'%s' contains characters not allowed in a string parameter", val)
+		}
+		for _, r := range val {
+			if r < 0x20 || r == 0x7f {
+				return fmt.Errorf("'%s' contains control characters", val)
+			}
+		}
+	case ParamEnum:
+		for _, v := range p.Values {
+			if v == val {
+				return nil
+			}
+		}
+		return fmt.Errorf("'%s' is not one of %s", val, strings.Join(p.Values, ", "))
+	case ParamInteger:
+		i, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return fmt.Errorf("'%s' is not an integer", val)
+		}
+		if p.Min != nil && i < *p.Min {
+			return fmt.Errorf("%d is less than the minimum of %d", i, *p.Min)
+		}
+		if p.Max != nil && i > *p.Max {
+			return fmt.Errorf("%d is more than the maximum of %d", i, *p.Max)
+		}
+	case ParamRegex:
+		if !p.re.MatchString(val) {
+			return fmt.Errorf("'%s' does not match %s", val, p.Pattern)
+		}
+	}
+	return nil
+}
+
+// Render fills in the template's command with the given arguments, checking
+// each one against its parameter.
+func (t *Template) Render(args map[string]string) (string, util.Gerror) {
+	if err := t.Validate(); err != nil {
+		return "", err
+	}
+	vals := make(map[string]string, len(t.Params))
+	var msg string
+	for _, p := range t.Params {
+		val, ok := args[p.Name]
+		if !ok {
+			if p.Required && p.Default == "" {
+				msg = fmt.Sprintf("missing required argument %s", p.Name)
+				break
+			}
+			val = p.Default
+		}
+		if ok || val != "" {
+			if err := p.check(val); err != nil {
+				msg = fmt.Sprintf("argument %s: %s", p.Name, err.Error())
+				break
+			}
+		}
+		vals[p.Name] = val
+	}
+	if msg == "" {
+		for a := range args {
+			if _, ok := vals[a]; !ok {
+				msg = fmt.Sprintf("shovey template %s has no parameter %s", t.Name, a)
+				break
+			}
+		}
+	}
+	if msg != "" {
+		err := util.Errorf("%s", msg)
+		err.SetStatus(http.StatusBadRequest)
+		return "", err
+	}
+	cmd := placeholderRe.ReplaceAllStringFunc(t.Command, func(m string) string {
+		return vals[placeholderRe.FindStringSubmatch(m)[1]]
+	})
+	return strings.TrimSpace(cmd), nil
+}
+
+// CheckTargets makes sure every node is in one of the template's allowed
+// environments and has one of its allowed roles, if it has any. A node has a
+// role if it's in the node's run list, or among the roles it expanded its run
+// list to on its last chef-client run.
+func (t *Template) CheckTargets(nodeNames []string) util.Gerror {
+	if len(t.Environments) == 0 && len(t.Roles) == 0 {
+		return nil
+	}
+	var bad []string
+	for _, n := range nodeNames {
+		nd, err := node.Get(n)
+		if err != nil {
+			bad = append(bad, n)
+			continue
+		}
+		if len(t.Environments) != 0 && !inSlice(nd.ChefEnvironment, t.Environments) {
+			bad = append(bad, n)
+			continue
+		}
+		if len(t.Roles) == 0 {
+			continue
+		}
+		hasRole := false
+		for _, r := range t.Roles {
+			if nd.HasRole(r) {
+				hasRole = true
+				break
+			}
+		}
+		if !hasRole {
+			bad = append(bad, n)
+		}
+	}
+	if len(bad) != 0 {
+		err := util.Errorf("shovey template %s is not allowed to run on these nodes: %s", t.Name, strings.Join(bad, ", "))
+		err.SetStatus(http.StatusForbidden)
+		return err
+	}
+	return nil
+}
+
+// Approve approves a job made from a template that needs approval, and starts
+// it. The admin approving the job can't be the one who asked for it.
+func (s *Shovey) Approve(approver string) util.Gerror {
+	if err := s.checkApprover(approver); err != nil {
+		return err
+	}
+	s.ApprovedBy = approver
+	if err := s.save(); err != nil {
+		return err
+	}
+	return s.Start()
+}
+
+// Reject turns down a job that's waiting for approval.
+func (s *Shovey) Reject(approver string) util.Gerror {
+	if err := s.checkApprover(approver); err != nil {
+		return err
+	}
+	s.ApprovedBy = approver
+	s.Status = "rejected"
+	return s.save()
+}
+
+func (s *Shovey) checkApprover(approver string) util.Gerror {
+	if s.Status != "awaiting_approval" {
+		err := util.Errorf("shovey job %s is not waiting for approval", s.RunID)
+		err.SetStatus(http.StatusConflict)
+		return err
+	}
+	if approver == s.RequestedBy {
+		err := util.Errorf("shovey job %s must be approved by someone other than %s, who asked for it", s.RunID, approver)
+		err.SetStatus(http.StatusForbidden)
+		return err
+	}
+	return nil
+}
+
+// Save saves the template.
+func (t *Template) Save() util.Gerror {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	t.UpdatedAt = time.Now()
+	if config.UsingDB() {
+		if err := t.saveSQL(); err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return gerr
+		}
+		return nil
+	}
+	ds := datastore.New()
+	ds.Set("shovey_template", t.Name, t)
+	return nil
+}
+
+// GetTemplate gets the shovey template with the given name.
+func GetTemplate(name string) (*Template, util.Gerror) {
+	var t *Template
+	var found bool
+	if config.UsingDB() {
+		var err error
+		t, err = getTemplateSQL(name)
+		if err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return nil, gerr
+		}
+		found = t != nil
+	} else {
+		ds := datastore.New()
+		var tt interface{}
+		tt, found = ds.Get("shovey_template", name)
+		if tt != nil {
+			t = tt.(*Template)
+		}
+	}
+	if !found {
+		err := util.Errorf("shovey template %s not found", name)
+		err.SetStatus(http.StatusNotFound)
+		return nil, err
+	}
+	return t, nil
+}
+
+func templateExists(name string) (bool, util.Gerror) {
+	_, err := GetTemplate(name)
+	if err != nil {
+		if err.Status() == http.StatusNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Delete removes the template. Jobs already made from it are left alone.
+func (t *Template) Delete() util.Gerror {
+	if config.UsingDB() {
+		if err := t.deleteSQL(); err != nil {
+			gerr := util.CastErr(err)
+			gerr.SetStatus(http.StatusInternalServerError)
+			return gerr
+		}
+		return nil
+	}
+	ds := datastore.New()
+	ds.Delete("shovey_template", t.Name)
+	return nil
+}
+
+// TemplateList returns the names of all the shovey templates.
+func TemplateList() []string {
+	if config.UsingDB() {
+		return templateListSQL()
+	}
+	ds := datastore.New()
+	list := ds.GetList("shovey_template")
+	sort.Strings(list)
+	return list
+}
+
+// AllTemplates returns all the shovey templates.
+func AllTemplates() []*Template {
+	var templates []*Template
+	for _, name := range TemplateList() {
+		t, err := GetTemplate(name)
+		if err != nil {
+			continue
+		}
+		templates = append(templates, t)
+	}
+	return templates
+}
+
+// ToJSON formats a template to render as JSON for the client.
+func (t *Template) ToJSON() map[string]interface{} {
+	toJSON := make(map[string]interface{})
+	toJSON["name"] = t.Name
+	toJSON["description"] = t.Description
+	toJSON["command"] = t.Command
+	toJSON["params"] = t.Params
+	toJSON["environments"] = t.Environments
+	toJSON["roles"] = t.Roles
+	toJSON["require_approval"] = t.RequireApproval
+	toJSON["created_at"] = t.CreatedAt
+	toJSON["updated_at"] = t.UpdatedAt
+	return toJSON
+}
+
+// ImportTemplate is used to import shovey templates from the exported JSON
+// dump.
+func ImportTemplate(templateJSON map[string]interface{}) error {
+	t := &Template{Name: templateJSON["name"].(string)}
+	if err := t.updateFromJSON(templateJSON); err != nil {
+		return err
+	}
+	for k, ts := range map[string]*time.Time{"created_at": &t.CreatedAt, "updated_at": &t.UpdatedAt} {
+		if s, ok := templateJSON[k].(string); ok {
+			*ts, _ = time.Parse(time.RFC3339, s)
+		}
+	}
+	if config.UsingDB() {
+		return t.saveSQL()
+	}
+	ds := datastore.New()
+	ds.Set("shovey_template", t.Name, t)
+	return nil
+}
+
+// UpdateFromJSON replaces the template's settings with ones from a JSON
+// request body. The name can't be changed.
+func (t *Template) UpdateFromJSON(templateJSON map[string]interface{}) util.Gerror {
+	if name, ok := templateJSON["name"].(string); ok && name != t.Name {
+		err := util.Errorf("shovey templates cannot be renamed")
+		err.SetStatus(http.StatusBadRequest)
+		return err
+	}
+	if err := t.updateFromJSON(templateJSON); err != nil {
+		gerr := util.CastErr(err)
+		gerr.SetStatus(http.StatusBadRequest)
+		return gerr
+	}
+	return t.Validate()
+}
+
+func (t *Template) updateFromJSON(templateJSON map[string]interface{}) error {
+	var ok bool
+	if t.Command, ok = templateJSON["command"].(string); !ok {
+		return fmt.Errorf("no command given, or the command isn't a string")
+	}
+	t.Description, _ = templateJSON["description"].(string)
+	t.RequireApproval, _ = templateJSON["require_approval"].(bool)
+	var err error
+	if t.Environments, err = stringList(templateJSON["environments"], "environments"); err != nil {
+		return err
+	}
+	if t.Roles, err = stringList(templateJSON["roles"], "roles"); err != nil {
+		return err
+	}
+	t.Params = make([]*TemplateParam, 0)
+	if ps, ok := templateJSON["params"]; ok {
+		plist, ok := ps.([]interface{})
+		if !ok {
+			return fmt.Errorf("params must be an array")
+		}
+		for _, pv := range plist {
+			pm, ok := pv.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("each param must be an object")
+			}
+			p := new(TemplateParam)
+			p.Name, _ = pm["name"].(string)
+			p.Type, _ = pm["type"].(string)
+			if p.Type == "" {
+				p.Type = ParamString
+			}
+			p.Required, _ = pm["required"].(bool)
+			p.Pattern, _ = pm["pattern"].(string)
+			if p.Values, err = stringList(pm["values"], "values"); err != nil {
+				return err
+			}
+			if d, ok := pm["default"]; ok {
+				p.Default = fmt.Sprintf("%v", d)
+			}
+			if m, ok := intify(pm["min"]); ok {
+				p.Min = &m
+			}
+			if m, ok := intify(pm["max"]); ok {
+				p.Max = &m
+			}
+			t.Params = append(t.Params, p)
+		}
+	}
+	return nil
+}
+
+func stringList(v interface{}, what string) ([]string, error) {
+	list := make([]string, 0)
+	if v == nil {
+		return list, nil
+	}
+	vs, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be an array of strings", what)
+	}
+	for _, s := range vs {
+		str, ok := s.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be an array of strings", what)
+		}
+		list = append(list, str)
+	}
+	return list, nil
+}
+
+func inSlice(s string, list []string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
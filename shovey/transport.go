@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package shovey
+
+import (
+	"github.com/ctdk/goiardi/config"
+	"github.com/ctdk/goiardi/node"
+	"github.com/ctdk/goiardi/serfin"
+	serfclient "github.com/hashicorp/serf/client"
+	"github.com/tideland/golib/logger"
+)
+
+// Transport delivers signed shovey commands to nodes, and knows which nodes
+// it can currently reach.
+type Transport interface {
+	// UpNodes returns the names of the given nodes that are up and able
+	// to receive commands.
+	UpNodes(nodeNames []string) ([]string, error)
+	// Send delivers the signed JSON payload to the given nodes. The names
+	// of nodes that acknowledge receiving it are sent on ackCh, which is
+	// closed once every node has acknowledged it or the transport gives
+	// up waiting.
+	Send(payload []byte, nodeNames []string, ackCh chan string) error
+}
+
+// getTransport returns the transport shovey is configured to use.
+func getTransport() Transport {
+	if config.Config.ShoveyTransport == "http" {
+		return pullQueue
+	}
+	return serfTransport{}
+}
+
+// serfTransport sends commands out as serf queries, and goes by the node
+// statuses schob sends back over serf to know which nodes are up.
+type serfTransport struct{}
+
+func (st serfTransport) UpNodes(nodeNames []string) ([]string, error) {
+	upNodes, err := node.GetNodesByStatus(nodeNames, "up")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(upNodes))
+	for i, n := range upNodes {
+		names[i] = n.Name
+	}
+	return names, nil
+}
+
+func (st serfTransport) Send(payload []byte, nodeNames []string, ackCh chan string) error {
+	respCh := make(chan serfclient.NodeResponse, len(nodeNames))
+	q := &serfclient.QueryParam{Name: "shovey", Payload: payload, FilterNodes: nodeNames, RequestAck: true, AckCh: ackCh, RespCh: respCh}
+	errch := make(chan error)
+	go serfin.Query(q, errch)
+	if err := <-errch; err != nil {
+		return err
+	}
+	go func() {
+		for r := range respCh {
+			logger.Debugf("got a response: %v", r)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,24 @@
+-- Deploy api_tokens
+-- requires: shovey_run_deadlines
+
+BEGIN;
+
+CREATE TABLE api_tokens (
+	id varchar(36) not null,
+	name varchar(255),
+	owner_name varchar(255) not null,
+	owner_type varchar(10) not null,
+	scopes text not null,
+	secret_hash varchar(64) not null,
+	created_by varchar(255),
+	organization_id int not null default 1,
+	created_at datetime not null,
+	expires_at datetime,
+	last_used_at datetime,
+	last_used_ip varchar(45),
+	revoked_at datetime,
+	primary key(id),
+	index(organization_id, owner_type, owner_name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+COMMIT;
@@ -0,0 +1,9 @@
+-- Deploy encrypt_data
+-- requires: log_auth_failures
+
+BEGIN;
+
+ALTER TABLE nodes ADD COLUMN enc_key_id varchar(32) NOT NULL DEFAULT '', ADD INDEX(enc_key_id);
+ALTER TABLE data_bag_items ADD COLUMN enc_key_id varchar(32) NOT NULL DEFAULT '', ADD INDEX(enc_key_id);
+
+COMMIT;
@@ -0,0 +1,23 @@
+-- Deploy log_auth_failures
+-- requires: api_tokens
+
+BEGIN;
+
+ALTER TABLE log_infos MODIFY actor_type enum('user', 'client', 'unknown') NOT NULL, MODIFY action enum('create', 'delete', 'modify', 'auth_failure') NOT NULL;
+
+CREATE TABLE auth_lockouts (
+	id int not null auto_increment,
+	kind varchar(10) not null,
+	name varchar(255) not null,
+	failures int not null default 0,
+	lockouts int not null default 0,
+	last_failure datetime,
+	last_reason text,
+	locked_until datetime,
+	organization_id int not null default 1,
+	primary key(id),
+	unique key(organization_id, kind, name),
+	index(locked_until)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+COMMIT;
@@ -0,0 +1,37 @@
+-- Deploy report_resources
+-- requires: reports
+
+BEGIN;
+
+CREATE TABLE report_resources (
+	id int not null auto_increment,
+	run_id varchar(36) not null,
+	node_name varchar(255),
+	organization_id int not null default 1,
+	seq int not null default 0,
+	resource_type varchar(255) not null,
+	resource_name text not null,
+	resource_id text,
+	cookbook_name varchar(255),
+	cookbook_version varchar(255),
+	recipe_name varchar(255),
+	result varchar(255),
+	status varchar(255),
+	duration bigint default 0,
+	delta mediumtext,
+	before_state mediumblob,
+	after_state mediumblob,
+	created_at datetime not null,
+	PRIMARY KEY(id),
+	INDEX(run_id),
+	INDEX(resource_type, resource_name(255)),
+	INDEX(cookbook_name, recipe_name),
+	INDEX(node_name),
+	FOREIGN KEY(run_id)
+		REFERENCES reports(run_id)
+		ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE INDEX report_start_time ON reports(start_time);
+
+COMMIT;
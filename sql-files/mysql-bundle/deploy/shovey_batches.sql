@@ -0,0 +1,8 @@
+-- Deploy shovey_batches
+-- requires: shovey_search
+
+BEGIN;
+
+ALTER TABLE shoveys ADD COLUMN batch_size varchar(25), ADD COLUMN batch_wait int default 0, ADD COLUMN max_failures int default -1, ADD COLUMN current_batch int default 0, ADD COLUMN total_batches int default 0;
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- Deploy shovey_run_deadlines
+-- requires: shovey_templates
+
+BEGIN;
+
+ALTER TABLE shovey_runs ADD COLUMN sent_at datetime;
+
+COMMIT;
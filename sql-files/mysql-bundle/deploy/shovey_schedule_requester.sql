@@ -0,0 +1,8 @@
+-- Deploy shovey_schedule_requester
+-- requires: encrypt_data
+
+BEGIN;
+
+ALTER TABLE shovey_schedules ADD COLUMN requested_by varchar(255);
+
+COMMIT;
@@ -0,0 +1,26 @@
+-- Deploy shovey_schedules
+-- requires: shovey_batches
+
+BEGIN;
+
+CREATE TABLE shovey_schedules (
+	id int not null auto_increment,
+	name varchar(255) not null,
+	job text not null,
+	cron varchar(255),
+	run_interval bigint default 0,
+	enabled tinyint default 1,
+	next_run datetime,
+	last_run datetime,
+	last_run_id varchar(36),
+	organization_id int not null default 1,
+	created_at datetime not null,
+	updated_at datetime not null,
+	primary key(id),
+	unique key(organization_id, name),
+	index(next_run)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+ALTER TABLE shoveys ADD COLUMN schedule_name varchar(255), ADD INDEX(schedule_name);
+
+COMMIT;
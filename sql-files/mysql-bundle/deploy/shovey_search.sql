@@ -0,0 +1,8 @@
+-- Deploy shovey_search
+-- requires: shovey
+
+BEGIN;
+
+ALTER TABLE shoveys ADD COLUMN search_query text, ADD COLUMN resolve_at_start tinyint default 0;
+
+COMMIT;
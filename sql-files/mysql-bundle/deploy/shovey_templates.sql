@@ -0,0 +1,24 @@
+-- Deploy shovey_templates
+-- requires: shovey_schedules
+
+BEGIN;
+
+CREATE TABLE shovey_templates (
+	id int not null auto_increment,
+	name varchar(255) not null,
+	description text,
+	command text not null,
+	params text not null,
+	environments text not null,
+	roles text not null,
+	require_approval tinyint default 0,
+	organization_id int not null default 1,
+	created_at datetime not null,
+	updated_at datetime not null,
+	primary key(id),
+	unique key(organization_id, name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+ALTER TABLE shoveys ADD COLUMN template_name varchar(255), ADD COLUMN template_args text, ADD COLUMN requested_by varchar(255), ADD COLUMN approved_by varchar(255), ADD INDEX(template_name);
+
+COMMIT;
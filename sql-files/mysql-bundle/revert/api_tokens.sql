@@ -0,0 +1,7 @@
+-- Revert api_tokens
+
+BEGIN;
+
+DROP TABLE api_tokens;
+
+COMMIT;
@@ -0,0 +1,9 @@
+-- Revert log_auth_failures
+
+BEGIN;
+
+DROP TABLE auth_lockouts;
+DELETE FROM log_infos WHERE action = 'auth_failure' OR actor_type = 'unknown';
+ALTER TABLE log_infos MODIFY actor_type enum('user', 'client') NOT NULL, MODIFY action enum('create', 'delete', 'modify') NOT NULL;
+
+COMMIT;
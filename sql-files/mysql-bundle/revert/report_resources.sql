@@ -0,0 +1,8 @@
+-- Revert report_resources
+
+BEGIN;
+
+DROP INDEX report_start_time ON reports;
+DROP TABLE report_resources;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Revert shovey_batches
+
+BEGIN;
+
+ALTER TABLE shoveys DROP COLUMN batch_size, DROP COLUMN batch_wait, DROP COLUMN max_failures, DROP COLUMN current_batch, DROP COLUMN total_batches;
+
+COMMIT;
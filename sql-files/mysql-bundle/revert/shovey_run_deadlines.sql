@@ -0,0 +1,7 @@
+-- Revert shovey_run_deadlines
+
+BEGIN;
+
+ALTER TABLE shovey_runs DROP COLUMN sent_at;
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- Revert shovey_schedules
+
+BEGIN;
+
+ALTER TABLE shoveys DROP COLUMN schedule_name;
+DROP TABLE shovey_schedules;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Revert shovey_search
+
+BEGIN;
+
+ALTER TABLE shoveys DROP COLUMN search_query, DROP COLUMN resolve_at_start;
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- Revert shovey_templates
+
+BEGIN;
+
+ALTER TABLE shoveys DROP COLUMN template_name, DROP COLUMN template_args, DROP COLUMN requested_by, DROP COLUMN approved_by;
+DROP TABLE shovey_templates;
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- Verify encrypt_data
+
+BEGIN;
+
+SELECT enc_key_id FROM nodes WHERE 0;
+SELECT enc_key_id FROM data_bag_items WHERE 0;
+
+ROLLBACK;
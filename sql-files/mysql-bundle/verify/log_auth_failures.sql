@@ -0,0 +1,8 @@
+-- Verify log_auth_failures
+
+BEGIN;
+
+SELECT id, kind, name, failures, lockouts, last_failure, last_reason, locked_until, organization_id FROM auth_lockouts WHERE 0;
+INSERT INTO log_infos (actor_id, actor_type, actor_info, action, object_type, object_name) VALUES (-1, 'unknown', '{"name":"nobody"}', 'auth_failure', 'authentication', 'nobody');
+
+ROLLBACK;
@@ -0,0 +1,7 @@
+-- Verify report_resources
+
+BEGIN;
+
+SELECT id, run_id, node_name, organization_id, seq, resource_type, resource_name, resource_id, cookbook_name, cookbook_version, recipe_name, result, status, duration, delta, before_state, after_state, created_at FROM report_resources WHERE 0;
+
+ROLLBACK;
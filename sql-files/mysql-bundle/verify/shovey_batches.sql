@@ -0,0 +1,7 @@
+-- Verify shovey_batches
+
+BEGIN;
+
+SELECT batch_size, batch_wait, max_failures, current_batch, total_batches FROM shoveys WHERE 0;
+
+ROLLBACK;
@@ -0,0 +1,7 @@
+-- Verify shovey_run_deadlines
+
+BEGIN;
+
+SELECT sent_at FROM shovey_runs WHERE 0;
+
+ROLLBACK;
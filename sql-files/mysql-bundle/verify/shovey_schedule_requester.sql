@@ -0,0 +1,7 @@
+-- Verify shovey_schedule_requester
+
+BEGIN;
+
+SELECT requested_by FROM shovey_schedules WHERE 0;
+
+ROLLBACK;
@@ -0,0 +1,8 @@
+-- Verify shovey_schedules
+
+BEGIN;
+
+SELECT id, name, job, cron, run_interval, enabled, next_run, last_run, last_run_id, organization_id, created_at, updated_at FROM shovey_schedules WHERE 0;
+SELECT schedule_name FROM shoveys WHERE 0;
+
+ROLLBACK;
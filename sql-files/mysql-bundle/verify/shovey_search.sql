@@ -0,0 +1,7 @@
+-- Verify shovey_search
+
+BEGIN;
+
+SELECT search_query, resolve_at_start FROM shoveys WHERE 0;
+
+ROLLBACK;
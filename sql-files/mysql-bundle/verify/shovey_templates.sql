@@ -0,0 +1,8 @@
+-- Verify shovey_templates
+
+BEGIN;
+
+SELECT id, name, description, command, params, environments, roles, require_approval, organization_id, created_at, updated_at FROM shovey_templates WHERE 0;
+SELECT template_name, template_args, requested_by, approved_by FROM shoveys WHERE 0;
+
+ROLLBACK;
@@ -0,0 +1,24 @@
+-- Deploy api_tokens
+-- requires: shovey_run_deadlines
+
+BEGIN;
+
+CREATE TABLE goiardi.api_tokens (
+	id uuid not null,
+	name text,
+	owner_name text not null,
+	owner_type varchar(10) not null,
+	scopes jsonb not null,
+	secret_hash varchar(64) not null,
+	created_by text,
+	organization_id bigint not null default 1,
+	created_at timestamp with time zone not null,
+	expires_at timestamp with time zone,
+	last_used_at timestamp with time zone,
+	last_used_ip text,
+	revoked_at timestamp with time zone,
+	PRIMARY KEY(id)
+);
+CREATE INDEX api_tokens_owner ON goiardi.api_tokens(organization_id, owner_type, owner_name);
+
+COMMIT;
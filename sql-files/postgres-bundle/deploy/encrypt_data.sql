@@ -0,0 +1,11 @@
+-- Deploy encrypt_data
+-- requires: log_auth_failures
+
+BEGIN;
+
+ALTER TABLE goiardi.nodes ADD COLUMN enc_key_id varchar(32) NOT NULL DEFAULT '';
+ALTER TABLE goiardi.data_bag_items ADD COLUMN enc_key_id varchar(32) NOT NULL DEFAULT '';
+CREATE INDEX nodes_enc_key_id ON goiardi.nodes(enc_key_id);
+CREATE INDEX data_bag_items_enc_key_id ON goiardi.data_bag_items(enc_key_id);
+
+COMMIT;
@@ -0,0 +1,26 @@
+-- Deploy log_auth_failures
+-- requires: api_tokens
+
+-- Adding values to an enum can't happen inside a transaction on older
+-- versions of PostgreSQL, so these come first.
+ALTER TYPE goiardi.log_action ADD VALUE IF NOT EXISTS 'auth_failure';
+ALTER TYPE goiardi.log_actor ADD VALUE IF NOT EXISTS 'unknown';
+
+BEGIN;
+
+CREATE TABLE goiardi.auth_lockouts (
+	id bigserial,
+	kind varchar(10) not null,
+	name text not null,
+	failures int not null default 0,
+	lockouts int not null default 0,
+	last_failure timestamp with time zone,
+	last_reason text,
+	locked_until timestamp with time zone,
+	organization_id bigint not null default 1,
+	PRIMARY KEY(id),
+	UNIQUE(organization_id, kind, name)
+);
+CREATE INDEX auth_lockouts_locked_until ON goiardi.auth_lockouts(locked_until);
+
+COMMIT;
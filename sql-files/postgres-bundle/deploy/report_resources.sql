@@ -0,0 +1,37 @@
+-- Deploy report_resources
+-- requires: reports, report_insert_update
+
+BEGIN;
+
+CREATE TABLE goiardi.report_resources (
+	id bigserial,
+	run_id uuid not null,
+	node_name varchar(255),
+	organization_id bigint not null default 1,
+	seq int not null default 0,
+	resource_type varchar(255) not null,
+	resource_name text not null,
+	resource_id text,
+	cookbook_name varchar(255),
+	cookbook_version varchar(255),
+	recipe_name varchar(255),
+	result varchar(255),
+	status varchar(255),
+	duration bigint default 0,
+	delta text,
+	before_state jsonb,
+	after_state jsonb,
+	created_at timestamp with time zone not null,
+	PRIMARY KEY(id),
+	FOREIGN KEY(run_id)
+		REFERENCES goiardi.reports(run_id)
+		ON DELETE CASCADE
+);
+
+CREATE INDEX report_resources_run_id ON goiardi.report_resources(run_id);
+CREATE INDEX report_resources_type_name ON goiardi.report_resources(resource_type, resource_name);
+CREATE INDEX report_resources_cookbook ON goiardi.report_resources(cookbook_name, recipe_name);
+CREATE INDEX report_resources_node_name ON goiardi.report_resources(node_name);
+CREATE INDEX report_start_time ON goiardi.reports(start_time);
+
+COMMIT;
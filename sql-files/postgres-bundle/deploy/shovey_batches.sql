@@ -0,0 +1,29 @@
+-- Deploy shovey_batches
+-- requires: shovey_search
+
+BEGIN;
+
+ALTER TABLE goiardi.shoveys ADD COLUMN batch_size varchar(25), ADD COLUMN batch_wait bigint DEFAULT 0, ADD COLUMN max_failures int DEFAULT -1, ADD COLUMN current_batch int DEFAULT 0, ADD COLUMN total_batches int DEFAULT 0;
+
+DROP FUNCTION goiardi.merge_shoveys(m_run_id uuid, m_command text, m_status text, m_timeout bigint, m_quorum varchar(25), m_search_query text, m_resolve_at_start bool);
+
+CREATE OR REPLACE FUNCTION goiardi.merge_shoveys(m_run_id uuid, m_command text, m_status text, m_timeout bigint, m_quorum varchar(25), m_search_query text, m_resolve_at_start bool, m_batch_size varchar(25), m_batch_wait bigint, m_max_failures int, m_current_batch int, m_total_batches int) RETURNS VOID AS
+$$
+BEGIN
+    LOOP
+	UPDATE goiardi.shoveys SET status = m_status, batch_size = NULLIF(m_batch_size, ''), batch_wait = m_batch_wait, max_failures = m_max_failures, current_batch = m_current_batch, total_batches = m_total_batches, updated_at = NOW() WHERE run_id = m_run_id;
+        IF found THEN
+	    RETURN;
+    	END IF;
+    	BEGIN
+	    INSERT INTO goiardi.shoveys (run_id, command, status, timeout, quorum, search_query, resolve_at_start, batch_size, batch_wait, max_failures, current_batch, total_batches, created_at, updated_at) VALUES (m_run_id, m_command, m_status, m_timeout, m_quorum, NULLIF(m_search_query, ''), m_resolve_at_start, NULLIF(m_batch_size, ''), m_batch_wait, m_max_failures, m_current_batch, m_total_batches, NOW(), NOW());
+            RETURN;
+        EXCEPTION WHEN unique_violation THEN
+            -- moo.
+    	END;
+    END LOOP;
+END;
+$$
+LANGUAGE plpgsql;
+
+COMMIT;
@@ -0,0 +1,48 @@
+-- Deploy shovey_schedules
+-- requires: shovey_batches
+
+BEGIN;
+
+CREATE TABLE goiardi.shovey_schedules (
+	id bigserial,
+	name text not null,
+	job jsonb not null,
+	cron text,
+	run_interval bigint default 0,
+	enabled boolean default true,
+	next_run timestamp with time zone,
+	last_run timestamp with time zone,
+	last_run_id varchar(36),
+	organization_id bigint not null default 1,
+	created_at timestamp with time zone not null,
+	updated_at timestamp with time zone not null,
+	PRIMARY KEY(id),
+	UNIQUE(organization_id, name)
+);
+CREATE INDEX shovey_schedules_next_run ON goiardi.shovey_schedules(next_run);
+
+ALTER TABLE goiardi.shoveys ADD COLUMN schedule_name text;
+CREATE INDEX shoveys_schedule_name ON goiardi.shoveys(schedule_name);
+
+DROP FUNCTION goiardi.merge_shoveys(m_run_id uuid, m_command text, m_status text, m_timeout bigint, m_quorum varchar(25), m_search_query text, m_resolve_at_start bool, m_batch_size varchar(25), m_batch_wait bigint, m_max_failures int, m_current_batch int, m_total_batches int);
+
+CREATE OR REPLACE FUNCTION goiardi.merge_shoveys(m_run_id uuid, m_command text, m_status text, m_timeout bigint, m_quorum varchar(25), m_search_query text, m_resolve_at_start bool, m_batch_size varchar(25), m_batch_wait bigint, m_max_failures int, m_current_batch int, m_total_batches int, m_schedule_name text) RETURNS VOID AS
+$$
+BEGIN
+    LOOP
+	UPDATE goiardi.shoveys SET status = m_status, batch_size = NULLIF(m_batch_size, ''), batch_wait = m_batch_wait, max_failures = m_max_failures, current_batch = m_current_batch, total_batches = m_total_batches, updated_at = NOW() WHERE run_id = m_run_id;
+        IF found THEN
+	    RETURN;
+    	END IF;
+    	BEGIN
+	    INSERT INTO goiardi.shoveys (run_id, command, status, timeout, quorum, search_query, resolve_at_start, batch_size, batch_wait, max_failures, current_batch, total_batches, schedule_name, created_at, updated_at) VALUES (m_run_id, m_command, m_status, m_timeout, m_quorum, NULLIF(m_search_query, ''), m_resolve_at_start, NULLIF(m_batch_size, ''), m_batch_wait, m_max_failures, m_current_batch, m_total_batches, NULLIF(m_schedule_name, ''), NOW(), NOW());
+            RETURN;
+        EXCEPTION WHEN unique_violation THEN
+            -- moo.
+    	END;
+    END LOOP;
+END;
+$$
+LANGUAGE plpgsql;
+
+COMMIT;
@@ -0,0 +1,46 @@
+-- Deploy shovey_templates
+-- requires: shovey_schedules
+
+BEGIN;
+
+CREATE TABLE goiardi.shovey_templates (
+	id bigserial,
+	name text not null,
+	description text,
+	command text not null,
+	params jsonb not null,
+	environments jsonb not null,
+	roles jsonb not null,
+	require_approval boolean default false,
+	organization_id bigint not null default 1,
+	created_at timestamp with time zone not null,
+	updated_at timestamp with time zone not null,
+	PRIMARY KEY(id),
+	UNIQUE(organization_id, name)
+);
+
+ALTER TABLE goiardi.shoveys ADD COLUMN template_name text, ADD COLUMN template_args jsonb, ADD COLUMN requested_by text, ADD COLUMN approved_by text;
+CREATE INDEX shoveys_template_name ON goiardi.shoveys(template_name);
+
+DROP FUNCTION goiardi.merge_shoveys(m_run_id uuid, m_command text, m_status text, m_timeout bigint, m_quorum varchar(25), m_search_query text, m_resolve_at_start bool, m_batch_size varchar(25), m_batch_wait bigint, m_max_failures int, m_current_batch int, m_total_batches int, m_schedule_name text);
+
+CREATE OR REPLACE FUNCTION goiardi.merge_shoveys(m_run_id uuid, m_command text, m_status text, m_timeout bigint, m_quorum varchar(25), m_search_query text, m_resolve_at_start bool, m_batch_size varchar(25), m_batch_wait bigint, m_max_failures int, m_current_batch int, m_total_batches int, m_schedule_name text, m_template_name text, m_template_args jsonb, m_requested_by text, m_approved_by text) RETURNS VOID AS
+$$
+BEGIN
+    LOOP
+	UPDATE goiardi.shoveys SET status = m_status, batch_size = NULLIF(m_batch_size, ''), batch_wait = m_batch_wait, max_failures = m_max_failures, current_batch = m_current_batch, total_batches = m_total_batches, approved_by = NULLIF(m_approved_by, ''), updated_at = NOW() WHERE run_id = m_run_id;
+        IF found THEN
+	    RETURN;
+    	END IF;
+    	BEGIN
+	    INSERT INTO goiardi.shoveys (run_id, command, status, timeout, quorum, search_query, resolve_at_start, batch_size, batch_wait, max_failures, current_batch, total_batches, schedule_name, template_name, template_args, requested_by, approved_by, created_at, updated_at) VALUES (m_run_id, m_command, m_status, m_timeout, m_quorum, NULLIF(m_search_query, ''), m_resolve_at_start, NULLIF(m_batch_size, ''), m_batch_wait, m_max_failures, m_current_batch, m_total_batches, NULLIF(m_schedule_name, ''), NULLIF(m_template_name, ''), m_template_args, NULLIF(m_requested_by, ''), NULLIF(m_approved_by, ''), NOW(), NOW());
+            RETURN;
+        EXCEPTION WHEN unique_violation THEN
+            -- moo.
+    	END;
+    END LOOP;
+END;
+$$
+LANGUAGE plpgsql;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Revert api_tokens
+
+BEGIN;
+
+DROP TABLE goiardi.api_tokens;
+
+COMMIT;
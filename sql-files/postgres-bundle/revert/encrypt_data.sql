@@ -0,0 +1,8 @@
+-- Revert encrypt_data
+
+BEGIN;
+
+ALTER TABLE goiardi.nodes DROP COLUMN enc_key_id;
+ALTER TABLE goiardi.data_bag_items DROP COLUMN enc_key_id;
+
+COMMIT;
@@ -0,0 +1,17 @@
+-- Revert log_auth_failures
+
+BEGIN;
+
+DROP TABLE goiardi.auth_lockouts;
+
+-- enum values can't be dropped, so the types have to be made over again
+DELETE FROM goiardi.log_infos WHERE action = 'auth_failure' OR actor_type = 'unknown';
+ALTER TYPE goiardi.log_action RENAME TO log_action_old;
+ALTER TYPE goiardi.log_actor RENAME TO log_actor_old;
+CREATE TYPE goiardi.log_action AS ENUM ( 'create', 'delete', 'modify');
+CREATE TYPE goiardi.log_actor AS ENUM ( 'user', 'client');
+ALTER TABLE goiardi.log_infos ALTER COLUMN action TYPE goiardi.log_action USING action::text::goiardi.log_action, ALTER COLUMN actor_type TYPE goiardi.log_actor USING actor_type::text::goiardi.log_actor;
+DROP TYPE goiardi.log_action_old;
+DROP TYPE goiardi.log_actor_old;
+
+COMMIT;
@@ -0,0 +1,8 @@
+-- Revert report_resources
+
+BEGIN;
+
+DROP INDEX goiardi.report_start_time;
+DROP TABLE goiardi.report_resources;
+
+COMMIT;
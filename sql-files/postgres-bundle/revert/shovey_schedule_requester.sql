@@ -0,0 +1,7 @@
+-- Revert shovey_schedule_requester
+
+BEGIN;
+
+ALTER TABLE goiardi.shovey_schedules DROP COLUMN requested_by;
+
+COMMIT;
@@ -0,0 +1,7 @@
+-- Verify api_tokens
+
+BEGIN;
+
+SELECT id, name, owner_name, owner_type, scopes, secret_hash, created_by, organization_id, created_at, expires_at, last_used_at, last_used_ip, revoked_at FROM goiardi.api_tokens WHERE false;
+
+ROLLBACK;
@@ -0,0 +1,8 @@
+-- Verify encrypt_data
+
+BEGIN;
+
+SELECT enc_key_id FROM goiardi.nodes WHERE false;
+SELECT enc_key_id FROM goiardi.data_bag_items WHERE false;
+
+ROLLBACK;
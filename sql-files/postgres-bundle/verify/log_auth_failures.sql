@@ -0,0 +1,8 @@
+-- Verify log_auth_failures
+
+BEGIN;
+
+SELECT id, kind, name, failures, lockouts, last_failure, last_reason, locked_until, organization_id FROM goiardi.auth_lockouts WHERE false;
+SELECT 'auth_failure'::goiardi.log_action, 'unknown'::goiardi.log_actor;
+
+ROLLBACK;
@@ -0,0 +1,9 @@
+-- Verify shovey_batches
+
+BEGIN;
+
+SELECT batch_size, batch_wait, max_failures, current_batch, total_batches FROM goiardi.shoveys WHERE false;
+SELECT goiardi.merge_shoveys('7c160544-460f-444f-bdbd-3f51f26bd006', 'moo', 'running', 10000, '100%', '', false, '25%', 30, 2, 1, 4);
+SELECT id FROM goiardi.shoveys WHERE run_id = '7c160544-460f-444f-bdbd-3f51f26bd006' AND batch_size = '25%';
+
+ROLLBACK;
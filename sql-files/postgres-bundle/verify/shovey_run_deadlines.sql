@@ -0,0 +1,10 @@
+-- Verify shovey_run_deadlines
+
+BEGIN;
+
+SELECT sent_at FROM goiardi.shovey_runs WHERE false;
+SELECT goiardi.merge_shoveys('7c160544-460f-444f-bdbd-3f51f26bd006', 'moo', 'running', 10000, '100%', '', false, '', 0, -1, 0, 0, '', '', NULL, '', '');
+SELECT goiardi.merge_shovey_runs('7c160544-460f-444f-bdbd-3f51f26bd006', 'moomer', 'created', '0001-01-01 00:00:00 +0000', '0001-01-01 00:00:00 +0000', '', 0, NOW());
+SELECT id FROM goiardi.shovey_runs WHERE shovey_uuid = '7c160544-460f-444f-bdbd-3f51f26bd006' AND node_name = 'moomer' AND sent_at IS NOT NULL;
+
+ROLLBACK;
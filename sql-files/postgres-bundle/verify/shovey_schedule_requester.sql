@@ -0,0 +1,7 @@
+-- Verify shovey_schedule_requester
+
+BEGIN;
+
+SELECT requested_by FROM goiardi.shovey_schedules WHERE false;
+
+ROLLBACK;
@@ -0,0 +1,9 @@
+-- Verify shovey_schedules
+
+BEGIN;
+
+SELECT id, name, job, cron, run_interval, enabled, next_run, last_run, last_run_id, organization_id, created_at, updated_at FROM goiardi.shovey_schedules WHERE false;
+SELECT goiardi.merge_shoveys('7c160544-460f-444f-bdbd-3f51f26bd006', 'moo', 'running', 10000, '100%', '', false, '', 0, -1, 0, 0, 'nightly');
+SELECT id FROM goiardi.shoveys WHERE run_id = '7c160544-460f-444f-bdbd-3f51f26bd006' AND schedule_name = 'nightly';
+
+ROLLBACK;
@@ -0,0 +1,9 @@
+-- Verify shovey_search
+
+BEGIN;
+
+SELECT search_query, resolve_at_start FROM goiardi.shoveys WHERE false;
+SELECT goiardi.merge_shoveys('7c160544-460f-444f-bdbd-3f51f26bd006', 'moo', 'running', 10000, '100%', 'role:web', true);
+SELECT id FROM goiardi.shoveys WHERE run_id = '7c160544-460f-444f-bdbd-3f51f26bd006' AND search_query = 'role:web';
+
+ROLLBACK;
@@ -0,0 +1,9 @@
+-- Verify shovey_templates
+
+BEGIN;
+
+SELECT id, name, description, command, params, environments, roles, require_approval, organization_id, created_at, updated_at FROM goiardi.shovey_templates WHERE false;
+SELECT goiardi.merge_shoveys('7c160544-460f-444f-bdbd-3f51f26bd006', 'moo', 'awaiting_approval', 10000, '100%', '', false, '', 0, -1, 0, 0, '', 'restart', '{"service": "nginx"}', 'admin', '');
+SELECT id FROM goiardi.shoveys WHERE run_id = '7c160544-460f-444f-bdbd-3f51f26bd006' AND template_name = 'restart' AND requested_by = 'admin';
+
+ROLLBACK;
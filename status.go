@@ -19,10 +19,15 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/ctdk/goiardi/client"
+	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/node"
 	"github.com/ctdk/goiardi/reqctx"
+	"github.com/ctdk/goiardi/secret"
 	"github.com/ctdk/goiardi/util"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 func statusHandler(w http.ResponseWriter, r *http.Request) {
@@ -32,11 +37,14 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
 		return
 	}
-	if !opUser.IsAdmin() {
+	pathArray := splitPath(r.URL.Path)
+	// nodes' own clients can send heartbeats, but everything else is
+	// admin only
+	isHeartbeat := r.Method == http.MethodPost && len(pathArray) == 4 && pathArray[1] == "node" && pathArray[3] == "heartbeat"
+	if !opUser.IsAdmin() && !(isHeartbeat && opUser.IsClient() && opUser.(*client.Client).NodeName == pathArray[2]) {
 		jsonErrorReport(w, r, "You must be an admin to do that", http.StatusForbidden)
 		return
 	}
-	pathArray := splitPath(r.URL.Path)
 
 	if len(pathArray) < 3 {
 		jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
@@ -59,6 +67,40 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 				jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
 				return
 			}
+			// /status/all/availability
+			if pathArray[2] == "availability" {
+				from, until, err := availabilityWindow(r)
+				if err != nil {
+					jsonErrorReport(w, r, err.Error(), http.StatusBadRequest)
+					return
+				}
+				var nodes []*node.Node
+				if env := r.FormValue("environment"); env != "" {
+					nodes, err = node.GetFromEnv(env)
+					if err != nil {
+						jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+						return
+					}
+				} else {
+					nodes = node.AllNodes()
+				}
+				if role := r.FormValue("role"); role != "" {
+					roleNodes := make([]*node.Node, 0, len(nodes))
+					for _, n := range nodes {
+						if n.HasRole(role) {
+							roleNodes = append(roleNodes, n)
+						}
+					}
+					nodes = roleNodes
+				}
+				summary, err := node.SummarizeAvailability(nodes, from, until)
+				if err != nil {
+					jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				statusResponse = summary
+				break
+			}
 			if pathArray[2] != "nodes" {
 				jsonErrorReport(w, r, "Invalid object to get status for", http.StatusBadRequest)
 				return
@@ -79,7 +121,14 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 				sr[i]["url"] = util.CustomURL(nsurl)
 			}
 			statusResponse = sr
-		// /status/node/<nodeName>/(all|latest)
+		// /status/secrets/health
+		case "secrets":
+			if len(pathArray) != 3 || pathArray[2] != "health" {
+				jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+				return
+			}
+			statusResponse = secret.GetHealth()
+		// /status/node/<nodeName>/(all|latest|availability)
 		case "node":
 			if len(pathArray) != 4 {
 				jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
@@ -111,6 +160,18 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 					sr[i] = v.ToJSON()
 				}
 				statusResponse = sr
+			case "availability":
+				from, until, err := availabilityWindow(r)
+				if err != nil {
+					jsonErrorReport(w, r, err.Error(), http.StatusBadRequest)
+					return
+				}
+				a, err := n.Availability(from, until)
+				if err != nil {
+					jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				statusResponse = a
 			default:
 				jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
 				return
@@ -119,6 +180,31 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 			jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
 			return
 		}
+	case http.MethodPost:
+		// /status/node/<nodeName>/heartbeat
+		if !isHeartbeat {
+			jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if !config.Config.NodeCheckIns {
+			jsonErrorReport(w, r, "node check-ins are not enabled", http.StatusPreconditionFailed)
+			return
+		}
+		n, gerr := node.Get(pathArray[2])
+		if gerr != nil {
+			jsonErrorReport(w, r, gerr.Error(), gerr.Status())
+			return
+		}
+		if err := n.CheckIn(); err != nil {
+			jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ns, err := n.LatestStatus()
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		statusResponse = ns.ToJSON()
 	default:
 		jsonErrorReport(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -128,3 +214,32 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
 	}
 }
+
+// availabilityWindow gets the window of time to compute availability over
+// from the "from" and "until" parameters, given in seconds since the epoch.
+// The default is the last 30 days.
+func availabilityWindow(r *http.Request) (time.Time, time.Time, error) {
+	until := time.Now()
+	from := until.Add(-30 * 24 * time.Hour)
+	if u := r.FormValue("until"); u != "" {
+		untilUnix, err := strconv.ParseInt(u, 10, 64)
+		if err != nil {
+			return from, until, fmt.Errorf("invalid until: %s", err.Error())
+		}
+		until = time.Unix(untilUnix, 0)
+		if r.FormValue("from") == "" {
+			from = until.Add(-30 * 24 * time.Hour)
+		}
+	}
+	if f := r.FormValue("from"); f != "" {
+		fromUnix, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return from, until, fmt.Errorf("invalid from: %s", err.Error())
+		}
+		from = time.Unix(fromUnix, 0)
+	}
+	if !until.After(from) {
+		return from, until, fmt.Errorf("until must be after from")
+	}
+	return from, until, nil
+}
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Issuing, listing, and revoking API tokens.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/apitoken"
+	"github.com/ctdk/goiardi/client"
+	"github.com/ctdk/goiardi/reqctx"
+	"github.com/ctdk/goiardi/user"
+	"github.com/ctdk/goiardi/util"
+)
+
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	opUser, oerr := reqctx.CtxReqUser(r.Context())
+	if oerr != nil {
+		jsonErrorReport(w, r, oerr.Error(), oerr.Status())
+		return
+	}
+	pathArray := splitPath(r.URL.Path)
+
+	var tokenResponse interface{}
+	switch len(pathArray) {
+	case 1:
+		switch r.Method {
+		case http.MethodGet:
+			var tokens []*apitoken.Token
+			if opUser.IsAdmin() {
+				tokens = apitoken.AllTokens()
+			} else {
+				tokens = apitoken.OwnerTokens(opUser)
+			}
+			tr := make([]map[string]interface{}, len(tokens))
+			for i, t := range tokens {
+				tr[i] = tokenJSON(t)
+			}
+			tokenResponse = tr
+		case http.MethodPost:
+			t, err := newToken(r, opUser)
+			if err != nil {
+				jsonErrorReport(w, r, err.Error(), err.Status())
+				return
+			}
+			tr := tokenJSON(t)
+			tr["token"] = t.String()
+			tokenResponse = tr
+			w.WriteHeader(http.StatusCreated)
+		default:
+			jsonErrorReport(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	case 2:
+		t, err := apitoken.Get(pathArray[1])
+		if err != nil {
+			jsonErrorReport(w, r, err.Error(), err.Status())
+			return
+		}
+		if !opUser.IsAdmin() && !ownsToken(opUser, t) {
+			jsonErrorReport(w, r, "You are not allowed to perform that action.", http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			if err = t.Revoke(); err != nil {
+				jsonErrorReport(w, r, err.Error(), err.Status())
+				return
+			}
+		default:
+			jsonErrorReport(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tokenResponse = tokenJSON(t)
+	default:
+		jsonErrorReport(w, r, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(&tokenResponse); err != nil {
+		jsonErrorReport(w, r, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func tokenJSON(t *apitoken.Token) map[string]interface{} {
+	tr := t.ToJSON()
+	tr["uri"] = util.CustomURL(fmt.Sprintf("/tokens/%s", t.ID))
+	return tr
+}
+
+func ownsToken(opUser actor.Actor, t *apitoken.Token) bool {
+	if opUser.IsUser() {
+		return t.OwnerType == apitoken.OwnerUser && opUser.GetName() == t.Owner
+	}
+	return t.OwnerType == apitoken.OwnerClient && opUser.GetName() == t.Owner
+}
+
+// newToken makes a new token from the request. Anyone can make tokens for
+// themselves, but only admins can make them for other users and clients.
+func newToken(r *http.Request, opUser actor.Actor) (*apitoken.Token, util.Gerror) {
+	tokenData, err := parseObjJSON(r.Body)
+	if err != nil {
+		return nil, badTokenReq(err.Error())
+	}
+	name, _ := tokenData["name"].(string)
+	var scopes []string
+	if s, ok := tokenData["scopes"].([]interface{}); ok {
+		for _, v := range s {
+			sv, ok := v.(string)
+			if !ok {
+				return nil, badTokenReq("scopes must be an array of strings")
+			}
+			scopes = append(scopes, sv)
+		}
+	} else if _, ok := tokenData["scopes"]; ok {
+		return nil, badTokenReq("scopes must be an array of strings")
+	}
+
+	var expires time.Time
+	switch e := tokenData["expires_in"].(type) {
+	case nil:
+	case string:
+		d, perr := time.ParseDuration(e)
+		if perr != nil {
+			return nil, badTokenReq(fmt.Sprintf("invalid expires_in: %s", perr.Error()))
+		}
+		expires = time.Now().Add(d)
+	case json.Number:
+		secs, perr := e.Int64()
+		if perr != nil {
+			return nil, badTokenReq("expires_in must be a whole number of seconds or a duration like '720h'")
+		}
+		expires = time.Now().Add(time.Duration(secs) * time.Second)
+	default:
+		return nil, badTokenReq("expires_in must be a whole number of seconds or a duration like '720h'")
+	}
+	if ea, ok := tokenData["expires_at"].(string); ok {
+		if !expires.IsZero() {
+			return nil, badTokenReq("only one of expires_in and expires_at may be given")
+		}
+		if expires, err = time.Parse(time.RFC3339, ea); err != nil {
+			return nil, badTokenReq(fmt.Sprintf("invalid expires_at: %s", err.Error()))
+		}
+	}
+
+	owner := opUser
+	if on, ok := tokenData["owner"].(string); ok && on != "" {
+		ot, _ := tokenData["owner_type"].(string)
+		if ot == "" {
+			ot = apitoken.OwnerUser
+		}
+		var gerr util.Gerror
+		switch ot {
+		case apitoken.OwnerUser:
+			owner, gerr = user.Get(on)
+		case apitoken.OwnerClient:
+			owner, gerr = client.Get(on)
+		default:
+			return nil, badTokenReq(fmt.Sprintf("invalid owner_type '%s'", ot))
+		}
+		if gerr != nil {
+			return nil, gerr
+		}
+		if !opUser.IsAdmin() && !opUser.IsSelf(owner) {
+			gerr = util.Errorf("You must be an admin to make tokens for other users or clients")
+			gerr.SetStatus(http.StatusForbidden)
+			return nil, gerr
+		}
+	}
+
+	t, gerr := apitoken.New(owner, name, scopes, expires, opUser.GetName())
+	if gerr != nil {
+		return nil, gerr
+	}
+	if gerr = t.Save(); gerr != nil {
+		return nil, gerr
+	}
+	return t, nil
+}
+
+func badTokenReq(msg string) util.Gerror {
+	err := util.Errorf("%s", msg)
+	err.SetStatus(http.StatusBadRequest)
+	return err
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package user
+
+// Hashing and checking user passwords. New hashes are made with argon2id or
+// bcrypt and stored in an encoded format that records the algorithm and its
+// settings, like "$argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>" or bcrypt's
+// usual "$2a$12$...". Older hashes are a hex encoded SHA-512 hash of the user's
+// salt and password, and are still checked against so they can be upgraded.
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/ctdk/chefcrypto"
+	"github.com/ctdk/goiardi/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// argon2Params are the settings an argon2id hash was made with.
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// hashPasswd hashes the password with the configured algorithm.
+func hashPasswd(password string) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("Password is empty")
+	}
+	if passwdHashAlgo() == "bcrypt" {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost())
+		if err != nil {
+			return "", err
+		}
+		return string(h), nil
+	}
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := currentArgon2Params()
+	key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, argon2KeyLen)
+	b64 := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.time, p.threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// verifyPasswd checks the password against the hash, using the salt for old
+// SHA-512 hashes. It also returns true if the password matched but the hash
+// should be replaced with one made with the current settings.
+func verifyPasswd(password string, hash string, salt []byte) (bool, bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		p, hsalt, key, err := decodeArgon2(hash)
+		if err != nil {
+			return false, false, err
+		}
+		check := argon2.IDKey([]byte(password), hsalt, p.time, p.memory, p.threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(check, key) != 1 {
+			return false, false, nil
+		}
+		return true, passwdHashAlgo() != "argon2id" || p != currentArgon2Params(), nil
+	case strings.HasPrefix(hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		} else if err != nil {
+			return false, false, err
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return false, false, err
+		}
+		return true, passwdHashAlgo() != "bcrypt" || cost != bcryptCost(), nil
+	}
+	// the old salted SHA-512 hash
+	h, err := chefcrypto.HashPasswd(password, salt)
+	if err != nil {
+		return false, false, err
+	}
+	if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) != 1 {
+		return false, false, nil
+	}
+	return true, true, nil
+}
+
+func decodeArgon2(hash string) (argon2Params, []byte, []byte, error) {
+	var p argon2Params
+	var version int
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, fmt.Errorf("invalid argon2id password hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id password hash version: %s", err.Error())
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id password hash settings: %s", err.Error())
+	}
+	b64 := base64.RawStdEncoding
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	return p, salt, key, nil
+}
+
+// The password hash settings, falling back to the defaults if the
+// configuration hasn't filled them in.
+
+func passwdHashAlgo() string {
+	if config.Config.PasswordHash == "" {
+		return config.DefaultPasswordHash
+	}
+	return config.Config.PasswordHash
+}
+
+func bcryptCost() int {
+	if config.Config.BcryptCost == 0 {
+		return config.DefaultBcryptCost
+	}
+	return config.Config.BcryptCost
+}
+
+func currentArgon2Params() argon2Params {
+	p := argon2Params{memory: config.Config.Argon2Memory, time: config.Config.Argon2Time, threads: config.Config.Argon2Threads}
+	if p.memory == 0 {
+		p.memory = config.DefaultArgon2Memory
+	}
+	if p.time == 0 {
+		p.time = config.DefaultArgon2Time
+	}
+	if p.threads == 0 {
+		p.threads = config.DefaultArgon2Threads
+	}
+	return p
+}
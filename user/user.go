@@ -127,6 +127,7 @@ func Get(name string) (*User, util.Gerror) {
 		u, found := ds.Get("user", name)
 		if !found {
 			err := util.Errorf("User %s not found", name)
+			err.SetStatus(http.StatusNotFound)
 			return nil, err
 		}
 		if u != nil {
@@ -360,8 +361,9 @@ ValidElem:
 }
 
 // SetPasswdHash is a utility function to directly set a password hash. Only
-// especially useful when importing user data with the -m/--import flags, since
-// it's still hashed with the user's salt.
+// especially useful when importing user data with the -m/--import flags. Old
+// style hashes are still hashed with the user's salt, and are upgraded the next
+// time the user logs in.
 func (u *User) SetPasswdHash(pwhash string) {
 	if pwhash != "" {
 		if config.UsingExternalSecrets() {
@@ -372,6 +374,14 @@ func (u *User) SetPasswdHash(pwhash string) {
 	}
 }
 
+// ClearStoredSecrets empties the public key and password hash kept with the
+// user itself, once they've been moved to an external secret store. Save() must
+// be called after this method is used.
+func (u *User) ClearStoredSecrets() {
+	u.pubKey = ""
+	u.passwd = ""
+}
+
 // GetList returns a list of users.
 func GetList() []string {
 	var userList []string
@@ -539,7 +549,11 @@ func (u *User) SetPasswd(password string) util.Gerror {
 		return err
 	}
 	/* If those validations pass, set the password */
-	pw, perr := chefcrypto.HashPasswd(password, u.salt)
+	return u.setPasswd(password)
+}
+
+func (u *User) setPasswd(password string) util.Gerror {
+	pw, perr := hashPasswd(password)
 	if perr != nil {
 		err := util.Errorf(perr.Error())
 		return err
@@ -556,21 +570,42 @@ func (u *User) SetPasswd(password string) util.Gerror {
 }
 
 // CheckPasswd checks the provided password to see if it matches the stored
-// password hash.
+// password hash. If it matches, but the hash is an old style SHA-512 hash or
+// was made with different settings than goiardi is using now, the password is
+// hashed again with the current settings and saved.
 func (u *User) CheckPasswd(password string) util.Gerror {
-	h, perr := chefcrypto.HashPasswd(password, u.salt)
+	ok, rehash, perr := verifyPasswd(password, u.Passwd(), u.salt)
 	if perr != nil {
 		err := util.Errorf(perr.Error())
 		return err
 	}
-	if u.Passwd() != h {
+	if !ok {
 		err := util.Errorf("password did not match")
 		return err
 	}
+	if rehash {
+		if err := u.rehashPasswd(password); err != nil {
+			// they still got the right password
+			logger.Errorf("error rehashing password for user %s: %s", u.Username, err.Error())
+		}
+	}
 
 	return nil
 }
 
+func (u *User) rehashPasswd(password string) util.Gerror {
+	logger.Infof("upgrading password hash for user %s", u.Username)
+	if err := u.setPasswd(password); err != nil {
+		return err
+	}
+	// Hashes in the external secret store are saved as soon as they're
+	// set.
+	if config.UsingExternalSecrets() {
+		return nil
+	}
+	return u.Save()
+}
+
 // Passwd returns the password hash, either from the user object or an external
 // secret store
 func (u *User) Passwd() string {
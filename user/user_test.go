@@ -22,7 +22,11 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"strings"
 	"testing"
+
+	"github.com/ctdk/chefcrypto"
+	"github.com/ctdk/goiardi/config"
 )
 
 func TestNewUser(t *testing.T) {
@@ -57,6 +61,56 @@ func TestSetPasswd(t *testing.T) {
 	}
 }
 
+func TestPasswdRehash(t *testing.T) {
+	gob.Register(new(User))
+	u, _ := New("rehash")
+	old, _ := chefcrypto.HashPasswd("abc123", u.salt)
+	u.SetPasswdHash(old)
+	if err := u.CheckPasswd("badpass"); err == nil {
+		t.Errorf("badpass should not have been accepted against an old hash, but it was")
+	}
+	if u.Passwd() != old {
+		t.Errorf("the password hash should not have changed after a bad password")
+	}
+	if err := u.CheckPasswd("abc123"); err != nil {
+		t.Errorf("abc123 should have been accepted against an old hash, but it wasn't")
+	}
+	if !strings.HasPrefix(u.Passwd(), "$argon2id$v=19$m=65536,t=1,p=4$") {
+		t.Errorf("the old hash should have been upgraded to argon2id, got %s", u.Passwd())
+	}
+	saved, err := Get("rehash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Passwd() != u.Passwd() {
+		t.Errorf("the upgraded hash was not saved")
+	}
+	if err := saved.CheckPasswd("abc123"); err != nil {
+		t.Errorf("abc123 should have been accepted against the upgraded hash, but it wasn't")
+	}
+
+	// changing the settings upgrades the hash again
+	config.Config.PasswordHash = "bcrypt"
+	config.Config.BcryptCost = 4
+	defer func() {
+		config.Config.PasswordHash = ""
+		config.Config.BcryptCost = 0
+	}()
+	if err := saved.CheckPasswd("abc123"); err != nil {
+		t.Errorf("abc123 should have been accepted, but it wasn't")
+	}
+	if !strings.HasPrefix(saved.Passwd(), "$2a$04$") {
+		t.Errorf("the hash should have been changed to bcrypt, got %s", saved.Passwd())
+	}
+	h := saved.Passwd()
+	if err := saved.CheckPasswd("abc123"); err != nil || saved.Passwd() != h {
+		t.Errorf("a hash made with the current settings should be left alone")
+	}
+	if err := saved.CheckPasswd("abc124"); err == nil {
+		t.Errorf("abc124 should not have been accepted against a bcrypt hash, but it was")
+	}
+}
+
 func TestGobEncodeDecode(t *testing.T) {
 	c, _ := New("footged")
 	saved := new(bytes.Buffer)
@@ -21,6 +21,7 @@ package main
 import (
 	"encoding/json"
 	"github.com/ctdk/goiardi/actor"
+	"github.com/ctdk/goiardi/apitoken"
 	"github.com/ctdk/goiardi/loginfo"
 	"github.com/ctdk/goiardi/reqctx"
 	"github.com/ctdk/goiardi/user"
@@ -81,6 +82,10 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 			jsonErrorReport(w, r, err.Error(), http.StatusForbidden)
 			return
 		}
+		if terr := apitoken.RevokeOwner(chefUser.GetName(), apitoken.OwnerUser); terr != nil {
+			jsonErrorReport(w, r, terr.Error(), terr.Status())
+			return
+		}
 		enc := json.NewEncoder(w)
 		if encerr := enc.Encode(&jsonUser); encerr != nil {
 			jsonErrorReport(w, r, encerr.Error(), http.StatusInternalServerError)
@@ -104,6 +109,10 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 		 * json_class
 		 */
 		jsonUser := chefUser.ToJSON()
+		if kerr := keyVersion(r, chefUser, jsonUser); kerr != nil {
+			jsonErrorReport(w, r, kerr.Error(), kerr.Status())
+			return
+		}
 		enc := json.NewEncoder(w)
 		if encerr := enc.Encode(&jsonUser); encerr != nil {
 			jsonErrorReport(w, r, encerr.Error(), http.StatusInternalServerError)
@@ -157,6 +166,10 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 				jsonErrorReport(w, r, err.Error(), err.Status())
 				return
 			}
+			if terr := apitoken.RevokeOwner(userName, apitoken.OwnerUser); terr != nil {
+				jsonErrorReport(w, r, terr.Error(), terr.Status())
+				return
+			}
 			w.WriteHeader(http.StatusCreated)
 		}
 		if uerr := chefUser.UpdateFromJSON(userData); uerr != nil {
@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2013-2017, Jeremy Bingham (<jeremy@goiardi.gl>)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+// Signed URLs for the local file store. Like the presigned URLs handed out
+// when using S3, a /file_store URL is only good for one checksum, for either
+// downloading or uploading, and only until it expires. The signature is an
+// HMAC of those things with a key every goiardi server using the same file
+// store needs to share.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ctdk/goiardi/config"
+)
+
+const fileURLKeyLen = 32
+
+var fileURLKey struct {
+	sync.RWMutex
+	key []byte
+}
+
+// InitFileURLKey loads the key /file_store URLs are signed with, making a new
+// one if the key file doesn't exist yet.
+func InitFileURLKey(conf *config.Conf) error {
+	fn := conf.FileURLKeyFile
+	key, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		key = make([]byte, fileURLKeyLen)
+		if _, err = rand.Read(key); err != nil {
+			return err
+		}
+		// O_EXCL in case another goiardi sharing the file made one
+		// first
+		var f *os.File
+		f, err = os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			return InitFileURLKey(conf)
+		} else if err != nil {
+			return fmt.Errorf("error creating the file store URL signing key %s: %s", fn, err.Error())
+		}
+		_, err = f.Write(key)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error loading the file store URL signing key %s: %s", fn, err.Error())
+	}
+	if len(key) < fileURLKeyLen {
+		return fmt.Errorf("the file store URL signing key %s is too short, it needs to be at least %d bytes", fn, fileURLKeyLen)
+	}
+	fileURLKey.Lock()
+	defer fileURLKey.Unlock()
+	fileURLKey.key = key
+	return nil
+}
+
+// UseTemporaryFileURLKey signs /file_store URLs with a key that only lasts as
+// long as goiardi's running. That's fine for a single server, but not for
+// several sharing a file store.
+func UseTemporaryFileURLKey() error {
+	key := make([]byte, fileURLKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("error making a temporary file store URL signing key: %s", err.Error())
+	}
+	fileURLKey.Lock()
+	defer fileURLKey.Unlock()
+	fileURLKey.key = key
+	return nil
+}
+
+func getFileURLKey() []byte {
+	fileURLKey.RLock()
+	defer fileURLKey.RUnlock()
+	return fileURLKey.key
+}
+
+// FileStoreGetURL makes a signed URL to download a file from the local file
+// store.
+func FileStoreGetURL(checksum string) string {
+	return fileStoreURL(http.MethodGet, checksum)
+}
+
+// FileStorePutURL makes a signed URL to upload a file to the local file store.
+func FileStorePutURL(checksum string) string {
+	return fileStoreURL(http.MethodPut, checksum)
+}
+
+func fileStoreURL(method string, checksum string) string {
+	expires := strconv.FormatInt(time.Now().Add(fileURLPeriod()).Unix(), 10)
+	q := url.Values{}
+	q.Set("expires", expires)
+	// without a key the URL goes out unsigned, and will only work if
+	// goiardi isn't checking signatures.
+	if sig, ok := fileURLSignature(method, checksum, expires); ok {
+		q.Set("signature", sig)
+	}
+	return fmt.Sprintf("%s?%s", CustomURL(fmt.Sprintf("/file_store/%s", checksum)), q.Encode())
+}
+
+func fileURLPeriod() time.Duration {
+	p := config.Config.FileURLPeriod
+	if p <= 0 {
+		p = 15
+	}
+	return time.Duration(p) * time.Minute
+}
+
+// A HEAD request can use a URL for downloading, and a POST a URL for
+// uploading.
+func fileURLMethod(method string) string {
+	switch method {
+	case http.MethodHead:
+		return http.MethodGet
+	case http.MethodPost:
+		return http.MethodPut
+	}
+	return method
+}
+
+func fileURLSignature(method string, checksum string, expires string) (string, bool) {
+	key := getFileURLKey()
+	if key == nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join([]string{fileURLMethod(method), checksum, expires}, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), true
+}
+
+// VerifyFileStoreURL checks that a request to the local file store came with
+// a signature for that checksum and method that hasn't expired yet.
+func VerifyFileStoreURL(method string, checksum string, query url.Values) Gerror {
+	expires := query.Get("expires")
+	sig := query.Get("signature")
+	if expires == "" || sig == "" {
+		return fileURLErr("file store URL is not signed")
+	}
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return fileURLErr("invalid expiration time for file store URL")
+	}
+	want, ok := fileURLSignature(method, checksum, expires)
+	if !ok {
+		return fileURLErr("no key loaded to check file store URL signatures")
+	}
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return fileURLErr("invalid signature for file store URL")
+	}
+	if time.Now().Unix() > exp {
+		return fileURLErr("file store URL has expired")
+	}
+	return nil
+}
+
+func fileURLErr(msg string) Gerror {
+	err := Errorf("%s", msg)
+	err.SetStatus(http.StatusForbidden)
+	return err
+}
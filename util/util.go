@@ -26,6 +26,7 @@ import (
 	"fmt"
 	"github.com/ctdk/goiardi/config"
 	"github.com/ctdk/goiardi/gerror"
+	"net"
 	"net/http"
 	"reflect"
 	"regexp"
@@ -110,6 +111,23 @@ func chkPath(p *string) {
 	}
 }
 
+// RemoteIP returns the address a request came from. If goiardi's configured to
+// trust a reverse proxy in front of it, that's the last address in the
+// X-Forwarded-For header, which the proxy added.
+func RemoteIP(r *http.Request) string {
+	if config.Config.TrustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			f := strings.Split(fwd, ",")
+			return strings.TrimSpace(f[len(f)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // FlattenObj flattens an object and expand its keys into a map[string]string so
 // it's suitable for indexing, either with solr (eventually) or with the whipped
 // up replacement for local mode. Objects fed into this function *must* have the
@@ -18,7 +18,10 @@ package util
 
 import (
 	"net/http"
+	"net/url"
+	"strconv"
 	"testing"
+	"time"
 )
 
 type testObj struct {
@@ -71,6 +74,57 @@ func TestCustomURL(t *testing.T) {
 	}
 }
 
+func TestFileStoreURL(t *testing.T) {
+	if err := UseTemporaryFileURLKey(); err != nil {
+		t.Fatal(err)
+	}
+	chk := "0123456789abcdef0123456789abcdef"
+	query := func(u string) url.Values {
+		pu, err := url.Parse(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pu.Path != "/file_store/"+chk {
+			t.Errorf("wrong path in signed URL %s", u)
+		}
+		return pu.Query()
+	}
+	get := query(FileStoreGetURL(chk))
+	if err := VerifyFileStoreURL(http.MethodGet, chk, get); err != nil {
+		t.Errorf("signed GET URL didn't verify: %s", err.Error())
+	}
+	if err := VerifyFileStoreURL(http.MethodHead, chk, get); err != nil {
+		t.Errorf("signed GET URL didn't verify for HEAD: %s", err.Error())
+	}
+	if err := VerifyFileStoreURL(http.MethodPut, chk, get); err == nil || err.Status() != http.StatusForbidden {
+		t.Errorf("a GET URL should not be good for uploading")
+	}
+	if err := VerifyFileStoreURL(http.MethodGet, "fedcba9876543210fedcba9876543210", get); err == nil {
+		t.Errorf("a URL should only be good for its own checksum")
+	}
+	put := query(FileStorePutURL(chk))
+	if err := VerifyFileStoreURL(http.MethodPost, chk, put); err != nil {
+		t.Errorf("signed PUT URL didn't verify for POST: %s", err.Error())
+	}
+	if err := VerifyFileStoreURL(http.MethodGet, chk, url.Values{}); err == nil {
+		t.Errorf("an unsigned URL should not verify")
+	}
+
+	// pushing the expiration time back changes the signature
+	exp, _ := strconv.ParseInt(get.Get("expires"), 10, 64)
+	get.Set("expires", strconv.FormatInt(exp+3600, 10))
+	if err := VerifyFileStoreURL(http.MethodGet, chk, get); err == nil {
+		t.Errorf("a URL with a changed expiration time should not verify")
+	}
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	get.Set("expires", past)
+	sig, _ := fileURLSignature(http.MethodGet, chk, past)
+	get.Set("signature", sig)
+	if err := VerifyFileStoreURL(http.MethodGet, chk, get); err == nil {
+		t.Errorf("an expired URL should not verify")
+	}
+}
+
 func TestGerror(t *testing.T) {
 	errmsg := "foo bar"
 	err := Errorf(errmsg)